@@ -9,8 +9,27 @@ import (
 type (
 	User interface {
 		Permission(name string) Level
-		// @todo: Root() string // get user's storage root?
-		// @todo: Quota() int64 ?
+	}
+
+	// UserWithRoot is implemented by Users that have their own storage
+	// root.
+	// It is only used if the server is configured WithUserRoots.
+	UserWithRoot interface {
+		User
+		// Root names the user's own storage root.
+		Root() string
+	}
+
+	// UserWithQuota is implemented by Users that may only store a limited
+	// number of bytes.
+	// With WithUserRoots, the quota limits the usage of the user's own
+	// root. Otherwise, all users share the same storage, and the quota is
+	// compared against the usage of the entire storage.
+	UserWithQuota interface {
+		User
+		// Quota limits the number of bytes the user may store.
+		// A quota of zero (or less) means that there is no limit.
+		Quota() int64
 	}
 
 	// UserReadOnly is a User with read access to any folder and document.
@@ -27,7 +46,11 @@ type (
 	key   int
 )
 
-const userKey key = iota
+const (
+	userKey key = iota
+	serverKey
+	rootKey
+)
 
 var (
 	LevelNone      Level = ""
@@ -51,16 +74,34 @@ func (UserReadPublic) Permission(name string) Level {
 	return LevelNone
 }
 
+// userRoot returns the storage root of user, or an empty string if it
+// doesn't have one, see UserWithRoot.
+func userRoot(user User) string {
+	if u, ok := user.(UserWithRoot); ok {
+		return u.Root()
+	}
+	return ""
+}
+
+// userQuota returns the quota of user, or zero if it isn't limited, see
+// UserWithQuota.
+func userQuota(user User) int64 {
+	if u, ok := user.(UserWithQuota); ok {
+		return u.Quota()
+	}
+	return 0
+}
+
 func UserFromContext(ctx context.Context) (User, bool) {
 	u, ok := ctx.Value(userKey).(User)
 	return u, ok
 }
 
-func handleAuthorization(next http.Handler) http.Handler {
+func (s *Server) handleAuthorization(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		bearer := r.Header.Get("Authorization")
 		bearer = strings.TrimPrefix(bearer, "Bearer ")
-		user, isAuthenticated := g.authenticate(r, bearer)
+		user, isAuthenticated := s.authenticateBearer(r, bearer)
 		if isAuthenticated {
 			nc := context.WithValue(r.Context(), userKey, user)
 			r = r.WithContext(nc)
@@ -70,7 +111,7 @@ func handleAuthorization(next http.Handler) http.Handler {
 		//    might want to split authentication and authorization up into two
 		//    separate middleware stages
 
-		isAuthorized := isAuthorized(r, user)
+		isAuthorized := s.isAuthorized(r, user)
 		if isAuthorized {
 			next.ServeHTTP(w, r)
 		} else if isAuthenticated {
@@ -81,11 +122,18 @@ func handleAuthorization(next http.Handler) http.Handler {
 	})
 }
 
-func isAuthorized(r *http.Request, user User) bool {
-	rname, isPublic, isFolder := parsePath(r.URL.Path)
+func (s *Server) isAuthorized(r *http.Request, user User) bool {
+	rname, isPublic, isFolder := s.parsePath(r.URL.Path)
 
 	isRequestRead := r.Method == http.MethodGet || r.Method == http.MethodHead
 
+	if user != nil && s.userRoots {
+		// users have no permissions outside of their own root
+		if root, _ := rootFromContext(r.Context()); userRoot(user) != root {
+			return isPublic && !isFolder && isRequestRead
+		}
+	}
+
 	if user != nil {
 		switch user.Permission(rname) {
 		case LevelNone:
@@ -100,8 +148,8 @@ func isAuthorized(r *http.Request, user User) bool {
 	return isPublic && !isFolder && isRequestRead
 }
 
-func parsePath(path string) (rname string, isPublic, isFolder bool) {
-	rname = strings.TrimPrefix(path, g.rroot)
+func (s *Server) parsePath(path string) (rname string, isPublic, isFolder bool) {
+	rname = strings.TrimPrefix(path, s.rroot)
 	isPublic = strings.HasPrefix(rname, "/public/")
 	isFolder = rname[len(rname)-1] == '/'
 	return
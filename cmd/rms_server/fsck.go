@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/cvanloo/rmsgo"
+)
+
+// fsck runs the fsck subcommand and returns the exit status.
+func fsck(rms *rmsgo.Server, args []string) int {
+	fset := flag.NewFlagSet("fsck", flag.ExitOnError)
+	gc := fset.Bool("gc", false, "Remove blobs that are not referenced by any document")
+	adopt := fset.Bool("adopt", false, "Add blobs that are not referenced by any document to "+rmsgo.LostAndFound)
+	drop := fset.Bool("drop", false, "Remove documents whose blob is missing")
+	fixLengths := fset.Bool("fix-lengths", false, "Update the length of documents whose blob has a different size")
+	_ = fset.Parse(args)
+
+	issues, err := rms.Fsck("", rmsgo.FsckOptions{
+		CollectOrphans: *gc,
+		AdoptOrphans:   *adopt,
+		DropDangling:   *drop,
+		FixLengths:     *fixLengths,
+	})
+	repaired, unrepaired := 0, 0
+	for _, issue := range issues {
+		fmt.Println(issue)
+		if issue.Repaired {
+			repaired++
+		} else {
+			unrepaired++
+		}
+	}
+	fmt.Printf("%d issues found, %d repaired\n", len(issues), repaired)
+	if err != nil {
+		log.Printf("fsck: %v", err)
+		return 1
+	}
+
+	if repaired > 0 {
+		if err := rms.Compact(); err != nil {
+			log.Printf("failed to persist server state: %v", err)
+			return 1
+		}
+	}
+	if unrepaired > 0 {
+		return 1
+	}
+	return 0
+}
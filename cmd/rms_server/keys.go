@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/cvanloo/rmsgo"
+)
+
+// loadKeys reads the master keys from the key file, one per line, as the
+// key's ID followed by the hex encoded key.
+// The key on the first line is the current one.
+func loadKeys(path string) (rmsgo.KeyProvider, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var current string
+	keys := map[string][]byte{}
+	sc := bufio.NewScanner(fd)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, key, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("%s: expected `<id> <hex key>', got: `%s'", path, line)
+		}
+		bs, err := hex.DecodeString(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %s: %w", path, id, err)
+		}
+		if current == "" {
+			current = id
+		}
+		keys[id] = bs
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return rmsgo.MasterKeys(current, keys)
+}
+
+// rotateKeys runs the rotate-keys subcommand and returns the exit status.
+func rotateKeys(rms *rmsgo.Server) int {
+	rotated, err := rms.RotateKeys("")
+	fmt.Printf("%d blobs rotated\n", rotated)
+	if err != nil {
+		log.Printf("rotate-keys: %v", err)
+		return 1
+	}
+	return 0
+}
@@ -27,6 +27,23 @@ var (
 	sroot       = flag.String("s", StorageRoot, "Storage directory (set based on `var' unless specified)")
 	rroot       = flag.String("r", RemoteRoot, "Remote storage root")
 	persistFile = flag.String("persist", PersistFile, "Restore server state from persistFile (set based on `var' unless specified)")
+	identity    = flag.String("id", "", "Stable server identity used in ETags (default is the host name)")
+	verify      = flag.Bool("verify", false, "Re-read all documents on startup, instead of trusting the persisted ETags")
+	compact     = flag.Int("compact", 1000, "Number of changes after which the journal is compacted into the persist file (0 to only compact on shutdown)")
+	uploads     = flag.Duration("uploads", 0, "Allow resumable uploads, abandoning them after this long without progress (0 disables resumable uploads)")
+	gzip        = flag.Int64("gzip", -1, "Compress responses of at least this many bytes with gzip (-1 disables compression)")
+	gzipBlobs   = flag.Bool("gzip-blobs", false, "Store text-like documents compressed with gzip")
+	keyFile     = flag.String("keys", "", "Encrypt documents with the master keys in keyFile, one `<id> <hex key>' per line, the first one is current")
+	scrub       = flag.Duration("scrub", 0, "Re-check the contents of all documents against their checksums this often (0 disables scrubbing)")
+	quarantine  = flag.Bool("quarantine", false, "Refuse to serve documents the scrubber found to be corrupt")
+	dedup       = flag.Bool("dedup", false, "Store identical documents only once, in blobs named by their content's digest")
+	shards      = flag.Int("shards", 0, "Distribute blobs over this many levels of subdirectories, run `relayout' after changing it")
+	shardWidth  = flag.Int("shard-width", 2, "Number of characters of the blob name that name a subdirectory, see -shards")
+	accounts    = flag.String("webfinger", "", "Answer WebFinger requests for these users (comma separated, `*' for any), pointing them to the storage")
+	authURL     = flag.String("auth-url", "", "OAuth dialog URL announced via WebFinger (default is the built-in dialog with -oauth)")
+	publicURL   = flag.String("public-url", "", "URL the server is reached at by clients, e.g., `https://example.org', announced via WebFinger (default is derived from each request)")
+	oauthFile   = flag.String("oauth", "", "Only accept bearer tokens granted via the OAuth dialog at /oauth/authorize, by the users in passwordFile, one `<user> <password>' per line")
+	tokenLife   = flag.Duration("token-lifetime", 0, "Expire bearer tokens granted via -oauth after this long (0 for never)")
 	origins     Origin
 	allOrigins  = true
 	help        = flag.Bool("h", false, "Print usage/help")
@@ -68,6 +85,10 @@ func logger(next http.Handler) http.Handler {
 
 func main() {
 	flag.Var(&origins, "o", "Allowed origins (default is any)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [fsck [fsck flags] | rotate-keys | relayout]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	if *help {
@@ -100,32 +121,71 @@ func main() {
 	} else {
 		fmt.Printf("allowed origins `%s'\n", origins)
 	}
+	journalFile := *persistFile + ".journal"
 	fmt.Printf("   persist file `%s'\n", *persistFile)
+	fmt.Printf("   journal file `%s'\n", journalFile)
 	fmt.Println("--------------------------------------")
 
 	if _, err := os.Stat(*sroot); err != nil {
 		log.Fatalf("storage root does not exist: %v", err)
 	}
 
-	err = rmsgo.Configure(*rroot, *sroot,
+	var keys rmsgo.KeyProvider
+	if *keyFile != "" {
+		keys, err = loadKeys(*keyFile)
+		if err != nil {
+			log.Fatalf("failed to load master keys: %v", err)
+		}
+	}
+
+	var credentials rmsgo.CredentialsFunc
+	if *oauthFile != "" {
+		credentials, err = loadPasswords(*oauthFile)
+		if err != nil {
+			log.Fatalf("failed to load oauth users: %v", err)
+		}
+	}
+
+	rms, err := rmsgo.New(*rroot, *sroot,
 		rmsgo.WithErrorHandler(func(err error) {
-			log.Fatalf("remote storage: unhandled error: %v", err)
+			var issue rmsgo.ScrubIssue
+			if errors.As(err, &issue) {
+				log.Printf("remote storage: %v", issue)
+				return
+			}
+			log.Printf("remote storage: unhandled error: %v", err)
 		}),
 		rmsgo.WithMiddleware(logger),
 		rmsgo.Optionally(!allOrigins, rmsgo.WithAllowedOrigins(origins.Origins)), // allow all is the default in opts
 		rmsgo.WithAuthentication(func(r *http.Request, bearer string) (rmsgo.User, bool) {
+			if credentials != nil {
+				return nil, false // only tokens of the authorization server are valid
+			}
 			return rmsgo.UserReadWrite{}, true
 		}),
+		rmsgo.Optionally(credentials != nil, rmsgo.WithOAuth("/oauth", credentials, *tokenLife)),
+		rmsgo.WithJournal(journalFile, *persistFile, *compact),
+		rmsgo.Optionally(*identity != "", rmsgo.WithServerIdentity(*identity)),
+		rmsgo.Optionally(*verify, rmsgo.WithVerifyETags()),
+		rmsgo.Optionally(*uploads > 0, rmsgo.WithResumableUploads(path.Join(*varData, "uploads"), *uploads)),
+		rmsgo.Optionally(*gzip >= 0, rmsgo.WithCompression(*gzip)),
+		rmsgo.Optionally(*gzipBlobs, rmsgo.WithBlobCompression(rmsgo.CodecGzip)),
+		rmsgo.Optionally(keys != nil, rmsgo.WithEncryption(keys)),
+		rmsgo.Optionally(*scrub > 0, rmsgo.WithScrubbing(*scrub, *quarantine)),
+		rmsgo.Optionally(*dedup, rmsgo.WithDeduplication()),
+		rmsgo.Optionally(*shards > 0, rmsgo.WithShardedBlobs(*shards, *shardWidth)),
+		rmsgo.Optionally(*publicURL != "", rmsgo.WithPublicURL(*publicURL)),
 	)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	fd, err := os.OpenFile(*persistFile, os.O_RDWR|os.O_CREATE, 0640)
+	fd, err := os.OpenFile(*persistFile, os.O_RDONLY|os.O_CREATE, 0640)
 	if err != nil {
 		log.Fatalf("failed to open or create persist file: %v", err)
 	}
-	err = rmsgo.Load(fd)
+	err = rms.Load(fd)
+	fd.Close()
 	if err != nil {
 		if errors.Is(err, io.EOF) {
 			log.Printf("server state was NOT restored: persist file is empty")
@@ -134,27 +194,55 @@ func main() {
 		}
 	}
 
+	if flag.Arg(0) == "fsck" {
+		os.Exit(fsck(rms, flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "rotate-keys" {
+		os.Exit(rotateKeys(rms))
+	}
+	if flag.Arg(0) == "relayout" {
+		os.Exit(relayout(rms))
+	}
+
 	defer func() {
-		_ = fd.Truncate(0)
-		_, _ = fd.Seek(0, io.SeekStart)
-		err := rmsgo.Persist(fd)
+		err := rms.Compact()
 		if err != nil {
 			log.Fatalf("failed to persist server state: %v", err)
 		}
-		log.Printf("wrote server state to persist file: %s", fd.Name())
+		log.Printf("wrote server state to persist file: %s", *persistFile)
 	}()
 
 	mux := http.NewServeMux()
-	rmsgo.Register(mux)
+	rms.Register(mux)
+	if *accounts != "" {
+		users := strings.Split(*accounts, ",")
+		rms.RegisterWebFinger(mux, func(r *http.Request, user, host string) (rmsgo.WebFingerAccount, bool) {
+			for _, u := range users {
+				if u = strings.TrimSpace(u); u == "*" || u == user {
+					return rmsgo.WebFingerAccount{AuthURL: *authURL}, true
+				}
+			}
+			return rmsgo.WebFingerAccount{}, false
+		})
+	}
 
 	srv := http.Server{
 		Addr:    fmt.Sprintf("%s:%s", *address, *port),
 		Handler: mux,
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *scrub > 0 {
+		go rms.RunScrubber(ctx)
+	}
+	if *uploads > 0 {
+		go rms.RunExpiry(ctx, *uploads)
+	}
+
 	wg := sync.WaitGroup{}
+	wg.Add(1)
 	go func() {
-		wg.Add(1)
 		defer wg.Done()
 		err := srv.ListenAndServe()
 		if err != nil && err != http.ErrServerClosed {
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/cvanloo/rmsgo"
+)
+
+// loadPasswords reads the users that may grant access via the OAuth dialog
+// from path, one `<user> <password>' per line, and returns a check for their
+// credentials.
+func loadPasswords(path string) (rmsgo.CredentialsFunc, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	passwords := map[string]string{}
+	sc := bufio.NewScanner(fd)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, password, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("%s: expected `<user> <password>', got: `%s'", path, line)
+		}
+		passwords[user] = strings.TrimSpace(password)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return func(r *http.Request, username, password string) (rmsgo.User, bool) {
+		want, ok := passwords[username]
+		if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(want)) != 1 {
+			return nil, false
+		}
+		return rmsgo.UserReadWrite{}, true
+	}, nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/cvanloo/rmsgo"
+)
+
+// relayout runs the relayout subcommand and returns the exit status.
+func relayout(rms *rmsgo.Server) int {
+	moved, err := rms.Relayout("")
+	fmt.Printf("%d blobs moved\n", moved)
+	if err != nil {
+		log.Printf("relayout: %v", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,229 @@
+package rmsgo
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	. "github.com/cvanloo/rmsgo/mock"
+)
+
+type (
+	// BlobCodec compresses the blobs of documents at rest, see
+	// WithBlobCompression.
+	BlobCodec interface {
+		// Name identifies the codec in the persist file, it must stay the
+		// same for as long as blobs compressed with it exist.
+		// Any ContentEncoding can be used as a codec, if it can also
+		// decompress.
+		ContentEncoding
+		// NewReader returns a reader decompressing the data read from r.
+		NewReader(r io.Reader) (io.ReadCloser, error)
+	}
+
+	// blobCompression configures which documents are compressed at rest.
+	blobCompression struct {
+		codec BlobCodec
+		mimes []string // nil to compress all compressible types
+	}
+
+	// encodingConfig configures how blobs are written to the storage root.
+	// It's shared by a tree and its documents.
+	encodingConfig struct {
+		compress *blobCompression // nil if disabled, see WithBlobCompression
+		keys     KeyProvider      // nil if disabled, see WithEncryption
+	}
+
+	// decodedBlob reads a compressed blob, as if it was stored verbatim.
+	decodedBlob struct {
+		sname  string
+		codec  BlobCodec
+		length int64
+
+		// The compressed data, kept open for as long as the blob is read,
+		// so that it stays readable even if the blob is removed meanwhile.
+		fd  io.ReadSeekCloser
+		r   io.ReadCloser
+		pos int64
+	}
+)
+
+// CodecGzip compresses blobs with gzip.
+var CodecGzip BlobCodec = gzipEncoding{}
+
+func (gzipEncoding) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// WithBlobCompression compresses the contents of documents with codec
+// before writing them to the storage root.
+// Only documents of the listed mime types are compressed, a type may be
+// given as, e.g., "application/json", or "text/*" to match all subtypes.
+// If no types are given, all types that are worth compressing (text, JSON,
+// XML, ...) are.
+// Compression is transparent to clients: documents are decompressed when
+// they are read, and their Content-Length and ETag are those of the
+// uncompressed contents.
+// The codec used is recorded per document, so that compression can be
+// turned on or off, or the codec changed, without having to rewrite the
+// existing blobs.
+// Blobs compressed with CodecGzip can always be read, those compressed with
+// another codec only while it is configured.
+func WithBlobCompression(codec BlobCodec, mimes ...string) Option {
+	return func(s *Server) {
+		s.blobCompression = &blobCompression{
+			codec: codec,
+			mimes: mimes,
+		}
+	}
+}
+
+// codecFor returns the codec to compress documents of the mime type with,
+// or nil if they are stored verbatim.
+func (c *blobCompression) codecFor(mimeType string) BlobCodec {
+	if c == nil {
+		return nil
+	}
+	if c.mimes == nil {
+		if compressible(mimeType) {
+			return c.codec
+		}
+		return nil
+	}
+	mt, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return nil
+	}
+	for _, m := range c.mimes {
+		if prefix, ok := strings.CutSuffix(m, "/*"); ok {
+			if strings.HasPrefix(mt, prefix+"/") {
+				return c.codec
+			}
+		} else if mt == m {
+			return c.codec
+		}
+	}
+	return nil
+}
+
+// codec returns the codec that blobs recorded as compressed with name are
+// decompressed with.
+// Blobs are always decompressed with the codec they were written with, even
+// if compression has since been configured differently.
+func (c *encodingConfig) codec(name string) (BlobCodec, bool) {
+	if c.compress != nil && c.compress.codec.Name() == name {
+		return c.compress.codec, true
+	}
+	if name == CodecGzip.Name() {
+		return CodecGzip, true
+	}
+	return nil, false
+}
+
+// codecName returns the name recorded for blobs compressed with codec.
+// Blobs that are stored verbatim have no codec.
+func codecName(codec BlobCodec) string {
+	if codec == nil {
+		return ""
+	}
+	return codec.Name()
+}
+
+// open opens the blob sname to read the original contents, which are length
+// bytes long.
+// codec (empty if none) and encrypted describe how the blob was written,
+// which may differ from how new blobs are written.
+func (c *encodingConfig) open(sname, codec string, encrypted bool, length int64) (io.ReadSeekCloser, error) {
+	var bc BlobCodec
+	if codec != "" {
+		var ok bool
+		bc, ok = c.codec(codec)
+		if !ok {
+			return nil, fmt.Errorf("blob %s: unknown codec: %s", sname, codec)
+		}
+	}
+
+	var fd io.ReadSeekCloser
+	fd, err := FS.Open(sname)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted {
+		if c.keys == nil {
+			return nil, errors.Join(fmt.Errorf("blob %s: encrypted, but no keys are configured", sname), fd.Close())
+		}
+		fd, err = openEncrypted(fd, c.keys)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if bc == nil {
+		return fd, nil
+	}
+	b := &decodedBlob{sname: sname, codec: bc, length: length, fd: fd}
+	if err := b.rewind(); err != nil {
+		return nil, errors.Join(err, fd.Close())
+	}
+	return b, nil
+}
+
+// rewind positions the blob at the start.
+func (b *decodedBlob) rewind() error {
+	if b.r != nil {
+		if err := b.r.Close(); err != nil {
+			return err
+		}
+		b.r = nil
+	}
+	if _, err := b.fd.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r, err := b.codec.NewReader(b.fd)
+	if err != nil {
+		return err
+	}
+	b.r, b.pos = r, 0
+	return nil
+}
+
+func (b *decodedBlob) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.pos += int64(n)
+	return n, err
+}
+
+// Seek is implemented by decompressing the blob up to offset, seeking
+// backwards starts over from the beginning.
+func (b *decodedBlob) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.pos
+	case io.SeekEnd:
+		offset += b.length
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("blob %s: seek to negative offset", b.sname)
+	}
+	if offset < b.pos {
+		if err := b.rewind(); err != nil {
+			return 0, err
+		}
+	}
+	_, err := io.CopyN(io.Discard, b, offset-b.pos)
+	if err != nil && err != io.EOF {
+		return b.pos, err
+	}
+	return offset, nil
+}
+
+func (b *decodedBlob) Close() error {
+	var err error
+	if b.r != nil {
+		err = b.r.Close()
+	}
+	b.r = nil
+	return errors.Join(err, b.fd.Close())
+}
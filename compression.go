@@ -0,0 +1,160 @@
+package rmsgo
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type (
+	// ContentEncoding is a content coding (RFC 9110, Section 8.4.1) that
+	// responses can be compressed with, see WithCompression.
+	ContentEncoding interface {
+		// Name is the coding's token as used in the Accept-Encoding and
+		// Content-Encoding headers, e.g., "gzip", "zstd", or "br".
+		Name() string
+		// NewWriter returns a writer compressing everything written to it
+		// into w.
+		// Close is called once the response has been written, it must flush
+		// any remaining data, but not close w.
+		NewWriter(w io.Writer) io.WriteCloser
+	}
+
+	// compression configures the negotiation of content codings.
+	compression struct {
+		minSize   int64
+		encodings []ContentEncoding
+	}
+
+	gzipEncoding struct{}
+)
+
+// EncodingGzip compresses responses with gzip.
+var EncodingGzip ContentEncoding = gzipEncoding{}
+
+func (gzipEncoding) Name() string {
+	return "gzip"
+}
+
+func (gzipEncoding) NewWriter(w io.Writer) io.WriteCloser {
+	return gzip.NewWriter(w)
+}
+
+// WithCompression compresses folder listings and documents of a
+// compressible content type (text, JSON, XML, ...) on the fly, if the client
+// accepts one of the encodings.
+// The encodings are listed in the order of the server's preference, if none
+// are given, EncodingGzip is used.
+// Other codings, such as zstd or brotli, can be plugged in by implementing
+// ContentEncoding.
+// Responses smaller than minSize bytes, as well as responses to Range
+// requests, are sent uncompressed.
+// Compressed responses carry the weak variant of the document's ETag, which
+// matches in If-None-Match, but not in If-Match or If-Range.
+func WithCompression(minSize int64, encodings ...ContentEncoding) Option {
+	return func(s *Server) {
+		if len(encodings) == 0 {
+			encodings = []ContentEncoding{EncodingGzip}
+		}
+		s.compression = &compression{
+			minSize:   minSize,
+			encodings: encodings,
+		}
+	}
+}
+
+// compressible reports whether content of the mime type is worth
+// compressing.
+// Images, audio, video, and archives are already compressed.
+func compressible(mimeType string) bool {
+	mt, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mt, "text/") ||
+		strings.HasSuffix(mt, "+json") ||
+		strings.HasSuffix(mt, "+xml") {
+		return true
+	}
+	switch mt {
+	case "application/json",
+		"application/xml",
+		"application/javascript",
+		"application/x-ndjson",
+		"application/x-yaml",
+		"application/yaml",
+		"application/toml",
+		"application/wasm":
+		return true
+	}
+	return false
+}
+
+// negotiate picks the content coding for a response of the given mime type
+// and size (-1 if not yet known), nil means that the response is sent
+// uncompressed.
+// The Vary header is set if the response depends on the request's
+// Accept-Encoding.
+func (c *compression) negotiate(w http.ResponseWriter, r *http.Request, mimeType string, size int64) ContentEncoding {
+	if c == nil || !compressible(mimeType) || (size >= 0 && size < c.minSize) {
+		return nil
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	return acceptEncoding(r.Header.Get("Accept-Encoding"), c.encodings)
+}
+
+// acceptEncoding returns the first of the encodings that is acceptable
+// according to the Accept-Encoding header (RFC 9110, Section 12.5.3).
+func acceptEncoding(header string, encodings []ContentEncoding) ContentEncoding {
+	weights := map[string]float64{}
+	for _, field := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(field, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+		}
+		weights[name] = q
+	}
+	for _, enc := range encodings {
+		q, ok := weights[enc.Name()]
+		if !ok {
+			q, ok = weights["*"]
+		}
+		if ok && q > 0 {
+			return enc
+		}
+	}
+	return nil
+}
+
+// writeEncoded writes the contents of src to w, compressed with enc.
+// The Content-Encoding header must already be set.
+func writeEncoded(w io.Writer, enc ContentEncoding, src io.Reader) error {
+	ew := enc.NewWriter(w)
+	if _, err := io.Copy(ew, src); err != nil {
+		return errors.Join(err, ew.Close())
+	}
+	return ew.Close()
+}
+
+// setEncoded sets the headers of a response compressed with enc.
+// The representation's ETag is weakened, since it's not byte-for-byte the
+// same as the stored document.
+func setEncoded(w http.ResponseWriter, enc ContentEncoding, etag ETag) {
+	hs := w.Header()
+	hs.Set("Content-Encoding", enc.Name())
+	hs.Set("ETag", entityTag{weak: true, etag: etag}.String())
+	hs.Del("Content-Length")
+}
@@ -0,0 +1,162 @@
+package rmsgo
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// entityTag is an ETag as it appears in HTTP headers, see RFC 9110, Section
+// 8.8.3.
+type entityTag struct {
+	weak bool
+	etag ETag
+}
+
+func (t entityTag) String() string {
+	if t.weak {
+		return `W/"` + t.etag.String() + `"`
+	}
+	return `"` + t.etag.String() + `"`
+}
+
+// strongTag formats etag as a strong entity tag for use in the ETag header.
+func strongTag(etag ETag) string {
+	return entityTag{etag: etag}.String()
+}
+
+// parseTagList parses the value of an If-Match or If-None-Match header.
+// star is true if the value is "*".
+// Tags that weren't produced by this server (i.e., aren't hex encoded) are
+// skipped, since they can never match.
+// For compatibility with clients that echo the unquoted ETags sent by
+// earlier versions of this server, bare tags are accepted as well.
+func parseTagList(s string) (star bool, tags []entityTag, ok bool) {
+	s = strings.TrimSpace(s)
+	if s == "*" {
+		return true, nil, true
+	}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue // empty list elements are allowed (RFC 9110, Section 5.6.1)
+		}
+		weak := strings.HasPrefix(field, "W/")
+		if weak {
+			field = field[2:]
+		}
+		quoted := len(field) >= 2 && field[0] == '"' && field[len(field)-1] == '"'
+		if quoted {
+			field = field[1 : len(field)-1]
+		}
+		if strings.ContainsAny(field, "\" ") {
+			return false, nil, false
+		}
+		etag, err := ParseETag(field)
+		if err != nil {
+			if quoted {
+				continue
+			}
+			return false, nil, false
+		}
+		tags = append(tags, entityTag{weak, etag})
+	}
+	return false, tags, true
+}
+
+// matchStrong reports whether any of the tags is strongly equal to etag
+// (RFC 9110, Section 8.8.3.2).
+func matchStrong(tags []entityTag, etag ETag) bool {
+	for _, t := range tags {
+		if !t.weak && t.etag.Equal(etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchWeak reports whether any of the tags is weakly equal to etag.
+func matchWeak(tags []entityTag, etag ETag) bool {
+	for _, t := range tags {
+		if t.etag.Equal(etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDate parses an HTTP-date, ok is false if s isn't one, in which case
+// the header must be ignored.
+func parseDate(s string) (t time.Time, ok bool) {
+	if s == "" {
+		return t, false
+	}
+	t, err := http.ParseTime(s)
+	return t, err == nil
+}
+
+// modifiedSince reports whether the document n has been modified after t.
+// HTTP-dates only have a precision of one second.
+func modifiedSince(n *NodeInfo, t time.Time) bool {
+	return n.LastMod.Truncate(time.Second).After(t)
+}
+
+// checkPreconditions evaluates the conditional headers of r against the
+// current state of the resource n (nil if it doesn't exist), following the
+// precedence rules of RFC 9110, Section 13.2.2.
+// A nil error means that the request should be processed normally,
+// otherwise the error responds with 304 (Not Modified), 412 (Precondition
+// Failed), or 400 (Bad Request) if a header is malformed.
+// The ETag header is set to the resource's current ETag when a
+// precondition fails.
+func checkPreconditions(w http.ResponseWriter, r *http.Request, n *NodeInfo) error {
+	safe := r.Method == http.MethodGet || r.Method == http.MethodHead
+	hasDate := n != nil && n.LastMod != nil // folders don't have a modification date
+	fail := func(err error) error {
+		if n != nil {
+			w.Header().Set("ETag", strongTag(n.ETag))
+		}
+		return err
+	}
+
+	// 1. If-Match, otherwise 2. If-Unmodified-Since
+	if cond := r.Header.Get("If-Match"); cond != "" {
+		star, tags, ok := parseTagList(cond)
+		if !ok {
+			return InvalidIfMatch(cond)
+		}
+		if n == nil {
+			return PreconditionFailed("If-Match", "the document does not exist")
+		}
+		if !(star || matchStrong(tags, n.ETag)) {
+			return fail(VersionMismatch(nil, n.ETag))
+		}
+	} else if t, ok := parseDate(r.Header.Get("If-Unmodified-Since")); ok && hasDate {
+		if modifiedSince(n, t) {
+			return fail(PreconditionFailed("If-Unmodified-Since", "the document has been modified since"))
+		}
+	}
+
+	// 3. If-None-Match, otherwise 4. If-Modified-Since
+	if cond := r.Header.Get("If-None-Match"); cond != "" {
+		star, tags, ok := parseTagList(cond)
+		if !ok {
+			return InvalidIfNonMatch(cond)
+		}
+		if n != nil && (star || matchWeak(tags, n.ETag)) {
+			if safe {
+				return fail(NotModified())
+			}
+			if star {
+				return fail(DocExists(n.Rname))
+			}
+			return fail(PreconditionFailed("If-None-Match", "the document's current version matches"))
+		}
+	} else if t, ok := parseDate(r.Header.Get("If-Modified-Since")); ok && hasDate && safe {
+		if !modifiedSince(n, t) {
+			return fail(NotModified())
+		}
+	}
+
+	return nil
+}
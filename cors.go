@@ -16,17 +16,31 @@ var (
 		"X-Requested-With",
 		"If-Match",
 		"If-None-Match",
+		"Content-Digest",
+		"Repr-Digest",
+		"Content-MD5",
+		"Content-Range",
+		"Range",
+		"If-Range",
+		"If-Modified-Since",
+		"If-Unmodified-Since",
+	}
+	// exposeHeaders are the response headers, besides the CORS-safelisted
+	// ones, that clients are allowed to read.
+	exposeHeaders = []string{
+		"Range",
+		"Content-Range",
 	}
 )
 
-func handleCORS(next http.Handler) http.Handler {
+func (s *Server) handleCORS(next http.Handler) http.Handler {
 	mux := &MuxWithError{}
-	mux.HandleFunc("OPTIONS /", preflight) // preflight does not pass on the request to the next handler
-	mux.Handle("/", cors(next))
+	mux.HandleFunc("OPTIONS /", s.preflight) // preflight does not pass on the request to the next handler
+	mux.Handle("/", s.cors(next))
 	return mux
 }
 
-func preflight(w http.ResponseWriter, r *http.Request) error {
+func (s *Server) preflight(w http.ResponseWriter, r *http.Request) error {
 	path := r.URL.Path
 	isFolder := path[len(path)-1] == '/'
 
@@ -38,15 +52,21 @@ func preflight(w http.ResponseWriter, r *http.Request) error {
 	hs.Add("Vary", "Access-Control-Request-Headers")
 
 	origin := r.Header.Get("Origin")
-	if !(g.allowAllOrigins || g.allowOrigin(r, origin)) {
+	if !(s.allowAllOrigins || s.allowOrigin(r, origin)) {
 		return errCorsFail
 	}
 
-	n, err := Retrieve(path)
+	st, err := s.storageFor(r)
+	if err != nil { // no such user root
+		return errCorsFail
+	}
+	st.RLock()
+	n, err := st.Get(path)
+	st.RUnlock()
 	if err != nil { // not found
 		return errCorsFail
 	}
-	if n.isFolder != isFolder { // malformed request
+	if n.IsFolder != isFolder { // malformed request
 		return errCorsFail
 	}
 
@@ -85,7 +105,7 @@ func preflight(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 
-	if g.allowAllOrigins {
+	if s.allowAllOrigins {
 		hs.Set("Access-Control-Allow-Origin", "*")
 	} else {
 		hs.Set("Access-Control-Allow-Origin", origin)
@@ -98,7 +118,7 @@ func preflight(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-func cors(next http.Handler) http.Handler {
+func (s *Server) cors(next http.Handler) http.Handler {
 	return HandlerWithError(func(w http.ResponseWriter, r *http.Request) error {
 		hs := w.Header()
 
@@ -106,15 +126,16 @@ func cors(next http.Handler) http.Handler {
 		hs.Set("Vary", "Origin")
 
 		origin := r.Header.Get("Origin")
-		if !(g.allowAllOrigins || g.allowOrigin(r, origin)) {
+		if !(s.allowAllOrigins || s.allowOrigin(r, origin)) {
 			return errCorsFail
 		}
 
-		if g.allowAllOrigins {
+		if s.allowAllOrigins {
 			hs.Set("Access-Control-Allow-Origin", "*")
 		} else {
 			hs.Set("Access-Control-Allow-Origin", origin)
 		}
+		hs.Set("Access-Control-Expose-Headers", strings.Join(exposeHeaders, ", "))
 
 		next.ServeHTTP(w, r)
 		return nil
@@ -0,0 +1,206 @@
+package rmsgo
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	. "github.com/cvanloo/rmsgo/mock"
+)
+
+// blobDir is the directory in the storage root that content-addressed blobs
+// are written to, see WithDeduplication.
+// It can't be used as a user root.
+const blobDir = ".blobs"
+
+// blobStore keeps track of the content-addressed blobs, which are shared by
+// the documents of all trees.
+type blobStore struct {
+	dir    string
+	layout blobLayout
+	mu     sync.Mutex
+	refs   map[string]int // by sname
+}
+
+// WithDeduplication stores documents by the SHA-256 digest of their
+// contents, in the ".blobs" directory of the storage root, so that identical
+// documents (even those of different user roots) share the same blob.
+// Blobs are reference counted, and removed once the last document (or
+// previous version, or trashed document) referring to them is removed or
+// overwritten.
+// Reference counts are not persisted, but rebuilt by Load and LoadRoot, all
+// user roots must therefore be loaded before requests are served.
+// Since blob names are derived from the contents, they reveal the digests of
+// documents, even if they are encrypted (see WithEncryption).
+// Existing blobs are left as they are, and are deduplicated as they are
+// overwritten or migrated.
+func WithDeduplication() Option {
+	return func(s *Server) {
+		s.dedup = true
+	}
+}
+
+func newBlobStore(sroot string) *blobStore {
+	return &blobStore{
+		dir:  filepath.Join(sroot, blobDir),
+		refs: map[string]int{},
+	}
+}
+
+// owns reports whether sname is a content-addressed blob.
+// Other blobs belong to a single document.
+func (s *blobStore) owns(sname string) bool {
+	return s != nil && strings.HasPrefix(sname, s.dir+string(filepath.Separator))
+}
+
+// name returns the content-addressed name of a blob, the codec and
+// encryption are part of it, since they change what is written to disk.
+func (s *blobStore) name(digest []byte, codec string, encrypted bool) string {
+	name := hex.EncodeToString(digest)
+	if codec != "" {
+		name += "." + codec
+	}
+	if encrypted {
+		name += ".enc"
+	}
+	return s.layout.path(s.dir, name)
+}
+
+// tmpName returns the name of a new blob that is still being written, see
+// add.
+func (s *blobStore) tmpName() (string, error) {
+	u, err := UUID()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, u.String()+".tmp"), nil
+}
+
+// add turns the newly written blob b (still named by tmpName) into the
+// content-addressed blob for its contents, returning its name.
+// If an intact blob with the same contents already exists, it is referenced
+// instead, and b is removed.
+// An existing blob that doesn't match its digest anymore (e.g., one the
+// scrubber found to be corrupt) is replaced by b, which repairs all
+// documents referring to it.
+func (s *blobStore) add(b blob, enc *encodingConfig) (string, error) {
+	tmp := b.sname
+	sname := s.name(b.digest, b.codec, b.encrypted)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.intact(sname, b, enc) {
+		s.refs[sname]++
+		// Failing to remove tmp only leaves behind an unreferenced file.
+		_ = FS.Remove(tmp)
+		return sname, nil
+	}
+	// The blob is new, or has gone missing or is corrupt, and is restored.
+	if _, err := s.layout.create(s.dir, filepath.Base(sname)); err != nil {
+		return "", errors.Join(err, FS.Remove(tmp))
+	}
+	if err := Rename(tmp, sname); err != nil {
+		return "", errors.Join(err, FS.Remove(tmp))
+	}
+	s.refs[sname]++
+	return sname, nil
+}
+
+// intact reports whether the content-addressed blob sname exists, and its
+// contents still match those of b.
+// The caller must hold s.mu, so that the blob isn't removed meanwhile.
+func (s *blobStore) intact(sname string, b blob, enc *encodingConfig) bool {
+	if _, err := FS.Stat(sname); err != nil {
+		return false
+	}
+	sum, err := enc.checksum(sname, b.codec, b.encrypted, b.length)
+	return err == nil && bytes.Equal(sum, b.digest)
+}
+
+// release drops a reference to the blob sname, removing it if it was the
+// last one.
+func (s *blobStore) release(sname string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refs[sname]--
+	if s.refs[sname] > 0 {
+		return nil
+	}
+	delete(s.refs, sname)
+	err := FS.Remove(sname)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil // already gone, e.g., collected by a previous run
+	}
+	return err
+}
+
+// count adds delta to the references of those snames that are
+// content-addressed, without removing any blobs.
+func (s *blobStore) count(snames []string, delta int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sname := range snames {
+		if !s.owns(sname) {
+			continue
+		}
+		s.refs[sname] += delta
+		if s.refs[sname] <= 0 {
+			delete(s.refs, sname)
+		}
+	}
+}
+
+// snames lists the blobs referenced by the tree's documents, their previous
+// versions, and the trash.
+func (t *tree) snames() (snames []string) {
+	for _, n := range t.files {
+		if n.isFolder {
+			continue
+		}
+		snames = append(snames, n.sname)
+		snames = append(snames, versionSnames(n.versions)...)
+	}
+	for _, item := range t.trash {
+		snames = append(snames, item.sname)
+		snames = append(snames, versionSnames(item.versions)...)
+	}
+	return snames
+}
+
+// removeBlob removes the blob sname, which is no longer referenced by the
+// tree.
+// Content-addressed blobs are only removed once no other document refers
+// to them.
+func (t *tree) removeBlob(sname string) error {
+	if t.shared.owns(sname) {
+		return t.shared.release(sname)
+	}
+	return FS.Remove(sname)
+}
+
+// releaseBlobs drops the references of the (already removed) document n and
+// its previous versions to content-addressed blobs.
+// Other blobs are left alone, they belong to whoever added the document.
+func (t *tree) releaseBlobs(n *node) error {
+	var errs []error
+	for _, sname := range append([]string{n.sname}, versionSnames(n.versions)...) {
+		if t.shared.owns(sname) {
+			errs = append(errs, t.shared.release(sname))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func versionSnames(versions []*version) (snames []string) {
+	for _, v := range versions {
+		snames = append(snames, v.sname)
+	}
+	return snames
+}
@@ -0,0 +1,130 @@
+package rmsgo
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// digestAlgorithms are the algorithms of Content-Digest and Repr-Digest
+// headers (RFC 9530) that uploads are verified against.
+// Digests using other algorithms are ignored.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+type (
+	// digestCheck verifies that the content hashes to want.
+	digestCheck struct {
+		header string
+		h      hash.Hash
+		want   []byte
+	}
+
+	// digestReader verifies the digests of the data read from r, once all of
+	// it has been read.
+	digestReader struct {
+		r      io.Reader
+		checks []digestCheck
+	}
+
+	// digestError is returned by digestReader if the content doesn't match
+	// a digest sent by the client.
+	digestError struct {
+		header string
+	}
+)
+
+func (e digestError) Error() string {
+	return fmt.Sprintf("the content does not match the %s header", e.header)
+}
+
+// expectedDigests parses the Content-Digest, Repr-Digest, and Content-MD5
+// headers of the upload r.
+// Since the server doesn't decode request bodies, the content and
+// representation digests both refer to the body as is.
+func expectedDigests(r *http.Request) (checks []digestCheck, err error) {
+	for _, header := range []string{"Content-Digest", "Repr-Digest"} {
+		for _, field := range r.Header.Values(header) {
+			cs, err := parseDigests(header, field)
+			if err != nil {
+				return nil, err
+			}
+			checks = append(checks, cs...)
+		}
+	}
+	if field := r.Header.Get("Content-MD5"); field != "" {
+		want, err := base64.StdEncoding.DecodeString(strings.TrimSpace(field))
+		if err != nil || len(want) != md5.Size {
+			return nil, BadRequest("invalid Content-MD5 header")
+		}
+		checks = append(checks, digestCheck{"Content-MD5", md5.New(), want})
+	}
+	return checks, nil
+}
+
+// parseDigests parses a digest dictionary, e.g., "sha-256=:<base64>:".
+func parseDigests(header, field string) (checks []digestCheck, err error) {
+	for _, member := range strings.Split(field, ",") {
+		member = strings.TrimSpace(member)
+		if member == "" {
+			continue
+		}
+		alg, value, ok := strings.Cut(member, "=")
+		value, ok2 := strings.CutPrefix(value, ":")
+		value, ok3 := strings.CutSuffix(value, ":")
+		if !(ok && ok2 && ok3) {
+			return nil, BadRequest(fmt.Sprintf("invalid %s header", header))
+		}
+		want, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, BadRequest(fmt.Sprintf("invalid %s header", header))
+		}
+		newHash, ok := digestAlgorithms[strings.ToLower(strings.TrimSpace(alg))]
+		if !ok {
+			continue
+		}
+		checks = append(checks, digestCheck{header, newHash(), want})
+	}
+	return checks, nil
+}
+
+func (d *digestReader) Read(bs []byte) (int, error) {
+	n, err := d.r.Read(bs)
+	for _, c := range d.checks {
+		c.h.Write(bs[:n])
+	}
+	if err == io.EOF {
+		for _, c := range d.checks {
+			if !bytes.Equal(c.h.Sum(nil), c.want) {
+				return n, digestError{c.header}
+			}
+		}
+	}
+	return n, err
+}
+
+// digestMismatch returns a 400 (Bad Request) error if err was caused by the
+// content not matching a digest, nil otherwise.
+func digestMismatch(err error) error {
+	var de digestError
+	if errors.As(err, &de) {
+		return BadRequest(de.Error())
+	}
+	return nil
+}
+
+// formatDigest formats the SHA-256 digest of a document for the
+// Content-Digest and Repr-Digest headers.
+func formatDigest(digest []byte) string {
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(digest) + ":"
+}
@@ -0,0 +1,489 @@
+package rmsgo
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	. "github.com/cvanloo/rmsgo/mock"
+)
+
+// Encrypted blobs start with a header:
+//
+//	magic | uint16 len(keyID) | keyID | uint16 len(wrapped) | wrapped | prefix
+//
+// where wrapped is the document's data key, wrapped by the master key keyID,
+// and prefix is the random nonce prefix.
+// The contents follow, split into segments of encSegmentSize bytes that are
+// sealed individually with AES-GCM, so that a blob can be read from any
+// offset without decrypting everything before it.
+// The nonce of a segment is the prefix, followed by the segment's index and a
+// flag marking the last segment, which prevents segments from being
+// reordered, or the blob from being truncated, unnoticed.
+const (
+	encMagic       = "rmsenc1\n"
+	encKeySize     = 32 // AES-256
+	encPrefixSize  = 7
+	encSegmentSize = 64 << 10
+)
+
+type (
+	// KeyProvider supplies the master keys that the data keys of encrypted
+	// blobs are wrapped with, see WithEncryption.
+	KeyProvider interface {
+		// KeyID identifies the current master key, which new data keys are
+		// wrapped with.
+		KeyID() string
+		// WrapKey encrypts the data key with the master key keyID.
+		WrapKey(keyID string, key []byte) (wrapped []byte, err error)
+		// UnwrapKey decrypts a data key that was wrapped with the master key
+		// keyID.
+		UnwrapKey(keyID string, wrapped []byte) (key []byte, err error)
+	}
+
+	masterKeys struct {
+		current string
+		keys    map[string]cipher.AEAD
+	}
+
+	encHeader struct {
+		keyID   string
+		wrapped []byte
+		prefix  []byte
+	}
+
+	// encryptWriter encrypts everything written to it into a blob.
+	encryptWriter struct {
+		w       io.Writer
+		aead    cipher.AEAD
+		prefix  []byte
+		counter uint32
+		buf     []byte // plain text of the current segment
+		out     []byte
+	}
+
+	// encryptedBlob reads an encrypted blob.
+	encryptedBlob struct {
+		fd       io.ReadSeekCloser
+		aead     cipher.AEAD
+		prefix   []byte
+		start    int64 // offset of the first segment
+		body     int64 // length of all segments
+		segments int64
+		size     int64 // length of the plain text
+		pos      int64
+
+		idx   int64 // index of the segment in plain, -1 if none
+		plain []byte
+		buf   []byte
+	}
+)
+
+// ErrNoEncryption is returned when keys are to be rotated, but encryption
+// isn't enabled.
+var ErrNoEncryption = errors.New("encryption is not enabled")
+
+// WithEncryption encrypts the blobs of documents with AES-256-GCM before
+// writing them to the storage root.
+// Every document is encrypted with its own random data key, which is stored
+// alongside the blob, wrapped by the current master key of keys.
+// Encryption is transparent to clients, documents are decrypted when they
+// are read.
+// Documents written before encryption was enabled remain readable, but are
+// not encrypted until they are overwritten.
+// To retire a master key, make a new one current, and call RotateKeys to
+// re-wrap the data keys, without having to re-encrypt the documents.
+func WithEncryption(keys KeyProvider) Option {
+	return func(s *Server) {
+		s.keys = keys
+	}
+}
+
+// MasterKeys returns a KeyProvider that wraps data keys with AES-256-GCM,
+// using the master keys, by ID, which must be 32 bytes long.
+// New data keys are wrapped with the key current, the others are only used
+// to unwrap the data keys that haven't been rotated yet.
+func MasterKeys(current string, keys map[string][]byte) (KeyProvider, error) {
+	mk := &masterKeys{current: current, keys: map[string]cipher.AEAD{}}
+	for id, key := range keys {
+		if len(key) != encKeySize {
+			return nil, fmt.Errorf("encryption: master key %s: must be %d bytes long, got: %d", id, encKeySize, len(key))
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		mk.keys[id] = aead
+	}
+	if _, ok := mk.keys[current]; !ok {
+		return nil, fmt.Errorf("encryption: current master key %s is missing", current)
+	}
+	return mk, nil
+}
+
+func (mk *masterKeys) KeyID() string {
+	return mk.current
+}
+
+func (mk *masterKeys) WrapKey(keyID string, key []byte) ([]byte, error) {
+	aead, ok := mk.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("encryption: unknown master key: %s", keyID)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, key, []byte(keyID)), nil
+}
+
+func (mk *masterKeys) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := mk.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("encryption: unknown master key: %s", keyID)
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("encryption: wrapped key is too short")
+	}
+	nonce, ct := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	return aead.Open(nil, nonce, ct, []byte(keyID))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// segmentNonce returns the nonce of the i-th segment.
+func segmentNonce(prefix []byte, i uint32, last bool) []byte {
+	nonce := make([]byte, 0, encPrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, i)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+func (h encHeader) marshal() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(encMagic)
+	buf.Write(binary.BigEndian.AppendUint16(nil, uint16(len(h.keyID))))
+	buf.WriteString(h.keyID)
+	buf.Write(binary.BigEndian.AppendUint16(nil, uint16(len(h.wrapped))))
+	buf.Write(h.wrapped)
+	buf.Write(h.prefix)
+	return buf.Bytes()
+}
+
+// readEncHeader reads the header of an encrypted blob from r, and returns
+// the number of bytes it took up.
+func readEncHeader(r io.Reader) (h encHeader, size int64, err error) {
+	field := func(n int) ([]byte, error) {
+		bs := make([]byte, n)
+		_, err := io.ReadFull(r, bs)
+		size += int64(n)
+		return bs, err
+	}
+	lenField := func() ([]byte, error) {
+		l, err := field(2)
+		if err != nil {
+			return nil, err
+		}
+		return field(int(binary.BigEndian.Uint16(l)))
+	}
+
+	magic, err := field(len(encMagic))
+	if err != nil || string(magic) != encMagic {
+		return h, 0, errors.Join(errors.New("encryption: not an encrypted blob"), err)
+	}
+	keyID, err := lenField()
+	if err != nil {
+		return h, 0, err
+	}
+	h.keyID = string(keyID)
+	if h.wrapped, err = lenField(); err != nil {
+		return h, 0, err
+	}
+	if h.prefix, err = field(encPrefixSize); err != nil {
+		return h, 0, err
+	}
+	return h, size, nil
+}
+
+// newEncryptWriter writes the header of a new encrypted blob, with a new
+// data key, to w.
+// The returned writer must be closed to write the last segment.
+func newEncryptWriter(w io.Writer, keys KeyProvider) (*encryptWriter, error) {
+	key := make([]byte, encKeySize)
+	prefix := make([]byte, encPrefixSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	keyID := keys.KeyID()
+	wrapped, err := keys.WrapKey(keyID, key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	h := encHeader{keyID: keyID, wrapped: wrapped, prefix: prefix}
+	if _, err := w.Write(h.marshal()); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:      w,
+		aead:   aead,
+		prefix: prefix,
+		buf:    make([]byte, 0, encSegmentSize),
+	}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		// A full segment is only sealed once more data arrives, since it
+		// might be the last one.
+		if len(e.buf) == encSegmentSize {
+			if err := e.seal(false); err != nil {
+				return n, err
+			}
+		}
+		k := copy(e.buf[len(e.buf):encSegmentSize], p)
+		e.buf = e.buf[:len(e.buf)+k]
+		p = p[k:]
+		n += k
+	}
+	return n, nil
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	e.out = e.aead.Seal(e.out[:0], segmentNonce(e.prefix, e.counter, last), e.buf, nil)
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(e.out)
+	return err
+}
+
+// Close seals the last segment, it does not close the underlying writer.
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+// openEncrypted prepares the encrypted blob fd for reading, fd is closed if
+// that fails.
+func openEncrypted(fd io.ReadSeekCloser, keys KeyProvider) (*encryptedBlob, error) {
+	b, err := newEncryptedBlob(fd, keys)
+	if err != nil {
+		return nil, errors.Join(err, fd.Close())
+	}
+	return b, nil
+}
+
+func newEncryptedBlob(fd io.ReadSeekCloser, keys KeyProvider) (*encryptedBlob, error) {
+	h, start, err := readEncHeader(fd)
+	if err != nil {
+		return nil, err
+	}
+	key, err := keys.UnwrapKey(h.keyID, h.wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	total, err := fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	b := &encryptedBlob{
+		fd:     fd,
+		aead:   aead,
+		prefix: h.prefix,
+		start:  start,
+		body:   total - start,
+		idx:    -1,
+		buf:    make([]byte, encSegmentSize+aead.Overhead()),
+	}
+	sealed := int64(encSegmentSize + aead.Overhead())
+	b.segments = (b.body + sealed - 1) / sealed
+	b.size = b.body - b.segments*int64(aead.Overhead())
+	if b.segments == 0 || b.size < 0 {
+		return nil, errors.New("encryption: blob is truncated")
+	}
+	// Authenticate the first segment right away, so that a wrong key or a
+	// corrupt blob is noticed even if the blob is empty.
+	if err := b.load(0); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// load decrypts the i-th segment.
+func (b *encryptedBlob) load(i int64) error {
+	sealed := int64(encSegmentSize + b.aead.Overhead())
+	if _, err := b.fd.Seek(b.start+i*sealed, io.SeekStart); err != nil {
+		return err
+	}
+	ct := b.buf[:min(sealed, b.body-i*sealed)]
+	if _, err := io.ReadFull(b.fd, ct); err != nil {
+		return err
+	}
+	plain, err := b.aead.Open(b.plain[:0], segmentNonce(b.prefix, uint32(i), i == b.segments-1), ct, nil)
+	if err != nil {
+		b.idx = -1
+		return fmt.Errorf("encryption: blob is corrupt: %w", err)
+	}
+	b.plain, b.idx = plain, i
+	return nil
+}
+
+func (b *encryptedBlob) Read(p []byte) (int, error) {
+	if b.pos >= b.size {
+		return 0, io.EOF
+	}
+	i := b.pos / encSegmentSize
+	if i != b.idx {
+		if err := b.load(i); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, b.plain[b.pos-i*encSegmentSize:])
+	b.pos += int64(n)
+	return n, nil
+}
+
+func (b *encryptedBlob) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.pos
+	case io.SeekEnd:
+		offset += b.size
+	}
+	if offset < 0 {
+		return 0, errors.New("encryption: seek to negative offset")
+	}
+	b.pos = offset
+	return offset, nil
+}
+
+func (b *encryptedBlob) Close() error {
+	return b.fd.Close()
+}
+
+// rewrapBlob wraps the data key of the encrypted blob sname with the current
+// master key, if it isn't already.
+// Only the header is rewritten, the contents stay the same.
+func rewrapBlob(sname string, keys KeyProvider) (rotated bool, err error) {
+	fd, err := FS.Open(sname)
+	if err != nil {
+		return false, err
+	}
+	defer fd.Close()
+	h, _, err := readEncHeader(fd)
+	if err != nil {
+		return false, err
+	}
+	current := keys.KeyID()
+	if h.keyID == current {
+		return false, nil
+	}
+	key, err := keys.UnwrapKey(h.keyID, h.wrapped)
+	if err != nil {
+		return false, err
+	}
+	h.keyID = current
+	if h.wrapped, err = keys.WrapKey(current, key); err != nil {
+		return false, err
+	}
+
+	// Replace the blob atomically, it must stay readable if we crash.
+	u, err := UUID()
+	if err != nil {
+		return false, err
+	}
+	tmp := filepath.Join(filepath.Dir(sname), u.String()+".tmp")
+	if _, err := writeBlob(tmp, io.MultiReader(bytes.NewReader(h.marshal()), fd), nil, nil); err != nil {
+		return false, errors.Join(err, FS.Remove(tmp))
+	}
+	if err := Rename(tmp, sname); err != nil {
+		return false, errors.Join(err, FS.Remove(tmp))
+	}
+	return true, nil
+}
+
+// RotateKeys re-wraps the data keys of all encrypted documents (including
+// previous versions and trashed documents) with the current master key, see
+// WithEncryption.
+// root names the user root (see WithUserRoots), leave it empty to rotate the
+// keys of the server's default storage tree.
+// The number of rotated blobs is returned.
+// Blobs that fail to be rotated are skipped, and reported in the error.
+// Requests can be served while keys are rotated, but the storage can't be
+// modified.
+func (s *Server) RotateKeys(root string) (rotated int, err error) {
+	t := s.tree
+	if root != "" {
+		t, err = s.userTree(root, false)
+		if err != nil {
+			return 0, err
+		}
+	}
+	t.RLock()
+	defer t.RUnlock()
+	return t.rotateKeys()
+}
+
+// RotateKeys rotates the keys of the default server, see (*Server).RotateKeys.
+func RotateKeys(root string) (rotated int, err error) {
+	return g.RotateKeys(root)
+}
+
+func (t *tree) rotateKeys() (rotated int, err error) {
+	keys := t.encoding.keys
+	if keys == nil {
+		return 0, ErrNoEncryption
+	}
+	var errs []error
+	rewrap := func(sname string, encrypted bool) {
+		if !encrypted {
+			return
+		}
+		ok, err := rewrapBlob(sname, keys)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", sname, err))
+		} else if ok {
+			rotated++
+		}
+	}
+	for _, n := range t.files {
+		if n.isFolder {
+			continue
+		}
+		rewrap(n.sname, n.encrypted)
+		for _, v := range n.versions {
+			rewrap(v.sname, v.encrypted)
+		}
+	}
+	for _, item := range t.trash {
+		rewrap(item.sname, item.encrypted)
+		for _, v := range item.versions {
+			rewrap(v.sname, v.encrypted)
+		}
+	}
+	return rotated, errors.Join(errs...)
+}
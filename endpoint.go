@@ -1,21 +1,18 @@
 package rmsgo
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"net/http"
-	"path/filepath"
-	"strings"
-
-	. "github.com/cvanloo/rmsgo/mock"
 )
 
-// @todo: https://datatracker.ietf.org/doc/html/draft-dejong-remotestorage-21#section-6
-// keep multiple versions of files around, option to restore deleted files
+// @note: https://datatracker.ietf.org/doc/html/draft-dejong-remotestorage-21#section-6
 // > A provider MAY offer version rollback functionality to its users,
 // > but this specification does not define the interface for that.
+// See WithVersionHistory and WithTrash.
 
 type (
 	Middleware func(next http.Handler) http.Handler
@@ -50,7 +47,7 @@ func (h HandlerWithError) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		status := http.StatusInternalServerError
 		http.Error(w, http.StatusText(status), status)
-		g.unhandled(err)
+		serverFromContext(r.Context()).unhandled(err)
 	}
 }
 
@@ -58,17 +55,20 @@ func (m *MuxWithError) HandleFunc(pattern string, handler func(http.ResponseWrit
 	m.ServeMux.Handle(pattern, HandlerWithError(handler))
 }
 
-func RMSRouter() http.Handler {
+// RMSRouter returns the handler serving the remote storage endpoints of s.
+// The handler expects the remote root to already be stripped from the
+// request's path.
+func (s *Server) RMSRouter() http.Handler {
 	folderMux := &MuxWithError{}
-	folderMux.HandleFunc("GET /", getFolder)
+	folderMux.HandleFunc("GET /", s.getFolder)
 	folderMux.Handle("/", HandlerWithError(func(http.ResponseWriter, *http.Request) error {
 		return BadRequest("method not allowed on folders")
 	}))
 
 	documentMux := &MuxWithError{}
-	documentMux.HandleFunc("GET /", getDocument)
-	documentMux.HandleFunc("PUT /", putDocument)
-	documentMux.HandleFunc("DELETE /", deleteDocument)
+	documentMux.HandleFunc("GET /", s.getDocument)
+	documentMux.HandleFunc("PUT /", s.putDocument)
+	documentMux.HandleFunc("DELETE /", s.deleteDocument)
 	documentMux.Handle("/", HandlerWithError(func(http.ResponseWriter, *http.Request) error {
 		return BadRequest("method not allowed on documents")
 	}))
@@ -88,50 +88,70 @@ func RMSRouter() http.Handler {
 	return mux
 }
 
-func getFolder(w http.ResponseWriter, r *http.Request) error {
-	n, err := Retrieve(r.URL.Path)
+// RMSRouter returns the router of the default server, see (*Server).RMSRouter.
+func RMSRouter() http.Handler {
+	return g.RMSRouter()
+}
+
+func (s *Server) getFolder(w http.ResponseWriter, r *http.Request) error {
+	st, err := s.storageFor(r)
 	if err != nil {
 		return MaybeNotFound(err)
 	}
-	if !n.isFolder {
-		return NotAFolder(n.rname)
+	// The listing is sent once the lock has been released.
+	st.RLock()
+	etag, buf, enc, err := s.listFolder(w, r, st)
+	st.RUnlock()
+	if err != nil {
+		return err
 	}
 
-	etag, err := n.Version()
+	hs := w.Header()
+	hs.Set("Content-Type", "application/ld+json")
+	hs.Set("Cache-Control", "no-cache")
+	hs.Set("ETag", strongTag(etag))
+	if enc != nil && int64(buf.Len()) >= s.compression.minSize {
+		setEncoded(w, enc, etag)
+		return writeEncoded(w, enc, buf)
+	}
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// listFolder describes the folder requested by r, once the preconditions
+// have been evaluated.
+// The caller must hold at least the storage's read lock.
+func (s *Server) listFolder(w http.ResponseWriter, r *http.Request, st Storage) (ETag, *bytes.Buffer, ContentEncoding, error) {
+	n, err := st.Get(r.URL.Path)
 	if err != nil {
-		return err // internal server error
+		return nil, nil, nil, notFound(w, r, err)
+	}
+	if !n.IsFolder {
+		return nil, nil, nil, NotAFolder(n.Rname)
 	}
 
-	if condStr := r.Header.Get("If-None-Match"); condStr != "" { // @todo: extract into its own type/functionality?
-		conds := strings.Split(condStr, ",")
-		for _, cond := range conds {
-			cond = strings.TrimSpace(cond)
-			rev, err := ParseETag(cond)
-			if err != nil {
-				// @note(#orig_error): it's ok to lose the original error,
-				// since it can only be caused by a malformed ETag.
-				return InvalidIfNonMatch(cond) // @todo: pass original err?
-			}
-			if rev.Equal(etag) {
-				return NotModified()
-			}
-		}
+	if err := checkPreconditions(w, r, &n); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// The size of the listing isn't known in advance.
+	enc := s.compression.negotiate(w, r, "application/ld+json", -1)
+
+	children, err := st.Children(n.Rname)
+	if err != nil {
+		return nil, nil, nil, err // internal server error
 	}
 
 	items := LDjson{}
-	for _, child := range n.children {
+	for _, child := range children {
 		desc := LDjson{}
-		etag, err := child.Version()
-		if err != nil {
-			return err // internal server error
+		desc["ETag"] = child.ETag.String()
+		if !child.IsFolder {
+			desc["Content-Type"] = child.Mime
+			desc["Content-Length"] = child.Length
+			desc["Last-Modified"] = child.LastMod.Format(timeFormat)
 		}
-		desc["ETag"] = etag.String()
-		if !child.isFolder {
-			desc["Content-Type"] = child.mime
-			desc["Content-Length"] = child.length
-			desc["Last-Modified"] = child.lastMod.Format(timeFormat)
-		}
-		items[child.name] = desc
+		items[child.Name] = desc
 	}
 
 	desc := LDjson{
@@ -139,222 +159,316 @@ func getFolder(w http.ResponseWriter, r *http.Request) error {
 		"items":    items,
 	}
 
-	hs := w.Header()
-	hs.Set("Content-Type", "application/ld+json")
-	hs.Set("Cache-Control", "no-cache")
-	hs.Set("ETag", etag.String())
-	return json.NewEncoder(w).Encode(desc)
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(desc); err != nil {
+		return nil, nil, nil, err // internal server error
+	}
+	return n.ETag, &buf, enc, nil
 }
 
-func getDocument(w http.ResponseWriter, r *http.Request) error {
-	n, err := Retrieve(r.URL.Path)
+func (s *Server) getDocument(w http.ResponseWriter, r *http.Request) error {
+	st, err := s.storageFor(r)
 	if err != nil {
 		return MaybeNotFound(err)
 	}
-	if n.isFolder {
-		return NotADocument(n.rname)
+	// The blob is opened with the read lock held, but the lock is released
+	// before the document is sent, so that slow clients don't block
+	// writers.
+	// Blobs are never modified once written, the open blob stays readable
+	// even if the document is overwritten in the meantime.
+	st.RLock()
+	n, fd, enc, err := s.openDocument(w, r, st)
+	st.RUnlock()
+	if err != nil {
+		return err
 	}
+	defer fd.Close()
+
+	hs := w.Header()
+	hs.Set("Cache-Control", "no-cache")
+	hs.Set("ETag", strongTag(n.ETag))
+	hs.Set("Content-Type", n.Mime)
+	return serveDocument(w, r, n, fd, enc)
+}
 
-	etag, err := n.Version()
+// openDocument opens the document requested by r, or a previous version of
+// it (see WithServeVersions), once the preconditions have been evaluated.
+// The caller must hold at least the storage's read lock.
+func (s *Server) openDocument(w http.ResponseWriter, r *http.Request, st Storage) (NodeInfo, io.ReadSeekCloser, ContentEncoding, error) {
+	n, err := st.Get(r.URL.Path)
 	if err != nil {
-		return err // internal server error
+		return NodeInfo{}, nil, nil, notFound(w, r, err)
+	}
+	if n.IsFolder {
+		return NodeInfo{}, nil, nil, NotADocument(n.Rname)
 	}
 
-	if condStr := r.Header.Get("If-None-Match"); condStr != "" {
-		conds := strings.Split(condStr, ",")
-		for _, cond := range conds {
-			cond = strings.TrimSpace(cond)
-			rev, err := ParseETag(cond)
-			if err != nil {
-				// @note(#orig_error): it's ok to lose the original error,
-				// since it can only have been caused by a malformed ETag.
-				return InvalidIfNonMatch(cond) // @todo: parse all and report all errors instead of only the first?
-			}
-			if rev.Equal(etag) {
-				return NotModified()
-			}
+	if s.serveVersions && r.URL.Query().Has("version") {
+		n, fd, err := openVersion(r, st, n.Rname)
+		if err != nil {
+			return NodeInfo{}, nil, nil, err
 		}
+		enc := s.compression.negotiate(w, r, n.Mime, n.Length)
+		if err := checkPreconditions(w, r, &n); err != nil {
+			fd.Close()
+			return NodeInfo{}, nil, nil, err
+		}
+		return n, fd, enc, nil
+	}
+
+	enc := s.compression.negotiate(w, r, n.Mime, n.Length)
+
+	if err := checkPreconditions(w, r, &n); err != nil {
+		return NodeInfo{}, nil, nil, err
 	}
 
-	fd, err := FS.Open(n.sname)
+	fd, err := st.Open(n.Rname)
+	if errors.Is(err, ErrCorrupt) {
+		return NodeInfo{}, nil, nil, DocumentCorrupt(n.Rname)
+	}
 	if err != nil {
-		return err // internal server error
+		return NodeInfo{}, nil, nil, err // internal server error
 	}
+	return n, fd, enc, nil
+}
 
-	hs := w.Header()
-	hs.Set("Cache-Control", "no-cache")
-	hs.Set("ETag", etag.String())
-	hs.Set("Content-Type", n.mime)
-	hs.Set("Content-Length", fmt.Sprintf("%d", n.length))
-	w.WriteHeader(http.StatusOK)
-	if r.Method != http.MethodHead {
-		_, err = io.Copy(w, fd)
+// openVersion opens a previous version of a document, see
+// WithServeVersions.
+// The caller must hold at least the storage's read lock.
+func openVersion(r *http.Request, st Storage, rname string) (NodeInfo, io.ReadSeekCloser, error) {
+	vs, ok := st.(VersionedStorage)
+	if !ok {
+		return NodeInfo{}, nil, NotFound("storage does not keep previous versions")
 	}
-	return err
+	cond := r.URL.Query().Get("version")
+	rev, err := ParseETag(cond)
+	if err != nil {
+		return NodeInfo{}, nil, BadRequest("invalid version")
+	}
+	n, fd, err := vs.OpenVersion(rname, rev)
+	if err != nil {
+		return NodeInfo{}, nil, MaybeNotFound(err)
+	}
+	return n, fd, nil
 }
 
-func putDocument(w http.ResponseWriter, r *http.Request) error {
+func (s *Server) putDocument(w http.ResponseWriter, r *http.Request) error {
 	rpath := r.URL.Path
 
-	n, err := Retrieve(rpath)
-	found := !errors.Is(err, ErrNotExist)
+	st, err := s.storageFor(r)
+	if err != nil {
+		return MaybeNotFound(err)
+	}
+	if s.uploads != nil && r.Header.Get("Content-Range") != "" {
+		return s.putChunk(w, r, st)
+	}
 
-	if found { // err is /not/ ErrNotExist
-		if err != nil {
-			return err // internal server error
-		}
-		if n.isFolder {
-			return Conflict(n.rname)
-		}
+	// Fail early, before the contents are received, if the document can't
+	// be written anyway.
+	st.RLock()
+	_, available, err := s.checkPut(w, r, st, r.ContentLength)
+	st.RUnlock()
+	if err != nil {
+		return err
 	}
 
-	if cond := r.Header.Get("If-None-Match"); cond == "*" && found {
-		etag, err := n.Version()
-		if err != nil {
-			return err // internal server error
-		}
-		w.Header().Set("ETag", etag.String())
-		return DocExists(n.rname)
+	checks, err := expectedDigests(r)
+	if err != nil {
+		return err
 	}
 
-	if cond := r.Header.Get("If-Match"); cond != "" {
-		rev, err := ParseETag(cond)
-		if err != nil {
-			// @note(#orig_error): it's ok to lose the original error, since
-			// it can only be caused by a malformed ETag.
-			return InvalidIfMatch(cond)
-		}
-		etag, err := n.Version()
-		if err != nil {
-			return err // internal server error
-		}
-		w.Header().Set("ETag", etag.String())
-		if !etag.Equal(rev) {
-			return VersionMismatch(rev, etag)
-		}
+	body := io.Reader(r.Body)
+	if len(checks) > 0 {
+		// A mismatch fails the write, leaving the old version in place.
+		body = &digestReader{r: body, checks: checks}
+	}
+	if available >= 0 {
+		// the Content-Length might not be known in advance
+		body = &quotaReader{r: body, remaining: available}
 	}
 
 	mime := r.Header.Get("Content-Type")
-
-	if found {
-		fd, err := FS.Create(n.sname)
-		if err != nil {
-			return err // internal server error
-		}
-
-		fsize, err := io.Copy(fd, r.Body)
+	if mime == "" {
+		mime, body, err = detectMime(body)
 		if err != nil {
-			return err // internal server error
+			return storeError(err, rpath, true)
 		}
+	}
 
-		if mime == "" {
-			_, err := fd.Seek(0, io.SeekStart)
-			if err != nil {
-				return err // internal server error
-			}
-			bs := make([]byte, 512)
-			_, err = fd.Read(bs)
-			if err != nil {
-				return err // internal server error
-			}
-			mime = http.DetectContentType(bs)
-		}
+	n, err := s.store(w, r, st, body, mime, r.ContentLength)
+	if err != nil {
+		return err
+	}
 
-		UpdateDocument(n, mime, fsize)
+	hs := w.Header()
+	hs.Set("ETag", strongTag(n.ETag))
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
 
-		err = fd.Close()
-		if err != nil {
-			return err // internal server error
-		}
-	} else {
-		u, err := UUID()
+// checkPut evaluates the preconditions and the user's quota against the
+// document about to be written, which is length bytes long (or -1 if not
+// known yet).
+// Whether the document already exists is returned, along with the number of
+// bytes it may take up, or -1 if there is no limit.
+// The caller must hold at least the storage's read lock.
+func (s *Server) checkPut(w http.ResponseWriter, r *http.Request, st Storage, length int64) (found bool, available int64, err error) {
+	n, err := st.Get(r.URL.Path)
+	found = !errors.Is(err, ErrNotExist)
+	var current *NodeInfo
+	if found {
 		if err != nil {
-			return err // internal server error
+			return found, 0, err // internal server error
 		}
-		sname := filepath.Join(g.sroot, u.String())
-
-		fd, err := FS.Create(sname)
-		if err != nil {
-			return err // internal server error
+		if n.IsFolder {
+			return found, 0, Conflict(n.Rname)
 		}
+		current = &n
+	}
+	if err := checkPreconditions(w, r, current); err != nil {
+		return found, 0, err
+	}
 
-		fsize, err := io.Copy(fd, r.Body)
-		if err != nil {
-			return err // internal server error
-		}
+	user, ok := UserFromContext(r.Context())
+	if !ok || userQuota(user) <= 0 {
+		return found, -1, nil
+	}
+	available = userQuota(user) - st.Usage()
+	if found {
+		// The old version is replaced. If it's kept as a previous version
+		// instead, it counts towards the usage once the new one is stored.
+		available += n.Length
+	}
+	if length > available {
+		return found, 0, InsufficientStorage(r.URL.Path)
+	}
+	return found, available, nil
+}
 
-		if mime == "" {
-			_, err := fd.Seek(0, io.SeekStart)
-			if err != nil {
-				return err // internal server error
-			}
-			bs := make([]byte, 512)
-			_, err = fd.Read(bs)
-			if err != nil {
-				return err // internal server error
-			}
-			mime = http.DetectContentType(bs)
-		}
+// store creates or replaces the document requested by r with the contents
+// read from body, which are length bytes long (or -1 if not known).
+// If the storage supports it (see StagingStorage), the contents are written
+// before the storage is locked, so that other requests aren't blocked while
+// they are being received.
+// Either way, the preconditions and quota are evaluated once the lock is
+// held, right before the document is created or replaced.
+func (s *Server) store(w http.ResponseWriter, r *http.Request, st Storage, body io.Reader, mime string, length int64) (NodeInfo, error) {
+	rpath := r.URL.Path
 
-		n, err = AddDocument(rpath, sname, fsize, mime)
+	ss, staging := st.(StagingStorage)
+	var b StagedBlob
+	if staging {
+		var err error
+		b, err = ss.Stage(body, mime)
 		if err != nil {
-			return MaybeAncestorConflict(err, rpath)
+			return NodeInfo{}, storeError(err, rpath, true)
 		}
+		length = b.Length()
+	}
 
-		err = fd.Close()
-		if err != nil {
-			return err // internal server error
+	st.Lock()
+	defer st.Unlock()
+
+	found, _, err := s.checkPut(w, r, st, length)
+	if err != nil {
+		if staging {
+			if err := ss.Discard(b); err != nil {
+				s.unhandled(err)
+			}
 		}
+		return NodeInfo{}, err
 	}
 
-	etag, err := n.Version()
+	var n NodeInfo
+	switch {
+	case staging && found:
+		n, err = ss.ReplaceStaged(rpath, b)
+	case staging:
+		n, err = ss.PutStaged(rpath, b)
+	case found:
+		n, err = st.Replace(rpath, body, mime)
+	default:
+		n, err = st.Put(rpath, body, mime)
+	}
 	if err != nil {
+		return NodeInfo{}, storeError(err, rpath, found)
+	}
+	return n, nil
+}
+
+// storeError converts an error that occurred while writing the document
+// rpath into the response to send.
+// found tells whether the document already existed.
+func storeError(err error, rpath string, found bool) error {
+	if errors.Is(err, ErrQuotaExceeded) {
+		return InsufficientStorage(rpath)
+	}
+	if err := digestMismatch(err); err != nil {
+		return err
+	}
+	if found {
 		return err // internal server error
 	}
+	return MaybeAncestorConflict(err, rpath)
+}
 
-	hs := w.Header()
-	hs.Set("ETag", etag.String())
-	w.WriteHeader(http.StatusCreated)
-	return nil
+// detectMime sniffs the content type of the data read from r.
+// The returned reader must be used in place of r, to read the data in its
+// entirety.
+func detectMime(r io.Reader) (mime string, rd io.Reader, err error) {
+	br := bufio.NewReaderSize(r, 512)
+	peek, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+	bs := make([]byte, 512)
+	copy(bs, peek)
+	return http.DetectContentType(bs), br, nil
 }
 
-func deleteDocument(w http.ResponseWriter, r *http.Request) error {
+func (s *Server) deleteDocument(w http.ResponseWriter, r *http.Request) error {
 	rpath := r.URL.Path
 
-	n, err := Retrieve(rpath)
+	st, err := s.storageFor(r)
 	if err != nil {
 		return MaybeNotFound(err)
 	}
-	if n.isFolder {
-		return NotADocument(n.rname)
-	}
+	st.Lock()
+	defer st.Unlock()
 
-	etag, err := n.Version()
+	n, err := st.Get(rpath)
 	if err != nil {
-		return err // internal server error
+		return notFound(w, r, err)
+	}
+	if n.IsFolder {
+		return NotADocument(n.Rname)
 	}
 
-	if cond := r.Header.Get("If-Match"); cond != "" {
-		rev, err := ParseETag(cond)
-		if err != nil {
-			// @note(#orig_error): it's ok to lose the original error, since
-			// it can only be caused by a malformed ETag.
-			return InvalidIfMatch(cond)
-		}
-		if !etag.Equal(rev) {
-			w.Header().Set("ETag", etag.String())
-			return VersionMismatch(rev, etag)
-		}
+	etag := n.ETag
+
+	if err := checkPreconditions(w, r, &n); err != nil {
+		return err
 	}
 
-	RemoveDocument(n)
-	err = FS.Remove(n.sname)
+	err = st.Delete(rpath)
 	if err != nil {
 		return err // internal server error
 	}
 
 	hs := w.Header()
-	hs.Set("ETag", etag.String())
+	hs.Set("ETag", strongTag(etag))
 	w.WriteHeader(http.StatusOK)
 	return nil
 }
+
+// notFound responds to a request for a resource that couldn't be retrieved.
+// Preconditions are evaluated first, so that, e.g., If-Match fails with 412
+// (Precondition Failed) rather than 404 (Not Found).
+func notFound(w http.ResponseWriter, r *http.Request, err error) error {
+	if errors.Is(err, ErrNotExist) {
+		if err := checkPreconditions(w, r, nil); err != nil {
+			return err
+		}
+	}
+	return MaybeNotFound(err)
+}
@@ -2,11 +2,25 @@ package rmsgo
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	. "github.com/cvanloo/rmsgo/mock"
 )
@@ -20,7 +34,7 @@ func mockServer(opts ...Option) (ts *httptest.Server, root string) {
 	Mock(
 		WithDirectory(sroot),
 	)
-	must(Configure(rroot, sroot,
+	mustVal(Configure(rroot, sroot,
 		WithAllowAnyReadWrite(),
 		Options(opts...),
 	))
@@ -69,6 +83,11 @@ func Header(k, v string) ExpectedOpt {
 	}
 }
 
+// quoted formats etag the way it appears in the ETag header.
+func quoted(etag string) string {
+	return `"` + etag + `"`
+}
+
 func Body(content string) ExpectedOpt {
 	return func(e *Expectation) {
 		e.Body = &content
@@ -101,7 +120,7 @@ func TestPutDocument(t *testing.T) {
 		testContent      = "The material is classified. Its composition is classified. Its use in the weapon is classified, and the process itself is classified."
 		testMime         = "top/secret"
 		testDocument     = "/Classified/FOGBANK.txt"
-		testDocumentEtag = "60ca7ee51a4a4886d00ae2470457b206"
+		testDocumentEtag = "5a0a05b90b9040665e3e5e702beb2e31"
 	)
 	ts, remoteRoot := mockServer()
 	defer ts.Close()
@@ -115,7 +134,7 @@ func TestPutDocument(t *testing.T) {
 
 	if err := Expect(
 		Status(http.StatusCreated),
-		Header("ETag", testDocumentEtag),
+		Header("ETag", quoted(testDocumentEtag)),
 	).Validate(r); err != nil {
 		t.Error(err)
 	}
@@ -130,7 +149,7 @@ func TestPutDocument(t *testing.T) {
 		Header("Cache-Control", "no-cache"),
 		Header("Content-Length", fmt.Sprint(len(testContent))),
 		Header("Content-Type", testMime),
-		Header("ETag", testDocumentEtag),
+		Header("ETag", quoted(testDocumentEtag)),
 		Body(testContent),
 	).Validate(r); err != nil {
 		t.Error(err)
@@ -143,10 +162,10 @@ func TestPutDocumentTwiceUpdatesIt(t *testing.T) {
 		testDocument = "/Lyrics/STARSET.txt"
 
 		testContent1      = "I will travel the distance in your eyes Interstellar Light years from you"
-		testDocumentEtag1 = "33f7b41f98820961b12134677ba3f231"
+		testDocumentEtag1 = "bdc010a429317024d79f9c39076c1ce6"
 
 		testContent2      = "I will travel the distance in your eyes Interstellar Light years from you Supernova We'll fuse when we collide Awaking in the light of all the stars aligned"
-		testDocumentEtag2 = "063c77ac4aa257f9396f1b5cae956004"
+		testDocumentEtag2 = "6e8e18ba70e6054cc898abaf2a2b60f2"
 	)
 
 	ts, remoteRoot := mockServer()
@@ -162,7 +181,7 @@ func TestPutDocumentTwiceUpdatesIt(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentEtag1),
+			Header("ETag", quoted(testDocumentEtag1)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -179,7 +198,7 @@ func TestPutDocumentTwiceUpdatesIt(t *testing.T) {
 			Header("Cache-Control", "no-cache"),
 			Header("Content-Length", fmt.Sprint(len(testContent1))),
 			Header("Content-Type", testMime),
-			Header("ETag", testDocumentEtag1),
+			Header("ETag", quoted(testDocumentEtag1)),
 			Body(testContent1),
 		).Validate(r); err != nil {
 			t.Error(err)
@@ -196,7 +215,7 @@ func TestPutDocumentTwiceUpdatesIt(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentEtag2),
+			Header("ETag", quoted(testDocumentEtag2)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -213,7 +232,7 @@ func TestPutDocumentTwiceUpdatesIt(t *testing.T) {
 			Header("Cache-Control", "no-cache"),
 			Header("Content-Length", fmt.Sprint(len(testContent2))),
 			Header("Content-Type", testMime),
-			Header("ETag", testDocumentEtag2),
+			Header("ETag", quoted(testDocumentEtag2)),
 			Body(testContent2),
 		).Validate(r); err != nil {
 			t.Error(err)
@@ -227,10 +246,10 @@ func TestPutDocumentIfMatchSuccessUpdatesIt(t *testing.T) {
 		testDocument = "/Lyrics/STARSET.txt"
 
 		testContent1      = "I will travel the distance in your eyes Interstellar Light years from you"
-		testDocumentEtag1 = "33f7b41f98820961b12134677ba3f231"
+		testDocumentEtag1 = "bdc010a429317024d79f9c39076c1ce6"
 
 		testContent2      = "I will travel the distance in your eyes Interstellar Light years from you Supernova We'll fuse when we collide Awaking in the light of all the stars aligned"
-		testDocumentEtag2 = "063c77ac4aa257f9396f1b5cae956004"
+		testDocumentEtag2 = "6e8e18ba70e6054cc898abaf2a2b60f2"
 	)
 	ts, remoteRoot := mockServer()
 	defer ts.Close()
@@ -245,7 +264,7 @@ func TestPutDocumentIfMatchSuccessUpdatesIt(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentEtag1),
+			Header("ETag", quoted(testDocumentEtag1)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -254,7 +273,7 @@ func TestPutDocumentIfMatchSuccessUpdatesIt(t *testing.T) {
 	{
 		req := mustVal(http.NewRequest(http.MethodPut, remoteRoot+testDocument, bytes.NewReader([]byte(testContent2))))
 		req.Header.Set("Content-Type", testMime)
-		req.Header.Set("If-Match", testDocumentEtag1) // Set If-Match header!
+		req.Header.Set("If-Match", quoted(testDocumentEtag1)) // Set If-Match header!
 
 		r, err := http.DefaultClient.Do(req)
 		if err != nil {
@@ -263,7 +282,7 @@ func TestPutDocumentIfMatchSuccessUpdatesIt(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentEtag2),
+			Header("ETag", quoted(testDocumentEtag2)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -274,10 +293,10 @@ func TestPutDocumentIfMatchFailDoesNotUpdateIt(t *testing.T) {
 	const (
 		testMime     = "application/x-subrip"
 		testDocument = "/Lyrics/STARSET.txt"
-		wrongETag    = "3de26fc06d5d1e20ff96a8142cd6fabf"
+		wrongETag    = "ae17e492ed143a12f510e6bdc8011627"
 
 		testContent1      = "I will travel the distance in your eyes Interstellar Light years from you"
-		testDocumentEtag1 = "33f7b41f98820961b12134677ba3f231"
+		testDocumentEtag1 = "bdc010a429317024d79f9c39076c1ce6"
 
 		testContent2 = "I will travel the distance in your eyes Interstellar Light years from you Supernova We'll fuse when we collide Awaking in the light of all the stars aligned"
 	)
@@ -294,7 +313,7 @@ func TestPutDocumentIfMatchFailDoesNotUpdateIt(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentEtag1),
+			Header("ETag", quoted(testDocumentEtag1)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -303,7 +322,7 @@ func TestPutDocumentIfMatchFailDoesNotUpdateIt(t *testing.T) {
 	{
 		req := mustVal(http.NewRequest(http.MethodPut, remoteRoot+testDocument, bytes.NewReader([]byte(testContent2))))
 		req.Header.Set("Content-Type", testMime)
-		req.Header.Set("If-Match", wrongETag)
+		req.Header.Set("If-Match", quoted(wrongETag))
 		r, err := http.DefaultClient.Do(req)
 		if err != nil {
 			t.Error(err)
@@ -311,7 +330,7 @@ func TestPutDocumentIfMatchFailDoesNotUpdateIt(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusPreconditionFailed),
-			Header("ETag", testDocumentEtag1), // Returns ETag of current (server) version
+			Header("ETag", quoted(testDocumentEtag1)), // Returns ETag of current (server) version
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -322,13 +341,13 @@ func TestPutDocumentIfMatchUpdateInBetween(t *testing.T) {
 	const (
 		testMime     = "application/x-subrip"
 		testDocument = "/Lyrics/STARSET.txt"
-		wrongETag    = "3de26fc06d5d1e20ff96a8142cd6fabf"
+		wrongETag    = "ae17e492ed143a12f510e6bdc8011627"
 
 		testContent1      = "I will travel the distance in your eyes Interstellar Light years from you"
-		testDocumentEtag1 = "33f7b41f98820961b12134677ba3f231"
+		testDocumentEtag1 = "bdc010a429317024d79f9c39076c1ce6"
 
 		testContent2      = "I will travel the distance in your eyes Interstellar Light years from you Supernova We'll fuse when we collide Awaking in the light of all the stars aligned"
-		testDocumentEtag2 = "063c77ac4aa257f9396f1b5cae956004"
+		testDocumentEtag2 = "6e8e18ba70e6054cc898abaf2a2b60f2"
 
 		testContent3 = "I will travel the distance in your eyes"
 	)
@@ -345,7 +364,7 @@ func TestPutDocumentIfMatchUpdateInBetween(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentEtag1),
+			Header("ETag", quoted(testDocumentEtag1)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -357,7 +376,7 @@ func TestPutDocumentIfMatchUpdateInBetween(t *testing.T) {
 	{ // update document
 		req := mustVal(http.NewRequest(http.MethodPut, remoteRoot+testDocument, bytes.NewReader([]byte(testContent2))))
 		req.Header.Set("Content-Type", testMime)
-		req.Header.Set("If-Match", testDocumentEtag1)
+		req.Header.Set("If-Match", quoted(testDocumentEtag1))
 		r, err := http.DefaultClient.Do(req)
 		if err != nil {
 			t.Error(err)
@@ -365,7 +384,7 @@ func TestPutDocumentIfMatchUpdateInBetween(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentEtag2),
+			Header("ETag", quoted(testDocumentEtag2)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -377,7 +396,7 @@ func TestPutDocumentIfMatchUpdateInBetween(t *testing.T) {
 	{ // try to update document again, from a version earlier
 		req := mustVal(http.NewRequest(http.MethodPut, remoteRoot+testDocument, bytes.NewReader([]byte(testContent2))))
 		req.Header.Set("Content-Type", testMime)
-		req.Header.Set("If-Match", wrongETag)
+		req.Header.Set("If-Match", quoted(wrongETag))
 		r, err := http.DefaultClient.Do(req)
 		if err != nil {
 			t.Error(err)
@@ -385,7 +404,7 @@ func TestPutDocumentIfMatchUpdateInBetween(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusPreconditionFailed),
-			Header("ETag", testDocumentEtag2), // Returns ETag of current (server) version
+			Header("ETag", quoted(testDocumentEtag2)), // Returns ETag of current (server) version
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -401,7 +420,7 @@ func TestPutDocumentIfNonMatchSuccessCreatesTheDocument(t *testing.T) {
 		testDocument = "/Lyrics/STARSET.txt"
 
 		testContent      = "I will travel the distance in your eyes Interstellar Light years from you"
-		testDocumentEtag = "33f7b41f98820961b12134677ba3f231"
+		testDocumentEtag = "bdc010a429317024d79f9c39076c1ce6"
 	)
 	ts, remoteRoot := mockServer()
 	defer ts.Close()
@@ -427,7 +446,7 @@ func TestPutDocumentIfNonMatchSuccessCreatesTheDocument(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentEtag),
+			Header("ETag", quoted(testDocumentEtag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -450,10 +469,10 @@ func TestPutDocumentIfNonMatchFailDoesNotUpdateIt(t *testing.T) {
 		testDocument = "/Lyrics/STARSET.txt"
 
 		testContent1      = "I will travel the distance in your eyes Interstellar Light years from you"
-		testDocumentETag1 = "33f7b41f98820961b12134677ba3f231"
+		testDocumentETag1 = "bdc010a429317024d79f9c39076c1ce6"
 
 		testContent2      = "I will travel the distance in your eyes Interstellar Light years from you Supernova We'll fuse when we collide Awaking in the light of all the stars aligned"
-		testDocumentEtag2 = "063c77ac4aa257f9396f1b5cae956004"
+		testDocumentEtag2 = "2b202ddc6f06416e1a2f5772e3df1c06"
 	)
 	ts, remoteRoot := mockServer()
 	defer ts.Close()
@@ -469,7 +488,7 @@ func TestPutDocumentIfNonMatchFailDoesNotUpdateIt(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentETag1),
+			Header("ETag", quoted(testDocumentETag1)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -486,7 +505,7 @@ func TestPutDocumentIfNonMatchFailDoesNotUpdateIt(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusPreconditionFailed),
-			Header("ETag", testDocumentETag1),
+			Header("ETag", quoted(testDocumentETag1)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -503,12 +522,12 @@ func TestPutDocumentSilentlyCreateAncestors(t *testing.T) {
 		testMime         = "wise/quote"
 		testDocument     = "/Quotes/Neal Stephenson.txt"
 		testDocumentName = "Neal Stephenson.txt"
-		testDocumentEtag = "3dc42d11db35b8354dc06c46a53c9c9d"
+		testDocumentEtag = "62762d7d753797c17112c1d0033ccab5"
 
 		testDocumentDir     = "/Quotes/"
-		testDocumentDirETag = "3de26fc06d5d1e20ff96a8142cd6fabf"
+		testDocumentDirETag = "022bd7f7045efed9ad392f2c789a6db4"
 
-		testDirListing = `{"@context":"http://remotestorage.io/spec/folder-description","items":{"Neal Stephenson.txt":{"Content-Length":83,"Content-Type":"wise/quote","ETag":"3dc42d11db35b8354dc06c46a53c9c9d","Last-Modified":"Mon, 01 Jan 0001 00:00:00 UTC"}}}
+		testDirListing = `{"@context":"http://remotestorage.io/spec/folder-description","items":{"Neal Stephenson.txt":{"Content-Length":83,"Content-Type":"wise/quote","ETag":"62762d7d753797c17112c1d0033ccab5","Last-Modified":"Mon, 01 Jan 0001 00:00:00 UTC"}}}
 ` // don't forget newline
 	)
 	ts, remoteRoot := mockServer()
@@ -523,7 +542,7 @@ func TestPutDocumentSilentlyCreateAncestors(t *testing.T) {
 
 	if err := Expect(
 		Status(http.StatusCreated),
-		Header("ETag", testDocumentEtag),
+		Header("ETag", quoted(testDocumentEtag)),
 	).Validate(r); err != nil {
 		t.Error(err)
 	}
@@ -536,7 +555,7 @@ func TestPutDocumentSilentlyCreateAncestors(t *testing.T) {
 	if err := Expect(
 		Status(http.StatusOK),
 		Header("Cache-Control", "no-cache"),
-		Header("ETag", testDocumentDirETag),
+		Header("ETag", quoted(testDocumentDirETag)),
 		Body(testDirListing),
 	).Validate(r); err != nil {
 		t.Error(err)
@@ -550,19 +569,19 @@ func TestPutDocumentUpdatesAncestorETags(t *testing.T) {
 		testContent1      = `Run for the heavens \\ Sing to the stars \\ Love like a lover \\ Shine in the dark \\ Shout like an army \\ Sound the alarm \\ I am a burning [...] Heart`
 		testDocument1     = "/Lyrics/SVRCINA.srt"
 		testDocument1Name = "SVRCINA.srt"
-		testDocument1ETag = "65973f0e09b0b8830949c134162d112e"
+		testDocument1ETag = "12738384febeddcd8bf75d439cd018e2"
 
 		testContent2      = `I'm attracted to the sky \\ To the sky \\ To the sky \\ Every life I learn to fly \\ Learn to fly \\ Learn to fly`
 		testDocument2     = "/Lyrics/Raizer.srt"
 		testDocument2Name = "Raizer.srt"
-		testDocument2ETag = "19ca2805893dd1db277e23d80c2f14cd"
+		testDocument2ETag = "498318d185bf439b60d365f1d515374c"
 
 		testDocumentDir      = "/Lyrics/"
-		testDocumentDirETag1 = "db72f39f4a2cf47b0d119946f066c894"
-		testDocumentDirETag2 = "5da5bbb350f940f06f4569f8552948b0"
+		testDocumentDirETag1 = "2313f06a9f50db3099f79158bfbe5d00"
+		testDocumentDirETag2 = "8d24b222f01ec5a3b5115605bc4f72cd"
 
-		testRootETag1 = "b5f199d0f2c635bf299450fe9f81da94"
-		testRootETag2 = "42e40ece81f1b30afe6ae1a6de3eaffa"
+		testRootETag1 = "f749a1e2a9b70ec27db582a36a2429f8"
+		testRootETag2 = "27b1b984985f07c0149ab1625c1db5f0"
 	)
 	ts, remoteRoot := mockServer()
 	defer ts.Close()
@@ -578,7 +597,7 @@ func TestPutDocumentUpdatesAncestorETags(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocument1ETag),
+			Header("ETag", quoted(testDocument1ETag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -594,7 +613,7 @@ func TestPutDocumentUpdatesAncestorETags(t *testing.T) {
 		if err := Expect(
 			Status(http.StatusOK),
 			Header("Cache-Control", "no-cache"),
-			Header("ETag", testDocumentDirETag1),
+			Header("ETag", quoted(testDocumentDirETag1)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -610,7 +629,7 @@ func TestPutDocumentUpdatesAncestorETags(t *testing.T) {
 		if err := Expect(
 			Status(http.StatusOK),
 			Header("Cache-Control", "no-cache"),
-			Header("ETag", testRootETag1),
+			Header("ETag", quoted(testRootETag1)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -627,7 +646,7 @@ func TestPutDocumentUpdatesAncestorETags(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocument2ETag),
+			Header("ETag", quoted(testDocument2ETag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -643,7 +662,7 @@ func TestPutDocumentUpdatesAncestorETags(t *testing.T) {
 		if err := Expect(
 			Status(http.StatusOK),
 			Header("Cache-Control", "no-cache"),
-			Header("ETag", testDocumentDirETag2),
+			Header("ETag", quoted(testDocumentDirETag2)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -659,7 +678,7 @@ func TestPutDocumentUpdatesAncestorETags(t *testing.T) {
 		if err := Expect(
 			Status(http.StatusOK),
 			Header("Cache-Control", "no-cache"),
-			Header("ETag", testRootETag2),
+			Header("ETag", quoted(testRootETag2)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -677,7 +696,7 @@ func TestPutDocumentAutodetectContentType(t *testing.T) {
 “But look, you found the notice, didn’t you?”
 “Yes,” said Arthur, “yes I did. It was on display in the bottom of a locked filing cabinet stuck in a disused lavatory with a sign on the door saying ‘Beware of the Leopard.”`
 		testDocument     = "/Quotes/Douglas Adams"
-		testDocumentETag = "c1d56d2d5814cf52357a0129341402db"
+		testDocumentETag = "29fcab1b1a8a177c20bba5dbaf056c82"
 		testMime         = "application/octet-stream"
 	)
 	ts, remoteRoot := mockServer()
@@ -693,7 +712,7 @@ func TestPutDocumentAutodetectContentType(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentETag),
+			Header("ETag", quoted(testDocumentETag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -710,7 +729,7 @@ func TestPutDocumentAutodetectContentType(t *testing.T) {
 			Header("Cache-Control", "no-cache"),
 			Header("Content-Length", fmt.Sprint(len(testContent))),
 			Header("Content-Type", testMime),
-			Header("ETag", testDocumentETag),
+			Header("ETag", quoted(testDocumentETag)),
 			Body(testContent),
 		).Validate(r); err != nil {
 			t.Error(err)
@@ -739,7 +758,7 @@ func TestPutDocumentClashesWithFolderFails(t *testing.T) {
 
 		testContent1      = "Run for the heavens Sing to the stars Love like a lover Shine in the dark Shout like an army Sound the alarm I am a burning [...] Heart"
 		testDocument1     = "/Lyrics/Favourite/SVRCINA.srt"
-		testDocument1ETag = "6f9cd924b8654c70d5bec5f96491f55e"
+		testDocument1ETag = "0cd033e54ecfe681eb2cd1c27d6d89db"
 
 		testContent2  = "I'm attracted to the sky To the sky To the sky Every life I learn to fly Learn to fly Learn to fly"
 		testDocument2 = "/Lyrics/Favourite" // this is going to clash with the already existing /Lyrics/Favourite/ folder
@@ -760,7 +779,7 @@ func TestPutDocumentClashesWithFolderFails(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocument1ETag),
+			Header("ETag", quoted(testDocument1ETag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -787,7 +806,7 @@ func TestPutDocumentAncestorFolderClashesWithDocumentFails(t *testing.T) {
 
 		testContent1      = "Run for the heavens Sing to the stars Love like a lover Shine in the dark Shout like an army Sound the alarm I am a burning [...] Heart"
 		testDocument1     = "/Lyrics/Favourite"
-		testDocument1ETag = "421432bf1a9f22883bac81ad1714dd90"
+		testDocument1ETag = "00e800702ab28bf9e2c764a14d3f7c8a"
 
 		testContent2  = "I'm attracted to the sky To the sky To the sky Every life I learn to fly Learn to fly Learn to fly"
 		testDocument2 = "/Lyrics/Favourite/STARSET.srt" // /Lyrics/Favourite/ is going to clash with the already existing /Lyrics/Favourite document
@@ -808,7 +827,7 @@ func TestPutDocumentAncestorFolderClashesWithDocumentFails(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocument1ETag),
+			Header("ETag", quoted(testDocument1ETag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -840,12 +859,12 @@ func TestGetFolder(t *testing.T) {
 > -- <cite>ThePrimeagen, Twitch.tv</cite>`
 		testDocument     = "/Quotes/Twitch/ThePrimeagen.md"
 		testMime         = "text/plain; charset=utf-8"
-		testDocumentETag = "8c2d95a5232b32d1ad8c794313c0c549"
+		testDocumentETag = "b0a5ef77d1dfe7e63fb962758b635a03"
 
 		testDocumentDir     = "/Quotes/Twitch/"
-		testDocumentDirETag = "25c3d4a9bc64c223d9b8c07e8336952d"
+		testDocumentDirETag = "c117f22baeda1a9142adcb2311d896d7"
 
-		responseBody = `{"@context":"http://remotestorage.io/spec/folder-description","items":{"ThePrimeagen.md":{"Content-Length":242,"Content-Type":"text/plain; charset=utf-8","ETag":"8c2d95a5232b32d1ad8c794313c0c549","Last-Modified":"Mon, 01 Jan 0001 00:00:00 UTC"}}}
+		responseBody = `{"@context":"http://remotestorage.io/spec/folder-description","items":{"ThePrimeagen.md":{"Content-Length":242,"Content-Type":"text/plain; charset=utf-8","ETag":"b0a5ef77d1dfe7e63fb962758b635a03","Last-Modified":"Mon, 01 Jan 0001 00:00:00 UTC"}}}
 ` // don't forget newline
 	)
 
@@ -859,7 +878,7 @@ func TestGetFolder(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentETag),
+			Header("ETag", quoted(testDocumentETag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -874,7 +893,7 @@ func TestGetFolder(t *testing.T) {
 		Status(http.StatusOK),
 		Header("Content-Type", "application/ld+json"),
 		Header("Cache-Control", "no-cache"),
-		Header("ETag", testDocumentDirETag),
+		Header("ETag", quoted(testDocumentDirETag)),
 		Body(responseBody),
 	).Validate(r); err != nil {
 		t.Error(err)
@@ -901,7 +920,7 @@ func TestGetFolderEmpty(t *testing.T) {
 		Status(http.StatusOK),
 		Header("Content-Type", "application/ld+json"),
 		Header("Cache-Control", "no-cache"),
-		Header("ETag", testDocumentDirETag),
+		Header("ETag", quoted(testDocumentDirETag)),
 		Body(responseBody),
 	).Validate(r); err != nil {
 		t.Error(err)
@@ -929,10 +948,10 @@ func TestGetFolderIfNonMatchRevMatches(t *testing.T) {
 		testContent      = `You may disagree with this idiom, and that's okay, because it's enforced by the compiler. You're welcome.`
 		testDocument     = "/public/go_devs_prbly"
 		testMime         = "text/joke"
-		testDocumentETag = "3e507240501005a29cc22520bd333f79"
+		testDocumentETag = "00c5605ec8dcf97b1121bf9177bafc65"
 
 		testDocumentDir     = "/public/"
-		testDocumentDirETag = "660d6f3f14d933aa8e60bb17e7cae7e8"
+		testDocumentDirETag = "2f0a75d8bdfff386a335a0f8b28ec9f2"
 	)
 
 	{
@@ -945,7 +964,7 @@ func TestGetFolderIfNonMatchRevMatches(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentETag),
+			Header("ETag", quoted(testDocumentETag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -972,12 +991,12 @@ func TestGetFolderIfNonMatchRevNoMatch(t *testing.T) {
 		testContent      = `You may disagree with this idiom, and that's okay, because it's enforced by the compiler. You're welcome.`
 		testDocument     = "/public/go_devs_prbly"
 		testMime         = "text/joke"
-		testDocumentETag = "3e507240501005a29cc22520bd333f79"
+		testDocumentETag = "00c5605ec8dcf97b1121bf9177bafc65"
 
 		testDocumentDir     = "/public/"
-		testDocumentDirETag = "660d6f3f14d933aa8e60bb17e7cae7e8"
+		testDocumentDirETag = "2f0a75d8bdfff386a335a0f8b28ec9f2"
 
-		responseBody = `{"@context":"http://remotestorage.io/spec/folder-description","items":{"go_devs_prbly":{"Content-Length":105,"Content-Type":"text/joke","ETag":"3e507240501005a29cc22520bd333f79","Last-Modified":"Mon, 01 Jan 0001 00:00:00 UTC"}}}
+		responseBody = `{"@context":"http://remotestorage.io/spec/folder-description","items":{"go_devs_prbly":{"Content-Length":105,"Content-Type":"text/joke","ETag":"00c5605ec8dcf97b1121bf9177bafc65","Last-Modified":"Mon, 01 Jan 0001 00:00:00 UTC"}}}
 ` // don't forget newline
 	)
 
@@ -991,7 +1010,7 @@ func TestGetFolderIfNonMatchRevNoMatch(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentETag),
+			Header("ETag", quoted(testDocumentETag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -999,7 +1018,7 @@ func TestGetFolderIfNonMatchRevNoMatch(t *testing.T) {
 
 	req := mustVal(http.NewRequest(http.MethodGet, remoteRoot+testDocumentDir, nil))
 	// none of the revisions match our public/ folder
-	req.Header.Set("If-None-Match", "03d871638b18f0b459bf8fd12a58f1d8, 3e507240501005a29cc22520bd333f79, 33f7b41f98820961b12134677ba3f231")
+	req.Header.Set("If-None-Match", "03d871638b18f0b459bf8fd12a58f1d8, 00c5605ec8dcf97b1121bf9177bafc65, 53b10417cc349cc1c59f51fc04e287bc")
 	r, err := http.DefaultClient.Do(req)
 	if err != nil {
 		t.Error(err)
@@ -1009,7 +1028,7 @@ func TestGetFolderIfNonMatchRevNoMatch(t *testing.T) {
 		Status(http.StatusOK),
 		Header("Content-Type", "application/ld+json"),
 		Header("Cache-Control", "no-cache"),
-		Header("ETag", testDocumentDirETag),
+		Header("ETag", quoted(testDocumentDirETag)),
 		Body(responseBody),
 	).Validate(r); err != nil {
 		t.Error(err)
@@ -1023,7 +1042,7 @@ func TestGetFolderThatIsADocumentFails(t *testing.T) {
 	const (
 		testContent      = "Since I am innocent of this crime, sir, I find it decidedly inconvenient that the gun was never found."
 		testDocument     = "/Quotes/Movies/Shawshank Redemption"
-		testDocumentETag = "2939b3af2cf45877eb61987397486084"
+		testDocumentETag = "922cea8691883b6d1c44c906ba8fe034"
 
 		testDirThatActuallyIsADocument = "/Quotes/Movies/Shawshank Redemption/"
 	)
@@ -1037,7 +1056,7 @@ func TestGetFolderThatIsADocumentFails(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentETag),
+			Header("ETag", quoted(testDocumentETag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -1057,8 +1076,8 @@ func TestHeadFolder(t *testing.T) {
 	defer ts.Close()
 
 	const (
-		testDocumentETag = "1d8fc022c47d2abb16e03f2765575a33"
-		rootETag         = "8bcad8e369ee8b5a6cfc069ca5b4d315"
+		testDocumentETag = "ab5f50958d8f19e06fdb2928a92957a7"
+		rootETag         = "7f5940936a685e804400840747c662b8"
 	)
 
 	{
@@ -1070,7 +1089,7 @@ func TestHeadFolder(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentETag),
+			Header("ETag", quoted(testDocumentETag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -1083,7 +1102,7 @@ func TestHeadFolder(t *testing.T) {
 
 	if err := Expect(
 		Status(http.StatusOK),
-		Header("ETag", rootETag),
+		Header("ETag", quoted(rootETag)),
 		Header("Content-Length", "123"),
 		Header("Content-Type", "application/ld+json"),
 		Header("Cache-Control", "no-cache"),
@@ -1106,7 +1125,7 @@ func TestGetDocument(t *testing.T) {
 		testContent      = "Lisp is a perfectly logical language to use." // 😤
 		testMime         = "text/plain; charset=utf-8"
 		testDocument     = "/everyone/would/agree/Fridman Quote"
-		testDocumentETag = "1439461086c3263260ca619a30278741"
+		testDocumentETag = "bf83857b061a0c463795babde7528683"
 	)
 
 	{
@@ -1119,7 +1138,7 @@ func TestGetDocument(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentETag),
+			Header("ETag", quoted(testDocumentETag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -1134,7 +1153,7 @@ func TestGetDocument(t *testing.T) {
 		Status(http.StatusOK),
 		Header("Cache-Control", "no-cache"),
 		Header("Content-Length", fmt.Sprint(len(testContent))),
-		Header("ETag", testDocumentETag),
+		Header("ETag", quoted(testDocumentETag)),
 		Header("Content-Type", testMime),
 		Body(testContent),
 	).Validate(r); err != nil {
@@ -1170,7 +1189,7 @@ of the estate, decided to add a construct named 'class' which revolved
 around inheritance.`
 		testMime         = "text/plain; charset=utf-8"
 		testDocument     = "/gh/jesseduffield/OK"
-		testDocumentETag = "9e57ccd4ec8d848d413e3e363cd48cdc"
+		testDocumentETag = "938e21934348534b21bc9dc2e251ece2"
 	)
 
 	{
@@ -1183,7 +1202,7 @@ around inheritance.`
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentETag),
+			Header("ETag", quoted(testDocumentETag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -1215,7 +1234,7 @@ of the estate, decided to add a construct named 'class' which revolved
 around inheritance.`
 		testMime         = "text/plain; charset=utf-8"
 		testDocument     = "/gh/jesseduffield/OK"
-		testDocumentETag = "9e57ccd4ec8d848d413e3e363cd48cdc"
+		testDocumentETag = "938e21934348534b21bc9dc2e251ece2"
 	)
 
 	{
@@ -1228,7 +1247,7 @@ around inheritance.`
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentETag),
+			Header("ETag", quoted(testDocumentETag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -1246,7 +1265,7 @@ around inheritance.`
 		Status(http.StatusOK),
 		Header("Cache-Control", "no-cache"),
 		Header("Content-Length", fmt.Sprint(len(testContent))),
-		Header("ETag", testDocumentETag),
+		Header("ETag", quoted(testDocumentETag)),
 		Header("Content-Type", testMime),
 		Body(testContent),
 	).Validate(r); err != nil {
@@ -1261,7 +1280,7 @@ func TestGetDocumentThatIsAFolderFails(t *testing.T) {
 	const (
 		testContent      = "Since I am innocent of this crime, sir, I find it decidedly inconvenient that the gun was never found."
 		testDocument     = "/Quotes/Movies/Shawshank Redemption"
-		testDocumentETag = "2939b3af2cf45877eb61987397486084"
+		testDocumentETag = "922cea8691883b6d1c44c906ba8fe034"
 
 		testDocThatActuallyIsAFolder = "/Quotes/Movies"
 	)
@@ -1275,7 +1294,7 @@ func TestGetDocumentThatIsAFolderFails(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentETag),
+			Header("ETag", quoted(testDocumentETag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -1298,7 +1317,7 @@ func TestHeadDocument(t *testing.T) {
 		testContent      = "Go is better than everything. In my opinion Go is even better than English."
 		testMime         = "text/plain; charset=us-ascii"
 		testDocument     = "/twitch.tv/ThePrimeagen"
-		testDocumentETag = "d53cc497c102d476599e7853cb3c5601"
+		testDocumentETag = "55738bcc9c0ba74ff029d20bd1d46bec"
 	)
 
 	{
@@ -1311,7 +1330,7 @@ func TestHeadDocument(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentETag),
+			Header("ETag", quoted(testDocumentETag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -1325,7 +1344,7 @@ func TestHeadDocument(t *testing.T) {
 	if err := Expect(
 		Status(http.StatusOK),
 		Header("Content-Length", fmt.Sprint(len(testContent))),
-		Header("ETag", testDocumentETag),
+		Header("ETag", quoted(testDocumentETag)),
 		Header("Content-Type", testMime),
 		Body(""), // response to a head request should have an empty body
 	).Validate(r); err != nil {
@@ -1340,20 +1359,20 @@ func TestDeleteDocument(t *testing.T) {
 	const (
 		testMime                = "text/plain; charset=utf-8"
 		testCommonAncestor      = "/home/"
-		testCommonAncestorETag1 = "59d054586b4316a31fcd76b434565d0e"
-		testCommonAncestorETag2 = "bdf46e2f1803235eb92ac0f939101d28"
+		testCommonAncestorETag1 = "63827ed478dadd7faaace389cffc6585"
+		testCommonAncestorETag2 = "80d1d4e519cc5eecb434820759b0c2f1"
 
-		testRootETag1 = "ed8ca43e261c8d2cf6dc7fb505859827"
-		testRootETag2 = "85e25d4cf67c9d01290b1ca02e6bf60f"
+		testRootETag1 = "88491c085d887a0e7b708f419d67a6e6"
+		testRootETag2 = "19759ddb8a1e508c6cc967717231a382"
 
 		testContent1      = "Rien n'est plus dangereux qu'une idée, quand on n'a qu'une idée"
 		testDocument1     = "/home/Chartier/idée"
-		testDocumentETag1 = "50156bf5e641d8d33cd7929e2a2146bd"
+		testDocumentETag1 = "db518479aa8072649af2f8eb44280d2c"
 		testDocumentDir1  = "/home/Chartier/"
 
 		testContent2      = "Did you know that unsigned integers are faster than signed integers because your CPU doesn't have to autograph all of them as they go by?"
 		testDocument2     = "/home/gamozo/unsigned"
-		testDocumentETag2 = "456599fd6afcb9e611b0914147dd5550"
+		testDocumentETag2 = "62e9200d4affba82a941ac1043a46d37"
 	)
 
 	// create document
@@ -1367,7 +1386,7 @@ func TestDeleteDocument(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentETag1),
+			Header("ETag", quoted(testDocumentETag1)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -1384,7 +1403,7 @@ func TestDeleteDocument(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentETag2),
+			Header("ETag", quoted(testDocumentETag2)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -1418,7 +1437,7 @@ func TestDeleteDocument(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusOK),
-			Header("ETag", testCommonAncestorETag1),
+			Header("ETag", quoted(testCommonAncestorETag1)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -1433,7 +1452,7 @@ func TestDeleteDocument(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusOK),
-			Header("ETag", testRootETag1),
+			Header("ETag", quoted(testRootETag1)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -1449,7 +1468,7 @@ func TestDeleteDocument(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusOK),
-			Header("ETag", testDocumentETag1),
+			Header("ETag", quoted(testDocumentETag1)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -1486,7 +1505,7 @@ func TestDeleteDocument(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusOK),
-			Header("ETag", testCommonAncestorETag2),
+			Header("ETag", quoted(testCommonAncestorETag2)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -1501,7 +1520,7 @@ func TestDeleteDocument(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusOK),
-			Header("ETag", testDocumentETag2),
+			Header("ETag", quoted(testDocumentETag2)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -1516,7 +1535,7 @@ func TestDeleteDocument(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusOK),
-			Header("ETag", testRootETag2),
+			Header("ETag", quoted(testRootETag2)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -1546,7 +1565,7 @@ func TestDeleteFolderFails(t *testing.T) {
 		testContent      = "Did you know that unsigned integers are faster than signed integers because your CPU doesn't have to autograph all of them as they go by?"
 		testDocument     = "/home/gamozo/unsigned"
 		testDocumentDir  = "/home/gamozo/"
-		testDocumentETag = "456599fd6afcb9e611b0914147dd5550"
+		testDocumentETag = "476ce84039eb3c1bc310f441a1ef27ca"
 	)
 
 	{
@@ -1558,7 +1577,7 @@ func TestDeleteFolderFails(t *testing.T) {
 		}
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentETag),
+			Header("ETag", quoted(testDocumentETag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -1584,7 +1603,7 @@ func TestDeleteDocumentIfMatch(t *testing.T) {
 		testMime         = "text/plain; charset=utf-8"
 		testContent      = "Asking a question should not change the answer, and nor should asking it twice!"
 		testDocument     = "/home/Henney/Asking Questions"
-		testDocumentETag = "23527eb0b17c95022684c5b878a4c726"
+		testDocumentETag = "18f893e96bf762c3decc64c3e60bd84a"
 	)
 
 	{
@@ -1597,7 +1616,7 @@ func TestDeleteDocumentIfMatch(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentETag),
+			Header("ETag", quoted(testDocumentETag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -1607,7 +1626,7 @@ func TestDeleteDocumentIfMatch(t *testing.T) {
 	{
 		req := mustVal(http.NewRequest(http.MethodDelete, remoteRoot+testDocument, nil))
 		// rev matches the document's current version
-		req.Header.Set("If-Match", testDocumentETag)
+		req.Header.Set("If-Match", quoted(testDocumentETag))
 		r, err := http.DefaultClient.Do(req)
 		if err != nil {
 			t.Error(err)
@@ -1615,7 +1634,7 @@ func TestDeleteDocumentIfMatch(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusOK),
-			Header("ETag", testDocumentETag),
+			Header("ETag", quoted(testDocumentETag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -1641,7 +1660,7 @@ func TestDeleteDocumentIfMatchFail(t *testing.T) {
 		testMime         = "text/plain; charset=utf-8"
 		testContent      = "Tetris is an inventory management survival horror game, from the Soviet Union in 1984."
 		testDocument     = "/yt/suckerpinch/Harder Drive"
-		testDocumentETag = "59c0c4a04a46df78d9873e212ef3f57f"
+		testDocumentETag = "85c081cc3bc5647ef463e63183173501"
 	)
 
 	{
@@ -1654,7 +1673,7 @@ func TestDeleteDocumentIfMatchFail(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", testDocumentETag),
+			Header("ETag", quoted(testDocumentETag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -1664,7 +1683,7 @@ func TestDeleteDocumentIfMatchFail(t *testing.T) {
 	{
 		req := mustVal(http.NewRequest(http.MethodDelete, remoteRoot+testDocument, nil))
 		// rev does NOT match the document's current version
-		req.Header.Set("If-Match", "456599fd6afcb9e611b0914147dd5550")
+		req.Header.Set("If-Match", "ac3c14f5025a2610906919de33c9f2be")
 		r, err := http.DefaultClient.Do(req)
 		if err != nil {
 			t.Error(err)
@@ -1672,7 +1691,7 @@ func TestDeleteDocumentIfMatchFail(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusPreconditionFailed),
-			Header("ETag", testDocumentETag),
+			Header("ETag", quoted(testDocumentETag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -1705,7 +1724,7 @@ func TestUnauthorizedCanReadPublicDocument(t *testing.T) {
 		mime           = "text/plain; charset=utf-8"
 		publicDocument = "/public/somewhere/somedoc.txt"
 		content        = "A person who has not done one half his day's work by ten o'clock, runs a chance of leaving the other half undone."
-		etag           = "56371d17bb32d583e4131eacfdda53eb"
+		etag           = "250c9ce2c1b5ade77d720fe71592efb8"
 	)
 
 	// PUT document with authorization
@@ -1720,7 +1739,7 @@ func TestUnauthorizedCanReadPublicDocument(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", etag),
+			Header("ETag", quoted(etag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -1735,7 +1754,7 @@ func TestUnauthorizedCanReadPublicDocument(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusOK),
-			Header("ETag", etag),
+			Header("ETag", quoted(etag)),
 			Body(content),
 		).Validate(r); err != nil {
 			t.Error(err)
@@ -1751,7 +1770,7 @@ func TestUnauthorizedCanReadPublicDocument(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusOK),
-			Header("ETag", etag),
+			Header("ETag", quoted(etag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -1798,7 +1817,7 @@ func TestUnauthorizedCannotAccessPublicFolder(t *testing.T) {
 		publicDocument    = "/public/Napoleon/quotes.txt"
 		publicDocumentDir = "/public/Napoleon/"
 		content           = "You can make a stop during the ascent, but not during the descent."
-		etag              = "12442797aace31d1efab9efd626c96bc"
+		etag              = "95dab264c31269e5eb5dbdb982185cd5"
 	)
 
 	// PUT document with authorization
@@ -1813,7 +1832,7 @@ func TestUnauthorizedCannotAccessPublicFolder(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", etag),
+			Header("ETag", quoted(etag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -1857,7 +1876,7 @@ func TestUnauthorizedCannotAccessNonPublicDocument(t *testing.T) {
 		mime              = "text/plain; charset=utf-8"
 		nonPublicDocument = "/non-public/Rebel/Nikiforova.txt"
 		content           = "May every state's flag burn, leaving only ashes and the black banner as its negation. Rebel, rebel until all organs of power are eliminated."
-		etag              = "a19f7c5dcf8daaba9f1411a02d6b99e1"
+		etag              = "02b0d8c10139eaf0dbdc51f8b8b64452"
 	)
 
 	// PUT document with authorization
@@ -1872,7 +1891,7 @@ func TestUnauthorizedCannotAccessNonPublicDocument(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", etag),
+			Header("ETag", quoted(etag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -1941,7 +1960,7 @@ func TestUnauthorizedCannotAccessNonPublicFolder(t *testing.T) {
 		nonPublicDocument    = "/non-public/Napoleon/Quotes.txt"
 		nonPublicDocumentDir = "/non-public/Napoleon/"
 		content              = "Death is nothing, but to live defeated and inglorious is to die daily."
-		etag                 = "28c579e7f6c8906fc24b8bd0b8087013"
+		etag                 = "8407a206c8ddc5f1ef0ca916fb8364f1"
 	)
 
 	// PUT document with authorization
@@ -1956,7 +1975,7 @@ func TestUnauthorizedCannotAccessNonPublicFolder(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", etag),
+			Header("ETag", quoted(etag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -2003,7 +2022,7 @@ func TestAuthorizationRead(t *testing.T) {
 		mime     = "text/plain; charset=utf-8"
 		document = "/Pythagoras/Quotes.txt"
 		content  = "Silence is the loudest answer."
-		etag     = "476012c1b4644cc16a59db9315b280bc"
+		etag     = "e6d770f618b6389b89df5040e3bdc99c"
 	)
 
 	// PUT document with rw authorization
@@ -2018,7 +2037,7 @@ func TestAuthorizationRead(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", etag),
+			Header("ETag", quoted(etag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -2035,7 +2054,7 @@ func TestAuthorizationRead(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusOK),
-			Header("ETag", etag),
+			Header("ETag", quoted(etag)),
 			Body(content),
 		).Validate(r); err != nil {
 			t.Error(err)
@@ -2053,7 +2072,7 @@ func TestAuthorizationRead(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusOK),
-			Header("ETag", etag),
+			Header("ETag", quoted(etag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -2101,7 +2120,7 @@ func TestAuthorizationReadPublicNoPerm(t *testing.T) {
 		mime     = "text/plain; charset=utf-8"
 		document = "/public/Pythagoras/Quotes.txt"
 		content  = "Learn silence. With the quiet serenity of a meditative mind, listen, absorb, transcribe, and transform."
-		etag     = "6681e4aec13ebde1e542809292232218"
+		etag     = "1cd6d97b6efe7ec8063061380c54d895"
 	)
 
 	// PUT document with authorization
@@ -2116,7 +2135,7 @@ func TestAuthorizationReadPublicNoPerm(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", etag),
+			Header("ETag", quoted(etag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -2132,7 +2151,7 @@ func TestAuthorizationReadPublicNoPerm(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusOK),
-			Header("ETag", etag),
+			Header("ETag", quoted(etag)),
 			Body(content),
 		).Validate(r); err != nil {
 			t.Error(err)
@@ -2149,7 +2168,7 @@ func TestAuthorizationReadPublicNoPerm(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusOK),
-			Header("ETag", etag),
+			Header("ETag", quoted(etag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -2195,7 +2214,7 @@ func TestAuthorizationReadNonPublicNoPerm(t *testing.T) {
 		mime     = "text/plain; charset=utf-8"
 		document = "/not-public/Pythagoras/Quotes.txt"
 		content  = "Learn silence. With the quiet serenity of a meditative mind, listen, absorb, transcribe, and transform."
-		etag     = "6681e4aec13ebde1e542809292232218"
+		etag     = "1cd6d97b6efe7ec8063061380c54d895"
 	)
 
 	// PUT document with authorization
@@ -2210,7 +2229,7 @@ func TestAuthorizationReadNonPublicNoPerm(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", etag),
+			Header("ETag", quoted(etag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -2282,7 +2301,7 @@ func TestAuthorizationReadPublicFolderNoPerm(t *testing.T) {
 		document    = "/public/Pythagoras/Quotes.txt"
 		documentDir = "/public/Pythagoras/"
 		content     = "Learn silence. With the quiet serenity of a meditative mind, listen, absorb, transcribe, and transform."
-		etag        = "6681e4aec13ebde1e542809292232218"
+		etag        = "1cd6d97b6efe7ec8063061380c54d895"
 	)
 
 	// PUT document with authorization
@@ -2297,7 +2316,7 @@ func TestAuthorizationReadPublicFolderNoPerm(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", etag),
+			Header("ETag", quoted(etag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -2370,7 +2389,7 @@ func TestAuthorizationReadPublic(t *testing.T) {
 		mime     = "text/plain; charset=utf-8"
 		document = "/public/Pythagoras/Quotes.txt"
 		content  = "Learn silence. With the quiet serenity of a meditative mind, listen, absorb, transcribe, and transform."
-		etag     = "6681e4aec13ebde1e542809292232218"
+		etag     = "1cd6d97b6efe7ec8063061380c54d895"
 	)
 
 	// PUT document with authorization
@@ -2385,7 +2404,7 @@ func TestAuthorizationReadPublic(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", etag),
+			Header("ETag", quoted(etag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -2402,7 +2421,7 @@ func TestAuthorizationReadPublic(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusOK),
-			Header("ETag", etag),
+			Header("ETag", quoted(etag)),
 			Body(content),
 		).Validate(r); err != nil {
 			t.Error(err)
@@ -2420,7 +2439,7 @@ func TestAuthorizationReadPublic(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusOK),
-			Header("ETag", etag),
+			Header("ETag", quoted(etag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -2471,7 +2490,7 @@ func TestAuthorizationReadWrite(t *testing.T) {
 		mime     = "text/plain; charset=utf-8"
 		document = "/Pythagoras/Quotes.txt"
 		content  = "A man is never as big as when he is on his knees to help a child."
-		etag     = "d8d529c108d78c12c7356ab9f8ac3af2"
+		etag     = "a76d6e54037242ac6ef8aeae64457e0b"
 	)
 
 	// PUT document with authorization
@@ -2486,7 +2505,7 @@ func TestAuthorizationReadWrite(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", etag),
+			Header("ETag", quoted(etag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -2503,7 +2522,7 @@ func TestAuthorizationReadWrite(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusOK),
-			Header("ETag", etag),
+			Header("ETag", quoted(etag)),
 			Body(content),
 		).Validate(r); err != nil {
 			t.Error(err)
@@ -2521,7 +2540,7 @@ func TestAuthorizationReadWrite(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusOK),
-			Header("ETag", etag),
+			Header("ETag", quoted(etag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -2574,7 +2593,7 @@ func TestAuthorizationReadWritePublic(t *testing.T) {
 		mime     = "text/plain; charset=utf-8"
 		document = "/public/Pythagoras/Quotes.txt"
 		content  = "Be silent, or let thy words be worth more than silence"
-		etag     = "e619d8ed176ca9848f0b978a9f8712fc"
+		etag     = "3f67c2bf092410b673178052eb0bd417"
 	)
 
 	// PUT document with authorization
@@ -2589,7 +2608,7 @@ func TestAuthorizationReadWritePublic(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusCreated),
-			Header("ETag", etag),
+			Header("ETag", quoted(etag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -2606,7 +2625,7 @@ func TestAuthorizationReadWritePublic(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusOK),
-			Header("ETag", etag),
+			Header("ETag", quoted(etag)),
 			Body(content),
 		).Validate(r); err != nil {
 			t.Error(err)
@@ -2624,7 +2643,7 @@ func TestAuthorizationReadWritePublic(t *testing.T) {
 
 		if err := Expect(
 			Status(http.StatusOK),
-			Header("ETag", etag),
+			Header("ETag", quoted(etag)),
 		).Validate(r); err != nil {
 			t.Error(err)
 		}
@@ -2665,7 +2684,7 @@ func TestPreflightAllowAny(t *testing.T) {
 	Mock(
 		WithDirectory(sroot),
 	)
-	must(Configure(rroot, sroot))
+	mustVal(Configure(rroot, sroot))
 	Reset()
 
 	mux := http.NewServeMux()
@@ -2695,7 +2714,7 @@ func TestOptionsAllowAny(t *testing.T) {
 	Mock(
 		WithDirectory(sroot),
 	)
-	must(Configure(rroot, sroot))
+	mustVal(Configure(rroot, sroot))
 	Reset()
 
 	mux := http.NewServeMux()
@@ -2723,7 +2742,7 @@ func TestPreflightAllowSpecific(t *testing.T) {
 	Mock(
 		WithDirectory(sroot),
 	)
-	must(Configure(rroot, sroot,
+	mustVal(Configure(rroot, sroot,
 		WithAllowedOrigins([]string{"other.example.com", "my.example.com"}),
 	))
 	Reset()
@@ -2755,7 +2774,7 @@ func TestOptionsAllowSpecific(t *testing.T) {
 	Mock(
 		WithDirectory(sroot),
 	)
-	must(Configure(rroot, sroot,
+	mustVal(Configure(rroot, sroot,
 		WithAllowedOrigins([]string{"other.example.com", "my.example.com"}),
 	))
 	Reset()
@@ -2785,7 +2804,7 @@ func TestPreflightAllowCustom(t *testing.T) {
 	Mock(
 		WithDirectory(sroot),
 	)
-	must(Configure(rroot, sroot,
+	mustVal(Configure(rroot, sroot,
 		WithAllowOrigin(func(r *http.Request, origin string) bool {
 			return origin == "my.example.com"
 		}),
@@ -2819,7 +2838,7 @@ func TestOptionsAllowCustom(t *testing.T) {
 	Mock(
 		WithDirectory(sroot),
 	)
-	must(Configure(rroot, sroot,
+	mustVal(Configure(rroot, sroot,
 		WithAllowOrigin(func(r *http.Request, origin string) bool {
 			return origin == "my.example.com"
 		}),
@@ -2851,7 +2870,7 @@ func TestPreflightAllowSpecificFail(t *testing.T) {
 	Mock(
 		WithDirectory(sroot),
 	)
-	must(Configure(rroot, sroot,
+	mustVal(Configure(rroot, sroot,
 		WithAllowedOrigins([]string{"other.example.com", "my.example.com"}),
 	))
 	Reset()
@@ -2883,7 +2902,7 @@ func TestOptionsAllowSpecificFail(t *testing.T) {
 	Mock(
 		WithDirectory(sroot),
 	)
-	must(Configure(rroot, sroot,
+	mustVal(Configure(rroot, sroot,
 		WithAllowedOrigins([]string{"other.example.com", "my.example.com"}),
 	))
 	Reset()
@@ -2913,7 +2932,7 @@ func TestPreflightAllowCustomFail(t *testing.T) {
 	Mock(
 		WithDirectory(sroot),
 	)
-	must(Configure(rroot, sroot,
+	mustVal(Configure(rroot, sroot,
 		WithAllowOrigin(func(r *http.Request, origin string) bool {
 			return origin == "my.example.com"
 		}),
@@ -2947,7 +2966,7 @@ func TestOptionsAllowCustomFail(t *testing.T) {
 	Mock(
 		WithDirectory(sroot),
 	)
-	must(Configure(rroot, sroot,
+	mustVal(Configure(rroot, sroot,
 		WithAllowOrigin(func(r *http.Request, origin string) bool {
 			return origin == "my.example.com"
 		}),
@@ -2979,7 +2998,7 @@ func TestPreflightNotFoundFail(t *testing.T) {
 	Mock(
 		WithDirectory(sroot),
 	)
-	must(Configure(rroot, sroot))
+	mustVal(Configure(rroot, sroot))
 	Reset()
 
 	mux := http.NewServeMux()
@@ -3009,7 +3028,7 @@ func TestOptionsNotFoundFail(t *testing.T) {
 	Mock(
 		WithDirectory(sroot),
 	)
-	must(Configure(rroot, sroot))
+	mustVal(Configure(rroot, sroot))
 	Reset()
 
 	mux := http.NewServeMux()
@@ -3037,7 +3056,7 @@ func TestPreflightADocumentIsNotAFolderFail(t *testing.T) {
 	Mock(
 		WithDirectory(sroot),
 	)
-	must(Configure(rroot, sroot,
+	mustVal(Configure(rroot, sroot,
 		WithAllowAnyReadWrite(),
 	))
 	Reset()
@@ -3083,7 +3102,7 @@ func TestOptionsADocumentIsNotAFolderFail(t *testing.T) {
 	Mock(
 		WithDirectory(sroot),
 	)
-	must(Configure(rroot, sroot,
+	mustVal(Configure(rroot, sroot,
 		WithAllowAnyReadWrite(),
 	))
 	Reset()
@@ -3127,7 +3146,7 @@ func TestPreflightAFolderIsNotADocumentFail(t *testing.T) {
 	Mock(
 		WithDirectory(sroot),
 	)
-	must(Configure(rroot, sroot,
+	mustVal(Configure(rroot, sroot,
 		WithAllowAnyReadWrite(),
 	))
 	Reset()
@@ -3173,7 +3192,7 @@ func TestOptionsAFolderIsNotADocumentFail(t *testing.T) {
 	Mock(
 		WithDirectory(sroot),
 	)
-	must(Configure(rroot, sroot,
+	mustVal(Configure(rroot, sroot,
 		WithAllowAnyReadWrite(),
 	))
 	Reset()
@@ -3215,7 +3234,7 @@ func TestPreflightMethodFail(t *testing.T) {
 	Mock(
 		WithDirectory(sroot),
 	)
-	must(Configure(rroot, sroot))
+	mustVal(Configure(rroot, sroot))
 	Reset()
 
 	mux := http.NewServeMux()
@@ -3245,7 +3264,7 @@ func TestPreflightHeaderFail(t *testing.T) {
 	Mock(
 		WithDirectory(sroot),
 	)
-	must(Configure(rroot, sroot))
+	mustVal(Configure(rroot, sroot))
 	Reset()
 
 	mux := http.NewServeMux()
@@ -3275,7 +3294,7 @@ func TestPreflightOptions(t *testing.T) {
 	Mock(
 		WithDirectory(sroot),
 	)
-	must(Configure(rroot, sroot))
+	mustVal(Configure(rroot, sroot))
 	Reset()
 
 	mux := http.NewServeMux()
@@ -3305,7 +3324,7 @@ func TestPreflightDocument(t *testing.T) {
 	Mock(
 		WithDirectory(sroot),
 	)
-	must(Configure(rroot, sroot,
+	mustVal(Configure(rroot, sroot,
 		WithAllowAnyReadWrite(),
 	))
 	Reset()
@@ -3343,4 +3362,1391 @@ func TestPreflightDocument(t *testing.T) {
 	}
 }
 
+func TestCorsHeaders(t *testing.T) {
+	const (
+		rroot = "/storage/"
+		sroot = "/tmp/rms/storage/"
+	)
+	Mock(
+		WithDirectory(sroot),
+	)
+	mustVal(Configure(rroot, sroot,
+		WithAllowAnyReadWrite(),
+	))
+	Reset()
+
+	mux := http.NewServeMux()
+	Register(mux)
+	ts := httptest.NewServer(mux)
+	remoteRoot := ts.URL + g.rroot
+	defer ts.Close()
+
+	// PUT a document
+	{
+		req := mustVal(http.NewRequest(http.MethodPut, remoteRoot+"/hello", bytes.NewReader([]byte("Hello, World!"))))
+		req.Header.Set("Origin", "my.example.com")
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Expect(
+			Status(http.StatusCreated),
+			Header("Access-Control-Expose-Headers", "Range, Content-Range"),
+		).Validate(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	{
+		req := mustVal(http.NewRequest(http.MethodOptions, remoteRoot+"/hello", nil))
+		req.Header.Set("Origin", "my.example.com")
+		req.Header.Set("Access-Control-Request-Method", "PUT")
+		req.Header.Set("Access-Control-Request-Headers", "Authorization, Content-Range")
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Expect(Status(http.StatusNoContent)).Validate(r); err != nil {
+			t.Error(err)
+		}
+	}
+
+	{
+		req := mustVal(http.NewRequest(http.MethodOptions, remoteRoot+"/hello", nil))
+		req.Header.Set("Origin", "my.example.com")
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		req.Header.Set("Access-Control-Request-Headers", "Authorization, Range, If-Range, If-Modified-Since, If-Unmodified-Since")
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Expect(Status(http.StatusNoContent)).Validate(r); err != nil {
+			t.Error(err)
+		}
+	}
+
+	{
+		req := mustVal(http.NewRequest(http.MethodGet, remoteRoot+"/hello", nil))
+		req.Header.Set("Origin", "my.example.com")
+		req.Header.Set("Range", "bytes=0-4")
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Expect(
+			Status(http.StatusPartialContent),
+			Header("Access-Control-Expose-Headers", "Range, Content-Range"),
+			Body("Hello"),
+		).Validate(r); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
 // @todo: write tests for unhandled errors!
+
+func TestMultipleServersAreIndependent(t *testing.T) {
+	Mock(
+		WithDirectory("/tmp/rms/alice/"),
+		WithDirectory("/tmp/rms/bob/"),
+	)
+	alice := mustVal(New("/alice/", "/tmp/rms/alice/", WithAllowAnyReadWrite()))
+	bob := mustVal(New("/bob/", "/tmp/rms/bob/", WithAllowAnyReadWrite()))
+
+	mux := http.NewServeMux()
+	alice.Register(mux)
+	bob.Register(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	{
+		req := mustVal(http.NewRequest(http.MethodPut, ts.URL+"/alice/hello.txt", bytes.NewReader([]byte("Hello, Alice!"))))
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Expect(Status(http.StatusCreated)).Validate(r); err != nil {
+			t.Error(err)
+		}
+	}
+
+	{
+		r, err := http.Get(ts.URL + "/alice/hello.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Expect(Status(http.StatusOK), Body("Hello, Alice!")).Validate(r); err != nil {
+			t.Error(err)
+		}
+	}
+
+	{
+		r, err := http.Get(ts.URL + "/bob/hello.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Expect(Status(http.StatusNotFound)).Validate(r); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err := alice.Retrieve("/hello.txt"); err != nil {
+		t.Error(err)
+	}
+	if _, err := bob.Retrieve("/hello.txt"); err != ErrNotExist {
+		t.Errorf("got: %v, want: %v", err, ErrNotExist)
+	}
+}
+
+// Run with -race to detect unsynchronized accesses to the storage tree.
+func TestParallelRequests(t *testing.T) {
+	ts, remoteRoot := mockServer()
+	defer ts.Close()
+
+	const (
+		workers    = 8
+		iterations = 16
+	)
+
+	do := func(method, path string, body []byte) {
+		var rd io.Reader
+		if body != nil {
+			rd = bytes.NewReader(body)
+		}
+		req := mustVal(http.NewRequest(method, remoteRoot+path, rd))
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		io.Copy(io.Discard, r.Body)
+		r.Body.Close()
+		if r.StatusCode >= 500 {
+			t.Errorf("%s %s: got: %s", method, path, r.Status)
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				doc := fmt.Sprintf("/Parallel/%d/%d.txt", i, j%4)
+				do(http.MethodPut, doc, []byte(fmt.Sprintf("worker %d iteration %d", i, j)))
+				do(http.MethodPut, "/Parallel/shared.txt", []byte(fmt.Sprintf("written by worker %d", i)))
+				do(http.MethodGet, "/Parallel/", nil)
+				do(http.MethodGet, "/", nil)
+				do(http.MethodGet, doc, nil)
+				if j%3 == 0 {
+					do(http.MethodDelete, doc, nil)
+				}
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < iterations; j++ {
+			if err := Persist(io.Discard); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	wg.Wait()
+
+	r, err := http.Get(remoteRoot + "/Parallel/shared.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Expect(Status(http.StatusOK)).Validate(r); err != nil {
+		t.Error(err)
+	}
+}
+
+// recordingStorage wraps another Storage, recording the methods called.
+type recordingStorage struct {
+	Storage
+	calls []string
+}
+
+func (rs *recordingStorage) Get(rname string) (NodeInfo, error) {
+	rs.calls = append(rs.calls, "Get "+rname)
+	return rs.Storage.Get(rname)
+}
+
+func (rs *recordingStorage) Children(rname string) ([]NodeInfo, error) {
+	rs.calls = append(rs.calls, "Children "+rname)
+	return rs.Storage.Children(rname)
+}
+
+func (rs *recordingStorage) Open(rname string) (io.ReadSeekCloser, error) {
+	rs.calls = append(rs.calls, "Open "+rname)
+	return rs.Storage.Open(rname)
+}
+
+func (rs *recordingStorage) Put(rname string, r io.Reader, mime string) (NodeInfo, error) {
+	rs.calls = append(rs.calls, "Put "+rname)
+	return rs.Storage.Put(rname, r, mime)
+}
+
+func (rs *recordingStorage) Replace(rname string, r io.Reader, mime string) (NodeInfo, error) {
+	rs.calls = append(rs.calls, "Replace "+rname)
+	return rs.Storage.Replace(rname, r, mime)
+}
+
+func (rs *recordingStorage) Delete(rname string) error {
+	rs.calls = append(rs.calls, "Delete "+rname)
+	return rs.Storage.Delete(rname)
+}
+
+func TestWithStorage(t *testing.T) {
+	const sroot = "/tmp/rms/other/"
+	Mock(
+		WithDirectory("/tmp/rms/storage/"),
+		WithDirectory(sroot),
+	)
+	st := &recordingStorage{Storage: newTree(sroot)}
+	s := mustVal(New("/storage/", "/tmp/rms/storage/",
+		WithAllowAnyReadWrite(),
+		WithStorage(st),
+	))
+
+	mux := http.NewServeMux()
+	s.Register(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	remoteRoot := ts.URL + "/storage"
+
+	requests := []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodPut, "/Notes/todo.txt", "buy milk", http.StatusCreated},
+		{http.MethodPut, "/Notes/todo.txt", "buy oat milk", http.StatusCreated},
+		{http.MethodGet, "/Notes/", "", http.StatusOK},
+		{http.MethodGet, "/Notes/todo.txt", "", http.StatusOK},
+		{http.MethodDelete, "/Notes/todo.txt", "", http.StatusOK},
+	}
+	for _, req := range requests {
+		r, err := http.DefaultClient.Do(mustVal(http.NewRequest(req.method, remoteRoot+req.path, bytes.NewReader([]byte(req.body)))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Expect(Status(req.status)).Validate(r); err != nil {
+			t.Errorf("%s %s: %v", req.method, req.path, err)
+		}
+	}
+
+	expected := []string{
+		"Get /Notes/todo.txt", // preconditions are checked before the body is received
+		"Get /Notes/todo.txt",
+		"Put /Notes/todo.txt",
+		"Get /Notes/todo.txt",
+		"Get /Notes/todo.txt",
+		"Replace /Notes/todo.txt",
+		"Get /Notes/",
+		"Children /Notes",
+		"Get /Notes/todo.txt",
+		"Open /Notes/todo.txt",
+		"Get /Notes/todo.txt",
+		"Delete /Notes/todo.txt",
+	}
+	if len(st.calls) != len(expected) {
+		t.Fatalf("got: %v, want: %v", st.calls, expected)
+	}
+	for i := range expected {
+		if st.calls[i] != expected[i] {
+			t.Errorf("got: `%s', want: `%s'", st.calls[i], expected[i])
+		}
+	}
+
+	// the default storage must not have been touched
+	if len(s.tree.files) != 1 {
+		t.Errorf("got: %d nodes in default storage, want: 1", len(s.tree.files))
+	}
+}
+
+type testUser struct {
+	root  string
+	quota int64
+}
+
+var (
+	_ UserWithRoot  = testUser{}
+	_ UserWithQuota = testUser{}
+)
+
+func (testUser) Permission(name string) Level {
+	return LevelReadWrite
+}
+
+func (u testUser) Root() string {
+	return u.root
+}
+
+func (u testUser) Quota() int64 {
+	return u.quota
+}
+
+func TestUserRoots(t *testing.T) {
+	ts, remoteRoot := mockServer(
+		WithUserRoots(),
+		WithAuthentication(func(r *http.Request, bearer string) (User, bool) {
+			switch bearer {
+			case "alice", "bob":
+				return testUser{root: bearer}, true
+			}
+			return nil, false
+		}),
+	)
+	defer ts.Close()
+
+	do := func(method, path, bearer, body string) *http.Response {
+		req := mustVal(http.NewRequest(method, remoteRoot+path, bytes.NewReader([]byte(body))))
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	checks := []struct {
+		method, path, bearer, body string
+		expect                     *Expectation
+	}{
+		{http.MethodPut, "/alice/Notes/secret.txt", "alice", "Alice's secret", Expect(Status(http.StatusCreated))},
+		{http.MethodPut, "/alice/public/hello.txt", "alice", "Hello from Alice", Expect(Status(http.StatusCreated))},
+		{http.MethodPut, "/bob/Notes/secret.txt", "bob", "Bob's secret", Expect(Status(http.StatusCreated))},
+		{http.MethodGet, "/alice/Notes/secret.txt", "alice", "", Expect(Status(http.StatusOK), Body("Alice's secret"))},
+		{http.MethodGet, "/bob/Notes/secret.txt", "bob", "", Expect(Status(http.StatusOK), Body("Bob's secret"))},
+		// users can't access each other's roots
+		{http.MethodGet, "/alice/Notes/secret.txt", "bob", "", Expect(Status(http.StatusForbidden))},
+		{http.MethodPut, "/alice/Notes/secret.txt", "bob", "Bob was here", Expect(Status(http.StatusForbidden))},
+		{http.MethodGet, "/alice/Notes/", "bob", "", Expect(Status(http.StatusForbidden))},
+		// ...except for public documents
+		{http.MethodGet, "/alice/public/hello.txt", "bob", "", Expect(Status(http.StatusOK), Body("Hello from Alice"))},
+		{http.MethodGet, "/alice/public/hello.txt", "", "", Expect(Status(http.StatusOK), Body("Hello from Alice"))},
+		{http.MethodGet, "/alice/Notes/secret.txt", "", "", Expect(Status(http.StatusUnauthorized))},
+		// roots that don't exist yet
+		{http.MethodGet, "/carol/public/hello.txt", "", "", Expect(Status(http.StatusNotFound))},
+		{http.MethodGet, "/", "alice", "", Expect(Status(http.StatusNotFound))},
+	}
+	for _, c := range checks {
+		r := do(c.method, c.path, c.bearer, c.body)
+		if err := c.expect.Validate(r); err != nil {
+			t.Errorf("%s %s (%s): %v", c.method, c.path, c.bearer, err)
+		}
+	}
+
+	if roots := g.Roots(); len(roots) != 2 || roots[0] != "alice" || roots[1] != "bob" {
+		t.Errorf("got: %v, want: [alice bob]", roots)
+	}
+
+	alice := mustVal(g.userTree("alice", false))
+	bob := mustVal(g.userTree("bob", false))
+	aliceDoc := mustVal(alice.retrieve("/Notes/secret.txt"))
+	bobDoc := mustVal(bob.retrieve("/Notes/secret.txt"))
+	if dir := filepath.Dir(aliceDoc.sname); dir != "/tmp/rms/storage/alice" {
+		t.Errorf("got: `%s', want: `/tmp/rms/storage/alice'", dir)
+	}
+	if dir := filepath.Dir(bobDoc.sname); dir != "/tmp/rms/storage/bob" {
+		t.Errorf("got: `%s', want: `/tmp/rms/storage/bob'", dir)
+	}
+	if len(g.tree.files) != 1 {
+		t.Errorf("got: %d nodes in default storage, want: 1", len(g.tree.files))
+	}
+}
+
+func TestQuota(t *testing.T) {
+	ts, remoteRoot := mockServer(
+		WithUserRoots(),
+		WithAuthentication(func(r *http.Request, bearer string) (User, bool) {
+			return testUser{root: "alice", quota: 32}, true
+		}),
+	)
+	defer ts.Close()
+
+	put := func(path string, body io.Reader) *http.Response {
+		req := mustVal(http.NewRequest(http.MethodPut, remoteRoot+"/alice"+path, body))
+		req.Header.Set("Content-Type", "text/plain")
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	usage := func(expected int64) {
+		t.Helper()
+		if u := mustVal(g.Usage("alice")); u != expected {
+			t.Errorf("got usage: %d, want: %d", u, expected)
+		}
+	}
+
+	usage(0)
+
+	r := put("/a.txt", bytes.NewReader([]byte("0123456789012345"))) // 16 bytes
+	if err := Expect(Status(http.StatusCreated)).Validate(r); err != nil {
+		t.Error(err)
+	}
+	usage(16)
+
+	// Content-Length is known in advance
+	r = put("/b.txt", bytes.NewReader([]byte("01234567890123456789"))) // 20 bytes
+	if err := Expect(Status(http.StatusInsufficientStorage)).Validate(r); err != nil {
+		t.Error(err)
+	}
+	usage(16)
+
+	// Content-Length is unknown, body is streamed
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < 4; i++ {
+			pw.Write([]byte("0123456789"))
+		}
+		pw.Close()
+	}()
+	r = put("/c.txt", pr)
+	if err := Expect(Status(http.StatusInsufficientStorage)).Validate(r); err != nil {
+		t.Error(err)
+	}
+	usage(16)
+	if _, err := mustVal(g.userTree("alice", false)).retrieve("/c.txt"); err != ErrNotExist {
+		t.Errorf("got: %v, want: %v", err, ErrNotExist)
+	}
+
+	// replacing a document only counts the difference
+	r = put("/a.txt", bytes.NewReader([]byte("01234567890123456789012345678901"))) // 32 bytes
+	if err := Expect(Status(http.StatusCreated)).Validate(r); err != nil {
+		t.Error(err)
+	}
+	usage(32)
+
+	req := mustVal(http.NewRequest(http.MethodDelete, remoteRoot+"/alice/a.txt", nil))
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Expect(Status(http.StatusOK)).Validate(r); err != nil {
+		t.Error(err)
+	}
+	usage(0)
+
+	if u := mustVal(g.Usage("bob")); u != 0 {
+		t.Errorf("got usage: %d, want: 0", u)
+	}
+}
+
+func TestGetDocumentVersion(t *testing.T) {
+	ts, remoteRoot := mockServer(WithVersionHistory(0, 0), WithServeVersions())
+	defer ts.Close()
+
+	put := func(content string) string {
+		req := mustVal(http.NewRequest(http.MethodPut, remoteRoot+"/notes.txt", bytes.NewReader([]byte(content))))
+		req.Header.Set("Content-Type", "text/plain")
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Expect(Status(http.StatusCreated)).Validate(r); err != nil {
+			t.Error(err)
+		}
+		return r.Header.Get("ETag")
+	}
+
+	v1 := put("first")
+	v2 := put("second")
+
+	checks := []struct {
+		query  string
+		expect *Expectation
+	}{
+		{"", Expect(Status(http.StatusOK), Header("ETag", v2), Body("second"))},
+		{"?version=" + strings.Trim(v1, `"`), Expect(Status(http.StatusOK), Header("ETag", v1), Header("Content-Type", "text/plain"), Body("first"))},
+		{"?version=" + strings.Trim(v2, `"`), Expect(Status(http.StatusNotFound))}, // the current version is not a previous version
+		{"?version=invalid", Expect(Status(http.StatusBadRequest))},
+	}
+	for _, c := range checks {
+		r, err := http.Get(remoteRoot + "/notes.txt" + c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.expect.Validate(r); err != nil {
+			t.Errorf("%s: %v", c.query, err)
+		}
+	}
+
+	// conditional requests apply to the requested version
+	conditionals := []struct {
+		header, value string
+		expect        *Expectation
+	}{
+		{"If-None-Match", v1, Expect(Status(http.StatusNotModified), Header("ETag", v1))},
+		{"If-None-Match", v2, Expect(Status(http.StatusOK), Header("ETag", v1), Body("first"))},
+		{"If-Match", v2, Expect(Status(http.StatusPreconditionFailed), Header("ETag", v1))},
+		{"If-Match", v1, Expect(Status(http.StatusOK), Header("ETag", v1), Body("first"))},
+	}
+	for _, c := range conditionals {
+		req := mustVal(http.NewRequest(http.MethodGet, remoteRoot+"/notes.txt?version="+strings.Trim(v1, `"`), nil))
+		req.Header.Set(c.header, c.value)
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.expect.Validate(r); err != nil {
+			t.Errorf("%s: %s: %v", c.header, c.value, err)
+		}
+	}
+}
+
+func TestDeleteDocumentMovesItToTrash(t *testing.T) {
+	ts, remoteRoot := mockServer(WithTrash(0))
+	defer ts.Close()
+
+	req := mustVal(http.NewRequest(http.MethodPut, remoteRoot+"/Notes/todo.txt", bytes.NewReader([]byte("buy milk"))))
+	req.Header.Set("Content-Type", "text/plain")
+	r := mustVal(http.DefaultClient.Do(req))
+	if err := Expect(Status(http.StatusCreated)).Validate(r); err != nil {
+		t.Fatal(err)
+	}
+	etag := r.Header.Get("ETag")
+
+	req = mustVal(http.NewRequest(http.MethodDelete, remoteRoot+"/Notes/todo.txt", nil))
+	r = mustVal(http.DefaultClient.Do(req))
+	if err := Expect(Status(http.StatusOK)).Validate(r); err != nil {
+		t.Fatal(err)
+	}
+	r = mustVal(http.Get(remoteRoot + "/Notes/"))
+	if err := Expect(Status(http.StatusNotFound)).Validate(r); err != nil {
+		t.Error(err)
+	}
+
+	items := mustVal(g.Trash(""))
+	if len(items) != 1 || items[0].Rname != "/Notes/todo.txt" {
+		t.Fatalf("got: %+v, want the deleted document", items)
+	}
+	mustVal(g.RestoreTrash("", items[0].ID))
+
+	r = mustVal(http.Get(remoteRoot + "/Notes/todo.txt"))
+	if err := Expect(Status(http.StatusOK), Header("ETag", etag), Body("buy milk")).Validate(r); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	ts, remoteRoot := mockServer()
+	defer ts.Close()
+
+	lastMod := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	Time = func() time.Time {
+		return lastMod
+	}
+
+	req := mustVal(http.NewRequest(http.MethodPut, remoteRoot+"/Notes/todo.txt", bytes.NewReader([]byte("buy milk"))))
+	req.Header.Set("Content-Type", "text/plain")
+	r := mustVal(http.DefaultClient.Do(req))
+	if err := Expect(Status(http.StatusCreated)).Validate(r); err != nil {
+		t.Fatal(err)
+	}
+	etag := r.Header.Get("ETag")
+	weak := "W/" + etag
+	other := `"00112233445566778899aabbccddeeff"`
+	before := lastMod.Add(-time.Hour).Format(http.TimeFormat)
+	after := lastMod.Add(time.Hour).Format(http.TimeFormat)
+
+	checks := []struct {
+		name    string
+		method  string
+		path    string
+		headers map[string]string
+		status  int
+	}{
+		{"If-None-Match matches", http.MethodGet, "/Notes/todo.txt", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"If-None-Match weak comparison", http.MethodGet, "/Notes/todo.txt", map[string]string{"If-None-Match": weak}, http.StatusNotModified},
+		{"If-None-Match list", http.MethodGet, "/Notes/todo.txt", map[string]string{"If-None-Match": other + ", " + etag}, http.StatusNotModified},
+		{"If-None-Match other", http.MethodGet, "/Notes/todo.txt", map[string]string{"If-None-Match": other}, http.StatusOK},
+		{"If-None-Match foreign tag", http.MethodGet, "/Notes/todo.txt", map[string]string{"If-None-Match": `"not-ours"`}, http.StatusOK},
+		{"If-None-Match malformed", http.MethodGet, "/Notes/todo.txt", map[string]string{"If-None-Match": `"unterminated`}, http.StatusBadRequest},
+		{"If-None-Match folder", http.MethodGet, "/Notes/", map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{"If-Match strong comparison", http.MethodGet, "/Notes/todo.txt", map[string]string{"If-Match": weak}, http.StatusPreconditionFailed},
+		{"If-Match list", http.MethodGet, "/Notes/todo.txt", map[string]string{"If-Match": other + ", " + etag}, http.StatusOK},
+		{"If-Match missing document", http.MethodGet, "/Notes/missing.txt", map[string]string{"If-Match": "*"}, http.StatusPreconditionFailed},
+		{"If-Modified-Since not modified", http.MethodGet, "/Notes/todo.txt", map[string]string{"If-Modified-Since": after}, http.StatusNotModified},
+		{"If-Modified-Since modified", http.MethodGet, "/Notes/todo.txt", map[string]string{"If-Modified-Since": before}, http.StatusOK},
+		{"If-Modified-Since exact", http.MethodGet, "/Notes/todo.txt", map[string]string{"If-Modified-Since": lastMod.Format(http.TimeFormat)}, http.StatusNotModified},
+		{"If-Modified-Since invalid", http.MethodGet, "/Notes/todo.txt", map[string]string{"If-Modified-Since": "yesterday"}, http.StatusOK},
+		{"If-None-Match takes precedence", http.MethodGet, "/Notes/todo.txt", map[string]string{"If-None-Match": other, "If-Modified-Since": after}, http.StatusOK},
+		{"If-Unmodified-Since modified", http.MethodGet, "/Notes/todo.txt", map[string]string{"If-Unmodified-Since": before}, http.StatusPreconditionFailed},
+		{"If-Match takes precedence", http.MethodGet, "/Notes/todo.txt", map[string]string{"If-Match": etag, "If-Unmodified-Since": before}, http.StatusOK},
+		{"PUT If-Match missing document", http.MethodPut, "/Notes/missing.txt", map[string]string{"If-Match": etag}, http.StatusPreconditionFailed},
+		{"PUT If-None-Match matches", http.MethodPut, "/Notes/todo.txt", map[string]string{"If-None-Match": etag}, http.StatusPreconditionFailed},
+		{"PUT If-Unmodified-Since", http.MethodPut, "/Notes/todo.txt", map[string]string{"If-Unmodified-Since": before}, http.StatusPreconditionFailed},
+		{"DELETE If-Match missing document", http.MethodDelete, "/Notes/missing.txt", map[string]string{"If-Match": etag}, http.StatusPreconditionFailed},
+		{"DELETE If-Match other", http.MethodDelete, "/Notes/todo.txt", map[string]string{"If-Match": other}, http.StatusPreconditionFailed},
+		{"DELETE If-Unmodified-Since", http.MethodDelete, "/Notes/todo.txt", map[string]string{"If-Unmodified-Since": before}, http.StatusPreconditionFailed},
+		{"DELETE If-Match list", http.MethodDelete, "/Notes/todo.txt", map[string]string{"If-Match": other + ", " + etag}, http.StatusOK},
+	}
+	for _, c := range checks {
+		req := mustVal(http.NewRequest(c.method, remoteRoot+c.path, bytes.NewReader([]byte("buy oat milk"))))
+		for k, v := range c.headers {
+			req.Header.Set(k, v)
+		}
+		r := mustVal(http.DefaultClient.Do(req))
+		exp := Expect(Status(c.status))
+		if (c.status == http.StatusNotModified || c.status == http.StatusPreconditionFailed) && !strings.HasSuffix(c.path, "/") && c.path != "/Notes/missing.txt" {
+			exp = Expect(Status(c.status), Header("ETag", etag))
+		}
+		if err := exp.Validate(r); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
+
+func TestRangeRequests(t *testing.T) {
+	ts, remoteRoot := mockServer()
+	defer ts.Close()
+
+	const content = "0123456789abcdefghij"
+	req := mustVal(http.NewRequest(http.MethodPut, remoteRoot+"/Music/song.txt", bytes.NewReader([]byte(content))))
+	req.Header.Set("Content-Type", "text/plain")
+	r := mustVal(http.DefaultClient.Do(req))
+	if err := Expect(Status(http.StatusCreated)).Validate(r); err != nil {
+		t.Fatal(err)
+	}
+	etag := r.Header.Get("ETag")
+
+	checks := []struct {
+		name    string
+		headers map[string]string
+		expect  *Expectation
+	}{
+		{"no range", nil, Expect(Status(http.StatusOK), Header("Accept-Ranges", "bytes"), Body(content))},
+		{"single range", map[string]string{"Range": "bytes=2-5"}, Expect(
+			Status(http.StatusPartialContent),
+			Header("Content-Range", "bytes 2-5/20"),
+			Header("Content-Length", "4"),
+			Header("ETag", etag),
+			Body("2345"),
+		)},
+		{"open range", map[string]string{"Range": "bytes=15-"}, Expect(Status(http.StatusPartialContent), Header("Content-Range", "bytes 15-19/20"), Body("fghij"))},
+		{"suffix range", map[string]string{"Range": "bytes=-3"}, Expect(Status(http.StatusPartialContent), Header("Content-Range", "bytes 17-19/20"), Body("hij"))},
+		{"range beyond end", map[string]string{"Range": "bytes=18-100"}, Expect(Status(http.StatusPartialContent), Header("Content-Range", "bytes 18-19/20"), Body("ij"))},
+		{"unsatisfiable", map[string]string{"Range": "bytes=20-"}, Expect(Status(http.StatusRequestedRangeNotSatisfiable), Header("Content-Range", "bytes */20"))},
+		{"malformed", map[string]string{"Range": "bytes=5-2"}, Expect(Status(http.StatusOK), Body(content))},
+		{"other unit", map[string]string{"Range": "pages=1-2"}, Expect(Status(http.StatusOK), Body(content))},
+		{"If-Range matches", map[string]string{"Range": "bytes=0-1", "If-Range": etag}, Expect(Status(http.StatusPartialContent), Body("01"))},
+		{"If-Range outdated", map[string]string{"Range": "bytes=0-1", "If-Range": `"00112233445566778899aabbccddeeff"`}, Expect(Status(http.StatusOK), Body(content))},
+		{"If-Range weak", map[string]string{"Range": "bytes=0-1", "If-Range": "W/" + etag}, Expect(Status(http.StatusOK), Body(content))},
+		{"If-Range date", map[string]string{"Range": "bytes=0-1", "If-Range": time.Time{}.Format(http.TimeFormat)}, Expect(Status(http.StatusPartialContent), Body("01"))},
+		{"precondition first", map[string]string{"Range": "bytes=0-1", "If-None-Match": etag}, Expect(Status(http.StatusNotModified))},
+	}
+	for _, c := range checks {
+		req := mustVal(http.NewRequest(http.MethodGet, remoteRoot+"/Music/song.txt", nil))
+		for k, v := range c.headers {
+			req.Header.Set(k, v)
+		}
+		r := mustVal(http.DefaultClient.Do(req))
+		if err := c.expect.Validate(r); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+
+	// multiple ranges
+	req = mustVal(http.NewRequest(http.MethodGet, remoteRoot+"/Music/song.txt", nil))
+	req.Header.Set("Range", "bytes=0-1, 10-12, -2")
+	r = mustVal(http.DefaultClient.Do(req))
+	if err := Expect(Status(http.StatusPartialContent)).Validate(r); err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/byteranges" {
+		t.Errorf("got: %s, want: multipart/byteranges", mediaType)
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	want := []struct{ contentRange, body string }{
+		{"bytes 0-1/20", "01"},
+		{"bytes 10-12/20", "abc"},
+		{"bytes 18-19/20", "ij"},
+	}
+	for _, w := range want {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cr := part.Header.Get("Content-Range"); cr != w.contentRange {
+			t.Errorf("got: %s, want: %s", cr, w.contentRange)
+		}
+		if ct := part.Header.Get("Content-Type"); ct != "text/plain" {
+			t.Errorf("got: %s, want: text/plain", ct)
+		}
+		if body := string(mustVal(io.ReadAll(part))); body != w.body {
+			t.Errorf("got: %s, want: %s", body, w.body)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("expected end of multipart body, got: %v", err)
+	}
+}
+
+func TestResumableUpload(t *testing.T) {
+	const uploads = "/tmp/rms/uploads/"
+	ts, remoteRoot := mockServer(WithResumableUploads(uploads, time.Hour))
+	defer ts.Close()
+
+	const content = "0123456789abcdefghij"
+	staged := func() (n int) {
+		must(FS.WalkDir(uploads, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				n++
+			}
+			return err
+		}))
+		return n
+	}
+	chunk := func(contentRange, body string, exp *Expectation) *http.Response {
+		t.Helper()
+		req := mustVal(http.NewRequest(http.MethodPut, remoteRoot+"/Backups/backup.tar", bytes.NewReader([]byte(body))))
+		req.Header.Set("Content-Type", "application/x-tar")
+		req.Header.Set("Content-Range", contentRange)
+		r := mustVal(http.DefaultClient.Do(req))
+		if err := exp.Validate(r); err != nil {
+			t.Errorf("%s: %v", contentRange, err)
+		}
+		return r
+	}
+
+	chunk("bytes */20", "", Expect(Status(http.StatusAccepted), Header("Range", "")))
+	chunk("bytes 5-9/20", content[5:10], Expect(Status(http.StatusConflict)))
+	chunk("bytes 0-7/20", content[0:8], Expect(Status(http.StatusAccepted), Header("Range", "bytes=0-7")))
+	chunk("bytes */20", "", Expect(Status(http.StatusAccepted), Header("Range", "bytes=0-7")))
+	chunk("bytes 10-14/20", content[10:15], Expect(Status(http.StatusConflict), Header("Range", "bytes=0-7")))
+	chunk("bytes 8-9/30", content[8:10], Expect(Status(http.StatusConflict)))
+	chunk("bytes 5-12/20", content[5:13], Expect(Status(http.StatusAccepted), Header("Range", "bytes=0-12")))
+
+	// the document isn't created before the upload is complete
+	r := mustVal(http.Get(remoteRoot + "/Backups/backup.tar"))
+	if err := Expect(Status(http.StatusNotFound)).Validate(r); err != nil {
+		t.Error(err)
+	}
+
+	r = chunk("bytes 13-19/20", content[13:], Expect(Status(http.StatusCreated)))
+	etag := r.Header.Get("ETag")
+	r = mustVal(http.Get(remoteRoot + "/Backups/backup.tar"))
+	if err := Expect(Status(http.StatusOK), Header("ETag", etag), Header("Content-Type", "application/x-tar"), Body(content)).Validate(r); err != nil {
+		t.Error(err)
+	}
+	if n := staged(); n != 0 {
+		t.Errorf("expected staged chunks to be removed, got: %d files", n)
+	}
+
+	// preconditions are evaluated against the existing document
+	req := mustVal(http.NewRequest(http.MethodPut, remoteRoot+"/Backups/backup.tar", bytes.NewReader([]byte("abc"))))
+	req.Header.Set("Content-Range", "bytes 0-2/10")
+	req.Header.Set("If-Match", `"00112233445566778899aabbccddeeff"`)
+	r = mustVal(http.DefaultClient.Do(req))
+	if err := Expect(Status(http.StatusPreconditionFailed), Header("ETag", etag)).Validate(r); err != nil {
+		t.Error(err)
+	}
+
+	// abandoned uploads expire
+	chunk("bytes 0-2/10", "abc", Expect(Status(http.StatusAccepted), Header("Range", "bytes=0-2")))
+	Time = func() time.Time {
+		return time.Time{}.Add(2 * time.Hour)
+	}
+	g.ExpireUploads()
+	if n := staged(); n != 0 {
+		t.Errorf("expected staged chunks to be removed, got: %d files", n)
+	}
+	chunk("bytes 3-5/10", "def", Expect(Status(http.StatusConflict)))
+}
+
+func TestResumableUploadDigests(t *testing.T) {
+	const uploads = "/tmp/rms/uploads/"
+	ts, remoteRoot := mockServer(WithResumableUploads(uploads, time.Hour))
+	defer ts.Close()
+
+	const content = "0123456789abcdefghij"
+	digest := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return formatDigest(sum[:])
+	}
+	chunk := func(contentRange, body string, headers map[string]string, exp *Expectation) {
+		t.Helper()
+		req := mustVal(http.NewRequest(http.MethodPut, remoteRoot+"/Backups/backup.tar", bytes.NewReader([]byte(body))))
+		req.Header.Set("Content-Type", "application/x-tar")
+		req.Header.Set("Content-Range", contentRange)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		r := mustVal(http.DefaultClient.Do(req))
+		if err := exp.Validate(r); err != nil {
+			t.Errorf("%s: %v", contentRange, err)
+		}
+	}
+
+	// Content-Digest refers to the chunk
+	chunk("bytes 0-9/20", content[:10], map[string]string{"Content-Digest": digest(content[:10])}, Expect(Status(http.StatusAccepted), Header("Range", "bytes=0-9")))
+	chunk("bytes 10-14/20", "XXXXX", map[string]string{"Content-Digest": digest(content[10:15])}, Expect(Status(http.StatusBadRequest), Header("Range", "bytes=0-9")))
+	chunk("bytes 10-14/20", content[10:15], map[string]string{"Content-Digest": digest(content[10:15])}, Expect(Status(http.StatusAccepted), Header("Range", "bytes=0-14")))
+
+	// Repr-Digest refers to the entire document, it's verified once the
+	// upload is complete
+	chunk("bytes 15-19/20", content[15:], map[string]string{"Repr-Digest": digest("something else")}, Expect(Status(http.StatusBadRequest)))
+	r := mustVal(http.Get(remoteRoot + "/Backups/backup.tar"))
+	if err := Expect(Status(http.StatusNotFound)).Validate(r); err != nil {
+		t.Error(err)
+	}
+	chunk("bytes */20", "", nil, Expect(Status(http.StatusAccepted), Header("Range", "")))
+
+	chunk("bytes 0-9/20", content[:10], map[string]string{"Repr-Digest": digest(content)}, Expect(Status(http.StatusAccepted)))
+	chunk("bytes 10-19/20", content[10:], nil, Expect(Status(http.StatusCreated)))
+	r = mustVal(http.Get(remoteRoot + "/Backups/backup.tar"))
+	if err := Expect(Status(http.StatusOK), Body(content)).Validate(r); err != nil {
+		t.Error(err)
+	}
+
+	// abandoned uploads are expired periodically
+	chunk("bytes 0-2/10", "abc", nil, Expect(Status(http.StatusAccepted)))
+	Time = func() time.Time {
+		return time.Time{}.Add(2 * time.Hour)
+	}
+	must(g.Expire())
+	chunk("bytes 3-5/10", "def", nil, Expect(Status(http.StatusConflict)))
+}
+
+func TestCompression(t *testing.T) {
+	ts, remoteRoot := mockServer(WithCompression(16))
+	defer ts.Close()
+
+	put := func(path, mime, content string) string {
+		req := mustVal(http.NewRequest(http.MethodPut, remoteRoot+path, bytes.NewReader([]byte(content))))
+		req.Header.Set("Content-Type", mime)
+		r := mustVal(http.DefaultClient.Do(req))
+		if err := Expect(Status(http.StatusCreated)).Validate(r); err != nil {
+			t.Fatal(err)
+		}
+		return r.Header.Get("ETag")
+	}
+	const content = `{"hello": "world", "how": "are you?"}`
+	etag := put("/Docs/hello.json", "application/json", content)
+	put("/Docs/tiny.json", "application/json", `{}`)
+	put("/Docs/cat.png", "image/png", strings.Repeat("meow", 10))
+	weak := "W/" + etag
+	varies := func(r *http.Response) bool {
+		for _, v := range r.Header.Values("Vary") {
+			if v == "Accept-Encoding" {
+				return true
+			}
+		}
+		return false
+	}
+
+	get := func(path string, headers map[string]string) *http.Response {
+		req := mustVal(http.NewRequest(http.MethodGet, remoteRoot+path, nil))
+		// setting Accept-Encoding stops the client from transparently
+		// decompressing the response
+		req.Header.Set("Accept-Encoding", "identity")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		return mustVal(http.DefaultClient.Do(req))
+	}
+
+	r := get("/Docs/hello.json", map[string]string{"Accept-Encoding": "br;q=1.0, gzip;q=0.5"})
+	if err := Expect(
+		Status(http.StatusOK),
+		Header("Content-Encoding", "gzip"),
+		Header("ETag", weak),
+	).Validate(r); err != nil {
+		t.Fatal(err)
+	}
+	if !varies(r) {
+		t.Error("expected Vary: Accept-Encoding")
+	}
+	zr := mustVal(gzip.NewReader(r.Body))
+	if bs := mustVal(io.ReadAll(zr)); string(bs) != content {
+		t.Errorf("got: `%s', want: `%s'", bs, content)
+	}
+
+	checks := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		vary    bool
+		expect  *Expectation
+	}{
+		{"not accepted", "/Docs/hello.json", nil, true, Expect(Status(http.StatusOK), Header("Content-Encoding", ""), Header("ETag", etag), Body(content))},
+		{"refused", "/Docs/hello.json", map[string]string{"Accept-Encoding": "gzip;q=0"}, true, Expect(Status(http.StatusOK), Header("Content-Encoding", ""), Body(content))},
+		{"wildcard", "/Docs/hello.json", map[string]string{"Accept-Encoding": "*"}, true, Expect(Status(http.StatusOK), Header("Content-Encoding", "gzip"))},
+		{"too small", "/Docs/tiny.json", map[string]string{"Accept-Encoding": "gzip"}, false, Expect(Status(http.StatusOK), Header("Content-Encoding", ""), Body(`{}`))},
+		{"already compressed", "/Docs/cat.png", map[string]string{"Accept-Encoding": "gzip"}, false, Expect(Status(http.StatusOK), Header("Content-Encoding", ""))},
+		{"range", "/Docs/hello.json", map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-1"}, true, Expect(Status(http.StatusPartialContent), Header("Content-Encoding", ""), Header("ETag", etag), Body(`{"`))},
+		{"weak If-None-Match", "/Docs/hello.json", map[string]string{"Accept-Encoding": "gzip", "If-None-Match": weak}, true, Expect(Status(http.StatusNotModified))},
+		{"folder", "/Docs/", map[string]string{"Accept-Encoding": "gzip"}, true, Expect(Status(http.StatusOK), Header("Content-Encoding", "gzip"))},
+	}
+	for _, c := range checks {
+		r := get(c.path, c.headers)
+		if err := c.expect.Validate(r); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		if varies(r) != c.vary {
+			t.Errorf("%s: Vary got: %v, want Accept-Encoding: %t", c.name, r.Header.Values("Vary"), c.vary)
+		}
+	}
+
+	// a client that doesn't set Accept-Encoding itself decompresses
+	// transparently
+	r = mustVal(http.Get(remoteRoot + "/Docs/hello.json"))
+	if err := Expect(Status(http.StatusOK), Body(content)).Validate(r); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDigests(t *testing.T) {
+	ts, remoteRoot := mockServer()
+	defer ts.Close()
+
+	digest := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+	}
+	contentMD5 := func(content string) string {
+		sum := md5.Sum([]byte(content))
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+	put := func(content string, headers map[string]string) *http.Response {
+		req := mustVal(http.NewRequest(http.MethodPut, remoteRoot+"/Notes/todo.txt", bytes.NewReader([]byte(content))))
+		req.Header.Set("Content-Type", "text/plain")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		return mustVal(http.DefaultClient.Do(req))
+	}
+
+	const content = "buy milk"
+	r := put(content, map[string]string{"Content-Digest": digest(content)})
+	if err := Expect(Status(http.StatusCreated)).Validate(r); err != nil {
+		t.Fatal(err)
+	}
+	r = mustVal(http.Get(remoteRoot + "/Notes/todo.txt"))
+	if err := Expect(
+		Status(http.StatusOK),
+		Header("Content-Digest", digest(content)),
+		Header("Repr-Digest", digest(content)),
+		Body(content),
+	).Validate(r); err != nil {
+		t.Error(err)
+	}
+
+	checks := []struct {
+		name    string
+		content string
+		headers map[string]string
+		status  int
+	}{
+		{"Repr-Digest", "buy eggs", map[string]string{"Repr-Digest": digest("buy eggs")}, http.StatusCreated},
+		{"Content-MD5", "buy bread", map[string]string{"Content-MD5": contentMD5("buy bread")}, http.StatusCreated},
+		{"unknown algorithm", "buy milk", map[string]string{"Content-Digest": "crc32=:AAAAAA==:"}, http.StatusCreated},
+		{"Content-Digest mismatch", "buy beer", map[string]string{"Content-Digest": digest("buy milk")}, http.StatusBadRequest},
+		{"Repr-Digest mismatch", "buy beer", map[string]string{"Repr-Digest": "sha-512=:" + base64.StdEncoding.EncodeToString(make([]byte, 64)) + ":"}, http.StatusBadRequest},
+		{"Content-MD5 mismatch", "buy beer", map[string]string{"Content-MD5": contentMD5("buy milk")}, http.StatusBadRequest},
+		{"one of many mismatches", "buy beer", map[string]string{"Content-Digest": digest("buy beer") + ", " + "sha-512=:" + base64.StdEncoding.EncodeToString(make([]byte, 64)) + ":"}, http.StatusBadRequest},
+		{"malformed", "buy beer", map[string]string{"Content-Digest": "sha-256=abc"}, http.StatusBadRequest},
+	}
+	for _, c := range checks {
+		r := put(c.content, c.headers)
+		if err := Expect(Status(c.status)).Validate(r); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+
+	// the rejected uploads left the last accepted version in place
+	r = mustVal(http.Get(remoteRoot + "/Notes/todo.txt"))
+	if err := Expect(Status(http.StatusOK), Header("Repr-Digest", digest(content)), Body(content)).Validate(r); err != nil {
+		t.Error(err)
+	}
+	blobs := 0
+	must(FS.WalkDir("/tmp/rms/storage/", func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			blobs++
+		}
+		return err
+	}))
+	if blobs != 1 {
+		t.Errorf("expected the blobs of rejected uploads to be removed, got: %d blobs", blobs)
+	}
+
+	// partial responses only carry the digest of the whole document
+	req := mustVal(http.NewRequest(http.MethodGet, remoteRoot+"/Notes/todo.txt", nil))
+	req.Header.Set("Range", "bytes=0-2")
+	r = mustVal(http.DefaultClient.Do(req))
+	if err := Expect(
+		Status(http.StatusPartialContent),
+		Header("Content-Digest", ""),
+		Header("Repr-Digest", digest(content)),
+		Body("buy"),
+	).Validate(r); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWebFinger(t *testing.T) {
+	mockServer(WithUserRoots())
+	mux := http.NewServeMux()
+	RegisterWebFinger(mux, func(r *http.Request, user, host string) (WebFingerAccount, bool) {
+		if user != "alice" {
+			return WebFingerAccount{}, false
+		}
+		return WebFingerAccount{Root: "alice", AuthURL: "https://" + host + "/oauth/alice"}, true
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	finger := func(query string) (*http.Response, jrd) {
+		r := mustVal(http.Get(ts.URL + WebFingerPath + "?" + query))
+		defer r.Body.Close()
+		var res jrd
+		if r.StatusCode == http.StatusOK {
+			must(json.NewDecoder(r.Body).Decode(&res))
+		}
+		return r, res
+	}
+
+	r, res := finger("resource=acct:alice@example.com")
+	if r.StatusCode != http.StatusOK {
+		t.Fatalf("got status: %d, want: %d", r.StatusCode, http.StatusOK)
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/jrd+json" {
+		t.Errorf("got content type: %s", ct)
+	}
+	if origin := r.Header.Get("Access-Control-Allow-Origin"); origin != "*" {
+		t.Errorf("got allowed origin: %s", origin)
+	}
+	if res.Subject != "acct:alice@example.com" || len(res.Links) != 1 {
+		t.Fatalf("got: %+v", res)
+	}
+	link := res.Links[0]
+	if link.Rel != RemoteStorageRel || link.Href != ts.URL+"/storage/alice" {
+		t.Errorf("got link: %+v", link)
+	}
+	props := map[string]string{
+		"http://remotestorage.io/spec/version":           SpecVersion,
+		"http://tools.ietf.org/html/rfc6749#section-4.2": "https://example.com/oauth/alice",
+		"http://tools.ietf.org/html/rfc7233":             "GET",
+	}
+	for prop, want := range props {
+		if got := link.Properties[prop]; got == nil || *got != want {
+			t.Errorf("%s: got: %v, want: %s", prop, got, want)
+		}
+	}
+	if v, ok := link.Properties["http://tools.ietf.org/html/rfc6750#section-2.3"]; !ok || v != nil {
+		t.Errorf("expected query tokens to be announced as unsupported, got: %v", v)
+	}
+
+	if _, res := finger("resource=acct:alice@example.com&rel=" + url.QueryEscape(RemoteStorageRel)); len(res.Links) != 1 {
+		t.Errorf("got: %+v", res)
+	}
+	if _, res := finger("resource=acct:alice@example.com&rel=http://webfinger.net/rel/avatar"); res.Links == nil || len(res.Links) != 0 {
+		t.Errorf("got: %+v", res)
+	}
+
+	for query, status := range map[string]int{
+		"":                              http.StatusBadRequest,
+		"resource=acct:bob@example.com": http.StatusNotFound,
+		"resource=https://example.com/": http.StatusNotFound,
+		"resource=acct:example.com":     http.StatusNotFound,
+	} {
+		if r, _ := finger(query); r.StatusCode != status {
+			t.Errorf("%s: got status: %d, want: %d", query, r.StatusCode, status)
+		}
+	}
+	r = mustVal(http.Post(ts.URL+WebFingerPath+"?resource=acct:alice@example.com", "text/plain", nil))
+	r.Body.Close()
+	if r.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("got status: %d, want: %d", r.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestWebFingerPublicURL(t *testing.T) {
+	mockServer(
+		WithPublicURL("https://rs.example.org/"),
+		WithOAuth("/oauth", func(r *http.Request, username, password string) (User, bool) {
+			return nil, false
+		}, 0),
+	)
+	mux := http.NewServeMux()
+	RegisterWebFinger(mux, func(r *http.Request, user, host string) (WebFingerAccount, bool) {
+		return WebFingerAccount{}, true
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// The Host header chosen by the client is not announced.
+	req := mustVal(http.NewRequest(http.MethodGet, ts.URL+WebFingerPath+"?resource=acct:alice@example.com", nil))
+	req.Host = "evil.example.com"
+	r := mustVal(http.DefaultClient.Do(req))
+	defer r.Body.Close()
+	var res jrd
+	must(json.NewDecoder(r.Body).Decode(&res))
+	if len(res.Links) != 1 {
+		t.Fatalf("got: %+v", res)
+	}
+	link := res.Links[0]
+	if link.Href != "https://rs.example.org/storage" {
+		t.Errorf("got href: %s", link.Href)
+	}
+	if auth := link.Properties[propAuth]; auth == nil || *auth != "https://rs.example.org/oauth/authorize" {
+		t.Errorf("got auth url: %v", auth)
+	}
+
+	for _, base := range []string{"rs.example.org", "ftp://rs.example.org", "https://", "https://rs.example.org/?q=1"} {
+		if _, err := New("/storage/", "/tmp/rms/storage/", WithPublicURL(base)); err == nil {
+			t.Errorf("%s: expected invalid public url to be rejected", base)
+		}
+	}
+}
+
+func TestOAuth(t *testing.T) {
+	ts, remoteRoot := mockServer(
+		WithAuthentication(func(r *http.Request, bearer string) (User, bool) {
+			return nil, false
+		}),
+		WithOAuth("/oauth", func(r *http.Request, username, password string) (User, bool) {
+			if username != "alice" || password != "hunter2" {
+				return nil, false
+			}
+			return UserReadWrite{}, true
+		}, time.Hour),
+	)
+	defer ts.Close()
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	const (
+		clientID    = "https://app.example.com"
+		redirectURI = "https://app.example.com/callback"
+	)
+	authorize := func(params url.Values) *http.Response {
+		params.Set("client_id", clientID)
+		params.Set("redirect_uri", redirectURI)
+		params.Set("state", "xyz")
+		r := mustVal(client.PostForm(ts.URL+"/oauth/authorize", params))
+		r.Body.Close()
+		return r
+	}
+	put := func(token, path string) int {
+		req := mustVal(http.NewRequest(http.MethodPut, remoteRoot+path, strings.NewReader("Hello")))
+		req.Header.Set("Content-Type", "text/plain")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		r := mustVal(http.DefaultClient.Do(req))
+		r.Body.Close()
+		return r.StatusCode
+	}
+
+	// The dialog lists the requested scopes.
+	r := mustVal(http.Get(ts.URL + "/oauth/authorize?" + url.Values{
+		"client_id":     {clientID},
+		"redirect_uri":  {redirectURI},
+		"response_type": {"token"},
+		"scope":         {"contacts:rw *:r"},
+	}.Encode()))
+	body := string(mustVal(io.ReadAll(r.Body)))
+	r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		t.Fatalf("got status: %d, want: %d", r.StatusCode, http.StatusOK)
+	}
+	for _, want := range []string{clientID, "contacts:rw", "*:r"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("dialog does not mention %q", want)
+		}
+	}
+	if r.Header.Get("X-Frame-Options") != "DENY" {
+		t.Errorf("dialog may be framed")
+	}
+
+	// Clients are identified by the origin of their redirect URI.
+	r = mustVal(http.Get(ts.URL + "/oauth/authorize?client_id=https://evil.example.com&response_type=token&scope=contacts:rw&redirect_uri=" + url.QueryEscape(redirectURI)))
+	r.Body.Close()
+	if r.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status: %d, want: %d", r.StatusCode, http.StatusBadRequest)
+	}
+
+	r = authorize(url.Values{"response_type": {"token"}, "scope": {"contacts:rw"}, "decision": {"deny"}})
+	if loc := r.Header.Get("Location"); loc != redirectURI+"#error=access_denied&state=xyz" {
+		t.Errorf("got location: %s", loc)
+	}
+	r = authorize(url.Values{"response_type": {"token"}, "scope": {"public:rw"}, "decision": {"allow"}})
+	if loc := r.Header.Get("Location"); loc != redirectURI+"#error=invalid_scope&state=xyz" {
+		t.Errorf("got location: %s", loc)
+	}
+	r = authorize(url.Values{"response_type": {"token"}, "scope": {"contacts:rw"}, "decision": {"allow"}, "username": {"alice"}, "password": {"wrong"}})
+	if r.StatusCode != http.StatusOK || r.Header.Get("Location") != "" {
+		t.Errorf("expected the dialog to be shown again, got status: %d", r.StatusCode)
+	}
+
+	// Implicit grant
+	r = authorize(url.Values{"response_type": {"token"}, "scope": {"contacts:rw"}, "decision": {"allow"}, "username": {"alice"}, "password": {"hunter2"}})
+	if r.StatusCode != http.StatusFound {
+		t.Fatalf("got status: %d, want: %d", r.StatusCode, http.StatusFound)
+	}
+	loc := mustVal(url.Parse(r.Header.Get("Location")))
+	fragment := mustVal(url.ParseQuery(loc.Fragment))
+	token := fragment.Get("access_token")
+	if token == "" || fragment.Get("token_type") != "bearer" || fragment.Get("state") != "xyz" || fragment.Get("expires_in") != "3600" {
+		t.Fatalf("got location: %s", loc)
+	}
+
+	for _, c := range []struct {
+		token, path string
+		status      int
+	}{
+		{token, "/contacts/alice.vcf", http.StatusCreated},
+		{token, "/public/contacts/alice.vcf", http.StatusCreated},
+		{token, "/notes/todo.txt", http.StatusForbidden},
+		{token, "/contacts.txt", http.StatusForbidden},
+		{"", "/contacts/bob.vcf", http.StatusUnauthorized},
+		{"invalid", "/contacts/bob.vcf", http.StatusUnauthorized},
+	} {
+		if status := put(c.token, c.path); status != c.status {
+			t.Errorf("%s: got status: %d, want: %d", c.path, status, c.status)
+		}
+	}
+
+	// Authorization code grant with PKCE
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	sum := sha256.Sum256([]byte(verifier))
+	r = authorize(url.Values{
+		"response_type":         {"code"},
+		"scope":                 {"notes:r"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+		"decision":              {"allow"},
+		"username":              {"alice"},
+		"password":              {"hunter2"},
+	})
+	loc = mustVal(url.Parse(r.Header.Get("Location")))
+	code := loc.Query().Get("code")
+	if code == "" || loc.Query().Get("state") != "xyz" || loc.Path != "/callback" {
+		t.Fatalf("got location: %s", loc)
+	}
+	exchange := func(code, verifier string) (int, map[string]any) {
+		r := mustVal(http.PostForm(ts.URL+"/oauth/token", url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {redirectURI},
+			"client_id":     {clientID},
+			"code_verifier": {verifier},
+		}))
+		defer r.Body.Close()
+		if r.Header.Get("Access-Control-Allow-Origin") != "*" {
+			t.Errorf("token endpoint does not allow cross origin requests")
+		}
+		var res map[string]any
+		must(json.NewDecoder(r.Body).Decode(&res))
+		return r.StatusCode, res
+	}
+	status, res := exchange(code, verifier)
+	if status != http.StatusOK || res["token_type"] != "bearer" || res["scope"] != "notes:r" {
+		t.Fatalf("got status: %d, response: %v", status, res)
+	}
+	codeToken := res["access_token"].(string)
+	if status, res := exchange(code, verifier); status != http.StatusBadRequest || res["error"] != "invalid_grant" {
+		t.Errorf("code could be used twice, got status: %d, response: %v", status, res)
+	}
+
+	req := mustVal(http.NewRequest(http.MethodGet, remoteRoot+"/notes/", nil))
+	req.Header.Set("Authorization", "Bearer "+codeToken)
+	r = mustVal(http.DefaultClient.Do(req))
+	r.Body.Close()
+	if r.StatusCode != http.StatusNotFound { // authorized, but still empty
+		t.Errorf("got status: %d, want: %d", r.StatusCode, http.StatusNotFound)
+	}
+	if status := put(codeToken, "/notes/todo.txt"); status != http.StatusForbidden {
+		t.Errorf("got status: %d, want: %d", status, http.StatusForbidden)
+	}
+
+	// The wrong verifier invalidates the code.
+	r = authorize(url.Values{
+		"response_type":  {"code"},
+		"scope":          {"notes:r"},
+		"code_challenge": {verifier},
+		"decision":       {"allow"},
+		"username":       {"alice"},
+		"password":       {"hunter2"},
+	})
+	code = mustVal(url.Parse(r.Header.Get("Location"))).Query().Get("code")
+	if status, res := exchange(code, "wrong"); status != http.StatusBadRequest || res["error"] != "invalid_grant" {
+		t.Errorf("got status: %d, response: %v", status, res)
+	}
+	if status, _ := exchange(code, verifier); status != http.StatusBadRequest {
+		t.Errorf("got status: %d, want: %d", status, http.StatusBadRequest)
+	}
+
+	if !RevokeToken(token) {
+		t.Errorf("expected token to be revoked")
+	}
+	if status := put(token, "/contacts/alice.vcf"); status != http.StatusUnauthorized {
+		t.Errorf("got status: %d, want: %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestSlowClientsDontBlock(t *testing.T) {
+	ts, remoteRoot := mockServer()
+	defer ts.Close()
+
+	r := mustVal(http.DefaultClient.Do(mustVal(http.NewRequest(http.MethodPut, remoteRoot+"/Notes/todo.txt", strings.NewReader("buy milk")))))
+	r.Body.Close()
+	if r.StatusCode != http.StatusCreated {
+		t.Fatalf("got status: %d, want: %d", r.StatusCode, http.StatusCreated)
+	}
+
+	// An upload that is still in transfer...
+	pr, pw := io.Pipe()
+	done := make(chan int)
+	go func() {
+		req := mustVal(http.NewRequest(http.MethodPut, remoteRoot+"/Notes/todo.txt", pr))
+		req.Header.Set("Content-Type", "text/plain")
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			done <- 0
+			return
+		}
+		r.Body.Close()
+		done <- r.StatusCode
+	}()
+	mustVal(pw.Write([]byte("buy ")))
+
+	// ...doesn't block readers of the same tree.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	r, err := http.DefaultClient.Do(mustVal(http.NewRequestWithContext(ctx, http.MethodGet, remoteRoot+"/Notes/todo.txt", nil)))
+	if err != nil {
+		t.Fatalf("reader blocked by upload: %v", err)
+	}
+	if body := string(mustVal(io.ReadAll(r.Body))); body != "buy milk" {
+		t.Errorf("got: %q, want the old version", body)
+	}
+	r.Body.Close()
+
+	mustVal(pw.Write([]byte("oat milk")))
+	must(pw.Close())
+	if status := <-done; status != http.StatusCreated {
+		t.Fatalf("got status: %d, want: %d", status, http.StatusCreated)
+	}
+	r = mustVal(http.Get(remoteRoot + "/Notes/todo.txt"))
+	if body := string(mustVal(io.ReadAll(r.Body))); body != "buy oat milk" {
+		t.Errorf("got: %q, want: %q", body, "buy oat milk")
+	}
+	r.Body.Close()
+}
@@ -73,6 +73,27 @@ type (
 	ErrVersionMismatch struct {
 		HttpError
 	}
+
+	ErrPreconditionFailed struct {
+		HttpError
+	}
+
+	ErrUploadConflict struct {
+		HttpError
+	}
+
+	ErrRangeNotSatisfiable struct {
+		HttpError
+		Size int64
+	}
+
+	ErrInsufficientStorage struct {
+		HttpError
+	}
+
+	ErrDocumentCorrupt struct {
+		HttpError
+	}
 )
 
 func (e HttpError) Error() string {
@@ -92,7 +113,7 @@ func (e HttpError) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	encErr := json.NewEncoder(w).Encode(e)
 	if encErr != nil {
 		// at this point we probably can't respond (eg., with internal server error) anymore
-		g.unhandled(errors.Join(encErr, e))
+		serverFromContext(r.Context()).unhandled(errors.Join(encErr, e))
 	}
 }
 
@@ -277,6 +298,27 @@ func DocExists(path string) error {
 	}
 }
 
+func InsufficientStorage(path string) error {
+	return ErrInsufficientStorage{
+		HttpError: HttpError{
+			Status: http.StatusInsufficientStorage,
+			Title:  "quota exceeded",
+			Detail: "the document can't be stored, because it would exceed the user's storage quota",
+			// @todo: fmt.Sprintf("%s", path),
+		},
+	}
+}
+
+func DocumentCorrupt(path string) error {
+	return ErrDocumentCorrupt{
+		HttpError: HttpError{
+			Status: http.StatusInternalServerError,
+			Title:  "document corrupt",
+			Detail: fmt.Sprintf("the stored contents of %s are damaged and can't be served, the document has to be uploaded again", path),
+		},
+	}
+}
+
 func VersionMismatch(expected, actual ETag) error {
 	return ErrVersionMismatch{
 		HttpError: HttpError{
@@ -287,3 +329,40 @@ func VersionMismatch(expected, actual ETag) error {
 		},
 	}
 }
+
+func PreconditionFailed(header, detail string) error {
+	return ErrPreconditionFailed{
+		HttpError: HttpError{
+			Status: http.StatusPreconditionFailed,
+			Title:  "precondition failed",
+			Detail: fmt.Sprintf("the condition of the %s header is not met: %s", header, detail),
+		},
+	}
+}
+
+func RangeNotSatisfiable(size int64) error {
+	s := http.StatusRequestedRangeNotSatisfiable
+	return ErrRangeNotSatisfiable{
+		HttpError: HttpError{
+			Status: s,
+			Title:  http.StatusText(s),
+			Detail: "none of the requested ranges overlap the document",
+		},
+		Size: size,
+	}
+}
+
+func (e ErrRangeNotSatisfiable) RespondError(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", e.Size))
+	return e.HttpError.RespondError(w, r)
+}
+
+func UploadConflict(detail string) error {
+	return ErrUploadConflict{
+		HttpError: HttpError{
+			Status: http.StatusConflict,
+			Title:  "upload conflict",
+			Detail: detail,
+		},
+	}
+}
@@ -1,15 +1,21 @@
 package rmsgo
 
 import (
+	"bytes"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/fnv"
 	"io"
 	"log"
 	"os"
 	"sort"
+	"time"
 
-	. "github.com/cvanloo/rmsgo/mock"
 	"golang.org/x/exp/maps"
 )
 
@@ -23,6 +29,7 @@ func init() {
 
 // ETag is a unique identifier assigned to a specific version of a
 // remoteStorage resource.
+// The length of an ETag depends on the ETagStrategy that produced it.
 type ETag []byte
 
 var hostname string
@@ -33,69 +40,349 @@ func (e ETag) String() string {
 	return hex.EncodeToString(e)
 }
 
+// maxETagSize is the length in bytes of the longest ETag accepted by
+// ParseETag.
+const maxETagSize = 64
+
 // ParseETag decodes an ETag previously encoded by (ETag).String()
 func ParseETag(s string) (ETag, error) {
 	// one byte is 2 hex digits
-	if len(s) != md5.Size*2 {
+	if len(s) == 0 || len(s) > maxETagSize*2 {
 		return nil, fmt.Errorf("not a valid etag")
 	}
 	return hex.DecodeString(s)
 }
 
+// Equal reports whether e and other are the same ETag.
+// ETags of different lengths (e.g., produced by different strategies) are
+// never equal.
 func (e ETag) Equal(other ETag) bool {
-	assert(len(e) == len(other), "comparison with malformed ETag")
-	for i := 0; i < len(e); i++ {
-		if e[i] != other[i] {
-			return false
-		}
+	return bytes.Equal(e, other)
+}
+
+type (
+	// ETagStrategy decides how the ETags of documents and folders are
+	// derived.
+	// Use one of the predefined strategies (ETagMD5, ETagSHA256, ETagFNV,
+	// ETagTimestamp, ETagRevision), HashETags for any other hash algorithm,
+	// or implement the interface yourself.
+	ETagStrategy interface {
+		// Name identifies the strategy in the persist file.
+		// If a storage tree is loaded using a different strategy than the
+		// one it was persisted with, all content hashes are recalculated.
+		Name() string
+
+		// ContentHash returns a new hash that the contents of documents are
+		// fed into, the sum is passed to Document as ContentHash.
+		// Return nil if the strategy doesn't depend on contents, in which
+		// case documents are never read to calculate their ETag.
+		ContentHash() hash.Hash
+
+		// Document derives the ETag of a document.
+		Document(d ETagDocument) ETag
+
+		// Folder derives the ETag of a folder.
+		Folder(f ETagFolder) ETag
+	}
+
+	// ETagDocument holds everything a document's ETag can be derived from.
+	ETagDocument struct {
+		Server  string
+		Name    string
+		Mime    string
+		Length  int64
+		LastMod time.Time
+
+		// Revision is increased every time the document is changed, it is
+		// unique within the storage tree.
+		Revision uint64
+
+		// Sum of the ContentHash, nil if the strategy doesn't have one.
+		ContentHash []byte
+	}
+
+	// ETagFolder holds everything a folder's ETag can be derived from.
+	ETagFolder struct {
+		Server string
+		Name   string
+
+		// Children are always sorted by name.
+		Children []ETagChild
+	}
+
+	// ETagChild is a document or folder contained in an ETagFolder.
+	ETagChild struct {
+		Name string
+		ETag ETag
+	}
+
+	// etagConfig is shared by all nodes of a storage tree.
+	etagConfig struct {
+		strategy ETagStrategy
+		identity string // empty to use the host name
+	}
+
+	hashETags struct {
+		name    string
+		newHash func() hash.Hash
+	}
+
+	timestampETags struct{}
+
+	revisionETags struct{}
+)
+
+var (
+	// ETagMD5 hashes the contents of documents using MD5.
+	// This is the default strategy.
+	ETagMD5 = HashETags("md5", md5.New)
+
+	// ETagSHA256 hashes the contents of documents using SHA-256.
+	ETagSHA256 = HashETags("sha256", sha256.New)
+
+	// ETagFNV hashes the contents of documents using the (much faster, but
+	// non-cryptographic) 128-bit FNV-1a hash.
+	ETagFNV = HashETags("fnv128a", func() hash.Hash { return fnv.New128a() })
+
+	// ETagTimestamp derives ETags from the metadata of documents only
+	// (including their last modification time), their contents are never
+	// read.
+	ETagTimestamp ETagStrategy = timestampETags{}
+
+	// ETagRevision uses a counter that is increased every time a document
+	// is changed as its ETag, the contents of documents are never read.
+	ETagRevision ETagStrategy = revisionETags{}
+)
+
+// WithETagStrategy configures how ETags are derived, per default ETagMD5 is
+// used.
+// Changing the strategy changes the ETags of all documents and folders, so
+// that clients will have to download everything again.
+func WithETagStrategy(st ETagStrategy) Option {
+	return func(s *Server) {
+		s.strategy = st
 	}
-	return true
 }
 
-func calculateETag(n *node) error {
-	hash := md5.New()
-	io.WriteString(hash, hostname)
-
-	ns := []*node{n}
-	for len(ns) > 0 {
-		cn := ns[0]
-		ns = ns[1:]
-
-		if cn.isFolder {
-			io.WriteString(hash, cn.name)
-			children := maps.Values(cn.children)
-			// Ensure that etag is deterministic by always hashing children in
-			// the same order.
-			sort.Slice(children, func(i, j int) bool {
-				return children[i].rname < children[j].rname
-			})
-			ns = append(ns, children...)
-		} else {
-			io.WriteString(hash, cn.name)
-			io.WriteString(hash, cn.mime)
-			io.WriteString(hash, cn.lastMod.Format(timeFormat))
-
-			fd, err := FS.Open(cn.sname)
-			if err != nil {
-				return err
-			}
+// WithServerIdentity configures the name that the server identifies itself
+// with in ETags, per default the host name is used.
+// Set a stable identity if the host name may change, or when moving the
+// storage to another machine, otherwise ETags will change as documents are
+// modified.
+// (Unchanged documents and folders keep their ETags either way, see Load.)
+func WithServerIdentity(identity string) Option {
+	return func(s *Server) {
+		s.identity = identity
+	}
+}
 
-			n, err := io.Copy(hash, fd)
-			if err != nil {
-				return err
-			}
-			if cn.length != n {
-				return fmt.Errorf("etag: expected to read %d bytes, got: %d", cn.length, n)
-			}
+// WithVerifyETags makes Load re-read the contents of all documents, instead
+// of trusting the ETags stored in the persist file.
+// The ETags of documents whose contents have changed on disk are
+// recalculated, all other ETags stay the same.
+func WithVerifyETags() Option {
+	return func(s *Server) {
+		s.verifyETags = true
+	}
+}
+
+func (c *etagConfig) server() string {
+	if c.identity == "" {
+		return hostname
+	}
+	return c.identity
+}
+
+// HashETags returns a strategy that hashes the contents of documents using
+// newHash, as well as their name, mime type, last modification time and
+// revision.
+// Folder ETags are derived from the names and ETags of their children.
+// name identifies the strategy in the persist file, and must be unique.
+func HashETags(name string, newHash func() hash.Hash) ETagStrategy {
+	return hashETags{name, newHash}
+}
+
+func (s hashETags) Name() string {
+	return s.name
+}
+
+func (s hashETags) ContentHash() hash.Hash {
+	return s.newHash()
+}
+
+func (s hashETags) Document(d ETagDocument) ETag {
+	h := s.newHash()
+	io.WriteString(h, d.Server)
+	io.WriteString(h, d.Name)
+	io.WriteString(h, d.Mime)
+	io.WriteString(h, d.LastMod.Format(timeFormat))
+	// The modification time only has a resolution of seconds, the revision
+	// tells apart versions with the same contents written within the same
+	// second.
+	binary.Write(h, binary.BigEndian, d.Revision)
+	h.Write(d.ContentHash)
+	return h.Sum(nil)
+}
+
+func (s hashETags) Folder(f ETagFolder) ETag {
+	return hashFolder(s.newHash(), f)
+}
+
+func (timestampETags) Name() string {
+	return "timestamp"
+}
+
+func (timestampETags) ContentHash() hash.Hash {
+	return nil
+}
+
+func (timestampETags) Document(d ETagDocument) ETag {
+	h := fnv.New64a()
+	io.WriteString(h, d.Server)
+	io.WriteString(h, d.Name)
+	io.WriteString(h, d.Mime)
+	binary.Write(h, binary.BigEndian, d.Length)
+	binary.Write(h, binary.BigEndian, d.LastMod.UnixNano())
+	return h.Sum(nil)
+}
+
+func (timestampETags) Folder(f ETagFolder) ETag {
+	return hashFolder(fnv.New64a(), f)
+}
+
+func (revisionETags) Name() string {
+	return "revision"
+}
+
+func (revisionETags) ContentHash() hash.Hash {
+	return nil
+}
+
+func (revisionETags) Document(d ETagDocument) ETag {
+	return binary.BigEndian.AppendUint64(nil, d.Revision)
+}
+
+func (revisionETags) Folder(f ETagFolder) ETag {
+	return hashFolder(fnv.New64a(), f)
+}
+
+// hashFolder feeds the folder's name and the names and ETags of its
+// children into h.
+func hashFolder(h hash.Hash, f ETagFolder) ETag {
+	io.WriteString(h, f.Server)
+	io.WriteString(h, f.Name)
+	for _, c := range f.Children {
+		io.WriteString(h, c.Name)
+		h.Write(c.ETag)
+	}
+	return h.Sum(nil)
+}
 
-			err = fd.Close()
+// calculateETag derives the etag of n using its strategy.
+// The hash of a document's content is only read from disk if it isn't known
+// yet (and the strategy needs it at all).
+// A folder's etag is derived from the etags of its children, so that only
+// the invalidated children have to be recalculated.
+// The caller must hold n.mu.
+func calculateETag(n *node) error {
+	if n.isFolder {
+		children := maps.Values(n.children)
+		// Ensure that etag is deterministic by always hashing children in
+		// the same order.
+		sort.Slice(children, func(i, j int) bool {
+			return children[i].rname < children[j].rname
+		})
+		f := ETagFolder{
+			Server:   n.etags.server(),
+			Name:     n.name,
+			Children: make([]ETagChild, 0, len(children)),
+		}
+		for _, c := range children {
+			etag, err := c.Version()
 			if err != nil {
 				return err
 			}
+			f.Children = append(f.Children, ETagChild{c.name, etag})
+		}
+		n.etag = n.etags.strategy.Folder(f)
+	} else {
+		if n.hash == nil {
+			if h := n.etags.strategy.ContentHash(); h != nil {
+				sum, err := hashBlob(h, n)
+				if err != nil {
+					return err
+				}
+				n.hash = sum
+			}
 		}
+		d := ETagDocument{
+			Server:      n.etags.server(),
+			Name:        n.name,
+			Mime:        n.mime,
+			Length:      n.length,
+			Revision:    n.revision,
+			ContentHash: n.hash,
+		}
+		if n.lastMod != nil {
+			d.LastMod = *n.lastMod
+		}
+		n.etag = n.etags.strategy.Document(d)
 	}
-
-	n.etag = hash.Sum(nil)
 	n.etagValid = true
 	return nil
 }
+
+// verify re-hashes the contents of all documents, and recalculates the etags
+// of those that have changed on disk (see WithVerifyETags).
+// Strategies that don't hash contents have nothing to verify.
+// The caller must hold the tree's write lock.
+func (t *tree) verify() {
+	for _, n := range t.files {
+		if n.isFolder {
+			continue
+		}
+		h := n.etags.strategy.ContentHash()
+		if h == nil {
+			return
+		}
+		sum, err := hashBlob(h, n)
+		if err != nil {
+			log.Printf("etag: failed to verify %s: %v", n.rname, err)
+		} else if bytes.Equal(sum, n.hash) {
+			continue
+		} else if n.hash != nil {
+			log.Printf("etag: contents of %s have changed on disk", n.rname)
+		}
+		n.hash = sum
+		n.digest = nil // outdated as well
+		for c := n; c != nil; c = c.parent {
+			c.Invalidate()
+		}
+	}
+}
+
+// hashBlob feeds the (decompressed and decrypted) contents of the document
+// n into h.
+func hashBlob(h hash.Hash, n *node) ([]byte, error) {
+	fd, err := n.open()
+	if err != nil {
+		return nil, err
+	}
+	read, err := io.Copy(h, fd)
+	if err != nil {
+		return nil, errors.Join(err, fd.Close())
+	}
+	if read != n.length {
+		return nil, errors.Join(fmt.Errorf("etag: expected to read %d bytes, got: %d", n.length, read), fd.Close())
+	}
+	return h.Sum(nil), fd.Close()
+}
+
+// parseHash decodes a content hash persisted as hex, an empty string yields
+// nil (not known).
+func parseHash(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return hex.DecodeString(s)
+}
@@ -0,0 +1,113 @@
+package rmsgo
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Expire removes the documents that have been in the trash for longer than
+// configured (see WithTrash), and previous versions that have been
+// superseded for longer than configured (see WithVersionHistory), from the
+// server's storage and all user roots.
+// Otherwise, they are only removed once the trash or the document is
+// modified again, and by Load and Fsck.
+// Abandoned resumable uploads are expired as well, see ExpireUploads.
+// Expire only knows about the built-in storage, storages set with
+// WithStorage are left alone.
+func (s *Server) Expire() error {
+	trees := []*tree{s.tree}
+	s.rootsMu.Lock()
+	for _, t := range s.roots {
+		trees = append(trees, t)
+	}
+	s.rootsMu.Unlock()
+
+	errs := []error{}
+	for _, t := range trees {
+		t.Lock()
+		errs = append(errs, t.expire())
+		t.Unlock()
+	}
+	s.ExpireUploads()
+	return errors.Join(errs...)
+}
+
+// Expire expires the trash and previous versions of the default server, see
+// (*Server).Expire.
+func Expire() error {
+	return g.Expire()
+}
+
+// RunExpiry calls Expire every interval, until ctx is done.
+// Failures are passed to the error handler.
+func (s *Server) RunExpiry(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := s.Expire(); err != nil {
+				s.unhandled(err)
+			}
+		}
+	}
+}
+
+// RunExpiry runs Expire on the default server, see (*Server).RunExpiry.
+func RunExpiry(ctx context.Context, interval time.Duration) error {
+	return g.RunExpiry(ctx, interval)
+}
+
+// expire takes expired documents out of the trash, and drops expired
+// previous versions.
+// If the change can't be recorded in the journal, it is rolled back.
+// The caller must hold the tree's write lock.
+func (t *tree) expire() error {
+	trash := t.trash
+	expired := t.expireTrash()
+	entries := purgeEntries(ids(expired))
+
+	var (
+		versions = map[*node][]*version{} // before pruning, by changed node
+		unused   []string
+	)
+	rollback := func() {
+		t.setTrash(trash)
+		for n, vs := range versions {
+			t.setVersions(n, vs)
+		}
+	}
+	if t.retention.enabled && t.retention.maxAge > 0 {
+		for _, n := range t.files {
+			if n.isFolder || len(n.versions) == 0 {
+				continue
+			}
+			vs := n.versions
+			pruned := t.pruneVersions(n)
+			if len(pruned) == 0 {
+				continue
+			}
+			versions[n] = vs
+			unused = append(unused, pruned...)
+			if t.journal == nil {
+				continue
+			}
+			e, err := nodeEntry(journalUpdate, n)
+			if err != nil {
+				rollback()
+				return err
+			}
+			entries = append(entries, e)
+		}
+	}
+
+	if err := t.commit(entries...); err != nil {
+		rollback()
+		return err
+	}
+	t.removeBlobs(unused)
+	return t.removeTrashed(expired)
+}
@@ -0,0 +1,458 @@
+package rmsgo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	. "github.com/cvanloo/rmsgo/mock"
+	"golang.org/x/exp/maps"
+)
+
+// LostAndFound is the folder that orphaned blobs are adopted into, see
+// FsckOptions.
+const LostAndFound = "/lost+found/"
+
+type (
+	FsckKind int
+
+	// FsckIssue describes an inconsistency between the storage tree and the
+	// blobs in the storage root.
+	FsckIssue struct {
+		Kind FsckKind
+
+		// Document (or folder) affected by the issue, empty for orphans.
+		Rname string
+
+		// Blob affected by the issue, empty for broken links.
+		Sname string
+
+		// Length recorded in the tree and actual length of the blob, only set
+		// for size mismatches.
+		Expected, Actual int64
+
+		// Whether the issue has been repaired.
+		Repaired bool
+	}
+
+	// FsckOptions selects which issues Fsck repairs.
+	// Fsck only reports issues if no option is set.
+	FsckOptions struct {
+		// Remove blobs that aren't referenced by any document.
+		CollectOrphans bool
+
+		// Add blobs that aren't referenced by any document to the
+		// LostAndFound folder, mutually exclusive with CollectOrphans.
+		AdoptOrphans bool
+
+		// Remove documents (as well as previous versions and trashed
+		// documents) whose blob is missing.
+		DropDangling bool
+
+		// Update the length of documents whose blob has a different size.
+		FixLengths bool
+	}
+)
+
+const (
+	// A blob in the storage root is not referenced by any document.
+	FsckOrphan FsckKind = iota
+
+	// The blob of a document is missing.
+	FsckMissingBlob
+
+	// The length of a document does not match the size of its blob.
+	FsckSizeMismatch
+
+	// A document or folder is not properly linked to its parent, or vice
+	// versa.
+	FsckBrokenLink
+)
+
+func (k FsckKind) String() string {
+	switch k {
+	case FsckOrphan:
+		return "orphan"
+	case FsckMissingBlob:
+		return "missing blob"
+	case FsckSizeMismatch:
+		return "size mismatch"
+	case FsckBrokenLink:
+		return "broken link"
+	}
+	return fmt.Sprintf("FsckKind(%d)", int(k))
+}
+
+func (i FsckIssue) String() string {
+	var s string
+	switch i.Kind {
+	case FsckOrphan:
+		s = fmt.Sprintf("%s: %s", i.Kind, i.Sname)
+	case FsckMissingBlob:
+		s = fmt.Sprintf("%s: %s -> %s", i.Kind, i.Rname, i.Sname)
+	case FsckSizeMismatch:
+		s = fmt.Sprintf("%s: %s -> %s (expected %d bytes, got %d)", i.Kind, i.Rname, i.Sname, i.Expected, i.Actual)
+	default:
+		s = fmt.Sprintf("%s: %s", i.Kind, i.Rname)
+	}
+	if i.Repaired {
+		s += " [repaired]"
+	}
+	return s
+}
+
+// Fsck checks the storage tree against the blobs in the storage root, and
+// repairs the issues selected by opts.
+// root names the user root (see WithUserRoots), leave it empty to check the
+// server's default storage tree.
+// Fsck only knows about the built-in storage, storages set with WithStorage
+// are not checked.
+// Expired documents in the trash and expired previous versions are removed
+// beforehand, see Expire.
+// Requests to the storage are blocked while Fsck is running.
+func (s *Server) Fsck(root string, opts FsckOptions) ([]FsckIssue, error) {
+	if opts.CollectOrphans && opts.AdoptOrphans {
+		return nil, errors.New("fsck: orphans can either be collected or adopted, not both")
+	}
+	t := s.tree
+	if root != "" {
+		var err error
+		t, err = s.userTree(root, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	t.Lock()
+	defer t.Unlock()
+	return t.fsck(opts)
+}
+
+func (t *tree) fsck(opts FsckOptions) (issues []FsckIssue, err error) {
+	// Expired documents and versions are removed first, rather than being
+	// checked.
+	errs := []error{t.expire()}
+	issues = append(issues, t.checkLinks()...)
+
+	blobs, err := t.blobs()
+	if err != nil {
+		return issues, errors.Join(append(errs, err)...)
+	}
+	referenced := map[string]bool{}
+
+	rnames := maps.Keys(t.files)
+	sort.Strings(rnames)
+	for _, rname := range rnames {
+		n, ok := t.files[rname]
+		if !ok || n.isFolder {
+			continue // folders may have been pruned by DropDangling
+		}
+		referenced[n.sname] = true
+		for _, v := range n.versions {
+			referenced[v.sname] = true
+		}
+
+		is, err := t.checkDocument(n, blobs, opts)
+		issues = append(issues, is...)
+		errs = append(errs, err)
+	}
+
+	keep := make([]*trashed, 0, len(t.trash))
+	purged := []*trashed{}
+	for _, item := range t.trash {
+		if _, ok := blobs[item.sname]; ok {
+			referenced[item.sname] = true
+			for _, v := range item.versions {
+				referenced[v.sname] = true
+			}
+			keep = append(keep, item)
+			continue
+		}
+		issues = append(issues, FsckIssue{
+			Kind:     FsckMissingBlob,
+			Rname:    item.rname,
+			Sname:    item.sname,
+			Repaired: opts.DropDangling,
+		})
+		if opts.DropDangling {
+			purged = append(purged, item)
+		} else {
+			keep = append(keep, item)
+		}
+	}
+	t.setTrash(keep)
+	if len(purged) > 0 {
+		errs = append(errs, t.commit(purgeEntries(ids(purged))...))
+		// previous versions are dropped along with the trashed document
+		for _, item := range purged {
+			t.shared.count([]string{item.sname}, -1)
+			for _, v := range item.versions {
+				if _, ok := blobs[v.sname]; ok {
+					errs = append(errs, t.removeBlob(v.sname))
+					if !t.shared.owns(v.sname) { // may still be referenced
+						delete(blobs, v.sname)
+					}
+				}
+			}
+		}
+	}
+
+	snames := maps.Keys(blobs)
+	sort.Strings(snames)
+	for _, sname := range snames {
+		// Content-addressed blobs may be referenced by other trees, they are
+		// collected once they're no longer referenced at all.
+		// Staged blobs are about to be added to the tree.
+		if referenced[sname] || t.shared.owns(sname) || t.isStaged(sname) {
+			continue
+		}
+		issue := FsckIssue{
+			Kind:  FsckOrphan,
+			Sname: sname,
+		}
+		switch {
+		case opts.CollectOrphans:
+			err := FS.Remove(sname)
+			issue.Repaired = err == nil
+			errs = append(errs, err)
+		case opts.AdoptOrphans:
+			err := t.adopt(sname, blobs[sname])
+			issue.Repaired = err == nil
+			errs = append(errs, err)
+		}
+		issues = append(issues, issue)
+	}
+
+	return issues, errors.Join(errs...)
+}
+
+// blobs lists the files in the storage root (and its shard directories, see
+// WithShardedBlobs), along with their size.
+// Other subdirectories (e.g., of user roots) are not included, except for
+// the content-addressed blobs, see WithDeduplication.
+func (t *tree) blobs() (map[string]int64, error) {
+	blobs := map[string]int64{}
+	err := listBlobs(t.sroot, t.layout, blobs)
+	if err != nil || t.shared == nil {
+		return blobs, err
+	}
+	err = listBlobs(t.shared.dir, t.shared.layout, blobs)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil // deduplication has never been enabled
+	}
+	return blobs, err
+}
+
+// listBlobs adds the files in dir, and in its shard directories, to blobs.
+func listBlobs(dir string, layout blobLayout, blobs map[string]int64) error {
+	dir = filepath.Clean(dir)
+	return FS.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		path = filepath.Clean(path)
+		if d.IsDir() {
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			depth := len(strings.Split(rel, string(filepath.Separator)))
+			if path != dir && (!layout.isShard(filepath.Base(path)) || depth > layout.levels) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		blobs[path] = fi.Size()
+		return nil
+	})
+}
+
+// checkDocument checks the blobs of the document n and its previous
+// versions.
+func (t *tree) checkDocument(n *node, blobs map[string]int64, opts FsckOptions) (issues []FsckIssue, err error) {
+	changed := false
+	size, ok := blobs[n.sname]
+	if !ok {
+		issues = append(issues, FsckIssue{
+			Kind:     FsckMissingBlob,
+			Rname:    n.rname,
+			Sname:    n.sname,
+			Repaired: opts.DropDangling,
+		})
+		if opts.DropDangling {
+			t.removeDocument(n)
+			t.shared.count([]string{n.sname}, -1)
+			// previous versions are dropped along with the document
+			errs := []error{t.commit(removeEntry(n))}
+			for _, v := range n.versions {
+				if _, ok := blobs[v.sname]; ok {
+					errs = append(errs, t.removeBlob(v.sname))
+					if !t.shared.owns(v.sname) { // may still be referenced
+						delete(blobs, v.sname)
+					}
+				}
+			}
+			return issues, errors.Join(errs...)
+		}
+	} else if n.codec == "" && !n.encrypted && size != n.length { // the size of encoded blobs differs
+		issues = append(issues, FsckIssue{
+			Kind:     FsckSizeMismatch,
+			Rname:    n.rname,
+			Sname:    n.sname,
+			Expected: n.length,
+			Actual:   size,
+			Repaired: opts.FixLengths,
+		})
+		if opts.FixLengths {
+			changed = true
+			t.usage += size - n.length
+			n.length = size
+			t.revision++
+			n.revision = t.revision
+			for c := n; c != nil; c = c.parent {
+				c.Invalidate()
+			}
+		}
+	}
+
+	keep := make([]*version, 0, len(n.versions))
+	for _, v := range n.versions {
+		if _, ok := blobs[v.sname]; ok {
+			keep = append(keep, v)
+			continue
+		}
+		issues = append(issues, FsckIssue{
+			Kind:     FsckMissingBlob,
+			Rname:    n.rname,
+			Sname:    v.sname,
+			Repaired: opts.DropDangling,
+		})
+		if opts.DropDangling {
+			changed = true
+		} else {
+			keep = append(keep, v)
+		}
+	}
+	t.setVersions(n, keep)
+
+	if changed {
+		err = t.commitNode(journalUpdate, n)
+	}
+	return issues, err
+}
+
+// checkLinks verifies that every node is linked to its parent and vice
+// versa.
+func (t *tree) checkLinks() (issues []FsckIssue) {
+	broken := func(rname string) {
+		issues = append(issues, FsckIssue{
+			Kind:  FsckBrokenLink,
+			Rname: rname,
+		})
+	}
+
+	rnames := maps.Keys(t.files)
+	sort.Strings(rnames)
+	for _, rname := range rnames {
+		n := t.files[rname]
+		switch {
+		case n.rname != rname:
+			broken(rname)
+		case n == t.root:
+			if n.parent != nil {
+				broken(rname)
+			}
+		case n.parent == nil || !n.parent.isFolder:
+			broken(rname)
+		case t.files[n.parent.rname] != n.parent || n.parent.children[n.rname] != n:
+			broken(rname)
+		}
+		for crname, c := range n.children {
+			if c.parent != n || t.files[crname] != c {
+				broken(crname)
+			}
+		}
+	}
+	return issues
+}
+
+// gzipMagic is the header that gzip compressed data starts with.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// adopt adds the orphaned blob sname to the LostAndFound folder.
+// Encrypted blobs, and blobs compressed with gzip, are recognized by their
+// header, and adopted with the length of their decoded contents.
+// Encrypted blobs are refused if no keys are configured.
+// Blobs compressed with another codec can't be told apart from verbatim
+// ones, they are adopted as they are.
+func (t *tree) adopt(sname string, size int64) error {
+	head, length, err := t.encoding.peek(sname, "", false, size)
+	if err != nil {
+		return err
+	}
+	encrypted := bytes.HasPrefix(head, []byte(encMagic))
+	if encrypted {
+		if t.encoding.keys == nil {
+			return fmt.Errorf("fsck: blob %s: encrypted, but no keys are configured", sname)
+		}
+		head, length, err = t.encoding.peek(sname, "", true, size)
+		if err != nil {
+			return err
+		}
+	}
+	var codec string
+	if bytes.HasPrefix(head, gzipMagic) {
+		codec = CodecGzip.Name()
+		head, length, err = t.encoding.peek(sname, codec, encrypted, size)
+		if err != nil {
+			return err
+		}
+	}
+	mime := http.DetectContentType(head)
+
+	rname := LostAndFound + filepath.Base(sname)
+	n, err := t.addDocument(rname, sname, length, mime)
+	if err != nil {
+		return err
+	}
+	n.codec, n.encrypted = codec, encrypted
+	if err := t.commitNode(journalAdd, n); err != nil {
+		t.removeDocument(n)
+		return err
+	}
+	return nil
+}
+
+// peek reads the blob sname, as it would be read if it was written with
+// codec and encrypted, and returns its first 512 bytes (enough to detect
+// its content type), along with its length.
+func (c *encodingConfig) peek(sname, codec string, encrypted bool, size int64) (head []byte, length int64, err error) {
+	fd, err := c.open(sname, codec, encrypted, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	head = make([]byte, 512)
+	nr, err := io.ReadFull(fd, head)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = nil
+	}
+	length = int64(nr)
+	if err == nil && nr == len(head) {
+		var rest int64
+		rest, err = io.Copy(io.Discard, fd)
+		length += rest
+	}
+	if err := errors.Join(err, fd.Close()); err != nil {
+		return nil, 0, err
+	}
+	return head[:nr], length, nil
+}
@@ -0,0 +1,359 @@
+package rmsgo
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	. "github.com/cvanloo/rmsgo/mock"
+)
+
+const (
+	journalAdd    = "add"
+	journalUpdate = "update"
+	journalRemove = "remove"
+	journalTrash  = "trash"
+	journalPurge  = "purge"
+)
+
+type (
+	journalConfig struct {
+		enabled      bool
+		path         string
+		snapshot     string
+		compactAfter int
+	}
+
+	// journal is an append-only log of the mutations of a tree since the
+	// last snapshot was written.
+	journal struct {
+		path         string
+		snapshot     string
+		compactAfter int
+		entries      int // written since the last compaction
+	}
+
+	// journalEntry records a single mutation.
+	// Replaying an entry more than once has the same effect as replaying it
+	// once, so that a crash during compaction does no harm.
+	journalEntry struct {
+		XMLName xml.Name  `xml:"Entry"`
+		Op      string    `xml:"Op,attr"`
+		ETags   string    `xml:"ETags,attr,omitempty"`
+		Node    *NodeDTO  `xml:"Node,omitempty"`
+		Trash   *TrashDTO `xml:"Trash,omitempty"`
+		ID      string    `xml:"ID,omitempty"`
+	}
+)
+
+// WithJournal records every change to the storage tree in an append-only
+// journal at journalFile, as soon as the change is made.
+// Load replays the journal after reading the persist file, so that no
+// changes are lost if the server isn't shut down cleanly.
+// After compactAfter entries (or when Compact is called), the tree is
+// written as a snapshot to snapshotFile, and the journal is cleared.
+// snapshotFile should therefore be the same file that is passed to Load.
+// A compactAfter of zero disables automatic compaction.
+// If automatic compaction fails, the error is passed to the error handler,
+// and compaction is attempted again with the next change.
+// With WithUserRoots, the user roots use their own journal and snapshot
+// files, named after the root, e.g., "persist.alice.xml" for
+// "persist.xml".
+func WithJournal(journalFile, snapshotFile string, compactAfter int) Option {
+	return func(s *Server) {
+		s.journal = journalConfig{
+			enabled:      true,
+			path:         journalFile,
+			snapshot:     snapshotFile,
+			compactAfter: compactAfter,
+		}
+	}
+}
+
+// newJournal returns the journal for the user root, or for the server's
+// tree if root is empty.
+// Returns nil if journaling is disabled.
+func (c journalConfig) newJournal(root string) *journal {
+	if !c.enabled {
+		return nil
+	}
+	if root == "" {
+		return &journal{
+			path:         c.path,
+			snapshot:     c.snapshot,
+			compactAfter: c.compactAfter,
+		}
+	}
+	return &journal{
+		path:         rootPath(c.path, root),
+		snapshot:     rootPath(c.snapshot, root),
+		compactAfter: c.compactAfter,
+	}
+}
+
+// rootPath turns "/var/rms/persist.xml" into "/var/rms/persist.alice.xml".
+func rootPath(path, root string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + root + ext
+}
+
+// nodeEntry records the addition (journalAdd) or update (journalUpdate) of
+// the document n, along with the strategy its content hash belongs to.
+func nodeEntry(op string, n *node) (journalEntry, error) {
+	dto, err := n.dto()
+	return journalEntry{Op: op, ETags: n.etags.strategy.Name(), Node: dto}, err
+}
+
+func removeEntry(n *node) journalEntry {
+	return journalEntry{Op: journalRemove, Node: &NodeDTO{Rname: n.rname}}
+}
+
+func trashEntry(item *trashed) journalEntry {
+	return journalEntry{Op: journalTrash, Trash: trashDTOs([]*trashed{item})[0]}
+}
+
+func purgeEntries(ids []string) (entries []journalEntry) {
+	for _, id := range ids {
+		entries = append(entries, journalEntry{Op: journalPurge, ID: id})
+	}
+	return entries
+}
+
+// commit appends the entries to the journal, and compacts it if it has
+// grown too large.
+// Failing to compact doesn't fail the commit, but is reported to the error
+// handler.
+// The caller must hold the tree's write lock.
+func (t *tree) commit(entries ...journalEntry) error {
+	if t.journal == nil || len(entries) == 0 {
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	for _, e := range entries {
+		bs, err := xml.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(bs)
+		buf.WriteByte('\n')
+	}
+
+	fd, err := FS.OpenFile(t.journal.path, os.O_WRONLY|os.O_APPEND, 0640)
+	if errors.Is(err, fs.ErrNotExist) {
+		fd, err = FS.Create(t.journal.path)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Seek(0, io.SeekEnd); err != nil {
+		return errors.Join(err, fd.Close())
+	}
+	if _, err := fd.Write(buf.Bytes()); err != nil {
+		return errors.Join(err, fd.Close())
+	}
+	if syncer, ok := fd.(interface{ Sync() error }); ok {
+		if err := syncer.Sync(); err != nil {
+			return errors.Join(err, fd.Close())
+		}
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+
+	t.journal.entries += len(entries)
+	if t.journal.compactAfter > 0 && t.journal.entries >= t.journal.compactAfter {
+		// The entries have been recorded at this point, failing to compact
+		// only lets the journal grow until the next commit tries again.
+		if err := t.compact(); err != nil {
+			t.unhandled(fmt.Errorf("journal: compaction failed: %w", err))
+		}
+	}
+	return nil
+}
+
+// compact writes a snapshot of the tree and clears the journal.
+// The caller must hold the tree's write lock.
+func (t *tree) compact() error {
+	if t.journal == nil {
+		return nil
+	}
+	bs, err := t.marshal()
+	if err != nil {
+		return err
+	}
+
+	// Replace the old snapshot atomically, a crash must not leave behind a
+	// partially written snapshot.
+	tmp := t.journal.snapshot + ".tmp"
+	if _, err := writeBlob(tmp, bytes.NewReader(bs), nil, nil); err != nil {
+		return errors.Join(err, FS.Remove(tmp))
+	}
+	if err := Rename(tmp, t.journal.snapshot); err != nil {
+		return err
+	}
+
+	// If we crash right here, the journal is replayed on top of a snapshot
+	// that already contains its changes, which is fine (see journalEntry).
+	err = FS.Truncate(t.journal.path, 0)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	t.journal.entries = 0
+	return nil
+}
+
+// replay applies the entries of the journal to the tree.
+// An incomplete entry at the end of the journal (left behind by a crash
+// while it was being written) is discarded.
+// The caller must hold the tree's write lock.
+func (t *tree) replay() error {
+	if t.journal == nil {
+		return nil
+	}
+	bs, err := FS.ReadFile(t.journal.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	dec := xml.NewDecoder(bytes.NewReader(bs))
+	good := int64(0)
+	for {
+		var e journalEntry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("journal: discarding incomplete entry at offset %d: %v", good, err)
+			if err := FS.Truncate(t.journal.path, good); err != nil {
+				return err
+			}
+			break
+		}
+		if err := t.apply(e); err != nil {
+			return fmt.Errorf("journal: failed to replay %s entry at offset %d: %w", e.Op, good, err)
+		}
+		good = dec.InputOffset()
+		if good < int64(len(bs)) && bs[good] == '\n' {
+			good++
+		}
+		t.journal.entries++
+	}
+	return nil
+}
+
+func (t *tree) apply(e journalEntry) error {
+	switch e.Op {
+	case journalAdd, journalUpdate:
+		if e.Node == nil {
+			return fmt.Errorf("missing node")
+		}
+		versions, err := versionsFromDTOs(e.Node.Versions)
+		if err != nil {
+			return err
+		}
+		var hash []byte
+		if t.sameStrategy(e.ETags) {
+			hash, err = parseHash(e.Node.Hash)
+			if err != nil {
+				return err
+			}
+		}
+		n, err := t.retrieve(e.Node.Rname)
+		if errors.Is(err, ErrNotExist) {
+			n, err = t.addDocument(e.Node.Rname, e.Node.Sname, e.Node.Length, e.Node.Mime)
+		} else if err == nil {
+			if n.isFolder {
+				return ConflictError{Path: e.Node.Rname, ConflictPath: n.rname}
+			}
+			n.sname = e.Node.Sname
+			t.updateDocument(n, e.Node.Mime, e.Node.Length)
+		}
+		if err != nil {
+			return err
+		}
+		n.codec, n.encrypted = e.Node.Compression, e.Node.Encrypted
+		n.corrupt = e.Node.Corrupt
+		n.digest, err = parseHash(e.Node.Digest)
+		if err != nil {
+			return err
+		}
+		n.lastMod = e.Node.LastMod
+		n.hash = hash
+		if etag, err := ParseETag(e.Node.ETag); err == nil && t.sameStrategy(e.ETags) {
+			n.etag = etag
+			n.etagValid = true
+		}
+		if e.Node.Revision > 0 {
+			n.revision = e.Node.Revision
+		}
+		if n.revision > t.revision {
+			t.revision = n.revision
+		}
+		t.setVersions(n, versions)
+	case journalRemove:
+		if e.Node == nil {
+			return fmt.Errorf("missing node")
+		}
+		n, err := t.retrieve(e.Node.Rname)
+		if errors.Is(err, ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !n.isFolder {
+			t.removeDocument(n)
+		}
+	case journalTrash:
+		if e.Trash == nil {
+			return fmt.Errorf("missing trash item")
+		}
+		items, err := trashFromDTOs([]*TrashDTO{e.Trash})
+		if err != nil {
+			return err
+		}
+		if _, err := t.findTrash(items[0].id()); errors.Is(err, ErrNotExist) {
+			t.setTrash(slices.Concat(t.trash, items))
+		}
+	case journalPurge:
+		if i, err := t.findTrash(e.ID); err == nil {
+			t.setTrash(slices.Concat(t.trash[:i], t.trash[i+1:]))
+		}
+	default:
+		return fmt.Errorf("unknown operation")
+	}
+	return nil
+}
+
+// Compact writes snapshots of the storage trees (including all user roots)
+// and clears their journals, see WithJournal.
+// Compact should be called before the server shuts down.
+func (s *Server) Compact() error {
+	trees := []*tree{s.tree}
+	s.rootsMu.Lock()
+	for _, t := range s.roots {
+		trees = append(trees, t)
+	}
+	s.rootsMu.Unlock()
+
+	errs := []error{}
+	for _, t := range trees {
+		t.Lock()
+		errs = append(errs, t.compact())
+		t.Unlock()
+	}
+	return errors.Join(errs...)
+}
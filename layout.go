@@ -0,0 +1,275 @@
+package rmsgo
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+
+	. "github.com/cvanloo/rmsgo/mock"
+	"golang.org/x/exp/maps"
+)
+
+// blobLayout distributes blobs over nested directories, named after the
+// leading characters of the blob's name, see WithShardedBlobs.
+// The zero value puts all blobs directly into the storage root.
+type blobLayout struct {
+	levels, width int
+}
+
+// WithShardedBlobs writes blobs into levels of nested directories, each
+// named after the next width characters of the blob's name, e.g.,
+// "ab/cd/abcd1234-..." for two levels of width two, instead of putting them
+// all directly into the storage root.
+// This keeps directories small, even with hundreds of thousands of
+// documents.
+// levels times width must not exceed eight.
+// Existing blobs keep working, Relayout moves them into the new layout.
+// With a sharded layout, user roots (see WithUserRoots) can't be named like
+// a shard directory.
+func WithShardedBlobs(levels, width int) Option {
+	return func(s *Server) {
+		s.layout = blobLayout{levels: levels, width: width}
+	}
+}
+
+// validate ensures that the layout can be applied to all blob names: UUIDs
+// begin with eight hexadecimal characters.
+func (l blobLayout) validate() error {
+	if l.levels < 0 || l.width < 0 || (l.levels > 0 && l.width == 0) || l.levels*l.width > 8 {
+		return fmt.Errorf("invalid blob layout: %d levels of width %d", l.levels, l.width)
+	}
+	return nil
+}
+
+// path returns where the blob called name is placed in dir.
+func (l blobLayout) path(dir, name string) string {
+	parts := []string{dir}
+	for i := 0; i < l.levels; i++ {
+		parts = append(parts, name[i*l.width:(i+1)*l.width])
+	}
+	return filepath.Join(append(parts, name)...)
+}
+
+// isShard reports whether a directory called name could be part of the
+// layout.
+func (l blobLayout) isShard(name string) bool {
+	return l.levels > 0 && len(name) == l.width && isHex(name)
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// create returns where the blob called name is placed in dir, creating any
+// missing directories.
+func (l blobLayout) create(dir, name string) (string, error) {
+	sname := l.path(dir, name)
+	if l.levels == 0 {
+		return sname, nil
+	}
+	return sname, MkdirAll(filepath.Dir(sname))
+}
+
+// Relayout moves all blobs of documents (including previous versions and
+// trashed documents) that aren't placed according to the configured layout
+// (see WithShardedBlobs), and updates the storage tree accordingly.
+// root names the user root (see WithUserRoots), leave it empty to move the
+// blobs of the server's default storage tree.
+// The number of moved blobs is returned.
+// Requests are served while blobs are moved, only the document being moved
+// is locked.
+// With a journal (see WithJournal), every move is recorded, and the persist
+// file is rewritten once all blobs have been moved.
+// Without, the tree must be persisted (see Persist) after Relayout returns.
+func (s *Server) Relayout(root string) (moved int, err error) {
+	t := s.tree
+	if root != "" {
+		t, err = s.userTree(root, false)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	t.RLock()
+	rnames := maps.Keys(t.files)
+	t.RUnlock()
+	sort.Strings(rnames)
+
+	var errs []error
+	for _, rname := range rnames {
+		t.Lock()
+		n, ok := t.files[rname]
+		if ok && !n.isFolder {
+			m, err := t.relayoutDocument(n)
+			moved += m
+			errs = append(errs, err)
+		}
+		t.Unlock()
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	m, err := t.relayoutTrash()
+	moved += m
+	errs = append(errs, err, t.compact())
+	return moved, errors.Join(errs...)
+}
+
+// Relayout moves the blobs of the default server, see (*Server).Relayout.
+func Relayout(root string) (moved int, err error) {
+	return g.Relayout(root)
+}
+
+// relayoutDocument moves the blobs of the document n and its previous
+// versions, recording the change in the journal.
+// The caller must hold the tree's write lock.
+func (t *tree) relayoutDocument(n *node) (moved int, err error) {
+	var errs []error
+	relocate := func(sname *string) {
+		ok, err := t.relocate(sname)
+		if ok {
+			moved++
+		}
+		errs = append(errs, err)
+	}
+	relocate(&n.sname)
+	for _, v := range n.versions {
+		relocate(&v.sname)
+	}
+	if moved > 0 {
+		errs = append(errs, t.commitNode(journalUpdate, n))
+	}
+	return moved, errors.Join(errs...)
+}
+
+// relayoutTrash moves the blobs of trashed documents and their previous
+// versions, recording the change in the journal.
+// The caller must hold the tree's write lock.
+func (t *tree) relayoutTrash() (moved int, err error) {
+	var errs []error
+	for _, item := range t.trash {
+		changed := false
+		for _, sname := range append([]*string{&item.sname}, versionSnamePtrs(item.versions)...) {
+			ok, err := t.relocate(sname)
+			if ok {
+				moved++
+				changed = true
+			}
+			errs = append(errs, err)
+		}
+		if changed {
+			// The item keeps its id, since the blob's name stays the same.
+			errs = append(errs, t.commit(journalEntry{Op: journalPurge, ID: item.id()}, trashEntry(item)))
+		}
+	}
+	return moved, errors.Join(errs...)
+}
+
+func versionSnamePtrs(versions []*version) (snames []*string) {
+	for _, v := range versions {
+		snames = append(snames, &v.sname)
+	}
+	return snames
+}
+
+// relocate moves the blob *sname to where the layout places it, and updates
+// *sname.
+// Blobs that aren't in the tree's storage root (e.g., added with
+// AddDocument) are left alone.
+func (t *tree) relocate(sname *string) (moved bool, err error) {
+	if t.shared.owns(*sname) {
+		return t.shared.relocate(sname)
+	}
+	dir := filepath.Clean(t.sroot)
+	if !inRoot(dir, *sname) {
+		return false, nil
+	}
+	target := t.layout.path(dir, filepath.Base(*sname))
+	if target == *sname {
+		return false, nil
+	}
+	if _, err := t.layout.create(dir, filepath.Base(*sname)); err != nil {
+		return false, err
+	}
+	if err := Rename(*sname, target); err != nil {
+		return false, err
+	}
+	*sname = target
+	return true, nil
+}
+
+// inRoot reports whether sname is a blob in dir, placed either directly in
+// it, or in the shard directories of any layout.
+func inRoot(dir, sname string) bool {
+	rel, err := filepath.Rel(dir, sname)
+	if err != nil || !filepath.IsLocal(rel) {
+		return false
+	}
+	for rel = filepath.Dir(rel); rel != "."; rel = filepath.Dir(rel) {
+		if !isHex(filepath.Base(rel)) {
+			return false
+		}
+	}
+	return true
+}
+
+// relocate moves the content-addressed blob *sname to where the layout
+// places it, and updates *sname.
+// Since other documents may still refer to the blob under its old name, it
+// is copied rather than moved, unless this is the last reference to it.
+func (s *blobStore) relocate(sname *string) (moved bool, err error) {
+	target := s.layout.path(s.dir, filepath.Base(*sname))
+	if target == *sname {
+		return false, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.layout.create(s.dir, filepath.Base(*sname)); err != nil {
+		return false, err
+	}
+	if _, err := FS.Stat(target); errors.Is(err, fs.ErrNotExist) {
+		if s.refs[*sname] <= 1 {
+			err = Rename(*sname, target)
+		} else {
+			err = copyBlob(*sname, target)
+		}
+		if err != nil {
+			return false, err
+		}
+	} else if err != nil {
+		return false, err
+	}
+
+	s.refs[target]++
+	s.refs[*sname]--
+	if s.refs[*sname] <= 0 {
+		delete(s.refs, *sname)
+		// Already gone if it has been moved, failing to remove it otherwise
+		// only leaves behind an unreferenced file.
+		_ = FS.Remove(*sname)
+	}
+	*sname = target
+	return true, nil
+}
+
+// copyBlob copies the (encoded) blob from to the file to.
+func copyBlob(from, to string) error {
+	fd, err := FS.Open(from)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	_, err = writeBlob(to, fd, nil, nil)
+	if err != nil {
+		return errors.Join(err, FS.Remove(to))
+	}
+	return nil
+}
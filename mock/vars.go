@@ -1,28 +1,66 @@
 package mock
 
 import (
-	"github.com/cvanloo/go-ffs"
+	"io/fs"
+	"os"
+	"sync"
 	"time"
 
+	"github.com/cvanloo/go-ffs"
+
 	"github.com/google/uuid"
 )
 
+type (
+	// FileSystem extends ffs.FileSystem by the operations that it lacks.
+	FileSystem interface {
+		ffs.FileSystem
+
+		// MkdirAll creates the directory path, along with any necessary
+		// parents.
+		MkdirAll(path string) error
+
+		// Rename moves the file oldpath to newpath, replacing newpath if it
+		// already exists.
+		Rename(oldpath, newpath string) error
+	}
+
+	// RealFileSystem is the FileSystem of the operating system.
+	RealFileSystem struct {
+		ffs.RealFileSystem
+	}
+
+	// FakeFileSystem is an in-memory FileSystem.
+	// Unlike ffs.FakeFileSystem, it may be used concurrently, except for
+	// WalkDir, which must not run concurrently with any modifications.
+	FakeFileSystem struct {
+		mu sync.Mutex
+		fs *ffs.FakeFileSystem
+	}
+)
+
 // Alias into this namespace, to make importing easier for users of mock.
 type (
-	FileSystem     = ffs.FileSystem
-	File           = ffs.File
-	RealFileSystem = ffs.RealFileSystem
-	FakeFileSystem = ffs.FakeFileSystem
-	FSOption       = ffs.FSOption
+	File     = ffs.File
+	FSOption = ffs.FSOption
+)
+
+var (
+	_ FileSystem = (*RealFileSystem)(nil)
+	_ FileSystem = (*FakeFileSystem)(nil)
 )
 
 // Alias into this namespace, to make importing easier for users of mock.
 var (
-	MockFS        = ffs.MockFS
 	WithFile      = ffs.WithFile
 	WithDirectory = ffs.WithDirectory
 )
 
+// MockFS creates a FakeFileSystem, set up by fsOpts.
+func MockFS(fsOpts ...FSOption) *FakeFileSystem {
+	return &FakeFileSystem{fs: ffs.MockFS(fsOpts...)}
+}
+
 // These variables might hold a concrete implementation or a mock.
 // Use these variables instead of using the concrete implementations directly.
 var (
@@ -66,3 +104,101 @@ func TimeFunc() func() (t time.Time) {
 		return
 	}
 }
+
+// MkdirAll creates the directory path, along with any necessary parents, in FS.
+func MkdirAll(path string) error {
+	return FS.MkdirAll(path)
+}
+
+// Rename moves the file oldpath to newpath in FS, replacing newpath if it
+// already exists.
+func Rename(oldpath, newpath string) error {
+	return FS.Rename(oldpath, newpath)
+}
+
+func (*RealFileSystem) MkdirAll(path string) error {
+	return os.MkdirAll(path, 0750)
+}
+
+func (*RealFileSystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (m *FakeFileSystem) Create(path string) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fs.Create(path)
+}
+
+func (m *FakeFileSystem) Open(path string) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fs.Open(path)
+}
+
+func (m *FakeFileSystem) Stat(path string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fs.Stat(path)
+}
+
+func (m *FakeFileSystem) OpenFile(path string, flag int, perm fs.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fs.OpenFile(path, flag, perm)
+}
+
+// WalkDir doesn't lock the file system, so that fn may access it.
+func (m *FakeFileSystem) WalkDir(root string, fn fs.WalkDirFunc) error {
+	return m.fs.WalkDir(root, fn)
+}
+
+func (m *FakeFileSystem) Truncate(path string, size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fs.Truncate(path, size)
+}
+
+func (m *FakeFileSystem) ReadFile(path string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fs.ReadFile(path)
+}
+
+func (m *FakeFileSystem) WriteFile(path string, data []byte, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fs.WriteFile(path, data, perm)
+}
+
+func (m *FakeFileSystem) Remove(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fs.Remove(path)
+}
+
+func (m *FakeFileSystem) RemoveAll(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fs.RemoveAll(path)
+}
+
+func (m *FakeFileSystem) MkdirAll(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	WithDirectory(path)(m.fs)
+	return nil
+}
+
+func (m *FakeFileSystem) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bs, err := m.fs.ReadFile(oldpath)
+	if err != nil {
+		return err
+	}
+	if err := m.fs.WriteFile(newpath, bs, 0640); err != nil {
+		return err
+	}
+	return m.fs.Remove(oldpath)
+}
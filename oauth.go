@@ -0,0 +1,639 @@
+package rmsgo
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/cvanloo/rmsgo/mock"
+)
+
+// codeLifetime is how long an authorization code may be exchanged for a
+// bearer token.
+const codeLifetime = 10 * time.Minute
+
+type (
+	// CredentialsFunc checks the credentials entered into the OAuth dialog
+	// (see WithOAuth), and returns the User that access is granted on behalf
+	// of.
+	// If the credentials are invalid, the returned values are nil and false.
+	CredentialsFunc func(r *http.Request, username, password string) (User, bool)
+
+	// authServer issues bearer tokens for remoteStorage scopes, see WithOAuth.
+	authServer struct {
+		path     string
+		check    CredentialsFunc
+		lifetime time.Duration
+		mu       sync.Mutex
+		tokens   map[string]*grant    // by bearer token
+		codes    map[string]*authCode // by authorization code
+	}
+
+	// grant is the access a user granted to a client.
+	grant struct {
+		user     User
+		clientID string
+		scopes   []scope
+		expires  time.Time // zero if the grant doesn't expire
+	}
+
+	// authCode is a grant waiting to be exchanged for a bearer token
+	// (RFC 6749, Section 4.1), protected by a PKCE challenge (RFC 7636).
+	authCode struct {
+		grant       *grant
+		redirectURI string
+		challenge   string
+		method      string
+		expires     time.Time
+	}
+
+	// scope is access to a module, e.g., "contacts:rw".
+	// Module "*" stands for all documents.
+	scope struct {
+		module string
+		level  Level
+	}
+
+	// authRequest are the parameters of an authorization request, see
+	// parseAuthRequest.
+	authRequest struct {
+		ClientID     string
+		RedirectURI  string
+		ResponseType string
+		Scope        string
+		State        string
+		Challenge    string
+		Method       string
+		scopes       []scope
+	}
+
+	// scopedUser restricts the permissions of User to the scopes granted to
+	// a client.
+	scopedUser struct {
+		User
+		scopes []scope
+	}
+)
+
+var (
+	_ UserWithRoot  = (*scopedUser)(nil)
+	_ UserWithQuota = (*scopedUser)(nil)
+)
+
+// WithOAuth serves an OAuth authorization server below path (e.g.,
+// "/oauth"), that lets users grant clients access to remoteStorage scopes
+// like "contacts:rw" (read and write access to /contacts/ and
+// /public/contacts/) or "*:r" (read access to all documents).
+// Clients are sent to the dialog at path + "/authorize", which lists the
+// requested scopes and asks for the user's credentials, which are checked
+// by check.
+// Both the implicit grant (response_type=token, RFC 6749, Section 4.2) of the
+// remoteStorage spec, and the authorization code grant (response_type=code,
+// RFC 6749, Section 4.1), which requires PKCE (RFC 7636) and exchanges codes
+// for bearer tokens at path + "/token", are supported.
+// As the spec requires, the client_id must be the origin of the
+// redirect_uri.
+// Bearer tokens are valid for lifetime (forever if zero), and are accepted
+// in addition to those authenticated by the AuthenticateFunc (see
+// WithAuthentication).
+// Tokens are kept in memory only, users have to grant access again after
+// the server is restarted.
+// The authorization server is registered along with the remote storage
+// endpoints by Register, and is announced by WebFinger (see
+// RegisterWebFinger) unless the account has an AuthURL of its own.
+func WithOAuth(path string, check CredentialsFunc, lifetime time.Duration) Option {
+	return func(s *Server) {
+		s.oauth = &authServer{
+			path:     strings.TrimSuffix(path, "/"),
+			check:    check,
+			lifetime: lifetime,
+			tokens:   map[string]*grant{},
+			codes:    map[string]*authCode{},
+		}
+	}
+}
+
+func (a *authServer) validate() error {
+	if a == nil {
+		return nil
+	}
+	if !strings.HasPrefix(a.path, "/") {
+		return fmt.Errorf("invalid oauth path: %q", a.path)
+	}
+	if a.check == nil {
+		return fmt.Errorf("oauth requires a credentials check")
+	}
+	return nil
+}
+
+// authURL returns the URL of the OAuth dialog, for a server reached at
+// origin (see (*Server).origin).
+func (a *authServer) authURL(origin string) string {
+	return origin + a.path + "/authorize"
+}
+
+func (s *Server) registerOAuth(mux *http.ServeMux) {
+	a := s.oauth
+	stack := MiddlewareStack(
+		s.withServer,
+		s.handlePanic,
+		s.middleware,
+	)
+	oauthMux := &MuxWithError{}
+	oauthMux.HandleFunc("GET "+a.path+"/authorize", a.dialog)
+	oauthMux.HandleFunc("POST "+a.path+"/authorize", a.authorize)
+	oauthMux.HandleFunc("POST "+a.path+"/token", a.token)
+	oauthMux.HandleFunc("OPTIONS "+a.path+"/token", a.token)
+	mux.Handle(a.path+"/", stack(oauthMux))
+}
+
+// authenticateBearer authenticates a request by a bearer token issued by the
+// authorization server (see WithOAuth), or else by the AuthenticateFunc.
+func (s *Server) authenticateBearer(r *http.Request, bearer string) (User, bool) {
+	if user, ok := s.oauth.user(bearer); ok {
+		return user, true
+	}
+	return s.authenticate(r, bearer)
+}
+
+// RevokeToken invalidates a bearer token issued by the authorization server
+// (see WithOAuth).
+// It reports whether the token was valid.
+func (s *Server) RevokeToken(token string) bool {
+	if s.oauth == nil {
+		return false
+	}
+	a := s.oauth
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	gt, ok := a.tokens[token]
+	delete(a.tokens, token)
+	return ok && !gt.expired(Time())
+}
+
+// RevokeToken revokes a token of the default server, see
+// (*Server).RevokeToken.
+func RevokeToken(token string) bool {
+	return g.RevokeToken(token)
+}
+
+// user returns the user that the bearer token was issued on behalf of,
+// restricted to the granted scopes.
+func (a *authServer) user(bearer string) (User, bool) {
+	if a == nil || bearer == "" {
+		return nil, false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	gt, ok := a.tokens[bearer]
+	if !ok {
+		return nil, false
+	}
+	if gt.expired(Time()) {
+		delete(a.tokens, bearer)
+		return nil, false
+	}
+	return scopedUser{User: gt.user, scopes: gt.scopes}, true
+}
+
+func (g *grant) expired(now time.Time) bool {
+	return !g.expires.IsZero() && !now.Before(g.expires)
+}
+
+// issue returns a new bearer token for the grant.
+func (a *authServer) issue(g *grant) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	now := Time()
+	if a.lifetime > 0 {
+		g.expires = now.Add(a.lifetime)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for t, other := range a.tokens {
+		if other.expired(now) {
+			delete(a.tokens, t)
+		}
+	}
+	a.tokens[token] = g
+	return token, nil
+}
+
+func randomToken() (string, error) {
+	bs := make([]byte, 32)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bs), nil
+}
+
+// parseAuthRequest reads the parameters of an authorization request.
+// If the client can't be identified, an error is returned, other problems
+// are reported to the client by redirecting back to it, in which case
+// errCode is set.
+func parseAuthRequest(r *http.Request) (req authRequest, errCode string, err error) {
+	req = authRequest{
+		ClientID:     r.FormValue("client_id"),
+		RedirectURI:  r.FormValue("redirect_uri"),
+		ResponseType: r.FormValue("response_type"),
+		Scope:        r.FormValue("scope"),
+		State:        r.FormValue("state"),
+		Challenge:    r.FormValue("code_challenge"),
+		Method:       r.FormValue("code_challenge_method"),
+	}
+	redirect, err := url.Parse(req.RedirectURI)
+	if err != nil || (redirect.Scheme != "http" && redirect.Scheme != "https") || redirect.Host == "" || redirect.Fragment != "" {
+		return req, "", BadRequest("invalid redirect_uri")
+	}
+	if req.ClientID != redirect.Scheme+"://"+redirect.Host {
+		return req, "", BadRequest("client_id must be the origin of the redirect_uri")
+	}
+
+	switch req.ResponseType {
+	case "token":
+	case "code":
+		if req.Method == "" {
+			req.Method = "plain"
+		}
+		if req.Challenge == "" || (req.Method != "plain" && req.Method != "S256") {
+			return req, "invalid_request", nil
+		}
+	default:
+		return req, "unsupported_response_type", nil
+	}
+
+	req.scopes, err = parseScopes(req.Scope)
+	if err != nil {
+		return req, "invalid_scope", nil
+	}
+	return req, "", nil
+}
+
+// parseScopes parses a space separated list of scopes, e.g.,
+// "contacts:rw calendar:r".
+func parseScopes(s string) ([]scope, error) {
+	var scopes []scope
+	for _, field := range strings.Fields(s) {
+		module, access, _ := strings.Cut(field, ":")
+		if !validModule(module) {
+			return nil, fmt.Errorf("invalid scope: %s", field)
+		}
+		sc := scope{module: module}
+		switch access {
+		case "r":
+			sc.level = LevelRead
+		case "rw":
+			sc.level = LevelReadWrite
+		default:
+			return nil, fmt.Errorf("invalid scope: %s", field)
+		}
+		scopes = append(scopes, sc)
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("no scope")
+	}
+	return scopes, nil
+}
+
+// validModule reports whether module can be named in a scope.
+// "public" is not a module, but contains the public documents of all modules.
+func validModule(module string) bool {
+	if module == "*" {
+		return true
+	}
+	if module == "" || module == "public" {
+		return false
+	}
+	for _, c := range module {
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func (sc scope) String() string {
+	return sc.module + string(sc.level)
+}
+
+// Description explains the scope to the user.
+func (sc scope) Description() string {
+	access := "Read"
+	if sc.level == LevelReadWrite {
+		access = "Read and write"
+	}
+	if sc.module == "*" {
+		return access + " access to all your documents"
+	}
+	return fmt.Sprintf("%s access to your %s (/%s/ and /public/%s/)", access, sc.module, sc.module, sc.module)
+}
+
+// permission returns the access the scopes grant to the document or folder
+// name.
+// A module scope covers the module's folder and its public folder, only "*"
+// covers the root and public folders themselves.
+func permission(scopes []scope, name string) Level {
+	rel := strings.TrimPrefix(name, "/")
+	rel = strings.TrimPrefix(rel, "public/")
+	module, _, inModule := strings.Cut(rel, "/")
+
+	level := LevelNone
+	for _, sc := range scopes {
+		if sc.module == "*" || (inModule && sc.module == module) {
+			level = maxLevel(level, sc.level)
+		}
+	}
+	return level
+}
+
+func levelRank(l Level) int {
+	switch l {
+	case LevelRead:
+		return 1
+	case LevelReadWrite:
+		return 2
+	}
+	return 0
+}
+
+func maxLevel(a, b Level) Level {
+	if levelRank(a) >= levelRank(b) {
+		return a
+	}
+	return b
+}
+
+func minLevel(a, b Level) Level {
+	if levelRank(a) <= levelRank(b) {
+		return a
+	}
+	return b
+}
+
+func (u scopedUser) Permission(name string) Level {
+	return minLevel(u.User.Permission(name), permission(u.scopes, name))
+}
+
+func (u scopedUser) Root() string {
+	return userRoot(u.User)
+}
+
+func (u scopedUser) Quota() int64 {
+	return userQuota(u.User)
+}
+
+var dialogTemplate = template.Must(template.New("dialog").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Allow access?</title>
+</head>
+<body>
+<h1>Allow access?</h1>
+<p><strong>{{.Request.ClientID}}</strong> requests access to your storage:</p>
+<ul>
+{{- range .Scopes}}
+<li><code>{{.}}</code>: {{.Description}}</li>
+{{- end}}
+</ul>
+{{- if .Error}}
+<p role="alert">{{.Error}}</p>
+{{- end}}
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="client_id" value="{{.Request.ClientID}}">
+<input type="hidden" name="redirect_uri" value="{{.Request.RedirectURI}}">
+<input type="hidden" name="response_type" value="{{.Request.ResponseType}}">
+<input type="hidden" name="scope" value="{{.Request.Scope}}">
+<input type="hidden" name="state" value="{{.Request.State}}">
+<input type="hidden" name="code_challenge" value="{{.Request.Challenge}}">
+<input type="hidden" name="code_challenge_method" value="{{.Request.Method}}">
+<p><label>Username <input name="username" value="{{.Username}}" autocomplete="username" required></label></p>
+<p><label>Password <input type="password" name="password" autocomplete="current-password" required></label></p>
+<p>
+<button type="submit" name="decision" value="allow">Allow</button>
+<button type="submit" name="decision" value="deny" formnovalidate>Deny</button>
+</p>
+</form>
+</body>
+</html>
+`))
+
+// dialog renders the page that lets the user grant the requested scopes.
+func (a *authServer) dialog(w http.ResponseWriter, r *http.Request) error {
+	req, errCode, err := parseAuthRequest(r)
+	if err != nil {
+		return err
+	}
+	if errCode != "" {
+		redirectError(w, r, req, errCode)
+		return nil
+	}
+	return a.render(w, r, req, "", "")
+}
+
+func (a *authServer) render(w http.ResponseWriter, r *http.Request, req authRequest, username, msg string) error {
+	hs := w.Header()
+	hs.Set("Content-Type", "text/html; charset=utf-8")
+	hs.Set("Cache-Control", "no-store")
+	// Don't let other sites trick users into granting access in a frame.
+	hs.Set("X-Frame-Options", "DENY")
+	hs.Set("Content-Security-Policy", "frame-ancestors 'none'")
+	return dialogTemplate.Execute(w, struct {
+		Action   string
+		Request  authRequest
+		Scopes   []scope
+		Username string
+		Error    string
+	}{
+		Action:   a.path + "/authorize",
+		Request:  req,
+		Scopes:   req.scopes,
+		Username: username,
+		Error:    msg,
+	})
+}
+
+// authorize handles the user's decision, and sends the user back to the
+// client with either a bearer token, or an authorization code.
+func (a *authServer) authorize(w http.ResponseWriter, r *http.Request) error {
+	req, errCode, err := parseAuthRequest(r)
+	if err != nil {
+		return err
+	}
+	if errCode != "" {
+		redirectError(w, r, req, errCode)
+		return nil
+	}
+	if r.PostFormValue("decision") != "allow" {
+		redirectError(w, r, req, "access_denied")
+		return nil
+	}
+
+	username := r.PostFormValue("username")
+	user, ok := a.check(r, username, r.PostFormValue("password"))
+	if !ok {
+		return a.render(w, r, req, username, "Invalid username or password.")
+	}
+	gt := &grant{
+		user:     user,
+		clientID: req.ClientID,
+		scopes:   req.scopes,
+	}
+
+	params := url.Values{}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	if req.ResponseType == "token" {
+		token, err := a.issue(gt)
+		if err != nil {
+			return err
+		}
+		params.Set("access_token", token)
+		params.Set("token_type", "bearer")
+		params.Set("scope", req.Scope)
+		if a.lifetime > 0 {
+			params.Set("expires_in", strconv.Itoa(int(a.lifetime.Seconds())))
+		}
+		// The implicit grant passes the token in the fragment, so that it is
+		// never sent to the client's server.
+		http.Redirect(w, r, req.RedirectURI+"#"+params.Encode(), http.StatusFound)
+		return nil
+	}
+
+	code, err := randomToken()
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	now := Time()
+	for c, ac := range a.codes {
+		if !now.Before(ac.expires) {
+			delete(a.codes, c)
+		}
+	}
+	a.codes[code] = &authCode{
+		grant:       gt,
+		redirectURI: req.RedirectURI,
+		challenge:   req.Challenge,
+		method:      req.Method,
+		expires:     now.Add(codeLifetime),
+	}
+	a.mu.Unlock()
+	params.Set("code", code)
+	http.Redirect(w, r, withQuery(req.RedirectURI, params), http.StatusFound)
+	return nil
+}
+
+// redirectError sends the user back to the client with an error (RFC 6749,
+// Section 4.1.2.1 and 4.2.2.1).
+func redirectError(w http.ResponseWriter, r *http.Request, req authRequest, code string) {
+	params := url.Values{}
+	params.Set("error", code)
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	if req.ResponseType == "token" {
+		http.Redirect(w, r, req.RedirectURI+"#"+params.Encode(), http.StatusFound)
+	} else {
+		http.Redirect(w, r, withQuery(req.RedirectURI, params), http.StatusFound)
+	}
+}
+
+// withQuery adds params to the query of the (already validated) URI.
+func withQuery(uri string, params url.Values) string {
+	u, _ := url.Parse(uri)
+	q := u.Query()
+	for k, vs := range params {
+		q[k] = vs
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// token exchanges an authorization code for a bearer token (RFC 6749,
+// Section 4.1.3).
+// Clients call it from the browser, so any origin is allowed.
+func (a *authServer) token(w http.ResponseWriter, r *http.Request) error {
+	hs := w.Header()
+	hs.Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		hs.Set("Access-Control-Allow-Methods", "POST")
+		hs.Set("Access-Control-Allow-Headers", "Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	hs.Set("Cache-Control", "no-store")
+
+	if gt := r.PostFormValue("grant_type"); gt != "authorization_code" {
+		return tokenError(w, "unsupported_grant_type")
+	}
+	code := r.PostFormValue("code")
+	a.mu.Lock()
+	ac, ok := a.codes[code]
+	// Codes can only be used once, even if the exchange fails.
+	delete(a.codes, code)
+	a.mu.Unlock()
+	if !ok || !Time().Before(ac.expires) {
+		return tokenError(w, "invalid_grant")
+	}
+	if r.PostFormValue("redirect_uri") != ac.redirectURI || r.PostFormValue("client_id") != ac.grant.clientID {
+		return tokenError(w, "invalid_grant")
+	}
+	if !ac.verify(r.PostFormValue("code_verifier")) {
+		return tokenError(w, "invalid_grant")
+	}
+
+	token, err := a.issue(ac.grant)
+	if err != nil {
+		return err
+	}
+	scopes := make([]string, len(ac.grant.scopes))
+	for i, sc := range ac.grant.scopes {
+		scopes[i] = sc.String()
+	}
+	res := map[string]any{
+		"access_token": token,
+		"token_type":   "bearer",
+		"scope":        strings.Join(scopes, " "),
+	}
+	if a.lifetime > 0 {
+		res["expires_in"] = int(a.lifetime.Seconds())
+	}
+	hs.Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(res)
+}
+
+// verify checks the PKCE code verifier against the challenge.
+func (ac *authCode) verify(verifier string) bool {
+	if verifier == "" {
+		return false
+	}
+	if ac.method == "S256" {
+		sum := sha256.Sum256([]byte(verifier))
+		verifier = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(verifier), []byte(ac.challenge)) == 1
+}
+
+// tokenError responds with an error of the token endpoint (RFC 6749, Section
+// 5.2).
+func tokenError(w http.ResponseWriter, code string) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	return json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
@@ -0,0 +1,36 @@
+package rmsgo
+
+import "io"
+
+// Usage reports the number of bytes stored in the user root (see
+// WithUserRoots).
+// If root is empty, the usage of the server's storage is reported instead.
+// A user root that does not exist yet has a usage of zero.
+func (s *Server) Usage(root string) (int64, error) {
+	st, err := s.rootStorage(root)
+	if err == ErrNotExist {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	st.RLock()
+	defer st.RUnlock()
+	return st.Usage(), nil
+}
+
+// quotaReader fails with ErrQuotaExceeded as soon as more than remaining
+// bytes have been read from r.
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (q *quotaReader) Read(bs []byte) (int, error) {
+	n, err := q.r.Read(bs)
+	q.remaining -= int64(n)
+	if q.remaining < 0 {
+		return n, ErrQuotaExceeded
+	}
+	return n, err
+}
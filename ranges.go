@@ -0,0 +1,201 @@
+package rmsgo
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRanges is the most ranges a client may request at once, requests for
+// more are answered with the entire document.
+const maxRanges = 64
+
+// byteRange is a range of bytes within a document.
+type byteRange struct {
+	start, length int64
+}
+
+// contentRange formats the range for the Content-Range header.
+func (br byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.start+br.length-1, size)
+}
+
+var errUnsatisfiable = errors.New("none of the ranges overlap the document")
+
+// parseRange parses the value of a Range header (RFC 9110, Section 14.1.2)
+// for a document of the given size.
+// Ranges that start beyond the end of the document are dropped, if none
+// remain errUnsatisfiable is returned.
+// ranges is nil if the header is to be ignored (it's empty, malformed, or
+// not worth honoring) and the entire document served instead.
+func parseRange(s string, size int64) (ranges []byteRange, err error) {
+	unit, set, ok := strings.Cut(s, "=")
+	if !ok || strings.TrimSpace(unit) != "bytes" {
+		return nil, nil
+	}
+	specs := strings.Split(set, ",")
+	if len(specs) > maxRanges {
+		return nil, nil
+	}
+	total, seen := int64(0), 0
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		seen++
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, nil
+		}
+		var br byteRange
+		if first == "" { // suffix range: the last n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 {
+				continue
+			}
+			n = min(n, size)
+			br = byteRange{size - n, n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, nil
+				}
+				end = min(end, size-1)
+			}
+			if start >= size {
+				continue
+			}
+			br = byteRange{start, end - start + 1}
+		}
+		if br.length <= 0 {
+			continue
+		}
+		ranges = append(ranges, br)
+		total += br.length
+	}
+	if len(ranges) == 0 {
+		if seen > 0 {
+			return nil, errUnsatisfiable
+		}
+		return nil, nil
+	}
+	// Requesting (overlapping) ranges that add up to more than the
+	// document is pointless, serve it entirely.
+	if total > size {
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+// ifRange reports whether the Range header of r should be honored, i.e.,
+// whether the If-Range condition (if any) holds for the document n (RFC
+// 9110, Section 13.1.5).
+func ifRange(r *http.Request, n *NodeInfo) bool {
+	cond := strings.TrimSpace(r.Header.Get("If-Range"))
+	if cond == "" {
+		return true
+	}
+	if t, ok := parseDate(cond); ok {
+		// Only an exact match is a strong enough validator.
+		return n.LastMod != nil && n.LastMod.Truncate(time.Second).Equal(t)
+	}
+	star, tags, ok := parseTagList(cond)
+	return ok && !star && len(tags) == 1 && matchStrong(tags, n.ETag)
+}
+
+// serveDocument sends the contents fd of the document n, or the ranges
+// requested thereof.
+// Unless ranges are requested, the contents are compressed with enc (if not
+// nil).
+// All other headers must already be set.
+func serveDocument(w http.ResponseWriter, r *http.Request, n NodeInfo, fd io.ReadSeeker, enc ContentEncoding) error {
+	hs := w.Header()
+	hs.Set("Accept-Ranges", "bytes")
+
+	var ranges []byteRange
+	if rs := r.Header.Get("Range"); rs != "" && ifRange(r, &n) {
+		var err error
+		ranges, err = parseRange(rs, n.Length)
+		if err != nil {
+			return RangeNotSatisfiable(n.Length)
+		}
+	}
+
+	// Digests of a compressed response would have to be computed on the
+	// fly, partial responses only have a representation digest.
+	if n.Digest != nil && (enc == nil || len(ranges) > 0) {
+		hs.Set("Repr-Digest", formatDigest(n.Digest))
+	}
+
+	switch len(ranges) {
+	case 0:
+		hs.Set("Content-Length", fmt.Sprintf("%d", n.Length))
+		if enc != nil {
+			setEncoded(w, enc, n.ETag)
+		} else if n.Digest != nil {
+			hs.Set("Content-Digest", formatDigest(n.Digest))
+		}
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodHead {
+			return nil
+		}
+		if enc != nil {
+			return writeEncoded(w, enc, fd)
+		}
+		_, err := io.Copy(w, fd)
+		return err
+	case 1:
+		br := ranges[0]
+		hs.Set("Content-Range", br.contentRange(n.Length))
+		hs.Set("Content-Length", fmt.Sprintf("%d", br.length))
+		w.WriteHeader(http.StatusPartialContent)
+		if r.Method == http.MethodHead {
+			return nil
+		}
+		return copyRange(w, fd, br)
+	}
+
+	mw := multipart.NewWriter(w)
+	hs.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	w.WriteHeader(http.StatusPartialContent)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	for _, br := range ranges {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":  {n.Mime},
+			"Content-Range": {br.contentRange(n.Length)},
+		})
+		if err != nil {
+			return err
+		}
+		if err := copyRange(part, fd, br); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+func copyRange(w io.Writer, fd io.ReadSeeker, br byteRange) error {
+	if _, err := fd.Seek(br.start, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.CopyN(w, fd, br.length)
+	return err
+}
@@ -0,0 +1,169 @@
+package rmsgo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	. "github.com/cvanloo/rmsgo/mock"
+	"golang.org/x/exp/maps"
+)
+
+// WithUserRoots gives every user their own isolated storage.
+// The first path segment below the remote root names the user root, e.g.,
+// the document "/Pictures/Kitten.avif" of a user whose Root is "alice" is
+// found at "/storage/alice/Pictures/Kitten.avif".
+// Each user root is backed by its own storage tree, whose documents are
+// written to a directory of the same name in the storage root.
+// Authenticated users only have access to their own root, the public
+// documents of other users can still be read.
+// User roots are persisted separately, see PersistRoot and LoadRoot.
+func WithUserRoots() Option {
+	return func(s *Server) {
+		s.userRoots = true
+	}
+}
+
+// handleUserRoot strips the user root from the request's path and makes it
+// available via rootFromContext.
+func (s *Server) handleUserRoot(next http.Handler) http.Handler {
+	if !s.userRoots {
+		return next
+	}
+	return HandlerWithError(func(w http.ResponseWriter, r *http.Request) error {
+		root, path, ok := splitRoot(r.URL.Path)
+		if !ok {
+			return NotFound("no such user root")
+		}
+		nc := context.WithValue(r.Context(), rootKey, root)
+		r = r.WithContext(nc)
+		r.URL.Path = path
+		if r.URL.RawPath != "" {
+			r.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, "/"+root)
+		}
+		next.ServeHTTP(w, r)
+		return nil
+	})
+}
+
+// splitRoot splits "/alice/Pictures/" into "alice" and "/Pictures/".
+func splitRoot(path string) (root, rest string, ok bool) {
+	path = strings.TrimPrefix(path, "/")
+	root, rest, found := strings.Cut(path, "/")
+	if !found || !validRoot(root) {
+		return "", "", false
+	}
+	return root, "/" + rest, true
+}
+
+func validRoot(root string) bool {
+	return root != "" && root != "." && root != ".." && root != blobDir && !strings.ContainsAny(root, `/\`)
+}
+
+// rootFromContext returns the user root a request is made to.
+func rootFromContext(ctx context.Context) (string, bool) {
+	root, ok := ctx.Value(rootKey).(string)
+	return root, ok
+}
+
+// storageFor returns the storage a request operates on.
+// With user roots enabled, the storage of a user root is created when its
+// owner first accesses it.
+// ErrNotExist is returned if the requested user root does not exist.
+func (s *Server) storageFor(r *http.Request) (Storage, error) {
+	if !s.userRoots {
+		return s.storage, nil
+	}
+	root, ok := rootFromContext(r.Context())
+	if !ok {
+		return nil, ErrNotExist
+	}
+	user, isAuthenticated := UserFromContext(r.Context())
+	create := isAuthenticated && userRoot(user) == root
+	t, err := s.userTree(root, create)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// userTree returns the tree of the user root.
+// If create is true, a tree that doesn't exist yet is created.
+func (s *Server) userTree(root string, create bool) (*tree, error) {
+	if !validRoot(root) || s.layout.isShard(root) {
+		return nil, fmt.Errorf("invalid user root: `%s'", root)
+	}
+
+	s.rootsMu.Lock()
+	defer s.rootsMu.Unlock()
+
+	if t, ok := s.roots[root]; ok {
+		return t, nil
+	}
+	if !create {
+		return nil, ErrNotExist
+	}
+
+	sroot := filepath.Join(s.tree.sroot, root)
+	if err := MkdirAll(sroot); err != nil {
+		return nil, err
+	}
+	t := newTree(sroot)
+	s.configureTree(t, root)
+	s.roots[root] = t
+	return t, nil
+}
+
+// rootStorage returns the storage of the user root, or the server's storage
+// if root is empty.
+func (s *Server) rootStorage(root string) (Storage, error) {
+	if root == "" {
+		return s.storage, nil
+	}
+	return s.userTree(root, false)
+}
+
+// Roots lists the names of all user roots known to the server.
+func (s *Server) Roots() []string {
+	s.rootsMu.Lock()
+	defer s.rootsMu.Unlock()
+	roots := maps.Keys(s.roots)
+	sort.Strings(roots)
+	return roots
+}
+
+// PersistRoot serializes the storage tree of the user root to XML, see Persist.
+func (s *Server) PersistRoot(root string, persistFile io.Writer) error {
+	t, err := s.userTree(root, false)
+	if err != nil {
+		return err
+	}
+	t.RLock()
+	bs, err := t.marshal()
+	t.RUnlock()
+	if err != nil {
+		return err
+	}
+	_, err = persistFile.Write(bs)
+	return err
+}
+
+// LoadRoot restores the storage tree of the user root (creating it if
+// necessary) from XML previously written by PersistRoot, see Load.
+func (s *Server) LoadRoot(root string, persistFile io.Reader) error {
+	bs, err := io.ReadAll(persistFile)
+	if err != nil {
+		return err
+	}
+	t, err := s.userTree(root, true)
+	if err != nil {
+		return err
+	}
+	t.Lock()
+	defer t.Unlock()
+	return t.load(bs)
+}
@@ -0,0 +1,259 @@
+package rmsgo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"time"
+
+	"golang.org/x/exp/maps"
+)
+
+type (
+	ScrubKind int
+
+	// ScrubIssue describes a document whose blob is missing or whose
+	// contents no longer match their checksum, see Scrub.
+	ScrubIssue struct {
+		Kind ScrubKind
+
+		// User root of the document, empty for the server's storage.
+		Root  string
+		Rname string
+		Sname string
+
+		// Why the document is considered corrupt.
+		Err error
+	}
+
+	// scrubbing configures the background scrubber, see WithScrubbing.
+	scrubbing struct {
+		interval   time.Duration
+		quarantine bool
+	}
+)
+
+const (
+	// The blob of a document is missing.
+	ScrubMissing ScrubKind = iota
+
+	// The contents of a document can't be read, or don't match the
+	// checksum taken when the document was written.
+	ScrubCorrupt
+)
+
+// ErrCorrupt is returned when a corrupt document is opened, see
+// WithScrubbing.
+var ErrCorrupt = errors.New("document is corrupt")
+
+var errNoScrubbing = errors.New("scrubbing is not enabled")
+
+func (k ScrubKind) String() string {
+	switch k {
+	case ScrubMissing:
+		return "missing blob"
+	case ScrubCorrupt:
+		return "corrupt"
+	}
+	return fmt.Sprintf("ScrubKind(%d)", int(k))
+}
+
+func (i ScrubIssue) String() string {
+	rname := i.Rname
+	if i.Root != "" {
+		rname = i.Root + ":" + rname
+	}
+	return fmt.Sprintf("%s: %s -> %s: %v", i.Kind, rname, i.Sname, i.Err)
+}
+
+// Error allows the issue to be passed to the error handler.
+func (i ScrubIssue) Error() string {
+	return "scrub: " + i.String()
+}
+
+func (i ScrubIssue) Unwrap() error {
+	return i.Err
+}
+
+// WithScrubbing periodically re-reads all documents (see RunScrubber) and
+// compares their contents to the checksum taken when they were written, to
+// detect blobs that have rotted or been tampered with.
+// Newly detected issues are passed to the error handler as ScrubIssue.
+// Documents without a checksum (e.g., added with AddDocument) are trusted
+// the first time, and their checksum is recorded.
+// If quarantine is true, corrupt documents are not served anymore, GET
+// requests for them fail with 500 (Internal Server Error) until they are
+// overwritten, or their blob is repaired and scrubbed again.
+func WithScrubbing(interval time.Duration, quarantine bool) Option {
+	return func(s *Server) {
+		s.scrubbing = &scrubbing{
+			interval:   interval,
+			quarantine: quarantine,
+		}
+	}
+}
+
+// RunScrubber scrubs the storage (see Scrub) every interval configured with
+// WithScrubbing, until ctx is done.
+// Failures are passed to the error handler.
+func (s *Server) RunScrubber(ctx context.Context) error {
+	if s.scrubbing == nil {
+		return errNoScrubbing
+	}
+	ticker := time.NewTicker(s.scrubbing.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if _, err := s.Scrub(); err != nil {
+				s.unhandled(err)
+			}
+		}
+	}
+}
+
+// RunScrubber runs the scrubber of the default server, see
+// (*Server).RunScrubber.
+func RunScrubber(ctx context.Context) error {
+	return g.RunScrubber(ctx)
+}
+
+// Scrub re-reads all documents, including those of user roots, and returns
+// the ones that are missing or corrupt.
+// Issues that weren't known before are also passed to the error handler.
+// Scrub only knows about the built-in storage, storages set with WithStorage
+// are not scrubbed.
+// Requests are served while Scrub is running, blobs are read without
+// holding the storage's lock.
+func (s *Server) Scrub() (issues []ScrubIssue, err error) {
+	trees := map[string]*tree{"": s.tree}
+	s.rootsMu.Lock()
+	for root, t := range s.roots {
+		trees[root] = t
+	}
+	s.rootsMu.Unlock()
+
+	var errs []error
+	roots := maps.Keys(trees)
+	sort.Strings(roots)
+	for _, root := range roots {
+		found, fresh, err := trees[root].scrub(root)
+		issues = append(issues, found...)
+		for _, issue := range fresh {
+			s.unhandled(issue)
+		}
+		errs = append(errs, err)
+	}
+	return issues, errors.Join(errs...)
+}
+
+// Scrub scrubs the default server, see (*Server).Scrub.
+func Scrub() ([]ScrubIssue, error) {
+	return g.Scrub()
+}
+
+// scrub checks all documents of the tree, one at a time.
+// fresh are the issues that weren't known before.
+// The caller must not hold the tree's lock.
+func (t *tree) scrub(root string) (issues, fresh []ScrubIssue, err error) {
+	t.RLock()
+	var rnames []string
+	for rname, n := range t.files {
+		if !n.isFolder {
+			rnames = append(rnames, rname)
+		}
+	}
+	t.RUnlock()
+	sort.Strings(rnames)
+
+	var errs []error
+	for _, rname := range rnames {
+		t.RLock()
+		n, ok := t.files[rname]
+		if !ok || n.isFolder {
+			t.RUnlock()
+			continue // removed in the meantime
+		}
+		// Blobs are never changed once written, so the blob can be read
+		// without holding the lock. If the document is changed or removed
+		// meanwhile, the outcome is discarded by scrubbed.
+		sname, codec, encrypted, length := n.sname, n.codec, n.encrypted, n.length
+		t.RUnlock()
+		sum, checkErr := t.encoding.checksum(sname, codec, encrypted, length)
+
+		t.Lock()
+		issue, known, err := t.scrubbed(n, sname, sum, checkErr)
+		t.Unlock()
+		errs = append(errs, err)
+		if issue == nil {
+			continue
+		}
+		issue.Root = root
+		issues = append(issues, *issue)
+		if !known {
+			fresh = append(fresh, *issue)
+		}
+	}
+	return issues, fresh, errors.Join(errs...)
+}
+
+// checksum reads the original contents of the blob sname (see open), and
+// returns their SHA-256 digest.
+func (c *encodingConfig) checksum(sname, codec string, encrypted bool, length int64) ([]byte, error) {
+	fd, err := c.open(sname, codec, encrypted, length)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	read, err := io.Copy(h, fd)
+	if err != nil {
+		return nil, errors.Join(err, fd.Close())
+	}
+	if read != length {
+		return nil, errors.Join(fmt.Errorf("expected %d bytes, got: %d", length, read), fd.Close())
+	}
+	return h.Sum(nil), fd.Close()
+}
+
+// scrubbed records the outcome of scrubbing the blob sname of n, unless the
+// document has changed in the meantime.
+// known reports whether the issue (if any) was already known.
+// The caller must hold the tree's write lock.
+func (t *tree) scrubbed(n *node, sname string, sum []byte, checkErr error) (issue *ScrubIssue, known bool, err error) {
+	if t.files[n.rname] != n || n.sname != sname {
+		return nil, false, nil // overwritten or removed
+	}
+	switch {
+	case errors.Is(checkErr, fs.ErrNotExist):
+		issue = &ScrubIssue{Kind: ScrubMissing, Err: checkErr}
+	case checkErr != nil:
+		issue = &ScrubIssue{Kind: ScrubCorrupt, Err: checkErr}
+	case n.digest != nil && !bytes.Equal(n.digest, sum):
+		issue = &ScrubIssue{Kind: ScrubCorrupt, Err: errors.New("checksum mismatch")}
+	}
+	if issue != nil {
+		issue.Rname, issue.Sname = n.rname, n.sname
+	}
+
+	known = n.corrupt
+	changed := false
+	if n.digest == nil && issue == nil {
+		n.digest = sum // trust on first scrub
+		changed = true
+	}
+	if n.corrupt != (issue != nil) {
+		n.corrupt = issue != nil
+		changed = true
+	}
+	if changed {
+		err = t.commitNode(journalUpdate, n)
+	}
+	return issue, known, err
+}
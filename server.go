@@ -10,17 +10,23 @@
 //
 // Use the Configure function and the various Options to setup the server.
 //
-//	err := rmsgo.Configure(RemoteRoot, StorageRoot, WithXXX(...), ...)
+//	s, err := rmsgo.Configure(RemoteRoot, StorageRoot, WithXXX(...), ...)
 //	if err != nil {
 //		log.Fatal(err)
 //	}
+//	s.Register(nil)
+//
+// Every Server owns its own storage tree, so multiple independent servers can
+// be hosted within the same process by using New instead of Configure.
 package rmsgo
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"path/filepath"
+	"sync"
 	"time"
 
 	. "github.com/cvanloo/rmsgo/mock"
@@ -31,9 +37,29 @@ type (
 	// You're not supposed to create an Option yourself, but instead use the WithXXX functions.
 	Option func(*Server)
 
-	// Server holds the server configuration.
+	// Server holds the server configuration and storage tree.
 	Server struct {
-		rroot, sroot    string
+		rroot           string
+		tree            *tree   // default storage
+		storage         Storage // storage used by the endpoints
+		userRoots       bool
+		rootsMu         sync.Mutex
+		roots           map[string]*tree
+		retention       versionRetention
+		serveVersions   bool
+		trash           trashRetention
+		journal         journalConfig
+		strategy        ETagStrategy
+		identity        string
+		verifyETags     bool
+		uploads         *uploads
+		compression     *compression
+		blobCompression *blobCompression
+		keys            KeyProvider
+		scrubbing       *scrubbing
+		dedup           bool
+		blobs           *blobStore
+		layout          blobLayout
 		allowAllOrigins bool
 		allowedOrigins  []string
 		allowOrigin     AllowOriginFunc
@@ -41,6 +67,8 @@ type (
 		unhandled       ErrorHandlerFunc
 		defaultUser     User
 		authenticate    AuthenticateFunc
+		oauth           *authServer
+		publicURL       string
 	}
 
 	// @todo: domain name (needed eg., for rfc9457 errors)
@@ -61,15 +89,34 @@ type (
 
 const timeFormat = time.RFC1123
 
-var g *Server
+// g is the default server used by the package level functions.
+// It is replaced by Configure.
+var g = func() *Server {
+	t := newTree("")
+	return &Server{tree: t, storage: t}
+}()
+
+// Configure initializes a remote storage server and installs it as the
+// default server, used by the package level functions (Register, Persist,
+// Load, ...).
+// See New for a description of the arguments.
+func Configure(remoteRoot, storageRoot string, opts ...Option) (*Server, error) {
+	s, err := New(remoteRoot, storageRoot, opts...)
+	if err != nil {
+		return nil, err
+	}
+	g = s
+	return s, nil
+}
 
-// Configure initializes the remote storage server.
+// New initializes a remote storage server.
 // remoteRoot is the URL path below which remote storage is accessible.
 // storageRoot is a folder on the server's file system where remoteStorage
 // documents are written to and read from.
 // It is recommended to properly configure authentication by using the
 // WithAuthentication option.
-func Configure(remoteRoot, storageRoot string, opts ...Option) error {
+// Unlike Configure, New does not touch the default server.
+func New(remoteRoot, storageRoot string, opts ...Option) (*Server, error) {
 	rroot := filepath.Clean(remoteRoot)
 	if rroot == "/" {
 		rroot = ""
@@ -78,43 +125,91 @@ func Configure(remoteRoot, storageRoot string, opts ...Option) error {
 	sroot := filepath.Clean(storageRoot)
 	fi, err := FS.Stat(sroot)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if !fi.IsDir() {
-		return fmt.Errorf("storage root is not a directory: %s", sroot)
+		return nil, fmt.Errorf("storage root is not a directory: %s", sroot)
 	}
 
+	t := newTree(sroot)
 	s := &Server{
 		rroot:           rroot,
-		sroot:           sroot,
+		tree:            t,
+		storage:         t,
+		roots:           map[string]*tree{},
+		blobs:           newBlobStore(sroot),
+		strategy:        ETagMD5,
 		allowAllOrigins: true,
 		allowedOrigins:  []string{},
-		allowOrigin: func(r *http.Request, origin string) bool {
-			for _, o := range g.allowedOrigins {
-				if o == origin {
-					return true
-				}
+	}
+	s.allowOrigin = func(r *http.Request, origin string) bool {
+		for _, o := range s.allowedOrigins {
+			if o == origin {
+				return true
 			}
-			return false
-		},
-		middleware: func(next http.Handler) http.Handler {
-			return next
-		},
-		unhandled: func(err error) {
-			log.Printf("rmsgo: unhandled error: %v\n", err)
-		},
-		defaultUser: UserReadOnly{},
-		authenticate: func(r *http.Request, bearer string) (User, bool) {
-			return g.defaultUser, true
-		},
+		}
+		return false
+	}
+	s.middleware = func(next http.Handler) http.Handler {
+		return next
+	}
+	s.unhandled = func(err error) {
+		log.Printf("rmsgo: unhandled error: %v\n", err)
+	}
+	s.defaultUser = UserReadOnly{}
+	s.authenticate = func(r *http.Request, bearer string) (User, bool) {
+		return s.defaultUser, true
 	}
 
 	for _, opt := range opts {
 		opt(s)
 	}
+	if err := s.layout.validate(); err != nil {
+		return nil, err
+	}
+	if err := s.oauth.validate(); err != nil {
+		return nil, err
+	}
+	if err := validatePublicURL(s.publicURL); err != nil {
+		return nil, err
+	}
+	s.blobs.layout = s.layout
 
-	g = s
-	return nil
+	s.configureTree(t, "")
+	if s.dedup {
+		if err := MkdirAll(s.blobs.dir); err != nil {
+			return nil, err
+		}
+	}
+	if s.uploads != nil {
+		if err := MkdirAll(s.uploads.dir); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// configureTree applies the server's configuration to the (still empty)
+// storage tree t of the user root, or of the server itself if root is empty.
+func (s *Server) configureTree(t *tree, root string) {
+	t.retention = s.retention
+	t.trashRetention = s.trash
+	t.journal = s.journal.newJournal(root)
+	t.etags = &etagConfig{
+		strategy: s.strategy,
+		identity: s.identity,
+	}
+	t.verifyETags = s.verifyETags
+	t.encoding = &encodingConfig{
+		compress: s.blobCompression,
+		keys:     s.keys,
+	}
+	t.quarantine = s.scrubbing != nil && s.scrubbing.quarantine
+	t.shared = s.blobs
+	t.dedup = s.dedup
+	t.layout = s.layout
+	t.unhandled = s.unhandled
+	t.reset()
 }
 
 // WithErrorHandler configures the error handler to use.
@@ -124,6 +219,17 @@ func WithErrorHandler(h ErrorHandlerFunc) Option {
 	}
 }
 
+// WithStorage configures the backend that documents and folders are kept in.
+// Per default, the hierarchy of documents and folders is kept in memory, and
+// their contents are written to the storage root.
+// Note that Persist, Load, Migrate, Reset, AddDocument, UpdateDocument,
+// RemoveDocument, and Retrieve always operate on the default storage.
+func WithStorage(st Storage) Option {
+	return func(s *Server) {
+		s.storage = st
+	}
+}
+
 // WithMiddleware configures middleware (e.g., for logging) in front of the
 // remote storage server.
 // The middleware is responsible for passing the request on to the rms server
@@ -198,7 +304,7 @@ func Options(opts ...Option) Option {
 	}
 }
 
-func handlePanic(next http.Handler) http.Handler {
+func (s *Server) handlePanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if r := recover(); r != nil {
@@ -209,32 +315,62 @@ func handlePanic(next http.Handler) http.Handler {
 				default:
 					err = fmt.Errorf("recovered panic: %v", t)
 				}
-				g.unhandled(err)
+				s.unhandled(err)
 			}
 		}()
 		next.ServeHTTP(w, r)
 	})
 }
 
-func stripRoot(next http.Handler) http.Handler {
-	return http.StripPrefix(g.rroot /* don't strip slash */, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+// withServer makes s available to handlers further down the stack, see
+// serverFromContext.
+func (s *Server) withServer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nc := context.WithValue(r.Context(), serverKey, s)
+		next.ServeHTTP(w, r.WithContext(nc))
+	})
+}
+
+// serverFromContext returns the server handling the request, or the default
+// server if the request did not pass through a server's handler stack.
+func serverFromContext(ctx context.Context) *Server {
+	if s, ok := ctx.Value(serverKey).(*Server); ok {
+		return s
+	}
+	return g
+}
+
+func (s *Server) stripRoot(next http.Handler) http.Handler {
+	return http.StripPrefix(s.rroot /* don't strip slash */, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		next.ServeHTTP(w, r)
 	}))
 }
 
 // Register the remote storage server (with middleware if configured via
-// Options.UseMiddleware) to the mux using g.Rroot() + '/' as pattern.
+// WithMiddleware) to the mux using s.rroot + '/' as pattern.
+// If the server is configured WithOAuth, its authorization server is
+// registered as well.
 // If mux is nil the http.DefaultServeMux is used.
-func Register(mux *http.ServeMux) {
+func (s *Server) Register(mux *http.ServeMux) {
 	if mux == nil {
 		mux = http.DefaultServeMux
 	}
 	stack := MiddlewareStack(
-		handlePanic,
-		g.middleware,
-		stripRoot,
-		handleCORS,
-		handleAuthorization,
+		s.withServer,
+		s.handlePanic,
+		s.middleware,
+		s.stripRoot,
+		s.handleUserRoot,
+		s.handleCORS,
+		s.handleAuthorization,
 	)
-	mux.Handle(g.rroot+"/", stack(RMSRouter()))
+	mux.Handle(s.rroot+"/", stack(s.RMSRouter()))
+	if s.oauth != nil {
+		s.registerOAuth(mux)
+	}
+}
+
+// Register registers the default server, see (*Server).Register.
+func Register(mux *http.ServeMux) {
+	g.Register(mux)
 }
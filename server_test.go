@@ -17,16 +17,16 @@ func ExampleRegister() {
 		storageRoot = "/var/rms/storage/"
 	)
 
-	// [!] TODO: Use a real file
-	persistFile := &bytes.Buffer{}
-
-	// Restore server state at startup
-	err := rmsgo.Load(persistFile)
+	s, err := rmsgo.Configure(remoteRoot, storageRoot)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = rmsgo.Configure(remoteRoot, storageRoot)
+	// [!] TODO: Use a real file
+	persistFile := &bytes.Buffer{}
+
+	// Restore server state at startup
+	err = s.Load(persistFile)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -34,11 +34,11 @@ func ExampleRegister() {
 	mux := http.NewServeMux()
 	// TODO: Other mux.Handle setup
 
-	rmsgo.Register(mux)
+	s.Register(mux)
 	http.ListenAndServe(":8080", mux) // [!] TODO: Use TLS
 
 	// Persist server state at shutdown
-	err = rmsgo.Persist(persistFile)
+	err = s.Persist(persistFile)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -52,16 +52,16 @@ func ExampleRegister_usingDefaultServeMux() {
 		storageRoot = "/var/rms/storage/"
 	)
 
-	// [!] TODO: Use a real file
-	persistFile := &bytes.Buffer{}
-
-	// Restore server state at startup
-	err := rmsgo.Load(persistFile)
+	_, err := rmsgo.Configure(remoteRoot, storageRoot)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = rmsgo.Configure(remoteRoot, storageRoot)
+	// [!] TODO: Use a real file
+	persistFile := &bytes.Buffer{}
+
+	// Restore server state at startup
+	err = rmsgo.Load(persistFile)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -85,7 +85,7 @@ func ExampleOptions() {
 		storageRoot = "/var/rms/storage/"
 	)
 
-	err := rmsgo.Configure(remoteRoot, storageRoot,
+	s, err := rmsgo.Configure(remoteRoot, storageRoot,
 
 		rmsgo.WithErrorHandler(func(err error) {
 			log.Panicf("remote storage: unhandled error: %v", err)
@@ -122,6 +122,24 @@ func ExampleOptions() {
 		log.Fatal(err)
 	}
 
-	rmsgo.Register(nil)
+	s.Register(nil)
 	http.ListenAndServe(":8080", nil) // [!] TODO: Use TLS
 }
+
+// Multiple independent servers, each with their own storage tree, can be
+// hosted in the same process by creating them with New.
+func ExampleNew() {
+	alice, err := rmsgo.New("/alice/", "/var/rms/alice/")
+	if err != nil {
+		log.Fatal(err)
+	}
+	bob, err := rmsgo.New("/bob/", "/var/rms/bob/")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	alice.Register(mux)
+	bob.Register(mux)
+	http.ListenAndServe(":8080", mux) // [!] TODO: Use TLS
+}
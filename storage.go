@@ -1,6 +1,9 @@
 package rmsgo
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/xml"
 	"errors"
 	"fmt"
@@ -10,8 +13,10 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cvanloo/rmsgo/isdelve"
@@ -26,8 +31,6 @@ func init() {
 		Time = time.Now
 		FS = &RealFileSystem{}
 	}
-
-	Reset()
 }
 
 type ConflictError struct {
@@ -39,18 +42,202 @@ func (e ConflictError) Error() string {
 	return fmt.Sprintf("%s: conflicts with already existing path: %s", e.Path, e.ConflictPath)
 }
 
-var ErrNotExist = errors.New("no such document or folder")
-
 var (
+	ErrNotExist      = errors.New("no such document or folder")
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+)
+
+type (
+	// Storage is the backend that documents and folders are kept in.
+	// The remote storage endpoints only ever talk to the server's Storage,
+	// so that alternative backends can be configured using WithStorage.
+	//
+	// The server synchronizes access to the Storage using its lock methods
+	// (see sync.RWMutex): Get, Children, and Open are called with at least
+	// the read lock held, Put, Replace, and Delete with the write lock held.
+	Storage interface {
+		Lock()
+		Unlock()
+		RLock()
+		RUnlock()
+
+		// Get retrieves the document or folder identified by rname.
+		// Returns ErrNotExist if rname can't be found.
+		Get(rname string) (NodeInfo, error)
+
+		// Children lists the documents and folders directly contained in
+		// the folder identified by rname.
+		// Returns ErrNotExist if rname can't be found.
+		Children(rname string) ([]NodeInfo, error)
+
+		// Open opens the contents of the document identified by rname for
+		// reading.
+		// The contents are read after the lock has been released, they
+		// must stay intact even if the document is replaced or deleted
+		// meanwhile.
+		Open(rname string) (io.ReadSeekCloser, error)
+
+		// Put creates a new document rname (along with any missing
+		// ancestors), using the contents read from r.
+		// If the document name conflicts with any other document or folder
+		// an error of type ConflictError is returned.
+		Put(rname string, r io.Reader, mime string) (NodeInfo, error)
+
+		// Replace overwrites the contents and mime type of the existing
+		// document rname.
+		Replace(rname string, r io.Reader, mime string) (NodeInfo, error)
+
+		// Delete removes the document rname.
+		// Ancestors that are left empty are removed as well.
+		Delete(rname string) error
+
+		// Usage reports the combined size of all documents in bytes.
+		// Storages that keep previous versions or deleted documents around
+		// (see VersionedStorage and TrashStorage) include them as well,
+		// since they take up space just the same.
+		Usage() int64
+	}
+
+	// StagingStorage is implemented by Storages that can write the contents
+	// of a document before it is created or replaced, so that the lock
+	// doesn't have to be held for as long as the contents are being
+	// received.
+	// Stage is called without any lock held, PutStaged, ReplaceStaged, and
+	// Discard with the write lock held.
+	StagingStorage interface {
+		Storage
+
+		// Stage writes the contents read from r into a new blob, which must
+		// then be passed to either PutStaged, ReplaceStaged, or Discard.
+		Stage(r io.Reader, mime string) (StagedBlob, error)
+
+		// PutStaged is Put, taking the contents from the staged blob b.
+		// If PutStaged fails, b is discarded.
+		PutStaged(rname string, b StagedBlob) (NodeInfo, error)
+
+		// ReplaceStaged is Replace, taking the contents from the staged blob
+		// b.
+		// If ReplaceStaged fails, b is discarded.
+		ReplaceStaged(rname string, b StagedBlob) (NodeInfo, error)
+
+		// Discard removes the staged blob b.
+		Discard(b StagedBlob) error
+	}
+
+	// StagedBlob holds the contents of a document written by
+	// StagingStorage.Stage.
+	StagedBlob interface {
+		// Length is the length of the contents in bytes.
+		Length() int64
+	}
+
+	// NodeInfo describes a document or folder contained in a Storage.
+	NodeInfo struct {
+		IsFolder bool
+		// "Kittens.png", folder names end in a slash: "Pictures/"
+		Name string
+		// "/Pictures/Kittens.png"
+		Rname string
+		ETag  ETag
+		Mime  string
+		// Length and LastMod are only set for documents.
+		Length  int64
+		LastMod *time.Time
+		// SHA-256 of a document's content, nil if not known.
+		Digest []byte
+	}
+)
+
+// tree is the default Storage.
+// It keeps the hierarchy of documents and folders in memory, while the
+// contents of documents are written to files in the storage root, named by
+// random UUIDs.
+// The tree can be saved and restored using Persist and Load.
+type tree struct {
+	// Guards the entire tree, including all nodes contained therein.
+	sync.RWMutex
+
+	sroot string
+
 	// The files map keeps a reference to each document and folder, allowing
 	// for easy access, using rname as the key.
 	files map[string]*node
 
 	// This root directly references the root folder.
-	// The reference will stay valid for the entire duration of execution once
-	// Reset has been called.
+	// The reference will stay valid for the entire duration of execution
+	// once reset has been called.
 	root *node
-)
+
+	// Combined length of all documents, their previous versions, and the
+	// documents in the trash.
+	// Kept up to date by addDocument, updateDocument, removeDocument,
+	// setVersions, and setTrash.
+	usage int64
+
+	// How many previous versions of documents to keep, see WithVersionHistory.
+	retention versionRetention
+
+	// Deleted documents, oldest first, see WithTrash.
+	trash          []*trashed
+	trashRetention trashRetention
+
+	// Records changes made to the tree, nil if disabled, see WithJournal.
+	journal *journal
+
+	// How etags are derived, see WithETagStrategy and WithServerIdentity.
+	etags *etagConfig
+
+	// Whether Load re-reads the contents of documents, see WithVerifyETags.
+	verifyETags bool
+
+	// How blobs are compressed and encrypted, see WithBlobCompression and
+	// WithEncryption.
+	encoding *encodingConfig
+
+	// Whether corrupt documents are refused to be opened, see
+	// WithScrubbing.
+	quarantine bool
+
+	// Content-addressed blobs, shared with the server's other trees, and
+	// whether new blobs are content-addressed, see WithDeduplication.
+	shared *blobStore
+	dedup  bool
+
+	// Where new blobs are placed, see WithShardedBlobs.
+	layout blobLayout
+
+	// Increased whenever a document is added or updated, see
+	// ETagDocument.Revision.
+	revision uint64
+
+	// Blobs that have been staged, but not yet been added to the tree, see
+	// Stage.
+	// They are written without the tree's lock held, and are therefore
+	// guarded by stagedMu.
+	stagedMu sync.Mutex
+	staged   map[string]bool
+
+	// Passed errors that don't fail the operation that caused them, e.g.,
+	// failing to remove a blob that is no longer referenced, see
+	// WithErrorHandler.
+	unhandled ErrorHandlerFunc
+}
+
+var _ StagingStorage = (*tree)(nil)
+
+func newTree(sroot string) *tree {
+	t := &tree{
+		sroot:    sroot,
+		etags:    &etagConfig{strategy: ETagMD5},
+		encoding: &encodingConfig{},
+		staged:   map[string]bool{},
+		unhandled: func(err error) {
+			log.Printf("rmsgo: unhandled error: %v\n", err)
+		},
+	}
+	t.reset()
+	return t
+}
 
 type node struct {
 	parent   *node
@@ -65,24 +252,60 @@ type node struct {
 	// "/var/rms/storage/(uuid)"
 	sname string
 
+	// Codec the blob is compressed with, empty if it's stored verbatim.
+	codec     string
+	encrypted bool
+
+	// Shared with the tree, see WithBlobCompression and WithEncryption.
+	encoding *encodingConfig
+
+	// Guards etag, etagValid, and hash.
+	// ETags are computed lazily, so that even readers (holding only the
+	// tree's read lock) may have to update them.
+	mu        sync.Mutex
 	etag      ETag
 	etagValid bool
 
+	// Hash of a document's content, nil if not known yet.
+	hash []byte
+
+	// SHA-256 of a document's content, see NodeInfo.Digest.
+	digest []byte
+
+	// Whether the scrubber found the blob to be missing or corrupt, see
+	// WithScrubbing.
+	corrupt bool
+
+	// Shared with the tree, see WithETagStrategy.
+	etags    *etagConfig
+	revision uint64
+
 	mime     string
 	length   int64
 	lastMod  *time.Time // pointer so that it can be nil (folder's don't have a mod time)
 	children map[string]*node
+
+	// Previous versions of a document, oldest first.
+	versions []*version
 }
 
 func (n *node) Valid() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 	return n.etagValid
 }
 
 func (n *node) Invalidate() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 	n.etagValid = false
 }
 
+// Version returns the node's ETag, calculating it first if necessary.
+// The caller must hold at least the tree's read lock.
 func (n *node) Version() (e ETag, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 	if !n.etagValid {
 		err = calculateETag(n)
 	}
@@ -98,17 +321,33 @@ func (n *node) Equal(other *node) bool {
 }
 
 // Reset (re-) initializes the storage tree, so that it only contains a root folder.
-func Reset() {
+func (s *Server) Reset() {
+	s.tree.Lock()
+	defer s.tree.Unlock()
+	s.tree.reset()
+}
+
+func (t *tree) reset() {
+	t.shared.count(t.snames(), -1)
 	rn := &node{
 		isFolder: true,
 		name:     "/",
 		rname:    "/",
 		mime:     "inode/directory",
 		children: map[string]*node{},
+		etags:    t.etags,
 	}
-	files = make(map[string]*node)
-	files["/"] = rn
-	root = rn
+	t.files = make(map[string]*node)
+	t.files["/"] = rn
+	t.root = rn
+	t.usage = 0
+	t.trash = nil
+	t.revision = 0
+}
+
+// Reset resets the storage tree of the default server, see (*Server).Reset.
+func Reset() {
+	g.Reset()
 }
 
 type NodeDTO struct {
@@ -120,29 +359,69 @@ type NodeDTO struct {
 	Mime        string
 	Length      int64      `xml:"Length,omitempty"`
 	LastMod     *time.Time `xml:"LastMod,omitempty"`
+	Hash        string     `xml:"Hash,omitempty"`
+	Revision    uint64     `xml:"Revision,omitempty"`
+	Compression string     `xml:"Compression,omitempty"`
+	Encrypted   bool       `xml:"Encrypted,omitempty"`
+	Digest      string     `xml:"Digest,omitempty"`
+	Corrupt     bool       `xml:"Corrupt,omitempty"`
 	ParentRName string
+	Versions    []*VersionDTO `xml:"Version,omitempty"`
 }
 
 // Persist serializes the storage tree to XML.
 // The generated XML is written to persistFile.
-func Persist(persistFile io.Writer) (err error) {
+// Persist may be called while requests are being served, the written tree
+// is a consistent snapshot.
+func (s *Server) Persist(persistFile io.Writer) (err error) {
+	s.tree.RLock()
+	bs, err := s.tree.marshal()
+	s.tree.RUnlock()
+	if err != nil {
+		return err
+	}
+	_, err = persistFile.Write(bs)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (n *node) dto() (*NodeDTO, error) {
+	etag, err := n.Version()
+	if err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	hash := hex.EncodeToString(n.hash)
+	n.mu.Unlock()
+	return &NodeDTO{
+		IsFolder:    n.isFolder,
+		Name:        n.name,
+		Rname:       n.rname,
+		Sname:       n.sname,
+		ETag:        etag.String(),
+		Mime:        n.mime,
+		Length:      n.length,
+		LastMod:     n.lastMod,
+		Hash:        hash,
+		Revision:    n.revision,
+		Compression: n.codec,
+		Encrypted:   n.encrypted,
+		Digest:      hex.EncodeToString(n.digest),
+		Corrupt:     n.corrupt,
+		ParentRName: n.parent.rname,
+		Versions:    versionDTOs(n.versions),
+	}, nil
+}
+
+func (t *tree) marshal() (bs []byte, err error) {
 	fileDTOs := []*NodeDTO{}
-	for _, n := range files {
-		if n != root {
-			etag, err := n.Version()
+	for _, n := range t.files {
+		if n != t.root {
+			dto, err := n.dto()
 			if err != nil {
-				return err
-			}
-			dto := &NodeDTO{
-				IsFolder:    n.isFolder,
-				Name:        n.name,
-				Rname:       n.rname,
-				Sname:       n.sname,
-				ETag:        etag.String(),
-				Mime:        n.mime,
-				Length:      n.length,
-				LastMod:     n.lastMod,
-				ParentRName: n.parent.rname,
+				return nil, err
 			}
 			fileDTOs = append(fileDTOs, dto)
 		}
@@ -156,47 +435,88 @@ func Persist(persistFile io.Writer) (err error) {
 		return fileDTOs[i].Rname < fileDTOs[j].Rname
 	})
 
+	etag, err := t.root.Version()
+	if err != nil {
+		return nil, err
+	}
+
 	type Root struct {
-		Nodes []*NodeDTO
+		ETags string `xml:"ETags,attr"`
+		ETag  string `xml:"ETag,attr"`
+		// The revision counter may be ahead of all remaining documents,
+		// if the latest ones have been removed.
+		Revision uint64 `xml:"Revision,attr,omitempty"`
+		Nodes    []*NodeDTO
+		Trash    []*TrashDTO `xml:"Trash,omitempty"`
 	}
-	persist := Root{fileDTOs}
+	persist := Root{t.etags.strategy.Name(), etag.String(), t.revision, fileDTOs, trashDTOs(t.trash)}
 
-	var bs []byte
 	if isdelve.Enabled {
-		bs, err = xml.MarshalIndent(persist, "", "\t")
-	} else {
-		bs, err = xml.Marshal(persist)
-	}
-	if err != nil {
-		return err
-	}
-	_, err = persistFile.Write(bs)
-	if err != nil {
-		return err
+		return xml.MarshalIndent(persist, "", "\t")
 	}
-	return nil
+	return xml.Marshal(persist)
+}
+
+// Persist persists the storage tree of the default server, see (*Server).Persist.
+func Persist(persistFile io.Writer) error {
+	return g.Persist(persistFile)
 }
 
 // Load deserializes XML data from persistFile and adds the documents and
 // folders to the storage tree.
+// The ETags stored in persistFile are reused as they are (unless the ETag
+// strategy has changed), so that unchanged documents and folders keep their
+// ETags across restarts, see also WithVerifyETags.
+// Documents in the trash and previous versions that have expired in the
+// meantime are removed, see Expire.
 // If storage has not been initialized before, Reset must be invoked before
 // calling Load.
-func Load(persistFile io.Reader) error {
-	if root == nil {
-		return fmt.Errorf("storage root not initialized, try calling Reset() before Load()")
-	}
-
+func (s *Server) Load(persistFile io.Reader) error {
 	bs, err := io.ReadAll(persistFile)
 	if err != nil {
 		return err
 	}
 
+	s.tree.Lock()
+	defer s.tree.Unlock()
+	return s.tree.load(bs)
+}
+
+func (t *tree) load(bs []byte) error {
+	if t.root == nil {
+		return fmt.Errorf("storage root not initialized, try calling Reset() before Load()")
+	}
+	// The references of the restored documents to content-addressed blobs
+	// are counted from scratch.
+	t.shared.count(t.snames(), -1)
+	defer func() { t.shared.count(t.snames(), 1) }()
+
 	var persist struct {
-		Nodes []*NodeDTO
+		ETags    string `xml:"ETags,attr"`
+		ETag     string `xml:"ETag,attr"`
+		Revision uint64 `xml:"Revision,attr"`
+		Nodes    []*NodeDTO
+		Trash    []*TrashDTO
 	}
-	err = xml.Unmarshal(bs, &persist)
-	if err != nil {
-		return err
+	// Without a snapshot, the entire tree is restored from the journal.
+	if t.journal == nil || len(bytes.TrimSpace(bs)) > 0 {
+		err := xml.Unmarshal(bs, &persist)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The persisted etags are trusted, so that they stay the same even if
+	// the server's identity has changed in the meantime.
+	// They can only be reused if they were produced by the same strategy.
+	same := t.sameStrategy(persist.ETags)
+	// The root's etag only holds if nothing else is in the tree yet.
+	if etag, err := ParseETag(persist.ETag); err == nil && same && len(t.files) == 1 {
+		t.root.etag = etag
+		t.root.etagValid = true
+	}
+	if persist.Revision > t.revision {
+		t.revision = persist.Revision
 	}
 
 	for _, n := range persist.Nodes {
@@ -209,30 +529,91 @@ func Load(persistFile io.Reader) error {
 		model.name = n.Name
 		model.rname = n.Rname
 		model.sname = n.Sname
+		model.codec = n.Compression
+		model.encrypted = n.Encrypted
+		model.corrupt = n.Corrupt
+		model.digest, err = parseHash(n.Digest)
+		if err != nil {
+			return err
+		}
+		model.encoding = t.encoding
 		model.etag = etag
+		model.etagValid = same
 		model.mime = n.Mime
 		model.length = n.Length
 		model.lastMod = n.LastMod
+		model.revision = n.Revision
+		if model.revision > t.revision {
+			t.revision = model.revision
+		}
+		if same {
+			model.hash, err = parseHash(n.Hash)
+			if err != nil {
+				return err
+			}
+		}
 		model.children = make(map[string]*node)
+		model.versions, err = versionsFromDTOs(n.Versions)
+		if err != nil {
+			return err
+		}
 
 		// N.b., this assumes that parents are always parsed before their
 		// children! [#parent_first]
-		p, ok := files[n.ParentRName]
+		p, ok := t.files[n.ParentRName]
 		if !ok {
 			return fmt.Errorf("node %s is missing its parent (%s), maybe it hasn't been parsed yet?", model.rname, n.ParentRName)
 		}
 		model.parent = p
+		model.etags = p.etags
 		p.children[model.rname] = model
-		files[model.rname] = model
+		t.files[model.rname] = model
+		t.usage += model.length + versionsLength(model.versions)
+	}
+
+	trash, err := trashFromDTOs(persist.Trash)
+	if err != nil {
+		return err
 	}
+	t.setTrash(slices.Concat(t.trash, trash))
 
-	log.Printf("Storage listing follows:\n%s\n", root)
+	err = t.replay()
+	if err != nil {
+		return err
+	}
+
+	// Documents and versions may have expired while the server was down.
+	if err := t.expire(); err != nil {
+		t.unhandled(err)
+	}
+
+	if t.verifyETags {
+		t.verify()
+	}
+
+	log.Printf("Storage listing follows:\n%s\n", t.root)
 	return nil
 }
 
+// sameStrategy reports whether content hashes persisted by the strategy name
+// can be reused.
+// Persist files written before strategies were configurable don't record
+// one, they always used MD5.
+func (t *tree) sameStrategy(name string) bool {
+	if name == "" {
+		name = ETagMD5.Name()
+	}
+	return name == t.etags.strategy.Name()
+}
+
+// Load restores the storage tree of the default server, see (*Server).Load.
+func Load(persistFile io.Reader) error {
+	return g.Load(persistFile)
+}
+
 // Migrate traverses the root directory and copies any files contained therein
-// into the remoteStorage root (g.Sroot).
-func Migrate(root string) (errs []error) {
+// into the storage root.
+func (s *Server) Migrate(root string) (errs []error) {
 	err := FS.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
@@ -254,30 +635,13 @@ func Migrate(root string) (errs []error) {
 			}
 		}()
 
-		u, err := UUID()
-		if err != nil {
-			errs = append(errs, err)
-			return nil
-		}
-		sname := filepath.Join(g.sroot, u.String())
-
-		rmsFD, err := FS.Create(sname)
-		if err != nil {
-			errs = append(errs, err)
-			return nil
-		}
-		defer func() {
-			err := rmsFD.Close()
-			if err != nil {
-				errs = append(errs, err)
-			}
-		}()
-
-		fsize, err := io.Copy(rmsFD, fd)
+		bs := make([]byte, 512)
+		_, err = fd.Read(bs)
 		if err != nil {
 			errs = append(errs, err)
 			return nil
 		}
+		mime := http.DetectContentType(bs)
 
 		_, err = fd.Seek(0, io.SeekStart)
 		if err != nil {
@@ -285,16 +649,12 @@ func Migrate(root string) (errs []error) {
 			return nil
 		}
 
-		bs := make([]byte, 512)
-		_, err = fd.Read(bs)
-		if err != nil {
-			errs = append(errs, err)
-			return nil
-		}
-		mime := http.DetectContentType(bs)
-
+		// The blob is written like any other document's, so that it's
+		// compressed if need be (see WithBlobCompression).
 		rname := strings.TrimPrefix(path, root[:len(root)-1])
-		_, err = AddDocument(rname, sname, fsize, mime)
+		s.tree.Lock()
+		_, err = s.tree.Put(rname, fd, mime)
+		s.tree.Unlock()
 		if err != nil {
 			errs = append(errs, err)
 			return nil
@@ -307,11 +667,28 @@ func Migrate(root string) (errs []error) {
 	return errs
 }
 
+// Migrate migrates files into the default server, see (*Server).Migrate.
+func Migrate(root string) (errs []error) {
+	return g.Migrate(root)
+}
+
 // AddDocument adds a new document to the storage tree and returns a reference to it.
 // ETags of ancestors are invalidated.
 // If the document name conflicts with any other document or folder an error of
 // type ConflictPath is returned and the *node is set to nil.
-func AddDocument(rname, sname string, fsize int64, mime string) (*node, error) {
+func (s *Server) AddDocument(rname, sname string, fsize int64, mime string) (*node, error) {
+	s.tree.Lock()
+	defer s.tree.Unlock()
+	n, err := s.tree.addDocument(rname, sname, fsize, mime)
+	if err != nil {
+		return nil, err
+	}
+	return n, s.tree.commitNode(journalAdd, n)
+}
+
+// addDocument is AddDocument without locking, the caller must hold the tree's
+// write lock.
+func (t *tree) addDocument(rname, sname string, fsize int64, mime string) (*node, error) {
 	rname = filepath.Clean(rname)
 
 	{
@@ -320,7 +697,7 @@ func AddDocument(rname, sname string, fsize int64, mime string) (*node, error) {
 		//assert(!ok, "AddDocument must only be used to create files that don't exist yet")
 	}
 
-	if _, ok := files[rname]; ok {
+	if _, ok := t.files[rname]; ok {
 		return nil, ConflictError{
 			Path:         rname,
 			ConflictPath: rname,
@@ -330,12 +707,12 @@ func AddDocument(rname, sname string, fsize int64, mime string) (*node, error) {
 	var (
 		pname = filepath.Dir(rname)
 		parts = strings.Split(pname, string(os.PathSeparator))[1:] // exclude empty ""
-		p     = root
+		p     = t.root
 	)
 
 	for i := range parts { // traverse through the hierarchy, starting at the top most ancestor (excluding root)
 		pname := "/" + strings.Join(parts[:i+1], string(os.PathSeparator))
-		pn, ok := files[pname]
+		pn, ok := t.files[pname]
 		if ok { // a document name clashes with one of the ancestor folders
 			if !pn.isFolder {
 				return nil, ConflictError{
@@ -351,9 +728,10 @@ func AddDocument(rname, sname string, fsize int64, mime string) (*node, error) {
 				rname:    pname,
 				mime:     "inode/directory",
 				children: map[string]*node{},
+				etags:    t.etags,
 			}
 			p.children[pname] = pn
-			files[pname] = pn
+			t.files[pname] = pn
 		}
 		p = pn
 	}
@@ -361,6 +739,7 @@ func AddDocument(rname, sname string, fsize int64, mime string) (*node, error) {
 
 	name := filepath.Base(rname)
 	tnow := Time()
+	t.revision++
 
 	f := &node{
 		parent:   p, // [#1] assign parent
@@ -371,9 +750,13 @@ func AddDocument(rname, sname string, fsize int64, mime string) (*node, error) {
 		mime:     mime,
 		length:   fsize,
 		lastMod:  &tnow,
+		etags:    t.etags,
+		encoding: t.encoding,
+		revision: t.revision,
 	}
 	p.children[rname] = f
-	files[rname] = f
+	t.files[rname] = f
+	t.usage += fsize
 
 	n := f
 	for n != nil {
@@ -384,15 +767,39 @@ func AddDocument(rname, sname string, fsize int64, mime string) (*node, error) {
 	return f, nil
 }
 
+// AddDocument adds a document to the default server, see (*Server).AddDocument.
+func AddDocument(rname, sname string, fsize int64, mime string) (*node, error) {
+	return g.AddDocument(rname, sname, fsize, mime)
+}
+
 // UpdateDocument updates an existing document in the storage tree with new
 // information and invalidates etags of the document and its ancestors.
-func UpdateDocument(n *node, mime string, fsize int64) {
+// Failing to record the change in the journal (see WithJournal) is reported
+// to the error handler.
+func (s *Server) UpdateDocument(n *node, mime string, fsize int64) {
+	s.tree.Lock()
+	defer s.tree.Unlock()
+	s.tree.updateDocument(n, mime, fsize)
+	if err := s.tree.commitNode(journalUpdate, n); err != nil {
+		s.unhandled(err)
+	}
+}
+
+// updateDocument is UpdateDocument without locking, the caller must hold the
+// tree's write lock.
+func (t *tree) updateDocument(n *node, mime string, fsize int64) {
 	assert(!n.isFolder, "UpdateDocument must not be called on a folder")
 
 	tnow := Time()
+	t.usage += fsize - n.length
 	n.mime = mime
 	n.length = int64(fsize)
 	n.lastMod = &tnow
+	n.hash = nil // the content may have changed
+	n.digest = nil
+	n.corrupt = false
+	t.revision++
+	n.revision = t.revision
 
 	c := n
 	for c != nil {
@@ -401,16 +808,41 @@ func UpdateDocument(n *node, mime string, fsize int64) {
 	}
 }
 
+// UpdateDocument updates a document of the default server, see (*Server).UpdateDocument.
+func UpdateDocument(n *node, mime string, fsize int64) {
+	g.UpdateDocument(n, mime, fsize)
+}
+
 // RemoveDocument deletes a document from the storage tree and invalidates the
 // etags of its ancestors.
-func RemoveDocument(n *node) {
+// The document's blob is left in place, unless it's content-addressed (see
+// WithDeduplication) and no longer referenced.
+// Failing to record the change in the journal (see WithJournal) is reported
+// to the error handler.
+func (s *Server) RemoveDocument(n *node) {
+	s.tree.Lock()
+	defer s.tree.Unlock()
+	s.tree.removeDocument(n)
+	if err := s.tree.commit(removeEntry(n)); err != nil {
+		s.unhandled(err)
+	}
+	if err := s.tree.releaseBlobs(n); err != nil {
+		s.unhandled(err)
+	}
+}
+
+// removeDocument is RemoveDocument without locking, the caller must hold the
+// tree's write lock.
+func (t *tree) removeDocument(n *node) {
 	assert(!n.isFolder, "RemoveDocument must not be called on a folder")
 
+	t.usage -= n.length + versionsLength(n.versions) // the versions are removed along with it
+
 	p := n // works because a document's children is nil and len(nil-map) is zero
-	for len(p.children) == 0 && p != root {
+	for len(p.children) == 0 && p != t.root {
 		pp := p.parent
 		delete(pp.children, p.rname)
-		delete(files, p.rname)
+		delete(t.files, p.rname)
 		p = pp
 	}
 	// p now points to the parent deepest down the ancestry that is not empty
@@ -421,22 +853,449 @@ func RemoveDocument(n *node) {
 	}
 }
 
+// RemoveDocument removes a document from the default server, see (*Server).RemoveDocument.
+func RemoveDocument(n *node) {
+	g.RemoveDocument(n)
+}
+
 // Retrieve a document or folder identified by rname.
 // Returns ErrNotExist if rname can't be found.
-func Retrieve(rname string) (*node, error) {
+func (s *Server) Retrieve(rname string) (*node, error) {
+	s.tree.RLock()
+	defer s.tree.RUnlock()
+	return s.tree.retrieve(rname)
+}
+
+// retrieve is Retrieve without locking, the caller must hold at least the
+// tree's read lock.
+func (t *tree) retrieve(rname string) (*node, error) {
 	rname = filepath.Clean(rname)
-	f, ok := files[rname]
+	f, ok := t.files[rname]
 	if !ok {
 		return nil, ErrNotExist
 	}
 	return f, nil
 }
 
-func (n node) String() string {
+// Retrieve retrieves a document or folder from the default server, see (*Server).Retrieve.
+func Retrieve(rname string) (*node, error) {
+	return g.Retrieve(rname)
+}
+
+func (n *node) info() (NodeInfo, error) {
+	etag, err := n.Version()
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	return NodeInfo{
+		IsFolder: n.isFolder,
+		Name:     n.name,
+		Rname:    n.rname,
+		ETag:     etag,
+		Mime:     n.mime,
+		Length:   n.length,
+		LastMod:  n.lastMod,
+		Digest:   n.digest,
+	}, nil
+}
+
+func (t *tree) Get(rname string) (NodeInfo, error) {
+	n, err := t.retrieve(rname)
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	return n.info()
+}
+
+func (t *tree) Children(rname string) ([]NodeInfo, error) {
+	n, err := t.retrieve(rname)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]NodeInfo, 0, len(n.children))
+	for _, c := range n.children {
+		info, err := c.info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (t *tree) Open(rname string) (io.ReadSeekCloser, error) {
+	n, err := t.retrieve(rname)
+	if err != nil {
+		return nil, err
+	}
+	if n.corrupt && t.quarantine {
+		return nil, ErrCorrupt
+	}
+	return n.open()
+}
+
+// open opens the document's blob for reading.
+func (n *node) open() (io.ReadSeekCloser, error) {
+	return n.encoding.open(n.sname, n.codec, n.encrypted, n.length)
+}
+
+func (t *tree) Put(rname string, r io.Reader, mime string) (NodeInfo, error) {
+	b, err := t.newBlob(r, mime)
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	return t.putBlob(rname, b)
+}
+
+// putBlob adds the document rname with the already written blob b.
+// If the document can't be added, b is removed.
+func (t *tree) putBlob(rname string, b blob) (NodeInfo, error) {
+	n, err := t.addDocument(rname, b.sname, b.length, b.mime)
+	if err != nil {
+		return NodeInfo{}, errors.Join(err, t.removeBlob(b.sname))
+	}
+	n.codec, n.encrypted = b.codec, b.encrypted
+	n.hash, n.digest = b.hash, b.digest
+	if err := t.commitNode(journalAdd, n); err != nil {
+		t.removeDocument(n)
+		return NodeInfo{}, errors.Join(err, t.removeBlob(b.sname))
+	}
+	return n.info()
+}
+
+// Replace writes the new contents into a new blob, the document is only
+// updated once all of r has been written successfully.
+// Until then, the old version remains intact.
+func (t *tree) Replace(rname string, r io.Reader, mime string) (NodeInfo, error) {
+	if _, err := t.retrieve(rname); err != nil {
+		return NodeInfo{}, err
+	}
+	b, err := t.newBlob(r, mime)
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	return t.replaceBlob(rname, b)
+}
+
+// replaceBlob makes the already written blob b the contents of the
+// document rname.
+// If the document can't be updated, it is left as it was and b is removed.
+func (t *tree) replaceBlob(rname string, b blob) (NodeInfo, error) {
+	n, err := t.retrieve(rname)
+	if err != nil {
+		return NodeInfo{}, errors.Join(err, t.removeBlob(b.sname))
+	}
+
+	prev := n.snapshot()
+	var unused []string
+	if t.retention.enabled {
+		unused, err = t.replaceKeepVersion(n, b)
+		if err != nil {
+			return NodeInfo{}, errors.Join(err, t.removeBlob(b.sname))
+		}
+	} else {
+		unused = []string{n.sname}
+		n.sname = b.sname
+		n.codec, n.encrypted = b.codec, b.encrypted
+		t.updateDocument(n, b.mime, b.length)
+		n.digest = b.digest
+	}
+	n.hash = b.hash
+	if err := t.commitNode(journalUpdate, n); err != nil {
+		t.rollback(n, prev)
+		return NodeInfo{}, errors.Join(err, t.removeBlob(b.sname))
+	}
+
+	// The document has been replaced successfully at this point, failing
+	// to remove the old blobs only leaves behind unreferenced files.
+	t.removeBlobs(unused)
+	return n.info()
+}
+
+// Stage writes the contents read from r into a new blob, see
+// StagingStorage.
+// Only the tree's configuration is used, which doesn't change once the
+// tree has been set up, so no lock needs to be held.
+func (t *tree) Stage(r io.Reader, mime string) (StagedBlob, error) {
+	b, err := t.newBlob(r, mime)
+	if err != nil {
+		return nil, err
+	}
+	t.stagedMu.Lock()
+	t.staged[b.sname] = true
+	t.stagedMu.Unlock()
+	return &b, nil
+}
+
+func (t *tree) PutStaged(rname string, sb StagedBlob) (NodeInfo, error) {
+	b, err := t.unstage(sb)
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	return t.putBlob(rname, b)
+}
+
+func (t *tree) ReplaceStaged(rname string, sb StagedBlob) (NodeInfo, error) {
+	b, err := t.unstage(sb)
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	return t.replaceBlob(rname, b)
+}
+
+func (t *tree) Discard(sb StagedBlob) error {
+	b, err := t.unstage(sb)
+	if err != nil {
+		return err
+	}
+	return t.removeBlob(b.sname)
+}
+
+// unstage hands over the staged blob sb to the caller.
+func (t *tree) unstage(sb StagedBlob) (blob, error) {
+	b, ok := sb.(*blob)
+	t.stagedMu.Lock()
+	defer t.stagedMu.Unlock()
+	if !ok || !t.staged[b.sname] {
+		return blob{}, errors.New("blob has not been staged by this storage")
+	}
+	delete(t.staged, b.sname)
+	return *b, nil
+}
+
+// isStaged reports whether the blob sname has been staged, but not yet
+// added to the tree.
+func (t *tree) isStaged(sname string) bool {
+	t.stagedMu.Lock()
+	defer t.stagedMu.Unlock()
+	return t.staged[sname]
+}
+
+func (t *tree) Delete(rname string) error {
+	n, err := t.retrieve(rname)
+	if err != nil {
+		return err
+	}
+	if t.trashRetention.enabled {
+		return t.moveToTrash(n)
+	}
+	if err := t.commit(removeEntry(n)); err != nil {
+		return err
+	}
+	t.removeDocument(n)
+	errs := []error{t.removeBlob(n.sname)}
+	for _, v := range n.versions {
+		errs = append(errs, t.removeBlob(v.sname))
+	}
+	return errors.Join(errs...)
+}
+
+// nodeState is the state of a document before it was changed, see
+// snapshot and rollback.
+type nodeState struct {
+	sname     string
+	codec     string
+	encrypted bool
+	hash      []byte
+	digest    []byte
+	corrupt   bool
+	revision  uint64
+	mime      string
+	length    int64
+	lastMod   *time.Time
+	versions  []*version
+}
+
+// snapshot records the state of the document n, so that a change can be
+// rolled back if it can't be committed to the journal.
+func (n *node) snapshot() nodeState {
+	n.mu.Lock()
+	hash := n.hash
+	n.mu.Unlock()
+	return nodeState{
+		sname:     n.sname,
+		codec:     n.codec,
+		encrypted: n.encrypted,
+		hash:      hash,
+		digest:    n.digest,
+		corrupt:   n.corrupt,
+		revision:  n.revision,
+		mime:      n.mime,
+		length:    n.length,
+		lastMod:   n.lastMod,
+		versions:  slices.Clone(n.versions),
+	}
+}
+
+// rollback restores the document n to the state st and invalidates the
+// etags of it and its ancestors.
+// The caller must hold the tree's write lock.
+func (t *tree) rollback(n *node, st nodeState) {
+	t.usage += st.length - n.length
+	t.setVersions(n, st.versions)
+	n.sname = st.sname
+	n.codec, n.encrypted = st.codec, st.encrypted
+	n.mu.Lock()
+	n.hash = st.hash
+	n.mu.Unlock()
+	n.digest = st.digest
+	n.corrupt = st.corrupt
+	n.revision = st.revision
+	n.mime = st.mime
+	n.length = st.length
+	n.lastMod = st.lastMod
+	for c := n; c != nil; c = c.parent {
+		c.Invalidate()
+	}
+}
+
+// removeBlobs removes blobs that are no longer referenced by the tree.
+// The change that made them unreferenced has already been committed, so
+// failing to remove them doesn't fail the change, but is reported to the
+// error handler.
+func (t *tree) removeBlobs(snames []string) {
+	for _, sname := range snames {
+		if err := t.removeBlob(sname); err != nil {
+			t.unhandled(err)
+		}
+	}
+}
+
+// commitNode records the addition or update of the document n in the
+// journal.
+func (t *tree) commitNode(op string, n *node) error {
+	if t.journal == nil {
+		return nil
+	}
+	e, err := nodeEntry(op, n)
+	if err != nil {
+		return err
+	}
+	return t.commit(e)
+}
+
+func (t *tree) Usage() int64 {
+	return t.usage
+}
+
+// blob is a newly written blob, see newBlob.
+type blob struct {
+	sname     string
+	mime      string
+	length    int64 // of the original contents
+	hash      []byte
+	digest    []byte // SHA-256, see NodeInfo.Digest
+	codec     string
+	encrypted bool
+}
+
+// newBlob writes the contents read from r into a new blob in the storage
+// root, compressing them if documents of the mime type are to be compressed
+// at rest (see WithBlobCompression), and encrypting them if enabled (see
+// WithEncryption).
+// The contents are hashed while being written (if the etag strategy needs
+// it), so that the document's etag can be calculated without reading it back
+// from disk, and their digest is taken.
+// If writing fails, the blob is removed again.
+func (t *tree) newBlob(r io.Reader, mime string) (b blob, err error) {
+	if t.dedup {
+		b.sname, err = t.shared.tmpName()
+	} else {
+		b.sname, err = t.newSname()
+	}
+	if err != nil {
+		return b, err
+	}
+
+	codec := t.encoding.compress.codecFor(mime)
+	keys := t.encoding.keys
+	d := sha256.New()
+	h := t.etags.strategy.ContentHash()
+	if h == nil {
+		b.length, err = writeBlob(b.sname, io.TeeReader(r, d), codec, keys)
+	} else {
+		b.length, err = writeBlob(b.sname, io.TeeReader(r, io.MultiWriter(h, d)), codec, keys)
+	}
+	if err != nil {
+		return blob{}, errors.Join(err, FS.Remove(b.sname))
+	}
+	if h != nil {
+		b.hash = h.Sum(nil)
+	}
+	b.digest = d.Sum(nil)
+	b.mime = mime
+	b.codec = codecName(codec)
+	b.encrypted = keys != nil
+	if t.dedup {
+		b.sname, err = t.shared.add(b, t.encoding)
+		if err != nil {
+			return blob{}, err
+		}
+	}
+	return b, nil
+}
+
+func (b *blob) Length() int64 {
+	return b.length
+}
+
+// newSname returns the name of a new (not content-addressed) blob.
+func (t *tree) newSname() (string, error) {
+	u, err := UUID()
+	if err != nil {
+		return "", err
+	}
+	return t.layout.create(t.sroot, u.String())
+}
+
+// writeBlob (over-) writes the file sname with the contents read from r,
+// compressed with codec and encrypted with a new data key wrapped by keys,
+// unless they are nil.
+// fsize is the number of bytes read from r.
+// The contents are flushed to stable storage before writeBlob returns.
+func writeBlob(sname string, r io.Reader, codec BlobCodec, keys KeyProvider) (fsize int64, err error) {
+	fd, err := FS.Create(sname)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		w       io.Writer = fd
+		closers []io.Closer
+	)
+	if keys != nil {
+		ew, err := newEncryptWriter(w, keys)
+		if err != nil {
+			return 0, errors.Join(err, fd.Close())
+		}
+		w = ew
+		closers = append(closers, ew)
+	}
+	if codec != nil {
+		cw := codec.NewWriter(w)
+		w = cw
+		closers = append(closers, cw)
+	}
+	fsize, err = io.Copy(w, r)
+	for i := len(closers) - 1; i >= 0; i-- { // innermost first
+		err = errors.Join(err, closers[i].Close())
+	}
+	if err != nil {
+		return fsize, errors.Join(err, fd.Close())
+	}
+	// The FileSystem interface doesn't require Sync, but *os.File has it.
+	if syncer, ok := fd.(interface{ Sync() error }); ok {
+		if err := syncer.Sync(); err != nil {
+			return fsize, errors.Join(err, fd.Close())
+		}
+	}
+	return fsize, fd.Close()
+}
+
+func (n *node) String() string {
 	return n.stringIndent(0)
 }
 
-func (n node) stringIndent(ident int) (s string) {
+func (n *node) stringIndent(ident int) (s string) {
 	for i := 0; i < ident; i++ {
 		s += "  "
 	}
@@ -2,17 +2,24 @@ package rmsgo
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net/http"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	. "github.com/cvanloo/rmsgo/mock"
 	"golang.org/x/exp/maps"
 )
 
 var genpath = func() string {
-	return filepath.Join(g.sroot, mustVal(UUID()).String())
+	return filepath.Join(g.tree.sroot, mustVal(UUID()).String())
 }
 
 func TestAddDocument(t *testing.T) {
@@ -76,7 +83,7 @@ func TestAddDocument(t *testing.T) {
 		},
 	}
 
-	p := root
+	p := g.tree.root
 	for _, c := range checks {
 		n, err := Retrieve(c.rname)
 		if err != nil {
@@ -126,13 +133,13 @@ func TestAddDocumentMultipleInSameFolder(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	if codeFolder.parent != root {
-		t.Errorf("got: `%s', want: `%s'", codeFolder.parent.rname, root.rname)
+	if codeFolder.parent != g.tree.root {
+		t.Errorf("got: `%s', want: `%s'", codeFolder.parent.rname, g.tree.root.rname)
 	}
-	if l := len(root.children); l != 1 {
+	if l := len(g.tree.root.children); l != 1 {
 		t.Errorf("got: `%d', want: 1", l)
 	}
-	if fc := maps.Values(root.children)[0]; fc != codeFolder {
+	if fc := maps.Values(g.tree.root.children)[0]; fc != codeFolder {
 		t.Errorf("got: `%s', want: `%s'", fc, codeFolder)
 	}
 	if l := len(codeFolder.children); l != 2 {
@@ -552,7 +559,7 @@ func TestAddDocumentDoesNotUpdateETagOfOtherFolders(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	rv1, err := root.Version()
+	rv1, err := g.tree.root.Version()
 	if err != nil {
 		t.Error(err)
 	}
@@ -606,10 +613,10 @@ func TestAddDocumentDoesNotUpdateETagOfOtherFolders(t *testing.T) {
 		t.Error("parent etag has changed")
 	}
 	// root folder should change
-	if root.Valid() {
+	if g.tree.root.Valid() {
 		t.Error("root etag is still valid")
 	}
-	rv2, err := root.Version()
+	rv2, err := g.tree.root.Version()
 	if err != nil {
 		t.Error(err)
 	}
@@ -618,11 +625,11 @@ func TestAddDocumentDoesNotUpdateETagOfOtherFolders(t *testing.T) {
 	}
 }
 
-const persistText = `<Root>
+const persistText = `<Root ETags="md5" ETag="674e141b50e9803f509f12d5e3aa2811" Revision="2">
 	<Nodes IsFolder="true">
 		<Name>Documents/</Name>
 		<Rname>/Documents</Rname>
-		<ETag>86f32f54096e02778610b22d1d6c56db</ETag>
+		<ETag>77a4810b2bd043e65fa85a6f1416cdef</ETag>
 		<Mime>inode/directory</Mime>
 		<ParentRName>/</ParentRName>
 	</Nodes>
@@ -630,24 +637,1311 @@ const persistText = `<Root>
 		<Name>hello.txt</Name>
 		<Rname>/Documents/hello.txt</Rname>
 		<Sname>/tmp/rms/storage/32000000-0000-0000-0000-000000000000</Sname>
-		<ETag>ea724748ce53d55deb465a6d045fd160</ETag>
+		<ETag>19b6ae16bb34b5f6629f714c38281719</ETag>
 		<Mime>text/plain</Mime>
 		<Length>13</Length>
 		<LastMod>0001-01-01T00:00:00Z</LastMod>
+		<Hash>65a8e27d8879283831b664bd8b7f0ad4</Hash>
+		<Revision>2</Revision>
 		<ParentRName>/Documents</ParentRName>
 	</Nodes>
 	<Nodes IsFolder="false">
 		<Name>test.txt</Name>
 		<Rname>/Documents/test.txt</Rname>
 		<Sname>/tmp/rms/storage/31000000-0000-0000-0000-000000000000</Sname>
-		<ETag>10b3bf730d787feceec1d534a876dc5f</ETag>
+		<ETag>7344622eac9fc3cd51e23116b01c24b7</ETag>
 		<Mime>text/plain</Mime>
 		<Length>20</Length>
 		<LastMod>0001-01-01T00:00:00Z</LastMod>
+		<Hash>35ab7a21f8856cbb097c4ea393cd478b</Hash>
+		<Revision>1</Revision>
 		<ParentRName>/Documents</ParentRName>
 	</Nodes>
 </Root>`
 
+type failingReader struct {
+	r io.Reader
+}
+
+func (f failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func TestReplaceFailedWriteKeepsOldVersion(t *testing.T) {
+	mockServer()
+	st := g.tree
+
+	blobs := func() (snames []string) {
+		t.Helper()
+		must(FS.WalkDir(st.sroot, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				snames = append(snames, path)
+			}
+			return err
+		}))
+		return snames
+	}
+
+	orig := mustVal(st.Put("/notes.txt", bytes.NewReader([]byte("first")), "text/plain"))
+	before := blobs()
+	if len(before) != 1 {
+		t.Fatalf("got: %d blobs, want: 1", len(before))
+	}
+
+	_, err := st.Replace("/notes.txt", failingReader{bytes.NewReader([]byte("second, but trunc"))}, "text/plain")
+	if err == nil {
+		t.Fatal("expected replace to fail")
+	}
+
+	n := mustVal(st.Get("/notes.txt"))
+	if !n.ETag.Equal(orig.ETag) || n.Length != orig.Length {
+		t.Errorf("got: %+v, want: %+v", n, orig)
+	}
+	fd := mustVal(st.Open("/notes.txt"))
+	defer fd.Close()
+	if c := string(mustVal(io.ReadAll(fd))); c != "first" {
+		t.Errorf("got: `%s', want: `first'", c)
+	}
+	if after := blobs(); !reflect.DeepEqual(before, after) {
+		t.Errorf("got blobs: %v, want: %v", after, before)
+	}
+
+	_, err = st.Put("/other.txt", failingReader{bytes.NewReader([]byte("trunc"))}, "text/plain")
+	if err == nil {
+		t.Fatal("expected put to fail")
+	}
+	if _, err := st.Get("/other.txt"); err != ErrNotExist {
+		t.Errorf("got: %v, want: %v", err, ErrNotExist)
+	}
+	if after := blobs(); !reflect.DeepEqual(before, after) {
+		t.Errorf("got blobs: %v, want: %v", after, before)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	Reset()
+
+	if u := g.tree.Usage(); u != 0 {
+		t.Errorf("got: %d, want: 0", u)
+	}
+	hello := mustVal(AddDocument("/code/hello.go", _s(), 13, "text/plain"))
+	world := mustVal(AddDocument("/code/world.go", _s(), 7, "text/plain"))
+	if u := g.tree.Usage(); u != 20 {
+		t.Errorf("got: %d, want: 20", u)
+	}
+	UpdateDocument(hello, "text/plain", 3)
+	if u := g.tree.Usage(); u != 10 {
+		t.Errorf("got: %d, want: 10", u)
+	}
+	RemoveDocument(world)
+	if u := g.tree.Usage(); u != 3 {
+		t.Errorf("got: %d, want: 3", u)
+	}
+	Reset()
+	if u := g.tree.Usage(); u != 0 {
+		t.Errorf("got: %d, want: 0", u)
+	}
+}
+
+func TestVersionHistory(t *testing.T) {
+	mockServer(WithVersionHistory(2, 0))
+	st := g.tree
+
+	put := func(content string) NodeInfo {
+		t.Helper()
+		if _, err := st.Get("/notes.txt"); err == ErrNotExist {
+			return mustVal(st.Put("/notes.txt", bytes.NewReader([]byte(content)), "text/plain"))
+		}
+		return mustVal(st.Replace("/notes.txt", bytes.NewReader([]byte(content)), "text/plain"))
+	}
+	read := func(fd io.ReadSeekCloser) string {
+		t.Helper()
+		defer fd.Close()
+		return string(mustVal(io.ReadAll(fd)))
+	}
+
+	v1 := put("first")
+	v2 := put("second")
+	v3 := put("third")
+	v4 := put("fourth")
+
+	vs := mustVal(st.Versions("/notes.txt"))
+	if len(vs) != 2 {
+		t.Fatalf("got: %d versions, want: 2", len(vs))
+	}
+	if !vs[0].ETag.Equal(v3.ETag) || !vs[1].ETag.Equal(v2.ETag) {
+		t.Errorf("got: [%s %s], want: [%s %s]", vs[0].ETag, vs[1].ETag, v3.ETag, v2.ETag)
+	}
+	if _, _, err := st.OpenVersion("/notes.txt", v1.ETag); err != ErrNotExist {
+		t.Errorf("got: %v, want: %v", err, ErrNotExist)
+	}
+	_, fd, err := st.OpenVersion("/notes.txt", v2.ETag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := read(fd); c != "second" {
+		t.Errorf("got: `%s', want: `second'", c)
+	}
+
+	restored, err := g.RestoreVersion("", "/notes.txt", v2.ETag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Length != int64(len("second")) {
+		t.Errorf("got: %d, want: %d", restored.Length, len("second"))
+	}
+	if c := read(mustVal(st.Open("/notes.txt"))); c != "second" {
+		t.Errorf("got: `%s', want: `second'", c)
+	}
+	vs = mustVal(g.Versions("", "/notes.txt"))
+	if len(vs) != 2 || !vs[0].ETag.Equal(v4.ETag) || !vs[1].ETag.Equal(v3.ETag) {
+		t.Errorf("got: %v, want versions: [%s %s]", vs, v4.ETag, v3.ETag)
+	}
+
+	// previous versions survive a restart
+	bs := &bytes.Buffer{}
+	must(Persist(bs))
+	Reset()
+	must(Load(bs))
+	vs = mustVal(g.Versions("", "/notes.txt"))
+	if len(vs) != 2 || !vs[0].ETag.Equal(v4.ETag) || !vs[1].ETag.Equal(v3.ETag) {
+		t.Errorf("got: %v, want versions: [%s %s]", vs, v4.ETag, v3.ETag)
+	}
+
+	// all versions are removed along with the document
+	snames := []string{}
+	for _, v := range mustVal(st.retrieve("/notes.txt")).versions {
+		snames = append(snames, v.sname)
+	}
+	must(st.Delete("/notes.txt"))
+	for _, sname := range snames {
+		if _, err := FS.Stat(sname); err == nil {
+			t.Errorf("expected blob of previous version to be removed: %s", sname)
+		}
+	}
+}
+
+func TestVersionHistorySameContent(t *testing.T) {
+	mockServer(WithVersionHistory(0, 0))
+	st := g.tree
+
+	// written within the same second
+	v1 := mustVal(st.Put("/notes.txt", bytes.NewReader([]byte("same")), "text/plain"))
+	v2 := mustVal(st.Replace("/notes.txt", bytes.NewReader([]byte("same")), "text/plain"))
+	if v1.ETag.Equal(v2.ETag) {
+		t.Errorf("expected versions to have different etags, got: %s", v1.ETag)
+	}
+	mustVal(st.Replace("/notes.txt", bytes.NewReader([]byte("other")), "text/plain"))
+
+	vs := mustVal(st.Versions("/notes.txt"))
+	if len(vs) != 2 || !vs[0].ETag.Equal(v2.ETag) || !vs[1].ETag.Equal(v1.ETag) {
+		t.Errorf("got: %v, want versions: [%s %s]", vs, v2.ETag, v1.ETag)
+	}
+	mustVal(st.RestoreVersion("/notes.txt", v1.ETag))
+	vs = mustVal(st.Versions("/notes.txt"))
+	if len(vs) != 2 || !vs[1].ETag.Equal(v2.ETag) {
+		t.Errorf("got: %v, want the other version to be kept: %s", vs, v2.ETag)
+	}
+}
+
+func TestVersionHistoryMaxAge(t *testing.T) {
+	mockServer(WithVersionHistory(0, time.Hour))
+	st := g.tree
+
+	tnow := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	Time = func() time.Time {
+		return tnow
+	}
+
+	mustVal(st.Put("/notes.txt", bytes.NewReader([]byte("first")), "text/plain"))
+	mustVal(st.Replace("/notes.txt", bytes.NewReader([]byte("second")), "text/plain"))
+	tnow = tnow.Add(30 * time.Minute)
+	mustVal(st.Replace("/notes.txt", bytes.NewReader([]byte("third")), "text/plain"))
+	if vs := mustVal(st.Versions("/notes.txt")); len(vs) != 2 {
+		t.Errorf("got: %d versions, want: 2", len(vs))
+	}
+	tnow = tnow.Add(45 * time.Minute)
+	mustVal(st.Replace("/notes.txt", bytes.NewReader([]byte("fourth")), "text/plain"))
+	if vs := mustVal(st.Versions("/notes.txt")); len(vs) != 2 {
+		t.Errorf("got: %d versions, want: 2", len(vs))
+	}
+}
+
+func TestTrash(t *testing.T) {
+	mockServer(WithTrash(24 * time.Hour))
+	st := g.tree
+
+	tnow := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	Time = func() time.Time {
+		return tnow
+	}
+
+	mustVal(st.Put("/Pictures/Kittens/cat.avif", bytes.NewReader([]byte("meow")), "image/avif"))
+	mustVal(st.Put("/notes.txt", bytes.NewReader([]byte("notes")), "text/plain"))
+	orig := mustVal(st.Get("/Pictures/Kittens/cat.avif"))
+	sname := mustVal(st.retrieve("/Pictures/Kittens/cat.avif")).sname
+
+	tnow = tnow.Add(time.Hour)
+	must(st.Delete("/Pictures/Kittens/cat.avif"))
+	if _, err := st.Get("/Pictures/"); err != ErrNotExist {
+		t.Errorf("got: %v, want: %v", err, ErrNotExist)
+	}
+	if _, err := FS.Stat(sname); err != nil {
+		t.Errorf("expected blob of trashed document to be kept: %v", err)
+	}
+	// trashed documents still take up space
+	if st.Usage() != int64(len("notes")+len("meow")) {
+		t.Errorf("got: %d, want: %d", st.Usage(), len("notes")+len("meow"))
+	}
+
+	tnow = tnow.Add(time.Hour)
+	must(st.Delete("/notes.txt"))
+
+	items := mustVal(g.Trash(""))
+	if len(items) != 2 {
+		t.Fatalf("got: %d trashed documents, want: 2", len(items))
+	}
+	if items[0].Rname != "/notes.txt" || items[1].Rname != "/Pictures/Kittens/cat.avif" {
+		t.Errorf("got: [%s %s], want: [/notes.txt /Pictures/Kittens/cat.avif]", items[0].Rname, items[1].Rname)
+	}
+	cat := items[1]
+	if cat.Mime != "image/avif" || cat.Length != 4 || !cat.LastMod.Equal(*orig.LastMod) || !cat.Deleted.Equal(tnow.Add(-time.Hour)) {
+		t.Errorf("unexpected trash item: %+v", cat)
+	}
+
+	// trash survives a restart
+	bs := &bytes.Buffer{}
+	must(Persist(bs))
+	Reset()
+	must(Load(bs))
+	if items := mustVal(g.Trash("")); len(items) != 2 {
+		t.Errorf("got: %d trashed documents, want: 2", len(items))
+	}
+	if st.Usage() != int64(len("notes")+len("meow")) {
+		t.Errorf("got: %d, want: %d", st.Usage(), len("notes")+len("meow"))
+	}
+
+	restored, err := g.RestoreTrash("", cat.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Rname != "/Pictures/Kittens/cat.avif" || !restored.LastMod.Equal(*orig.LastMod) || !restored.ETag.Equal(orig.ETag) {
+		t.Errorf("got: %+v, want: %+v", restored, orig)
+	}
+	if _, err := st.Get("/Pictures/Kittens/"); err != nil {
+		t.Errorf("expected ancestors to be recreated: %v", err)
+	}
+	if _, err := g.RestoreTrash("", cat.ID); err != ErrNotExist {
+		t.Errorf("got: %v, want: %v", err, ErrNotExist)
+	}
+
+	// expired documents are purged
+	notes := mustVal(g.Trash(""))[0]
+	tnow = tnow.Add(25 * time.Hour)
+	if items := mustVal(g.Trash("")); len(items) != 0 {
+		t.Errorf("got: %d trashed documents, want: 0", len(items))
+	}
+	if _, err := g.RestoreTrash("", notes.ID); err != ErrNotExist {
+		t.Errorf("got: %v, want: %v", err, ErrNotExist)
+	}
+	if len(st.trash) != 0 {
+		t.Errorf("got: %d trashed documents, want: 0", len(st.trash))
+	}
+
+	must(st.Delete("/Pictures/Kittens/cat.avif"))
+	must(g.PurgeTrash("", ""))
+	if _, err := FS.Stat(sname); err == nil {
+		t.Errorf("expected blob of purged document to be removed: %s", sname)
+	}
+	if st.Usage() != 0 {
+		t.Errorf("got: %d, want: 0", st.Usage())
+	}
+}
+
+func TestExpire(t *testing.T) {
+	mockServer(WithTrash(24*time.Hour), WithVersionHistory(0, time.Hour))
+	st := g.tree
+
+	tnow := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	Time = func() time.Time {
+		return tnow
+	}
+
+	mustVal(st.Put("/notes.txt", bytes.NewReader([]byte("first")), "text/plain"))
+	mustVal(st.Replace("/notes.txt", bytes.NewReader([]byte("second")), "text/plain"))
+	version := st.files["/notes.txt"].versions[0].sname
+	mustVal(st.Put("/cat.avif", bytes.NewReader([]byte("meow")), "image/avif"))
+	trashed := st.files["/cat.avif"].sname
+	must(st.Delete("/cat.avif"))
+
+	must(Expire())
+	if len(st.trash) != 1 || len(st.files["/notes.txt"].versions) != 1 {
+		t.Error("expected nothing to expire yet")
+	}
+
+	// Neither the trash nor the document are modified in the meantime.
+	tnow = tnow.Add(25 * time.Hour)
+	must(Expire())
+	if len(st.trash) != 0 {
+		t.Errorf("got: %d trashed documents, want: 0", len(st.trash))
+	}
+	if vs := st.files["/notes.txt"].versions; len(vs) != 0 {
+		t.Errorf("got: %d versions, want: 0", len(vs))
+	}
+	for _, sname := range []string{version, trashed} {
+		if _, err := FS.Stat(sname); err == nil {
+			t.Errorf("expected expired blob to be removed: %s", sname)
+		}
+	}
+	if st.Usage() != int64(len("second")) {
+		t.Errorf("got: %d, want: %d", st.Usage(), len("second"))
+	}
+}
+
+func TestJournal(t *testing.T) {
+	const (
+		journalFile  = "/tmp/rms/journal.xml"
+		snapshotFile = "/tmp/rms/persist.xml"
+	)
+	mockServer(WithJournal(journalFile, snapshotFile, 0))
+	st := g.tree
+
+	restart := func(persist []byte) *Server {
+		t.Helper()
+		s := mustVal(New(g.rroot, st.sroot, WithJournal(journalFile, snapshotFile, 0)))
+		must(s.Load(bytes.NewReader(persist)))
+		return s
+	}
+	read := func(s *Server, rname string) string {
+		t.Helper()
+		fd := mustVal(s.tree.Open(rname))
+		defer fd.Close()
+		return string(mustVal(io.ReadAll(fd)))
+	}
+
+	mustVal(st.Put("/Notes/todo.txt", bytes.NewReader([]byte("buy milk")), "text/plain"))
+	mustVal(st.Put("/Notes/done.txt", bytes.NewReader([]byte("nothing")), "text/plain"))
+	mustVal(st.Replace("/Notes/todo.txt", bytes.NewReader([]byte("buy oat milk")), "text/plain"))
+	must(st.Delete("/Notes/done.txt"))
+	want := mustVal(st.Get("/Notes/todo.txt"))
+
+	// crash without having persisted anything
+	s := restart(nil)
+	got, err := s.tree.Get("/Notes/todo.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Length != want.Length || got.Mime != want.Mime || !got.LastMod.Equal(*want.LastMod) || !got.ETag.Equal(want.ETag) {
+		t.Errorf("got: %+v, want: %+v", got, want)
+	}
+	if c := read(s, "/Notes/todo.txt"); c != "buy oat milk" {
+		t.Errorf("got: `%s', want: `buy oat milk'", c)
+	}
+	if _, err := s.tree.Get("/Notes/done.txt"); err != ErrNotExist {
+		t.Errorf("got: %v, want: %v", err, ErrNotExist)
+	}
+	if s.tree.Usage() != st.Usage() {
+		t.Errorf("got: %d, want: %d", s.tree.Usage(), st.Usage())
+	}
+
+	// crash while an entry was being written
+	journal := mustVal(FS.ReadFile(journalFile))
+	must(FS.WriteFile(journalFile, append(journal, []byte(`<Entry Op="add"><Node><Rname>/Notes/new`)...), 0640))
+	s = restart(nil)
+	if _, err := s.tree.Get("/Notes/todo.txt"); err != nil {
+		t.Error(err)
+	}
+	if bs := mustVal(FS.ReadFile(journalFile)); !bytes.Equal(bs, journal) {
+		t.Errorf("expected incomplete entry to be discarded, got: %s", bs)
+	}
+
+	// compaction writes a snapshot and clears the journal
+	must(g.Compact())
+	if bs := mustVal(FS.ReadFile(journalFile)); len(bs) != 0 {
+		t.Errorf("expected journal to be empty, got: %s", bs)
+	}
+	s = restart(mustVal(FS.ReadFile(snapshotFile)))
+	if c := read(s, "/Notes/todo.txt"); c != "buy oat milk" {
+		t.Errorf("got: `%s', want: `buy oat milk'", c)
+	}
+
+	// replaying a journal on top of a snapshot that already contains its
+	// changes has no effect
+	must(FS.WriteFile(journalFile, journal, 0640))
+	s = restart(mustVal(FS.ReadFile(snapshotFile)))
+	if got := mustVal(s.tree.Get("/Notes/todo.txt")); !got.ETag.Equal(want.ETag) {
+		t.Errorf("got: %s, want: %s", got.ETag, want.ETag)
+	}
+	if s.tree.Usage() != st.Usage() {
+		t.Errorf("got: %d, want: %d", s.tree.Usage(), st.Usage())
+	}
+}
+
+func TestJournalCompactAfter(t *testing.T) {
+	const (
+		journalFile  = "/tmp/rms/journal.xml"
+		snapshotFile = "/tmp/rms/persist.xml"
+	)
+	mockServer(WithJournal(journalFile, snapshotFile, 3))
+	st := g.tree
+
+	mustVal(st.Put("/a.txt", bytes.NewReader([]byte("a")), "text/plain"))
+	mustVal(st.Put("/b.txt", bytes.NewReader([]byte("b")), "text/plain"))
+	if bs := mustVal(FS.ReadFile(journalFile)); len(bs) == 0 {
+		t.Error("expected journal to contain entries")
+	}
+	if _, err := FS.Stat(snapshotFile); err == nil {
+		t.Error("expected no snapshot to be written yet")
+	}
+	mustVal(st.Put("/c.txt", bytes.NewReader([]byte("c")), "text/plain"))
+	if bs := mustVal(FS.ReadFile(journalFile)); len(bs) != 0 {
+		t.Errorf("expected journal to be empty, got: %s", bs)
+	}
+	if _, err := FS.Stat(snapshotFile); err != nil {
+		t.Errorf("expected snapshot to be written: %v", err)
+	}
+}
+
+func TestJournalCompactionFails(t *testing.T) {
+	const (
+		journalFile  = "/tmp/rms/journal.xml"
+		snapshotFile = "/tmp/rms/persist.xml"
+	)
+	var unhandled []error
+	mockServer(WithJournal(journalFile, snapshotFile, 1), WithErrorHandler(func(err error) {
+		unhandled = append(unhandled, err)
+	}))
+	st := g.tree
+	must(MkdirAll(snapshotFile)) // the snapshot can't be written
+
+	// The document has been journaled, so the write must succeed anyway.
+	if _, err := st.Put("/a.txt", bytes.NewReader([]byte("a")), "text/plain"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(unhandled) != 1 {
+		t.Errorf("got: %v, want compaction error to be reported", unhandled)
+	}
+	if bs := mustVal(FS.ReadFile(journalFile)); len(bs) == 0 {
+		t.Error("expected journal to keep its entries")
+	}
+}
+
+func TestJournalFailsRollsBack(t *testing.T) {
+	const (
+		journalFile  = "/tmp/rms/journal.xml"
+		snapshotFile = "/tmp/rms/persist.xml"
+	)
+	mockServer(WithTrash(0), WithJournal(journalFile, snapshotFile, 0))
+	st := g.tree
+
+	mustVal(st.Put("/a.txt", bytes.NewReader([]byte("a")), "text/plain"))
+	mustVal(st.Put("/Notes/b.txt", bytes.NewReader([]byte("bb")), "text/plain"))
+	must(st.Delete("/Notes/b.txt"))
+	id := mustVal(st.Trash())[0].ID
+
+	// the journal can't be written
+	must(FS.Remove(journalFile))
+	must(MkdirAll(journalFile))
+
+	if err := st.Delete("/a.txt"); err == nil {
+		t.Error("expected delete to fail")
+	}
+	if _, err := st.Get("/a.txt"); err != nil {
+		t.Errorf("expected document to be kept: %v", err)
+	}
+	if items := mustVal(st.Trash()); len(items) != 1 {
+		t.Errorf("got: %d trashed documents, want: 1", len(items))
+	}
+
+	if _, err := st.RestoreTrash(id); err == nil {
+		t.Error("expected restore to fail")
+	}
+	if _, err := st.Get("/Notes/"); err != ErrNotExist {
+		t.Errorf("got: %v, want: %v", err, ErrNotExist)
+	}
+	if items := mustVal(st.Trash()); len(items) != 1 {
+		t.Errorf("got: %d trashed documents, want: 1", len(items))
+	}
+	if st.Usage() != int64(len("a")+len("bb")) {
+		t.Errorf("got: %d, want: %d", st.Usage(), len("a")+len("bb"))
+	}
+}
+
+func TestFsck(t *testing.T) {
+	setup := func() (st *tree, orphan, missing, resized string) {
+		mockServer(WithVersionHistory(0, 0))
+		st = g.tree
+		mustVal(st.Put("/Notes/todo.txt", bytes.NewReader([]byte("buy milk")), "text/plain"))
+		mustVal(st.Replace("/Notes/todo.txt", bytes.NewReader([]byte("buy oat milk")), "text/plain"))
+		mustVal(st.Put("/Notes/done.txt", bytes.NewReader([]byte("nothing")), "text/plain"))
+		mustVal(st.Put("/Pictures/cat.txt", bytes.NewReader([]byte("meow")), "text/plain"))
+
+		orphan = filepath.Join(st.sroot, "orphan")
+		must(FS.WriteFile(orphan, []byte("I am lost"), 0640))
+		missing = mustVal(st.retrieve("/Pictures/cat.txt")).sname
+		must(FS.Remove(missing))
+		resized = mustVal(st.retrieve("/Notes/done.txt")).sname
+		must(FS.WriteFile(resized, []byte("nothing at all"), 0640))
+		return
+	}
+
+	st, orphan, missing, resized := setup()
+	issues := mustVal(g.Fsck("", FsckOptions{}))
+	want := []FsckIssue{
+		{Kind: FsckSizeMismatch, Rname: "/Notes/done.txt", Sname: resized, Expected: 7, Actual: 14},
+		{Kind: FsckMissingBlob, Rname: "/Pictures/cat.txt", Sname: missing},
+		{Kind: FsckOrphan, Sname: orphan},
+	}
+	if !reflect.DeepEqual(issues, want) {
+		t.Errorf("got: %v, want: %v", issues, want)
+	}
+
+	issues = mustVal(g.Fsck("", FsckOptions{CollectOrphans: true, DropDangling: true, FixLengths: true}))
+	for _, issue := range issues {
+		if !issue.Repaired {
+			t.Errorf("expected issue to be repaired: %s", issue)
+		}
+	}
+	if _, err := FS.Stat(orphan); err == nil {
+		t.Error("expected orphan to be removed")
+	}
+	if _, err := st.Get("/Pictures/"); err != ErrNotExist {
+		t.Errorf("got: %v, want: %v", err, ErrNotExist)
+	}
+	if n := mustVal(st.Get("/Notes/done.txt")); n.Length != 14 {
+		t.Errorf("got: %d, want: 14", n.Length)
+	}
+	// the previous version of todo.txt counts as well
+	if want := int64(len("buy oat milk") + len("buy milk") + len("nothing at all")); st.Usage() != want {
+		t.Errorf("got: %d, want: %d", st.Usage(), want)
+	}
+	if issues := mustVal(g.Fsck("", FsckOptions{})); len(issues) != 0 {
+		t.Errorf("got: %v, want no issues", issues)
+	}
+
+	st, orphan, _, _ = setup()
+	mustVal(g.Fsck("", FsckOptions{AdoptOrphans: true}))
+	adopted := mustVal(st.Get(LostAndFound + "orphan"))
+	if adopted.Length != int64(len("I am lost")) || adopted.Mime != "text/plain; charset=utf-8" {
+		t.Errorf("unexpected adopted document: %+v", adopted)
+	}
+
+	if _, err := g.Fsck("", FsckOptions{AdoptOrphans: true, CollectOrphans: true}); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestFsckAdoptEncoded(t *testing.T) {
+	keys := mustVal(MasterKeys("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)}))
+	content := strings.Repeat("All work and no play makes Jack a dull boy.\n", 100)
+
+	// orphan removes the document rname from the tree, but keeps its blob.
+	orphan := func(rname string) string {
+		n := mustVal(g.tree.retrieve(rname))
+		g.tree.removeDocument(n)
+		return n.sname
+	}
+
+	for _, opts := range [][]Option{
+		{WithEncryption(keys)},
+		{WithBlobCompression(CodecGzip)},
+		{WithEncryption(keys), WithBlobCompression(CodecGzip)},
+	} {
+		mockServer(opts...)
+		st := g.tree
+		mustVal(st.Put("/Notes/jack.txt", strings.NewReader(content), "text/plain"))
+		sname := orphan("/Notes/jack.txt")
+		if st.Usage() != 0 {
+			t.Fatalf("got usage: %d, want: 0", st.Usage())
+		}
+
+		mustVal(g.Fsck("", FsckOptions{AdoptOrphans: true}))
+		rname := LostAndFound + filepath.Base(sname)
+		adopted := mustVal(st.Get(rname))
+		if adopted.Length != int64(len(content)) || adopted.Mime != "text/plain; charset=utf-8" {
+			t.Errorf("unexpected adopted document: %+v", adopted)
+		}
+		if st.Usage() != int64(len(content)) {
+			t.Errorf("got usage: %d, want: %d", st.Usage(), len(content))
+		}
+		fd := mustVal(st.Open(rname))
+		if bs := mustVal(io.ReadAll(fd)); string(bs) != content {
+			t.Error("adopted content differs")
+		}
+		must(fd.Close())
+	}
+
+	// encrypted blobs can't be adopted without the keys
+	mockServer(WithEncryption(keys))
+	mustVal(g.tree.Put("/Notes/jack.txt", strings.NewReader(content), "text/plain"))
+	sname := orphan("/Notes/jack.txt")
+	s := mustVal(New("/storage/", "/tmp/rms/storage/"))
+	issues, err := s.Fsck("", FsckOptions{AdoptOrphans: true})
+	if err == nil {
+		t.Error("expected error")
+	}
+	if len(issues) != 1 || issues[0].Sname != sname || issues[0].Repaired {
+		t.Errorf("got: %v, want unrepaired orphan %s", issues, sname)
+	}
+	if _, err := s.tree.Get(LostAndFound); err != ErrNotExist {
+		t.Errorf("got: %v, want: %v", err, ErrNotExist)
+	}
+}
+
+func TestETagsDoNotRereadContent(t *testing.T) {
+	mockServer()
+	st := g.tree
+
+	mustVal(st.Put("/Pictures/Kittens/cat.avif", bytes.NewReader([]byte("meow")), "image/avif"))
+	mustVal(st.Put("/Notes/todo.txt", bytes.NewReader([]byte("buy milk")), "text/plain"))
+	root := mustVal(st.Get("/"))
+
+	// The content was hashed while it was being written, and folders only
+	// depend on the etags of their children.
+	must(FS.Remove(mustVal(st.retrieve("/Pictures/Kittens/cat.avif")).sname))
+	mustVal(st.Replace("/Notes/todo.txt", bytes.NewReader([]byte("buy oat milk")), "text/plain"))
+	if n, err := st.Get("/"); err != nil {
+		t.Error(err)
+	} else if n.ETag.Equal(root.ETag) {
+		t.Error("expected etag of root to change")
+	}
+
+	// content hashes survive a restart
+	bs := &bytes.Buffer{}
+	must(Persist(bs))
+	Reset()
+	must(Load(bs))
+	if _, err := st.Get("/"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestETagStrategies(t *testing.T) {
+	strategies := []struct {
+		st        ETagStrategy
+		size      int
+		readsBlob bool
+	}{
+		{ETagMD5, 16, true},
+		{ETagSHA256, 32, true},
+		{ETagFNV, 16, true},
+		{ETagTimestamp, 8, false},
+		{ETagRevision, 8, false},
+	}
+	for _, tc := range strategies {
+		t.Run(tc.st.Name(), func(t *testing.T) {
+			mockServer(WithETagStrategy(tc.st))
+			st := g.tree
+
+			doc := mustVal(st.Put("/Notes/todo.txt", bytes.NewReader([]byte("buy milk")), "text/plain"))
+			folder := mustVal(st.Get("/Notes/"))
+			if len(doc.ETag) != tc.size || len(folder.ETag) != tc.size {
+				t.Errorf("got etags of length %d and %d, want: %d", len(doc.ETag), len(folder.ETag), tc.size)
+			}
+
+			// recalculating yields the same etag
+			n := mustVal(st.retrieve("/Notes/todo.txt"))
+			n.Invalidate()
+			if etag := mustVal(n.Version()); !etag.Equal(doc.ETag) {
+				t.Errorf("got: %s, want: %s", etag, doc.ETag)
+			}
+
+			// only strategies that hash content need to read the blob
+			must(FS.Remove(n.sname))
+			n.mu.Lock()
+			n.hash = nil
+			n.mu.Unlock()
+			n.Invalidate()
+			_, err := n.Version()
+			if tc.readsBlob != (err != nil) {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			replaced := mustVal(st.Replace("/Notes/todo.txt", bytes.NewReader([]byte("buy oat milk")), "text/plain"))
+			if replaced.ETag.Equal(doc.ETag) {
+				t.Error("expected etag of document to change")
+			}
+			if f := mustVal(st.Get("/Notes/")); f.ETag.Equal(folder.ETag) {
+				t.Error("expected etag of folder to change")
+			}
+
+			// etags survive a restart
+			bs := &bytes.Buffer{}
+			must(Persist(bs))
+			if !strings.Contains(bs.String(), fmt.Sprintf(`<Root ETags="%s"`, tc.st.Name())) {
+				t.Error("expected persist file to record the strategy")
+			}
+			Reset()
+			must(Load(bs))
+			if got := mustVal(st.Get("/Notes/todo.txt")); !got.ETag.Equal(replaced.ETag) {
+				t.Errorf("got: %s, want: %s", got.ETag, replaced.ETag)
+			}
+		})
+	}
+}
+
+func TestLoadKeepsRevision(t *testing.T) {
+	mockServer(WithETagStrategy(ETagRevision))
+	st := g.tree
+	mustVal(st.Put("/Notes/todo.txt", bytes.NewReader([]byte("buy milk")), "text/plain"))
+	deleted := mustVal(st.Put("/Notes/done.txt", bytes.NewReader([]byte("nothing")), "text/plain"))
+	must(st.Delete("/Notes/done.txt"))
+
+	bs := &bytes.Buffer{}
+	must(Persist(bs))
+	Reset()
+	must(Load(bs))
+
+	// The revision of the deleted document must not be handed out again.
+	recreated := mustVal(st.Put("/Notes/done.txt", bytes.NewReader([]byte("nothing")), "text/plain"))
+	if recreated.ETag.Equal(deleted.ETag) {
+		t.Errorf("expected recreated document to get a new etag, got: %s", recreated.ETag)
+	}
+	if n := mustVal(st.retrieve("/Notes/done.txt")); n.revision != 3 {
+		t.Errorf("got revision: %d, want: 3", n.revision)
+	}
+}
+
+func TestLoadWithOtherETagStrategy(t *testing.T) {
+	mockServer()
+	st := g.tree
+	mustVal(st.Put("/Notes/todo.txt", bytes.NewReader([]byte("buy milk")), "text/plain"))
+	bs := &bytes.Buffer{}
+	must(Persist(bs))
+
+	// The persisted md5 content hash must not be mistaken for a sha256 one.
+	st.etags.strategy = ETagSHA256
+	Reset()
+	must(Load(bs))
+	n := mustVal(st.retrieve("/Notes/todo.txt"))
+	if got := mustVal(n.Version()); len(got) != sha256.Size {
+		t.Errorf("got etag of length %d, want: %d", len(got), sha256.Size)
+	}
+	if len(n.hash) != sha256.Size {
+		t.Errorf("got content hash of length %d, want: %d", len(n.hash), sha256.Size)
+	}
+}
+
+func TestLoadKeepsETags(t *testing.T) {
+	mockServer()
+	st := g.tree
+	mustVal(st.Put("/Notes/todo.txt", bytes.NewReader([]byte("buy milk")), "text/plain"))
+	mustVal(st.Put("/Pictures/cat.avif", bytes.NewReader([]byte("meow")), "image/avif"))
+	etags := map[string]ETag{}
+	for _, rname := range []string{"/", "/Notes/", "/Notes/todo.txt", "/Pictures/", "/Pictures/cat.avif"} {
+		etags[rname] = mustVal(st.Get(rname)).ETag
+	}
+	bs := &bytes.Buffer{}
+	must(Persist(bs))
+
+	// The storage has moved to a host with a different name.
+	s := mustVal(New("/storage/", "/tmp/rms/storage/", WithServerIdentity("elsewhere")))
+	must(s.Load(bytes.NewReader(bs.Bytes())))
+	for rname, want := range etags {
+		if got := mustVal(s.tree.Get(rname)).ETag; !got.Equal(want) {
+			t.Errorf("%s: got: %s, want: %s", rname, got, want)
+		}
+	}
+
+	// Only etags of changed documents and their ancestors change.
+	mustVal(s.tree.Replace("/Pictures/cat.avif", bytes.NewReader([]byte("purr")), "image/avif"))
+	for rname, want := range etags {
+		got := mustVal(s.tree.Get(rname)).ETag
+		changed := rname == "/" || strings.HasPrefix(rname, "/Pictures/")
+		if changed == got.Equal(want) {
+			t.Errorf("%s: got: %s, want changed: %t", rname, got, changed)
+		}
+	}
+}
+
+func TestLoadVerifyETags(t *testing.T) {
+	mockServer()
+	st := g.tree
+	todo := mustVal(st.Put("/Notes/todo.txt", bytes.NewReader([]byte("buy milk")), "text/plain"))
+	done := mustVal(st.Put("/Notes/done.txt", bytes.NewReader([]byte("nothing")), "text/plain"))
+	bs := &bytes.Buffer{}
+	must(Persist(bs))
+
+	// modify the document behind the server's back
+	must(FS.WriteFile(mustVal(st.retrieve("/Notes/todo.txt")).sname, []byte("buy beer"), 0666))
+
+	s := mustVal(New("/storage/", "/tmp/rms/storage/"))
+	must(s.Load(bytes.NewReader(bs.Bytes())))
+	if got := mustVal(s.tree.Get("/Notes/todo.txt")).ETag; !got.Equal(todo.ETag) {
+		t.Errorf("got: %s, want: %s", got, todo.ETag)
+	}
+
+	s = mustVal(New("/storage/", "/tmp/rms/storage/", WithVerifyETags()))
+	must(s.Load(bytes.NewReader(bs.Bytes())))
+	if got := mustVal(s.tree.Get("/Notes/todo.txt")).ETag; got.Equal(todo.ETag) {
+		t.Error("expected etag of modified document to change")
+	}
+	if got := mustVal(s.tree.Get("/Notes/done.txt")).ETag; !got.Equal(done.ETag) {
+		t.Errorf("got: %s, want: %s", got, done.ETag)
+	}
+}
+
+func TestBlobCompression(t *testing.T) {
+	const content = `{"todo": ["buy milk", "buy milk", "buy milk", "buy milk"]}`
+	mockServer()
+	plain := mustVal(g.tree.Put("/Notes/todo.json", strings.NewReader(content), "application/json"))
+
+	mockServer(WithBlobCompression(CodecGzip))
+	st := g.tree
+	n := mustVal(st.Put("/Notes/todo.json", strings.NewReader(content), "application/json"))
+	img := mustVal(st.Put("/Pictures/cat.png", strings.NewReader(content), "image/png"))
+
+	if n.Length != int64(len(content)) {
+		t.Errorf("got length: %d, want: %d", n.Length, len(content))
+	}
+	if !n.ETag.Equal(plain.ETag) {
+		t.Errorf("etag should not depend on compression, got: %s, want: %s", n.ETag, plain.ETag)
+	}
+	todo := mustVal(st.retrieve("/Notes/todo.json"))
+	if todo.codec != "gzip" {
+		t.Errorf("got codec: `%s', want: gzip", todo.codec)
+	}
+	if bs := mustVal(FS.ReadFile(todo.sname)); bytes.Equal(bs, []byte(content)) || bs[0] != 0x1f || bs[1] != 0x8b {
+		t.Errorf("expected blob to be compressed with gzip, got: %q", bs)
+	}
+	if cat := mustVal(st.retrieve(img.Rname)); cat.codec != "" {
+		t.Errorf("expected image to be stored verbatim, got codec: %s", cat.codec)
+	}
+
+	fd := mustVal(st.Open("/Notes/todo.json"))
+	if bs := mustVal(io.ReadAll(fd)); string(bs) != content {
+		t.Errorf("got: `%s', want: `%s'", bs, content)
+	}
+	mustVal(fd.Seek(2, io.SeekStart))
+	bs := make([]byte, 4)
+	mustVal(io.ReadFull(fd, bs))
+	if string(bs) != "todo" {
+		t.Errorf("got: `%s', want: `todo'", bs)
+	}
+	must(fd.Close())
+
+	// the codec is recorded in the persist file, so that the blob can be
+	// read even if compression is no longer configured
+	buf := &bytes.Buffer{}
+	must(Persist(buf))
+	if !strings.Contains(buf.String(), "<Compression>gzip</Compression>") {
+		t.Errorf("expected codec to be persisted, got:\n%s", buf)
+	}
+	s := mustVal(New("/storage/", "/tmp/rms/storage/", WithVerifyETags()))
+	must(s.Load(bytes.NewReader(buf.Bytes())))
+	if got := mustVal(s.tree.Get("/Notes/todo.json")).ETag; !got.Equal(n.ETag) {
+		t.Errorf("got: %s, want: %s", got, n.ETag)
+	}
+	fd = mustVal(s.tree.Open("/Notes/todo.json"))
+	if bs := mustVal(io.ReadAll(fd)); string(bs) != content {
+		t.Errorf("got: `%s', want: `%s'", bs, content)
+	}
+	must(fd.Close())
+
+	// other codecs are only known to the server they are configured on
+	mockServer(WithBlobCompression(customCodec{}))
+	mustVal(g.tree.Put("/Notes/todo.json", strings.NewReader(content), "application/json"))
+	buf.Reset()
+	must(Persist(buf))
+	s = mustVal(New("/storage/", "/tmp/rms/storage/"))
+	must(s.Load(bytes.NewReader(buf.Bytes())))
+	if _, err := s.tree.Open("/Notes/todo.json"); err == nil {
+		t.Error("expected custom codec to be unknown")
+	}
+	fd = mustVal(g.tree.Open("/Notes/todo.json"))
+	if bs := mustVal(io.ReadAll(fd)); string(bs) != content {
+		t.Errorf("got: `%s', want: `%s'", bs, content)
+	}
+	must(fd.Close())
+}
+
+// customCodec is gzip under another name.
+type customCodec struct {
+	gzipEncoding
+}
+
+func (customCodec) Name() string {
+	return "custom"
+}
+
+func TestEncryption(t *testing.T) {
+	key := func(b byte) []byte {
+		return bytes.Repeat([]byte{b}, 32)
+	}
+	k1 := mustVal(MasterKeys("k1", map[string][]byte{"k1": key(1)}))
+	k2 := mustVal(MasterKeys("k2", map[string][]byte{"k1": key(1), "k2": key(2)}))
+	onlyK2 := mustVal(MasterKeys("k2", map[string][]byte{"k2": key(2)}))
+
+	// spans multiple segments
+	content := strings.Repeat("All work and no play makes Jack a dull boy.\n", 5000)
+
+	mockServer()
+	plain := mustVal(g.tree.Put("/Notes/jack.txt", strings.NewReader(content), "text/plain"))
+
+	mockServer(WithEncryption(k1))
+	st := g.tree
+	n := mustVal(st.Put("/Notes/jack.txt", strings.NewReader(content), "text/plain"))
+	mustVal(st.Put("/Notes/empty.txt", strings.NewReader(""), "text/plain"))
+	if n.Length != int64(len(content)) {
+		t.Errorf("got length: %d, want: %d", n.Length, len(content))
+	}
+	if !n.ETag.Equal(plain.ETag) {
+		t.Errorf("etag should not depend on encryption, got: %s, want: %s", n.ETag, plain.ETag)
+	}
+	jack := mustVal(st.retrieve("/Notes/jack.txt"))
+	if bs := mustVal(FS.ReadFile(jack.sname)); bytes.Contains(bs, []byte("Jack")) {
+		t.Error("expected blob to be encrypted")
+	}
+
+	read := func(st *tree, rname string) (string, error) {
+		fd, err := st.Open(rname)
+		if err != nil {
+			return "", err
+		}
+		defer fd.Close()
+		bs, err := io.ReadAll(fd)
+		return string(bs), err
+	}
+	if got := mustVal(read(st, "/Notes/jack.txt")); got != content {
+		t.Error("decrypted content differs")
+	}
+	if got := mustVal(read(st, "/Notes/empty.txt")); got != "" {
+		t.Errorf("got: `%s', want empty document", got)
+	}
+	fd := mustVal(st.Open("/Notes/jack.txt"))
+	offset := int64(encSegmentSize + 10)
+	mustVal(fd.Seek(offset, io.SeekStart))
+	bs := make([]byte, 20)
+	mustVal(io.ReadFull(fd, bs))
+	if want := content[offset : offset+20]; string(bs) != want {
+		t.Errorf("got: `%s', want: `%s'", bs, want)
+	}
+	must(fd.Close())
+
+	buf := &bytes.Buffer{}
+	must(Persist(buf))
+
+	// keys are rotated without touching the contents
+	s := mustVal(New("/storage/", "/tmp/rms/storage/", WithEncryption(onlyK2)))
+	must(s.Load(bytes.NewReader(buf.Bytes())))
+	if _, err := read(s.tree, "/Notes/jack.txt"); err == nil {
+		t.Error("expected the data key to be wrapped by the old master key")
+	}
+	s = mustVal(New("/storage/", "/tmp/rms/storage/", WithEncryption(k2)))
+	must(s.Load(bytes.NewReader(buf.Bytes())))
+	if rotated := mustVal(s.RotateKeys("")); rotated != 2 {
+		t.Errorf("got: %d rotated, want: 2", rotated)
+	}
+	if rotated := mustVal(s.RotateKeys("")); rotated != 0 {
+		t.Errorf("got: %d rotated, want: 0", rotated)
+	}
+	s = mustVal(New("/storage/", "/tmp/rms/storage/", WithEncryption(onlyK2), WithVerifyETags()))
+	must(s.Load(bytes.NewReader(buf.Bytes())))
+	if got := mustVal(read(s.tree, "/Notes/jack.txt")); got != content {
+		t.Error("decrypted content differs after rotation")
+	}
+	if got := mustVal(s.tree.Get("/Notes/jack.txt")).ETag; !got.Equal(n.ETag) {
+		t.Errorf("got: %s, want: %s", got, n.ETag)
+	}
+
+	// tampering is detected
+	bs = mustVal(FS.ReadFile(jack.sname))
+	bs[len(bs)-1] ^= 1
+	must(FS.WriteFile(jack.sname, bs, 0666))
+	if _, err := read(s.tree, "/Notes/jack.txt"); err == nil {
+		t.Error("expected modified blob to fail authentication")
+	}
+
+	// compressed before being encrypted
+	mockServer(WithEncryption(k1), WithBlobCompression(CodecGzip))
+	mustVal(g.tree.Put("/Notes/jack.txt", strings.NewReader(content), "text/plain"))
+	jack = mustVal(g.tree.retrieve("/Notes/jack.txt"))
+	if !jack.encrypted || jack.codec != "gzip" {
+		t.Errorf("got encrypted: %t, codec: `%s'", jack.encrypted, jack.codec)
+	}
+	if size := len(mustVal(FS.ReadFile(jack.sname))); size >= len(content) {
+		t.Errorf("expected blob to be compressed, got: %d bytes", size)
+	}
+	if got := mustVal(read(g.tree, "/Notes/jack.txt")); got != content {
+		t.Error("decrypted content differs")
+	}
+}
+
+func TestPersistDigest(t *testing.T) {
+	mockServer()
+	n := mustVal(g.tree.Put("/Notes/todo.txt", strings.NewReader("buy milk"), "text/plain"))
+	if want := sha256.Sum256([]byte("buy milk")); !bytes.Equal(n.Digest, want[:]) {
+		t.Errorf("got digest: %x, want: %x", n.Digest, want)
+	}
+	buf := &bytes.Buffer{}
+	must(Persist(buf))
+
+	s := mustVal(New("/storage/", "/tmp/rms/storage/"))
+	must(s.Load(bytes.NewReader(buf.Bytes())))
+	if got := mustVal(s.tree.Get("/Notes/todo.txt")).Digest; !bytes.Equal(got, n.Digest) {
+		t.Errorf("got digest: %x, want: %x", got, n.Digest)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	var reported []error
+	ts, remoteRoot := mockServer(
+		WithScrubbing(time.Hour, true),
+		WithErrorHandler(func(err error) { reported = append(reported, err) }),
+	)
+	defer ts.Close()
+
+	mustVal(g.tree.Put("/Notes/todo.txt", strings.NewReader("buy milk"), "text/plain"))
+	mustVal(g.tree.Put("/Notes/done.txt", strings.NewReader("buy eggs"), "text/plain"))
+	sname := genpath()
+	must(FS.WriteFile(sname, []byte("adopted"), 0666))
+	mustVal(AddDocument("/Notes/adopted.txt", sname, 7, "text/plain"))
+
+	issues := mustVal(Scrub())
+	if len(issues) != 0 || len(reported) != 0 {
+		t.Fatalf("unexpected issues: %v, reported: %v", issues, reported)
+	}
+	if g.tree.files["/Notes/adopted.txt"].digest == nil {
+		t.Error("expected digest of adopted document to be recorded")
+	}
+
+	todo := g.tree.files["/Notes/todo.txt"]
+	must(FS.WriteFile(todo.sname, []byte("buy mild"), 0666))
+	must(FS.Remove(g.tree.files["/Notes/done.txt"].sname))
+
+	issues = mustVal(Scrub())
+	if len(issues) != 2 || len(reported) != 2 {
+		t.Fatalf("got issues: %v, reported: %v", issues, reported)
+	}
+	kinds := map[string]ScrubKind{}
+	for _, issue := range issues {
+		kinds[issue.Rname] = issue.Kind
+	}
+	if kinds["/Notes/todo.txt"] != ScrubCorrupt || kinds["/Notes/done.txt"] != ScrubMissing {
+		t.Errorf("got issues: %v", issues)
+	}
+
+	// Known issues are returned, but not reported again.
+	issues = mustVal(Scrub())
+	if len(issues) != 2 || len(reported) != 2 {
+		t.Errorf("got issues: %v, reported: %v", issues, reported)
+	}
+
+	if _, err := g.tree.Open("/Notes/todo.txt"); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("got: %v, want: %v", err, ErrCorrupt)
+	}
+	r := mustVal(http.Get(remoteRoot + "/Notes/todo.txt"))
+	r.Body.Close()
+	if r.StatusCode != http.StatusInternalServerError {
+		t.Errorf("got status: %d, want: %d", r.StatusCode, http.StatusInternalServerError)
+	}
+
+	// The corrupt mark survives a restart.
+	buf := &bytes.Buffer{}
+	must(Persist(buf))
+	s := mustVal(New("/storage/", "/tmp/rms/storage/", WithScrubbing(time.Hour, true)))
+	must(s.Load(bytes.NewReader(buf.Bytes())))
+	if _, err := s.tree.Open("/Notes/todo.txt"); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("got: %v, want: %v", err, ErrCorrupt)
+	}
+
+	// Overwriting the document clears the mark.
+	mustVal(g.tree.Replace("/Notes/todo.txt", strings.NewReader("buy bread"), "text/plain"))
+	fd := mustVal(g.tree.Open("/Notes/todo.txt"))
+	fd.Close()
+	issues = mustVal(Scrub())
+	if len(issues) != 1 || issues[0].Rname != "/Notes/done.txt" {
+		t.Errorf("got issues: %v", issues)
+	}
+}
+
+func TestDeduplication(t *testing.T) {
+	mockServer(WithDeduplication(), WithUserRoots(), WithTrash(0))
+	st := g.tree
+	alice := mustVal(g.userTree("alice", true))
+	photo := func() io.Reader { return strings.NewReader("the same photo") }
+
+	mustVal(st.Put("/Pictures/a.jpg", photo(), "image/jpeg"))
+	mustVal(st.Put("/Camera/b.jpg", photo(), "image/jpeg"))
+	mustVal(alice.Put("/Pictures/c.jpg", photo(), "image/jpeg"))
+	sname := st.files["/Pictures/a.jpg"].sname
+	if filepath.Dir(sname) != filepath.Join(st.sroot, blobDir) {
+		t.Errorf("expected content-addressed blob, got: %s", sname)
+	}
+	if st.files["/Camera/b.jpg"].sname != sname || alice.files["/Pictures/c.jpg"].sname != sname {
+		t.Error("expected identical documents to share their blob")
+	}
+	if refs := g.blobs.refs[sname]; refs != 3 {
+		t.Errorf("got %d references, want: 3", refs)
+	}
+	if bs := mustVal(FS.ReadFile(sname)); string(bs) != "the same photo" {
+		t.Errorf("got: %q", bs)
+	}
+
+	// A corrupt blob is repaired by writing the same contents again.
+	must(FS.WriteFile(sname, []byte("the same phot0"), 0640))
+	mustVal(alice.Put("/Pictures/d.jpg", photo(), "image/jpeg"))
+	if bs := mustVal(FS.ReadFile(sname)); string(bs) != "the same photo" {
+		t.Errorf("got: %q", bs)
+	}
+	if refs := g.blobs.refs[sname]; refs != 4 {
+		t.Errorf("got %d references, want: 4", refs)
+	}
+	must(alice.Delete("/Pictures/d.jpg"))
+	must(g.PurgeTrash("alice", ""))
+
+	// Identical documents have distinct trash ids.
+	must(st.Delete("/Pictures/a.jpg"))
+	must(st.Delete("/Camera/b.jpg"))
+	items := mustVal(g.Trash(""))
+	if len(items) != 2 || items[0].ID == items[1].ID {
+		t.Fatalf("got trash: %v", items)
+	}
+	mustVal(g.RestoreTrash("", items[1].ID))
+	must(g.PurgeTrash("", items[0].ID))
+	if _, err := FS.Stat(sname); err != nil {
+		t.Errorf("expected shared blob to be kept: %v", err)
+	}
+
+	if issues := mustVal(g.Fsck("", FsckOptions{CollectOrphans: true})); len(issues) != 0 {
+		t.Errorf("unexpected issues: %v", issues)
+	}
+	if _, err := FS.Stat(sname); err != nil {
+		t.Errorf("expected shared blob to be kept: %v", err)
+	}
+
+	// References are counted from scratch on load.
+	buf := &bytes.Buffer{}
+	must(Persist(buf))
+	must(g.Load(bytes.NewReader(buf.Bytes())))
+	if refs := g.blobs.refs[sname]; refs != 2 {
+		t.Errorf("got %d references, want: 2", refs)
+	}
+
+	mustVal(st.Replace("/Pictures/a.jpg", strings.NewReader("another photo"), "image/jpeg"))
+	if _, err := FS.Stat(sname); err != nil {
+		t.Errorf("expected shared blob to be kept: %v", err)
+	}
+	must(alice.Delete("/Pictures/c.jpg"))
+	must(g.PurgeTrash("alice", ""))
+	if _, err := FS.Stat(sname); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected unreferenced blob to be removed, got: %v", err)
+	}
+	if _, ok := g.blobs.refs[sname]; ok {
+		t.Error("expected unreferenced blob to be forgotten")
+	}
+
+	if _, err := g.userTree(blobDir, true); err == nil {
+		t.Errorf("expected %s to be an invalid user root", blobDir)
+	}
+}
+
+func TestShardedBlobs(t *testing.T) {
+	opts := []Option{WithVersionHistory(0, 0), WithTrash(0)}
+	mockServer(opts...)
+	st := g.tree
+	mustVal(st.Put("/Notes/todo.txt", strings.NewReader("buy milk"), "text/plain"))
+	mustVal(st.Replace("/Notes/todo.txt", strings.NewReader("buy eggs"), "text/plain"))
+	mustVal(st.Put("/Notes/done.txt", strings.NewReader("buy bread"), "text/plain"))
+	must(st.Delete("/Notes/done.txt"))
+	if sname := st.files["/Notes/todo.txt"].sname; filepath.Dir(sname) != st.sroot {
+		t.Errorf("expected flat layout, got: %s", sname)
+	}
+	trashID := mustVal(g.Trash(""))[0].ID
+	buf := &bytes.Buffer{}
+	must(Persist(buf))
+
+	s := mustVal(New("/storage/", "/tmp/rms/storage/", append(opts, WithShardedBlobs(2, 2))...))
+	must(s.Load(bytes.NewReader(buf.Bytes())))
+	if moved := mustVal(s.Relayout("")); moved != 3 {
+		t.Errorf("got %d moved blobs, want: 3", moved)
+	}
+	if moved := mustVal(s.Relayout("")); moved != 0 {
+		t.Errorf("got %d moved blobs, want: 0", moved)
+	}
+	sharded := func(sname string) {
+		t.Helper()
+		base := filepath.Base(sname)
+		if want := filepath.Join(s.tree.sroot, base[0:2], base[2:4], base); sname != want {
+			t.Errorf("got: %s, want: %s", sname, want)
+		}
+	}
+	n := s.tree.files["/Notes/todo.txt"]
+	sharded(n.sname)
+	sharded(n.versions[0].sname)
+	sharded(s.tree.trash[0].sname)
+
+	fd := mustVal(s.tree.Open("/Notes/todo.txt"))
+	if bs := mustVal(io.ReadAll(fd)); string(bs) != "buy eggs" {
+		t.Errorf("got: %q, want: %q", bs, "buy eggs")
+	}
+	fd.Close()
+	if issues := mustVal(s.Fsck("", FsckOptions{})); len(issues) != 0 {
+		t.Errorf("unexpected issues: %v", issues)
+	}
+	if info := mustVal(s.RestoreTrash("", trashID)); info.Rname != "/Notes/done.txt" {
+		t.Errorf("got: %s, want: /Notes/done.txt", info.Rname)
+	}
+
+	mustVal(s.tree.Put("/Notes/new.txt", strings.NewReader("buy cheese"), "text/plain"))
+	sharded(s.tree.files["/Notes/new.txt"].sname)
+
+	// Shared blobs are moved once, and stay shared.
+	s = mustVal(New("/storage/", "/tmp/rms/storage/", WithDeduplication()))
+	mustVal(s.tree.Put("/a.txt", strings.NewReader("same"), "text/plain"))
+	mustVal(s.tree.Put("/b.txt", strings.NewReader("same"), "text/plain"))
+	flat := s.tree.files["/a.txt"].sname
+	buf.Reset()
+	must(s.Persist(buf))
+	s = mustVal(New("/storage/", "/tmp/rms/storage/", WithDeduplication(), WithShardedBlobs(2, 2)))
+	must(s.Load(bytes.NewReader(buf.Bytes())))
+	if moved := mustVal(s.Relayout("")); moved != 2 {
+		t.Errorf("got %d moved blobs, want: 2", moved)
+	}
+	a, b := s.tree.files["/a.txt"].sname, s.tree.files["/b.txt"].sname
+	base := filepath.Base(flat)
+	if want := filepath.Join(s.blobs.dir, base[0:2], base[2:4], base); a != want || b != want {
+		t.Errorf("got: %s and %s, want: %s", a, b, want)
+	}
+	if refs := s.blobs.refs[a]; refs != 2 {
+		t.Errorf("got %d references, want: 2", refs)
+	}
+	if _, err := FS.Stat(flat); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected old blob to be removed, got: %v", err)
+	}
+
+	if _, err := New("/storage/", "/tmp/rms/storage/", WithShardedBlobs(3, 3)); err == nil {
+		t.Error("expected invalid layout to be rejected")
+	}
+	s = mustVal(New("/storage/", "/tmp/rms/storage/", WithUserRoots(), WithShardedBlobs(2, 2)))
+	if _, err := s.userTree("ab", true); err == nil {
+		t.Error("expected user root named like a shard to be rejected")
+	}
+}
+
+func TestParseETag(t *testing.T) {
+	for _, s := range []string{"0123456789abcdef", "00112233445566778899aabbccddeeff", strings.Repeat("ab", 32)} {
+		etag, err := ParseETag(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+		} else if etag.String() != s {
+			t.Errorf("got: %s, want: %s", etag, s)
+		}
+	}
+	for _, s := range []string{"", "abc", "xyz0", strings.Repeat("ab", 65)} {
+		if _, err := ParseETag(s); err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+	if ETag([]byte{1, 2}).Equal(ETag([]byte{1, 2, 3})) {
+		t.Error("etags of different lengths must not be equal")
+	}
+}
+
 func TestPersist(t *testing.T) {
 	mockServer()
 
@@ -732,8 +2026,8 @@ func TestLoad(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	if len(files) != 4 {
-		t.Errorf("got: %d, want: 4", len(files))
+	if len(g.tree.files) != 4 {
+		t.Errorf("got: %d, want: 4", len(g.tree.files))
 	}
 
 	// ensure root is set correctly
@@ -741,8 +2035,8 @@ func TestLoad(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	if r != root {
-		t.Errorf("got: `%v', want: `%v'", r, root)
+	if r != g.tree.root {
+		t.Errorf("got: `%v', want: `%v'", r, g.tree.root)
 	}
 	if len(r.children) != 1 {
 		t.Errorf("got: %d, want: 1", len(r.children))
@@ -775,9 +2069,9 @@ func TestLoad(t *testing.T) {
 		},
 	}
 
-	t.Logf("Root Listing:\n%s", root)
+	t.Logf("Root Listing:\n%s", g.tree.root)
 
-	p := root
+	p := g.tree.root
 	for _, c := range checks {
 		n, err := Retrieve(c.rname)
 		if err != nil {
@@ -823,7 +2117,7 @@ func TestMigrate(t *testing.T) {
 		rroot = "/storage/"
 		sroot = "/tmp/rms/storage/"
 	)
-	must(Configure(rroot, sroot))
+	mustVal(Configure(rroot, sroot))
 	Mock(
 		WithDirectory(sroot),
 		WithFile("/somewhere/Documents/hello.txt", []byte("Hello, World!")),
@@ -836,7 +2130,7 @@ func TestMigrate(t *testing.T) {
 		t.Error(err)
 	}
 
-	t.Log(root)
+	t.Log(g.tree.root)
 
 	// Children must be listed immediately after their parents for parent/child
 	// check to work correctly. [#child_after]
@@ -865,7 +2159,7 @@ func TestMigrate(t *testing.T) {
 		},
 	}
 
-	p := root
+	p := g.tree.root
 	for _, c := range checks {
 		n, err := Retrieve(c.rname)
 		if err != nil {
@@ -906,6 +2200,55 @@ func TestMigrate(t *testing.T) {
 	}
 }
 
+func TestPersistLoadRoot(t *testing.T) {
+	mockServer(WithUserRoots())
+
+	const testContent = "Whole life's a test."
+
+	alice, err := g.userTree("alice", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = alice.Put("/Documents/test.txt", bytes.NewReader([]byte(testContent)), "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := mustVal(alice.Get("/")).ETag
+
+	bs := &bytes.Buffer{}
+	err = g.PersistRoot("alice", bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.PersistRoot("bob", &bytes.Buffer{}); err != ErrNotExist {
+		t.Errorf("got: %v, want: %v", err, ErrNotExist)
+	}
+
+	g.roots = map[string]*tree{}
+	err = g.LoadRoot("alice", bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice = mustVal(g.userTree("alice", false))
+	if len(alice.files) != 3 {
+		t.Errorf("got: %d, want: 3", len(alice.files))
+	}
+	n, err := alice.Get("/Documents/test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Length != int64(len(testContent)) {
+		t.Errorf("got: %d, want: %d", n.Length, len(testContent))
+	}
+	if r := mustVal(alice.Get("/")); !r.ETag.Equal(etag) {
+		t.Errorf("got: %s, want: %s", r.ETag, etag)
+	}
+	if len(g.tree.files) != 1 {
+		t.Errorf("got: %d nodes in default storage, want: 1", len(g.tree.files))
+	}
+}
+
 func ExamplePersist() {
 	mockServer()
 
@@ -936,7 +2279,7 @@ func ExamplePersist() {
 		panicIf(err)
 	}
 
-	fd, err := FS.Create(g.sroot + "/marshalled.xml")
+	fd, err := FS.Create(g.tree.sroot + "/marshalled.xml")
 	panicIf(err)
 	defer fd.Close()
 	err = Persist(fd)
@@ -951,14 +2294,14 @@ func ExamplePersist() {
 	Reset()
 	err = Load(fd)
 	panicIf(err)
-	fmt.Printf("Storage listing follows:\n%s", root)
+	fmt.Printf("Storage listing follows:\n%s", g.tree.root)
 
 	// Output: XML follows:
-	// <Root>
+	// <Root ETags="md5" ETag="674e141b50e9803f509f12d5e3aa2811" Revision="2">
 	// 	<Nodes IsFolder="true">
 	// 		<Name>Documents/</Name>
 	// 		<Rname>/Documents</Rname>
-	// 		<ETag>86f32f54096e02778610b22d1d6c56db</ETag>
+	// 		<ETag>77a4810b2bd043e65fa85a6f1416cdef</ETag>
 	// 		<Mime>inode/directory</Mime>
 	// 		<ParentRName>/</ParentRName>
 	// 	</Nodes>
@@ -966,26 +2309,30 @@ func ExamplePersist() {
 	// 		<Name>hello.txt</Name>
 	// 		<Rname>/Documents/hello.txt</Rname>
 	// 		<Sname>/tmp/rms/storage/32000000-0000-0000-0000-000000000000</Sname>
-	// 		<ETag>ea724748ce53d55deb465a6d045fd160</ETag>
+	// 		<ETag>19b6ae16bb34b5f6629f714c38281719</ETag>
 	// 		<Mime>text/plain</Mime>
 	// 		<Length>13</Length>
 	// 		<LastMod>0001-01-01T00:00:00Z</LastMod>
+	// 		<Hash>65a8e27d8879283831b664bd8b7f0ad4</Hash>
+	// 		<Revision>2</Revision>
 	// 		<ParentRName>/Documents</ParentRName>
 	// 	</Nodes>
 	// 	<Nodes IsFolder="false">
 	// 		<Name>test.txt</Name>
 	// 		<Rname>/Documents/test.txt</Rname>
 	// 		<Sname>/tmp/rms/storage/31000000-0000-0000-0000-000000000000</Sname>
-	// 		<ETag>10b3bf730d787feceec1d534a876dc5f</ETag>
+	// 		<ETag>7344622eac9fc3cd51e23116b01c24b7</ETag>
 	// 		<Mime>text/plain</Mime>
 	// 		<Length>20</Length>
 	// 		<LastMod>0001-01-01T00:00:00Z</LastMod>
+	// 		<Hash>35ab7a21f8856cbb097c4ea393cd478b</Hash>
+	// 		<Revision>1</Revision>
 	// 		<ParentRName>/Documents</ParentRName>
 	// 	</Nodes>
 	// </Root>
 	// Storage listing follows:
-	// {F} / [/] [6330643033303764]
-	//   {F} Documents/ [/Documents] [3836663332663534]
-	//     {D} hello.txt (text/plain, 13) [/Documents/hello.txt -> /tmp/rms/storage/32000000-0000-0000-0000-000000000000] [6561373234373438]
-	//     {D} test.txt (text/plain, 20) [/Documents/test.txt -> /tmp/rms/storage/31000000-0000-0000-0000-000000000000] [3130623362663733]
+	// {F} / [/] [3637346531343162]
+	//   {F} Documents/ [/Documents] [3737613438313062]
+	//     {D} hello.txt (text/plain, 13) [/Documents/hello.txt -> /tmp/rms/storage/32000000-0000-0000-0000-000000000000] [3139623661653136]
+	//     {D} test.txt (text/plain, 20) [/Documents/test.txt -> /tmp/rms/storage/31000000-0000-0000-0000-000000000000] [3733343436323265]
 }
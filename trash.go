@@ -0,0 +1,418 @@
+package rmsgo
+
+import (
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"slices"
+	"time"
+
+	. "github.com/cvanloo/rmsgo/mock"
+)
+
+type (
+	// TrashStorage is implemented by Storages that move deleted documents
+	// into a trash, from where they can be restored.
+	// The same locking rules as for Storage apply: Trash is called with at
+	// least the read lock held, RestoreTrash and PurgeTrash with the write
+	// lock held.
+	TrashStorage interface {
+		Storage
+
+		// Trash lists the deleted documents, most recently deleted first.
+		Trash() ([]TrashItem, error)
+
+		// RestoreTrash moves the deleted document identified by id back to
+		// its original location, recreating any missing ancestors.
+		// If the location is taken by another document or folder, an error
+		// of type ConflictError is returned.
+		RestoreTrash(id string) (NodeInfo, error)
+
+		// PurgeTrash irrevocably deletes the document identified by id.
+		// If id is empty, the entire trash is emptied.
+		PurgeTrash(id string) error
+	}
+
+	// TrashItem describes a deleted document.
+	TrashItem struct {
+		ID      string
+		Rname   string
+		Mime    string
+		Length  int64
+		LastMod *time.Time
+		Deleted time.Time
+	}
+
+	trashed struct {
+		uid       string // see id
+		rname     string
+		sname     string
+		codec     string
+		encrypted bool
+		digest    []byte
+		revision  uint64 // restored along with the document, so that it keeps its ETag
+		mime      string
+		length    int64
+		lastMod   *time.Time
+		deleted   time.Time
+		versions  []*version
+	}
+
+	TrashDTO struct {
+		ID          string `xml:"ID,omitempty"`
+		Rname       string
+		Sname       string
+		Mime        string
+		Length      int64 `xml:"Length,omitempty"`
+		LastMod     *time.Time
+		Deleted     time.Time
+		Versions    []*VersionDTO `xml:"Version,omitempty"`
+		Compression string        `xml:"Compression,omitempty"`
+		Encrypted   bool          `xml:"Encrypted,omitempty"`
+		Digest      string        `xml:"Digest,omitempty"`
+		Revision    uint64        `xml:"Revision,omitempty"`
+	}
+
+	trashRetention struct {
+		enabled bool
+		expiry  time.Duration
+	}
+)
+
+var _ TrashStorage = (*tree)(nil)
+
+// WithTrash moves deleted documents into a trash instead of removing them
+// right away.
+// Documents are removed from the trash for good once they have been deleted
+// for longer than expiry. An expiry of zero means that documents stay in
+// the trash until purged.
+// Documents in the trash count towards the usage of the storage, and
+// therefore towards the users' quotas (see UserWithQuota), until they are
+// purged.
+// Use Trash, RestoreTrash, and PurgeTrash to manage the trash.
+func WithTrash(expiry time.Duration) Option {
+	return func(s *Server) {
+		s.trash = trashRetention{
+			enabled: true,
+			expiry:  expiry,
+		}
+	}
+}
+
+// id identifies the trashed document.
+// The document's blob name is unique, and stays the same for as long as the
+// document is in the trash.
+// Content-addressed blobs (see WithDeduplication) may be shared, documents
+// using them are given their own id instead.
+func (t *trashed) id() string {
+	if t.uid != "" {
+		return t.uid
+	}
+	return filepath.Base(t.sname)
+}
+
+func (t *trashed) info() TrashItem {
+	return TrashItem{
+		ID:      t.id(),
+		Rname:   t.rname,
+		Mime:    t.mime,
+		Length:  t.length,
+		LastMod: t.lastMod,
+		Deleted: t.deleted,
+	}
+}
+
+// moveToTrash removes the document n from the tree and moves it into the
+// trash.
+// If the change can't be recorded in the journal, it is rolled back.
+func (t *tree) moveToTrash(n *node) error {
+	var uid string
+	if t.shared.owns(n.sname) {
+		u, err := UUID()
+		if err != nil {
+			return err
+		}
+		uid = u.String()
+	}
+	item := &trashed{
+		uid:       uid,
+		rname:     n.rname,
+		sname:     n.sname,
+		codec:     n.codec,
+		encrypted: n.encrypted,
+		digest:    n.digest,
+		revision:  n.revision,
+		mime:      n.mime,
+		length:    n.length,
+		lastMod:   n.lastMod,
+		deleted:   Time(),
+		versions:  n.versions,
+	}
+	trash := t.trash
+	t.setTrash(slices.Concat(t.trash, []*trashed{item}))
+	expired := t.expireTrash()
+
+	entries := []journalEntry{removeEntry(n), trashEntry(item)}
+	entries = append(entries, purgeEntries(ids(expired))...)
+	if err := t.commit(entries...); err != nil {
+		t.setTrash(trash)
+		return err
+	}
+	t.removeDocument(n)
+	return t.removeTrashed(expired)
+}
+
+// expireTrash takes documents that have been in the trash for too long out
+// of it.
+// The caller is responsible for removing their blobs, see removeTrashed.
+func (t *tree) expireTrash() (expired []*trashed) {
+	if t.trashRetention.expiry <= 0 {
+		return nil
+	}
+	var (
+		keep = make([]*trashed, 0, len(t.trash))
+		tnow = Time()
+	)
+	for _, item := range t.trash {
+		if tnow.Sub(item.deleted) > t.trashRetention.expiry {
+			expired = append(expired, item)
+		} else {
+			keep = append(keep, item)
+		}
+	}
+	t.setTrash(keep)
+	return expired
+}
+
+// setTrash replaces the documents in the trash and updates the tree's usage
+// accordingly.
+// items must not share its backing array with the current trash.
+func (t *tree) setTrash(items []*trashed) {
+	t.usage += trashLength(items) - trashLength(t.trash)
+	t.trash = items
+}
+
+// trashLength returns the combined length of the trashed documents items,
+// including their previous versions.
+func trashLength(items []*trashed) (length int64) {
+	for _, item := range items {
+		length += item.length + versionsLength(item.versions)
+	}
+	return length
+}
+
+// removeTrashed removes the blobs of trashed documents and their previous
+// versions.
+func (t *tree) removeTrashed(items []*trashed) error {
+	errs := []error{}
+	for _, item := range items {
+		errs = append(errs, t.removeBlob(item.sname))
+		for _, v := range item.versions {
+			errs = append(errs, t.removeBlob(v.sname))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func ids(items []*trashed) (ids []string) {
+	for _, item := range items {
+		ids = append(ids, item.id())
+	}
+	return ids
+}
+
+func (t *tree) findTrash(id string) (int, error) {
+	for i, item := range t.trash {
+		if item.id() == id {
+			return i, nil
+		}
+	}
+	return 0, ErrNotExist
+}
+
+func (t *tree) Trash() ([]TrashItem, error) {
+	tnow := Time()
+	items := make([]TrashItem, 0, len(t.trash))
+	for i := len(t.trash) - 1; i >= 0; i-- {
+		item := t.trash[i]
+		// Only the read lock is held, expired items are purged the next
+		// time the trash is modified, or by Expire.
+		if t.trashRetention.expiry > 0 && tnow.Sub(item.deleted) > t.trashRetention.expiry {
+			continue
+		}
+		items = append(items, item.info())
+	}
+	return items, nil
+}
+
+func (t *tree) RestoreTrash(id string) (NodeInfo, error) {
+	trash := t.trash
+	expired := t.expireTrash()
+	entries := purgeEntries(ids(expired))
+	if err := t.commit(entries...); err != nil {
+		t.setTrash(trash)
+		return NodeInfo{}, err
+	}
+	if err := t.removeTrashed(expired); err != nil {
+		return NodeInfo{}, err
+	}
+
+	i, err := t.findTrash(id)
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	item := t.trash[i]
+
+	n, err := t.addDocument(item.rname, item.sname, item.length, item.mime)
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	n.codec, n.encrypted = item.codec, item.encrypted
+	n.digest = item.digest
+	n.lastMod = item.lastMod
+	if item.revision != 0 { // zero if trashed before revisions were kept
+		n.revision = item.revision
+	}
+	t.setVersions(n, item.versions)
+	trash = t.trash
+	t.setTrash(slices.Concat(t.trash[:i], t.trash[i+1:]))
+
+	rollback := func() {
+		t.removeDocument(n)
+		t.setTrash(trash)
+	}
+	e, err := nodeEntry(journalAdd, n)
+	if err != nil {
+		rollback()
+		return NodeInfo{}, err
+	}
+	if err := t.commit(e, journalEntry{Op: journalPurge, ID: id}); err != nil {
+		rollback()
+		return NodeInfo{}, err
+	}
+	return n.info()
+}
+
+func (t *tree) PurgeTrash(id string) error {
+	var purged []*trashed
+	if id == "" {
+		purged = t.trash
+		t.setTrash(nil)
+	} else {
+		i, err := t.findTrash(id)
+		if err != nil {
+			return err
+		}
+		purged = []*trashed{t.trash[i]}
+		t.setTrash(slices.Concat(t.trash[:i], t.trash[i+1:]))
+	}
+	if err := t.commit(purgeEntries(ids(purged))...); err != nil {
+		return err
+	}
+	return t.removeTrashed(purged)
+}
+
+// trashStorage returns the storage of the user root (see WithUserRoots), or
+// the server's storage if root is empty.
+func (s *Server) trashStorage(root string) (TrashStorage, error) {
+	st, err := s.rootStorage(root)
+	if err != nil {
+		return nil, err
+	}
+	ts, ok := st.(TrashStorage)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return ts, nil
+}
+
+// Trash lists the deleted documents, most recently deleted first.
+// root names the user root (see WithUserRoots), leave it empty to use the
+// server's storage.
+func (s *Server) Trash(root string) ([]TrashItem, error) {
+	ts, err := s.trashStorage(root)
+	if err != nil {
+		return nil, err
+	}
+	ts.RLock()
+	defer ts.RUnlock()
+	return ts.Trash()
+}
+
+// RestoreTrash moves the deleted document identified by id back to its
+// original location.
+// root names the user root (see WithUserRoots), leave it empty to use the
+// server's storage.
+func (s *Server) RestoreTrash(root, id string) (NodeInfo, error) {
+	ts, err := s.trashStorage(root)
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	ts.Lock()
+	defer ts.Unlock()
+	return ts.RestoreTrash(id)
+}
+
+// PurgeTrash irrevocably deletes the document identified by id from the
+// trash, or empties the trash entirely if id is empty.
+// root names the user root (see WithUserRoots), leave it empty to use the
+// server's storage.
+func (s *Server) PurgeTrash(root, id string) error {
+	ts, err := s.trashStorage(root)
+	if err != nil {
+		return err
+	}
+	ts.Lock()
+	defer ts.Unlock()
+	return ts.PurgeTrash(id)
+}
+
+func trashDTOs(items []*trashed) []*TrashDTO {
+	var dtos []*TrashDTO
+	for _, item := range items {
+		dtos = append(dtos, &TrashDTO{
+			ID:          item.uid,
+			Rname:       item.rname,
+			Sname:       item.sname,
+			Mime:        item.mime,
+			Length:      item.length,
+			LastMod:     item.lastMod,
+			Deleted:     item.deleted,
+			Versions:    versionDTOs(item.versions),
+			Compression: item.codec,
+			Encrypted:   item.encrypted,
+			Digest:      hex.EncodeToString(item.digest),
+			Revision:    item.revision,
+		})
+	}
+	return dtos
+}
+
+func trashFromDTOs(dtos []*TrashDTO) ([]*trashed, error) {
+	var items []*trashed
+	for _, dto := range dtos {
+		versions, err := versionsFromDTOs(dto.Versions)
+		if err != nil {
+			return nil, err
+		}
+		digest, err := parseHash(dto.Digest)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, &trashed{
+			uid:       dto.ID,
+			rname:     dto.Rname,
+			sname:     dto.Sname,
+			codec:     dto.Compression,
+			encrypted: dto.Encrypted,
+			digest:    digest,
+			revision:  dto.Revision,
+			mime:      dto.Mime,
+			length:    dto.Length,
+			lastMod:   dto.LastMod,
+			deleted:   dto.Deleted,
+			versions:  versions,
+		})
+	}
+	return items, nil
+}
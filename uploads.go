@@ -0,0 +1,400 @@
+package rmsgo
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/cvanloo/rmsgo/mock"
+)
+
+var errUploadBusy = errors.New("upload is busy")
+
+type (
+	// uploads keeps track of the resumable uploads in progress, see
+	// WithResumableUploads.
+	uploads struct {
+		dir    string
+		expiry time.Duration
+
+		mu       sync.Mutex
+		sessions map[string]*upload
+	}
+
+	// upload stages the chunks of a document until all of them have been
+	// received.
+	upload struct {
+		// Guards all fields, held while a chunk is being written.
+		mu      sync.Mutex
+		path    string // staging file
+		total   int64
+		offset  int64 // number of bytes received so far
+		mime    string
+		touched time.Time
+		done    bool // committed or expired
+
+		// Repr-Digest fields sent along with any of the chunks, they refer
+		// to the entire document and are verified once it's complete.
+		repr []string
+	}
+)
+
+// WithResumableUploads allows clients to upload large documents in chunks,
+// resuming where they left off if a chunk fails to arrive.
+// A chunk is uploaded by a PUT request with a Content-Range header, e.g.,
+// "Content-Range: bytes 0-1048575/5000000", starting a new upload if it
+// begins at offset zero.
+// Until the last chunk has been received, the server responds with 202
+// (Accepted) and a Range header announcing the bytes it already has, e.g.,
+// "Range: bytes=0-1048575".
+// A PUT without body and "Content-Range: bytes */5000000" queries the
+// progress of the upload.
+// Chunks are staged in dir, the document itself is only created (or
+// replaced) once the upload is complete.
+// A Content-Digest or Content-MD5 header refers to the chunk it is sent
+// with, a Repr-Digest header (which may be sent with any of the chunks) to
+// the entire document. If the document doesn't match it, the upload is
+// abandoned.
+// Uploads that haven't received a chunk for longer than expiry are
+// abandoned, see also RunExpiry.
+func WithResumableUploads(dir string, expiry time.Duration) Option {
+	return func(s *Server) {
+		s.uploads = &uploads{
+			dir:      dir,
+			expiry:   expiry,
+			sessions: map[string]*upload{},
+		}
+	}
+}
+
+// parseContentRange parses "bytes 0-99/1000", or "bytes */1000" in which
+// case query is true.
+func parseContentRange(s string) (start, end, total int64, query, ok bool) {
+	rest, found := strings.CutPrefix(s, "bytes ")
+	if !found {
+		return
+	}
+	rng, size, found := strings.Cut(rest, "/")
+	if !found {
+		return
+	}
+	total, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || total < 0 {
+		return
+	}
+	if rng == "*" {
+		return 0, 0, total, true, true
+	}
+	first, last, found := strings.Cut(rng, "-")
+	if !found {
+		return
+	}
+	start, err1 := strconv.ParseInt(first, 10, 64)
+	end, err2 := strconv.ParseInt(last, 10, 64)
+	if err1 != nil || err2 != nil || start < 0 || end < start || end >= total {
+		return
+	}
+	return start, end, total, false, true
+}
+
+// session returns the upload of the document rname in the user root.
+// If start is true, a new upload is begun, replacing any existing one.
+// Returns nil if there is no such upload.
+func (us *uploads) session(root, rname string, total int64, mime string, start bool) (*upload, error) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	us.expire()
+
+	key := root + ":" + rname
+	u := us.sessions[key]
+	if !start {
+		return u, nil
+	}
+
+	if u != nil {
+		// Never block on an upload while holding us.mu (see finish).
+		if !u.mu.TryLock() {
+			return nil, errUploadBusy
+		}
+		u.done = true
+		err := FS.Remove(u.path)
+		u.mu.Unlock()
+		delete(us.sessions, key)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	id, err := UUID()
+	if err != nil {
+		return nil, err
+	}
+	u = &upload{
+		path:    filepath.Join(us.dir, id.String()),
+		total:   total,
+		mime:    mime,
+		touched: Time(),
+	}
+	fd, err := FS.Create(u.path)
+	if err != nil {
+		return nil, err
+	}
+	if err := fd.Close(); err != nil {
+		return nil, err
+	}
+	us.sessions[key] = u
+	return u, nil
+}
+
+// finish forgets about the (committed) upload u.
+// The caller must hold u.mu, which is why u.mu must only ever be acquired
+// using TryLock while holding us.mu.
+func (us *uploads) finish(root, rname string, u *upload) error {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	key := root + ":" + rname
+	if us.sessions[key] == u {
+		delete(us.sessions, key)
+	}
+	u.done = true
+	return FS.Remove(u.path)
+}
+
+// expire abandons uploads that haven't been touched for too long.
+// Uploads that are currently receiving a chunk are left alone.
+// The caller must hold us.mu.
+func (us *uploads) expire() {
+	if us.expiry <= 0 {
+		return
+	}
+	tnow := Time()
+	for key, u := range us.sessions {
+		if !u.mu.TryLock() {
+			continue
+		}
+		if tnow.Sub(u.touched) > us.expiry {
+			u.done = true
+			_ = FS.Remove(u.path)
+			delete(us.sessions, key)
+		}
+		u.mu.Unlock()
+	}
+}
+
+// ExpireUploads abandons resumable uploads that have been inactive for too
+// long (see WithResumableUploads), and removes their staged chunks.
+// This also happens whenever a chunk is received, and by Expire, which
+// RunExpiry calls periodically to clean up even if no uploads are made.
+func (s *Server) ExpireUploads() {
+	if s.uploads == nil {
+		return
+	}
+	s.uploads.mu.Lock()
+	defer s.uploads.mu.Unlock()
+	s.uploads.expire()
+}
+
+// write appends the chunk read from r, which starts at offset start, to the
+// staging file.
+// Data that has already been received is skipped.
+// The caller must hold u.mu.
+func (u *upload) write(r io.Reader, start, end int64) error {
+	if end < u.offset {
+		return nil // received entirely already
+	}
+	if skip := u.offset - start; skip > 0 {
+		if _, err := io.CopyN(io.Discard, r, skip); err != nil {
+			return err
+		}
+	}
+	fd, err := FS.OpenFile(u.path, os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Seek(u.offset, io.SeekStart); err != nil {
+		return errors.Join(err, fd.Close())
+	}
+	// Whatever arrives counts, so that the client can resume from there.
+	n, err := io.Copy(fd, io.LimitReader(r, end+1-u.offset))
+	u.offset += n
+	u.touched = Time()
+	if err != nil {
+		return errors.Join(err, fd.Close())
+	}
+	return fd.Close()
+}
+
+// writeChecked writes the chunk like write, but only accepts it if all of
+// it matches the digests checks.
+// The caller must hold u.mu.
+func (u *upload) writeChecked(r io.Reader, start, end int64, checks []digestCheck) error {
+	if len(checks) == 0 {
+		return u.write(r, start, end)
+	}
+	offset := u.offset
+	dr := &digestReader{r: r, checks: checks}
+	err := u.write(dr, start, end)
+	if err == nil {
+		// The digests are only compared once the entire chunk has been read.
+		_, err = io.Copy(io.Discard, dr)
+	}
+	if digestMismatch(err) != nil {
+		u.offset = offset // to be overwritten by the next attempt
+	}
+	return err
+}
+
+// contentChecks returns the checks that refer to the content of a single
+// request, as opposed to the entire document (Repr-Digest).
+func contentChecks(checks []digestCheck) (content []digestCheck) {
+	for _, c := range checks {
+		if c.header != "Repr-Digest" {
+			content = append(content, c)
+		}
+	}
+	return content
+}
+
+// reprChecks parses the Repr-Digest fields received with the chunks of u.
+func (u *upload) reprChecks() (checks []digestCheck, err error) {
+	for _, field := range u.repr {
+		cs, err := parseDigests("Repr-Digest", field)
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, cs...)
+	}
+	return checks, nil
+}
+
+// setRange announces the bytes received so far.
+func (u *upload) setRange(w http.ResponseWriter) {
+	if u.offset > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", u.offset-1))
+	}
+}
+
+// putChunk handles a PUT request with a Content-Range header, see
+// WithResumableUploads.
+func (s *Server) putChunk(w http.ResponseWriter, r *http.Request, st Storage) error {
+	rpath := r.URL.Path
+	root, _ := rootFromContext(r.Context())
+
+	start, end, total, query, ok := parseContentRange(r.Header.Get("Content-Range"))
+	if !ok {
+		return BadRequest("invalid Content-Range")
+	}
+	checks, err := expectedDigests(r)
+	if err != nil {
+		return err
+	}
+
+	st.RLock()
+	_, _, err = s.checkPut(w, r, st, total)
+	st.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	u, err := s.uploads.session(root, rpath, total, r.Header.Get("Content-Type"), !query && start == 0)
+	if errors.Is(err, errUploadBusy) {
+		return UploadConflict("a chunk of the upload is still being received")
+	}
+	if err != nil {
+		return err // internal server error
+	}
+	if u == nil {
+		if query {
+			w.WriteHeader(http.StatusAccepted) // nothing received yet
+			return nil
+		}
+		return UploadConflict("no upload in progress, start at offset 0")
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.done {
+		return UploadConflict("the upload has been abandoned, start at offset 0")
+	}
+	if u.total != total {
+		return UploadConflict("the total length differs from the one the upload was started with")
+	}
+	u.repr = append(u.repr, r.Header.Values("Repr-Digest")...)
+	if !query {
+		if start > u.offset {
+			u.setRange(w)
+			return UploadConflict("the chunk does not continue the upload")
+		}
+		if err := u.writeChecked(r.Body, start, end, contentChecks(checks)); err != nil {
+			if err := digestMismatch(err); err != nil {
+				u.setRange(w)
+				return err
+			}
+			return err // internal server error
+		}
+	}
+	if u.offset < u.total {
+		u.setRange(w)
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+	}
+	return s.commitUpload(w, r, st, root, u)
+}
+
+// commitUpload creates or replaces the document from the completely
+// received upload u.
+// The caller must hold u.mu.
+func (s *Server) commitUpload(w http.ResponseWriter, r *http.Request, st Storage, root string, u *upload) error {
+	fd, err := FS.Open(u.path)
+	if err != nil {
+		return err // internal server error
+	}
+	defer fd.Close()
+
+	checks, err := u.reprChecks()
+	if err != nil {
+		return err
+	}
+	body := io.Reader(fd)
+	if len(checks) > 0 {
+		body = &digestReader{r: body, checks: checks}
+	}
+	mime := u.mime
+	if mime == "" {
+		mime, body, err = detectMime(body)
+		if err != nil {
+			return err // internal server error
+		}
+	}
+
+	// The document may have changed since the last chunk was received, the
+	// preconditions and quota are evaluated again.
+	rpath := r.URL.Path
+	n, err := s.store(w, r, st, body, mime, u.total)
+	if errors.As(err, &ErrBadRequest{}) {
+		// The document doesn't match its Repr-Digest, resuming won't help.
+		if err := s.uploads.finish(root, rpath, u); err != nil {
+			s.unhandled(err)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s.uploads.finish(root, rpath, u); err != nil {
+		s.unhandled(err) // the document has been stored nonetheless
+	}
+
+	hs := w.Header()
+	hs.Set("ETag", strongTag(n.ETag))
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
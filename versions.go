@@ -0,0 +1,347 @@
+package rmsgo
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"slices"
+	"time"
+
+	. "github.com/cvanloo/rmsgo/mock"
+)
+
+// ErrNotSupported is returned when a feature is used that the configured
+// Storage does not implement.
+var ErrNotSupported = errors.New("not supported by storage")
+
+type (
+	// VersionedStorage is implemented by Storages that keep previous
+	// versions of documents around.
+	// The same locking rules as for Storage apply: Versions and OpenVersion
+	// are called with at least the read lock held, RestoreVersion with the
+	// write lock held.
+	VersionedStorage interface {
+		Storage
+
+		// Versions lists the previous versions of the document rname,
+		// newest first.
+		Versions(rname string) ([]NodeInfo, error)
+
+		// OpenVersion opens the previous version of the document rname
+		// identified by etag for reading.
+		// As with Open, the contents must stay intact after the lock has
+		// been released.
+		// Returns ErrNotExist if there is no such version.
+		OpenVersion(rname string, etag ETag) (NodeInfo, io.ReadSeekCloser, error)
+
+		// RestoreVersion makes the previous version identified by etag the
+		// current version of the document rname.
+		// The replaced version is kept as a previous version itself.
+		RestoreVersion(rname string, etag ETag) (NodeInfo, error)
+	}
+
+	versionRetention struct {
+		enabled bool
+		keep    int
+		maxAge  time.Duration
+	}
+
+	version struct {
+		sname     string
+		codec     string
+		encrypted bool
+		digest    []byte
+		etag      ETag
+		mime      string
+		length    int64
+		lastMod   *time.Time
+		replaced  time.Time // when this version was superseded
+	}
+
+	VersionDTO struct {
+		Sname       string
+		ETag        string
+		Mime        string
+		Length      int64 `xml:"Length,omitempty"`
+		LastMod     *time.Time
+		Replaced    time.Time
+		Compression string `xml:"Compression,omitempty"`
+		Encrypted   bool   `xml:"Encrypted,omitempty"`
+		Digest      string `xml:"Digest,omitempty"`
+	}
+)
+
+var _ VersionedStorage = (*tree)(nil)
+
+// WithVersionHistory keeps previous versions of documents around when they
+// are overwritten.
+// At most keep versions are retained per document, and versions are
+// discarded once they have been superseded for longer than maxAge.
+// A value of zero means no limit.
+// Previous versions count towards the usage of the storage, and therefore
+// towards the users' quotas (see UserWithQuota).
+// Use Versions and RestoreVersion to list and roll back to previous
+// versions.
+func WithVersionHistory(keep int, maxAge time.Duration) Option {
+	return func(s *Server) {
+		s.retention = versionRetention{
+			enabled: true,
+			keep:    keep,
+			maxAge:  maxAge,
+		}
+	}
+}
+
+// WithServeVersions allows clients to retrieve previous versions of a
+// document by specifying their ETag in the version query parameter, e.g.,
+// "GET /storage/Notes/todo.txt?version=a5b2...".
+// This is an extension to the remoteStorage protocol.
+func WithServeVersions() Option {
+	return func(s *Server) {
+		s.serveVersions = true
+	}
+}
+
+// replaceKeepVersion makes the already written blob b the current version
+// of n, keeping the old one as a previous version.
+// Returns the blobs of the versions that have been pruned, which are to be
+// removed once the change has been committed.
+func (t *tree) replaceKeepVersion(n *node, b blob) ([]string, error) {
+	etag, err := n.Version()
+	if err != nil {
+		return nil, err
+	}
+
+	t.setVersions(n, append(slices.Clone(n.versions), &version{
+		sname:     n.sname,
+		codec:     n.codec,
+		encrypted: n.encrypted,
+		digest:    n.digest,
+		etag:      etag,
+		mime:      n.mime,
+		length:    n.length,
+		lastMod:   n.lastMod,
+		replaced:  Time(),
+	}))
+	n.sname = b.sname
+	n.codec, n.encrypted = b.codec, b.encrypted
+	t.updateDocument(n, b.mime, b.length)
+	n.digest = b.digest
+	return t.pruneVersions(n), nil
+}
+
+// pruneVersions drops the previous versions of n that exceed the retention
+// limits.
+// Their blobs are not removed yet, but returned, so that they can be
+// removed once the change has been committed (see removeBlobs).
+func (t *tree) pruneVersions(n *node) (unused []string) {
+	var (
+		keep = make([]*version, 0, len(n.versions))
+		tnow = Time()
+	)
+	for i, v := range n.versions {
+		tooMany := t.retention.keep > 0 && len(n.versions)-i > t.retention.keep
+		tooOld := t.retention.maxAge > 0 && tnow.Sub(v.replaced) > t.retention.maxAge
+		if tooMany || tooOld {
+			unused = append(unused, v.sname)
+		} else {
+			keep = append(keep, v)
+		}
+	}
+	t.setVersions(n, keep)
+	return unused
+}
+
+// setVersions replaces the previous versions of the document n, which is
+// part of the tree, and updates the tree's usage accordingly.
+// vs must not share its backing array with n's current versions.
+func (t *tree) setVersions(n *node, vs []*version) {
+	t.usage += versionsLength(vs) - versionsLength(n.versions)
+	n.versions = vs
+}
+
+// versionsLength returns the combined length of the versions vs.
+func versionsLength(vs []*version) (length int64) {
+	for _, v := range vs {
+		length += v.length
+	}
+	return length
+}
+
+func (t *tree) findVersion(rname string, etag ETag) (*node, int, error) {
+	n, err := t.retrieve(rname)
+	if err != nil {
+		return nil, 0, err
+	}
+	if n.isFolder {
+		return nil, 0, ErrNotExist
+	}
+	for i, v := range n.versions {
+		if v.etag.Equal(etag) {
+			return n, i, nil
+		}
+	}
+	return nil, 0, ErrNotExist
+}
+
+func (v *version) info(n *node) NodeInfo {
+	return NodeInfo{
+		Name:    n.name,
+		Rname:   n.rname,
+		ETag:    v.etag,
+		Mime:    v.mime,
+		Length:  v.length,
+		LastMod: v.lastMod,
+		Digest:  v.digest,
+	}
+}
+
+func (t *tree) Versions(rname string) ([]NodeInfo, error) {
+	n, err := t.retrieve(rname)
+	if err != nil {
+		return nil, err
+	}
+	if n.isFolder {
+		return nil, ErrNotExist
+	}
+	infos := make([]NodeInfo, 0, len(n.versions))
+	for i := len(n.versions) - 1; i >= 0; i-- {
+		infos = append(infos, n.versions[i].info(n))
+	}
+	return infos, nil
+}
+
+func (t *tree) OpenVersion(rname string, etag ETag) (NodeInfo, io.ReadSeekCloser, error) {
+	n, i, err := t.findVersion(rname, etag)
+	if err != nil {
+		return NodeInfo{}, nil, err
+	}
+	v := n.versions[i]
+	fd, err := n.encoding.open(v.sname, v.codec, v.encrypted, v.length)
+	if err != nil {
+		return NodeInfo{}, nil, err
+	}
+	return v.info(n), fd, nil
+}
+
+func (t *tree) RestoreVersion(rname string, etag ETag) (NodeInfo, error) {
+	n, i, err := t.findVersion(rname, etag)
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	current, err := n.Version()
+	if err != nil {
+		return NodeInfo{}, err
+	}
+
+	prev := n.snapshot()
+	v := n.versions[i]
+	t.setVersions(n, slices.Concat(n.versions[:i], n.versions[i+1:], []*version{{
+		sname:     n.sname,
+		codec:     n.codec,
+		encrypted: n.encrypted,
+		digest:    n.digest,
+		etag:      current,
+		mime:      n.mime,
+		length:    n.length,
+		lastMod:   n.lastMod,
+		replaced:  Time(),
+	}}))
+	n.sname = v.sname
+	n.codec, n.encrypted = v.codec, v.encrypted
+	t.updateDocument(n, v.mime, v.length)
+	n.digest = v.digest
+
+	unused := t.pruneVersions(n)
+	if err := t.commitNode(journalUpdate, n); err != nil {
+		t.rollback(n, prev)
+		return NodeInfo{}, err
+	}
+	t.removeBlobs(unused)
+	return n.info()
+}
+
+// versionedStorage returns the storage of the user root (see
+// WithUserRoots), or the server's storage if root is empty.
+func (s *Server) versionedStorage(root string) (VersionedStorage, error) {
+	st, err := s.rootStorage(root)
+	if err != nil {
+		return nil, err
+	}
+	vs, ok := st.(VersionedStorage)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return vs, nil
+}
+
+// Versions lists the previous versions of the document rname, newest first.
+// root names the user root (see WithUserRoots), leave it empty to use the
+// server's storage.
+func (s *Server) Versions(root, rname string) ([]NodeInfo, error) {
+	vs, err := s.versionedStorage(root)
+	if err != nil {
+		return nil, err
+	}
+	vs.RLock()
+	defer vs.RUnlock()
+	return vs.Versions(rname)
+}
+
+// RestoreVersion rolls the document rname back to the previous version
+// identified by etag.
+// root names the user root (see WithUserRoots), leave it empty to use the
+// server's storage.
+func (s *Server) RestoreVersion(root, rname string, etag ETag) (NodeInfo, error) {
+	vs, err := s.versionedStorage(root)
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	vs.Lock()
+	defer vs.Unlock()
+	return vs.RestoreVersion(rname, etag)
+}
+
+func versionDTOs(vs []*version) []*VersionDTO {
+	var dtos []*VersionDTO
+	for _, v := range vs {
+		dtos = append(dtos, &VersionDTO{
+			Sname:       v.sname,
+			ETag:        v.etag.String(),
+			Mime:        v.mime,
+			Length:      v.length,
+			LastMod:     v.lastMod,
+			Replaced:    v.replaced,
+			Compression: v.codec,
+			Encrypted:   v.encrypted,
+			Digest:      hex.EncodeToString(v.digest),
+		})
+	}
+	return dtos
+}
+
+func versionsFromDTOs(dtos []*VersionDTO) ([]*version, error) {
+	var vs []*version
+	for _, dto := range dtos {
+		etag, err := ParseETag(dto.ETag)
+		if err != nil {
+			return nil, err
+		}
+		digest, err := parseHash(dto.Digest)
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, &version{
+			sname:     dto.Sname,
+			codec:     dto.Compression,
+			encrypted: dto.Encrypted,
+			digest:    digest,
+			etag:      etag,
+			mime:      dto.Mime,
+			length:    dto.Length,
+			lastMod:   dto.LastMod,
+			replaced:  dto.Replaced,
+		})
+	}
+	return vs, nil
+}
@@ -0,0 +1,256 @@
+package rmsgo
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// WebFingerPath is where RegisterWebFinger serves WebFinger requests
+	// (RFC 7033).
+	WebFingerPath = "/.well-known/webfinger"
+
+	// RemoteStorageRel is the link relation of remoteStorage accounts.
+	RemoteStorageRel = "http://tools.ietf.org/id/draft-dejong-remotestorage"
+
+	// SpecVersion is the version of the remoteStorage protocol implemented
+	// by the server.
+	SpecVersion = "draft-dejong-remotestorage-21"
+)
+
+// Link properties of remoteStorage accounts.
+const (
+	propVersion      = "http://remotestorage.io/spec/version"
+	propAuth         = "http://tools.ietf.org/html/rfc6749#section-4.2"
+	propQueryTokens  = "http://tools.ietf.org/html/rfc6750#section-2.3"
+	propRanges       = "http://tools.ietf.org/html/rfc7233"
+	propWebAuthoring = "http://remotestorage.io/spec/web-authoring"
+)
+
+type (
+	// WebFingerFunc looks up the account of the "acct:user@host" resource
+	// of a WebFinger request.
+	// If there is no such account, the returned values are the zero value
+	// and false.
+	WebFingerFunc func(r *http.Request, user, host string) (WebFingerAccount, bool)
+
+	// WebFingerAccount describes a remoteStorage account, see
+	// RegisterWebFinger.
+	WebFingerAccount struct {
+		// URL of the account's storage.
+		// If empty, it is derived from the server's public URL (see
+		// WithPublicURL) and the remote root, followed by Root if the
+		// server is configured WithUserRoots.
+		Href string
+
+		// User root of the account, only used to derive Href.
+		Root string
+
+		// URL of the OAuth dialog (RFC 6749, Section 4.2) that clients
+		// obtain bearer tokens from.
+		// If empty, the dialog of the server's own authorization server is
+		// announced, if it is configured WithOAuth.
+		AuthURL string
+
+		// Whether bearer tokens may be passed in the access_token query
+		// parameter (RFC 6750, Section 2.3).
+		// The server itself only reads them from the Authorization header,
+		// a middleware must take care of the parameter.
+		QueryTokens bool
+
+		// Domain that public documents are served on, empty if not
+		// supported.
+		WebAuthoring string
+	}
+
+	// jrd is a JSON Resource Descriptor (RFC 7033, Section 4.4).
+	jrd struct {
+		Subject string    `json:"subject"`
+		Links   []jrdLink `json:"links"`
+	}
+
+	jrdLink struct {
+		Rel        string             `json:"rel"`
+		Href       string             `json:"href,omitempty"`
+		Properties map[string]*string `json:"properties,omitempty"`
+	}
+)
+
+// WithPublicURL configures the URL that clients reach the server at, e.g.,
+// "https://example.org", which is announced in WebFinger responses (see
+// RegisterWebFinger).
+// If the server is mounted below a path prefix by a reverse proxy, the
+// prefix must be included, e.g., "https://example.org/rms".
+// Per default, the URL is derived from the Host header of each request, and
+// whether it was made over TLS, which doesn't hold behind a reverse proxy,
+// and lets clients choose the announced host.
+func WithPublicURL(base string) Option {
+	return func(s *Server) {
+		s.publicURL = strings.TrimSuffix(base, "/")
+	}
+}
+
+// validatePublicURL checks the URL configured with WithPublicURL, if any.
+func validatePublicURL(base string) error {
+	if base == "" {
+		return nil
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return fmt.Errorf("invalid public url: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("invalid public url: `%s'", base)
+	}
+	return nil
+}
+
+// RegisterWebFinger registers a WebFinger (RFC 7033) handler to the mux at
+// WebFingerPath, which lets clients discover the storage of an account
+// ("acct:user@host") looked up by lookup.
+// Responses can be limited to the remoteStorage link by the rel parameter,
+// and may be requested from any origin.
+// If mux is nil the http.DefaultServeMux is used.
+func (s *Server) RegisterWebFinger(mux *http.ServeMux, lookup WebFingerFunc) {
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
+	stack := MiddlewareStack(
+		s.withServer,
+		s.handlePanic,
+		s.middleware,
+	)
+	mux.Handle(WebFingerPath, stack(HandlerWithError(func(w http.ResponseWriter, r *http.Request) error {
+		return s.webFinger(w, r, lookup)
+	})))
+}
+
+// RegisterWebFinger registers the WebFinger handler of the default server,
+// see (*Server).RegisterWebFinger.
+func RegisterWebFinger(mux *http.ServeMux, lookup WebFingerFunc) {
+	g.RegisterWebFinger(mux, lookup)
+}
+
+func (s *Server) webFinger(w http.ResponseWriter, r *http.Request, lookup WebFingerFunc) error {
+	hs := w.Header()
+	// The information is public, and meant to be fetched by web apps of any
+	// origin (RFC 7033, Section 5).
+	hs.Set("Access-Control-Allow-Origin", "*")
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions:
+		hs.Set("Access-Control-Allow-Methods", "GET, HEAD")
+		hs.Set("Access-Control-Allow-Headers", "Accept")
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	default:
+		hs.Set("Allow", "GET, HEAD, OPTIONS")
+		return MethodNotAllowed("webfinger only supports GET")
+	}
+
+	query := r.URL.Query()
+	resource := query.Get("resource")
+	if resource == "" {
+		return BadRequest("missing resource parameter")
+	}
+	user, host, ok := parseAcct(resource)
+	if !ok {
+		return NotFound("unknown resource")
+	}
+	account, ok := lookup(r, user, host)
+	if !ok {
+		return NotFound("unknown resource")
+	}
+
+	res := jrd{
+		Subject: resource,
+		Links:   []jrdLink{},
+	}
+	if rels := query["rel"]; len(rels) == 0 || slices.Contains(rels, RemoteStorageRel) {
+		res.Links = append(res.Links, s.remoteStorageLink(r, account))
+	}
+
+	hs.Set("Content-Type", "application/jrd+json")
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	return json.NewEncoder(w).Encode(res)
+}
+
+// parseAcct splits an "acct:user@host" URI (RFC 7565) into its user and
+// host.
+func parseAcct(resource string) (user, host string, ok bool) {
+	acct, ok := strings.CutPrefix(resource, "acct:")
+	if !ok {
+		return "", "", false
+	}
+	i := strings.LastIndex(acct, "@")
+	if i <= 0 || i == len(acct)-1 {
+		return "", "", false
+	}
+	user, err := url.PathUnescape(acct[:i])
+	if err != nil {
+		return "", "", false
+	}
+	return user, strings.ToLower(acct[i+1:]), true
+}
+
+func (s *Server) remoteStorageLink(r *http.Request, account WebFingerAccount) jrdLink {
+	href := account.Href
+	if href == "" {
+		href = s.origin(r) + s.rroot
+		if s.userRoots && account.Root != "" {
+			href += "/" + url.PathEscape(account.Root)
+		}
+	}
+	// Unsupported features are announced as null.
+	version, ranges, queryTokens := SpecVersion, "GET", "true"
+	props := map[string]*string{
+		propVersion:      &version,
+		propAuth:         nil,
+		propQueryTokens:  nil,
+		propRanges:       &ranges,
+		propWebAuthoring: nil,
+	}
+	if account.AuthURL == "" && s.oauth != nil {
+		account.AuthURL = s.oauth.authURL(s.origin(r))
+	}
+	if account.AuthURL != "" {
+		props[propAuth] = &account.AuthURL
+	}
+	if account.QueryTokens {
+		props[propQueryTokens] = &queryTokens
+	}
+	if account.WebAuthoring != "" {
+		props[propWebAuthoring] = &account.WebAuthoring
+	}
+	return jrdLink{
+		Rel:        RemoteStorageRel,
+		Href:       href,
+		Properties: props,
+	}
+}
+
+// origin returns the URL that clients reach the server at, see
+// WithPublicURL.
+func (s *Server) origin(r *http.Request) string {
+	if s.publicURL != "" {
+		return s.publicURL
+	}
+	return requestOrigin(r)
+}
+
+// requestOrigin returns the scheme and host that request r was sent to.
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}